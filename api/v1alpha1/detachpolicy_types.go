@@ -0,0 +1,147 @@
+/*
+Copyright 2020 The node-detacher-controller authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// DetachPolicySpec defines which nodes are managed by node-detacher and what triggers a detach
+type DetachPolicySpec struct {
+	// NodeSelector selects nodes managed by this policy. An empty selector selects all the nodes.
+	// +optional
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+
+	// Triggers is the set of rules any of which makes the node detached
+	Triggers DetachTriggers `json:"triggers"`
+
+	// Exclusions is the set of rules any of which prevents the node from being detached
+	// +optional
+	Exclusions DetachExclusions `json:"exclusions,omitempty"`
+
+	// DrainTimeout is the maximum duration node-detacher waits for the node to be drained after de-registering it,
+	// before it starts deleting pods running on the node
+	// +optional
+	DrainTimeout *metav1.Duration `json:"drainTimeout,omitempty"`
+
+	// MaxConcurrentDetachments is the maximum number of nodes selected by this policy that can be detached at once
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxConcurrentDetachments *int32 `json:"maxConcurrentDetachments,omitempty"`
+
+	// MaxUnavailableLocalEndpoints is the maximum number or percentage of ready endpoints of each
+	// `externalTrafficPolicy: Local` service that nodes selected by this policy can remove by being detached at once.
+	// A node is always allowed to be detached when no other node being detached removes endpoints of the same services
+	// +optional
+	MaxUnavailableLocalEndpoints *intstr.IntOrString `json:"maxUnavailableLocalEndpoints,omitempty"`
+}
+
+// DetachTriggers is the set of rules any of which makes the node detached
+type DetachTriggers struct {
+	// Cordon triggers a detach when the node is cordoned, i.e. `spec.unschedulable` is true
+	// +optional
+	Cordon bool `json:"cordon,omitempty"`
+
+	// +optional
+	Taints []TaintRule `json:"taints,omitempty"`
+
+	// +optional
+	Conditions []NodeConditionRule `json:"conditions,omitempty"`
+
+	// +optional
+	Annotations []AnnotationRule `json:"annotations,omitempty"`
+}
+
+// DetachExclusions is the set of rules any of which prevents the node from being detached
+type DetachExclusions struct {
+	// NodeSelector selects nodes that are never detached
+	// +optional
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+
+	// +optional
+	Taints []TaintRule `json:"taints,omitempty"`
+
+	// +optional
+	Annotations []AnnotationRule `json:"annotations,omitempty"`
+}
+
+// TaintRule matches a node taint
+type TaintRule struct {
+	// +kubebuilder:validation:MinLength=1
+	Key string `json:"key"`
+
+	// Effect matches any effect when omitted
+	// +kubebuilder:validation:Enum=NoSchedule;PreferNoSchedule;NoExecute
+	// +optional
+	Effect corev1.TaintEffect `json:"effect,omitempty"`
+}
+
+// NodeConditionRule matches a node condition
+type NodeConditionRule struct {
+	Type corev1.NodeConditionType `json:"type"`
+
+	// +kubebuilder:validation:Enum=True;False;Unknown
+	Status corev1.ConditionStatus `json:"status"`
+
+	// For is how long the condition must have been in the status before the node is detached
+	// +optional
+	For *metav1.Duration `json:"for,omitempty"`
+
+	// NoCordon, when true, makes node-detacher only detach the node from load balancers without tainting the node
+	// nor deleting pods on it, leaving those to a drain tool if any.
+	// The node is re-attached once the condition clears.
+	// +optional
+	NoCordon bool `json:"noCordon,omitempty"`
+}
+
+// AnnotationRule matches a node annotation
+type AnnotationRule struct {
+	// +kubebuilder:validation:MinLength=1
+	Key string `json:"key"`
+
+	// Value matches any value when omitted
+	// +optional
+	Value string `json:"value,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:JSONPath=".spec.maxConcurrentDetachments",name=MaxConcurrentDetachments,type=integer
+// +kubebuilder:printcolumn:JSONPath=".spec.drainTimeout",name=DrainTimeout,type=string
+
+// DetachPolicy is the Schema for the detachpolicies API
+type DetachPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec DetachPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// DetachPolicyList contains a list of DetachPolicy
+type DetachPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DetachPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DetachPolicy{}, &DetachPolicyList{})
+}
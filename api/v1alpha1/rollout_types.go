@@ -0,0 +1,138 @@
+/*
+Copyright 2020 The node-detacher-controller authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// RolloutSpec defines how the OnDelete daemonset is rolled out across nodes
+type RolloutSpec struct {
+	// DaemonSetName is the name of the daemonset in the same namespace as the rollout
+	// +kubebuilder:validation:MinLength=1
+	DaemonSetName string `json:"daemonSetName"`
+
+	// MaxUnavailable is the maximum number or percentage of nodes being detached for the rollout at once.
+	// Defaults to 1.
+	// +optional
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+
+	// MaxUnavailablePerZone is the maximum number or percentage of nodes in each zone being detached at once
+	// +optional
+	MaxUnavailablePerZone *intstr.IntOrString `json:"maxUnavailablePerZone,omitempty"`
+
+	// MaxUnavailablePerTargetGroup is the maximum number or percentage of nodes in each target group being detached at once
+	// +optional
+	MaxUnavailablePerTargetGroup *intstr.IntOrString `json:"maxUnavailablePerTargetGroup,omitempty"`
+
+	// PodReadyTimeout is how long to wait for the replacement pod to become ready before pausing the rollout
+	// +optional
+	PodReadyTimeout *metav1.Duration `json:"podReadyTimeout,omitempty"`
+
+	// Paused stops rolling more nodes. Nodes already being rolled continue to be re-attached.
+	// It is set by node-detacher when the replacement pod fails to become ready or the node fails load balancer
+	// health checks after re-attachment.
+	// +optional
+	Paused bool `json:"paused,omitempty"`
+
+	// Abort stops the rollout and re-attaches all the nodes detached for it
+	// +optional
+	Abort bool `json:"abort,omitempty"`
+}
+
+// RolloutStatus defines the observed state of Rollout
+type RolloutStatus struct {
+	// Phase is one of Progressing, Paused, Aborted, and Completed
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// ObservedGeneration is the generation of the daemonset being rolled out
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// DesiredNodes is the number of nodes that should be running the daemonset pod
+	// +optional
+	DesiredNodes int32 `json:"desiredNodes,omitempty"`
+
+	// UpdatedNodes is the number of nodes running the up-to-date and ready daemonset pod
+	// +optional
+	UpdatedNodes int32 `json:"updatedNodes,omitempty"`
+
+	// Nodes is the list of nodes being rolled
+	// +optional
+	Nodes []RolloutNode `json:"nodes,omitempty"`
+
+	// PauseReason is why node-detacher paused the rollout
+	// +optional
+	PauseReason string `json:"pauseReason,omitempty"`
+
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// +optional
+	LastUpdateTime *metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// RolloutNode is the node being rolled
+type RolloutNode struct {
+	Name string `json:"name"`
+
+	// +optional
+	Zone string `json:"zone,omitempty"`
+
+	// +optional
+	TargetGroups []string `json:"targetGroups,omitempty"`
+
+	// Step is one of Detaching, ReplacingPod, and Reattaching
+	Step string `json:"step"`
+
+	StartedAt metav1.Time `json:"startedAt"`
+
+	// StepStartedAt is when the node entered the current step
+	// +optional
+	StepStartedAt *metav1.Time `json:"stepStartedAt,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:JSONPath=".spec.daemonSetName",name=DaemonSet,type=string
+// +kubebuilder:printcolumn:JSONPath=".status.phase",name=Phase,type=string
+// +kubebuilder:printcolumn:JSONPath=".status.updatedNodes",name=Updated,type=integer
+// +kubebuilder:printcolumn:JSONPath=".status.desiredNodes",name=Desired,type=integer
+
+// Rollout is the Schema for the rollouts API
+type Rollout struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RolloutSpec   `json:"spec,omitempty"`
+	Status RolloutStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// RolloutList contains a list of Rollout
+type RolloutList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Rollout `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Rollout{}, &RolloutList{})
+}
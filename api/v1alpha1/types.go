@@ -30,6 +30,15 @@ type AttachmentSpec struct {
 
 	// +optional
 	AwsLoadBalancers []AwsLoadBalancer `json:"awsLoadBalancers,omitempty"`
+
+	// +optional
+	ConsulServices []ConsulService `json:"consulServices,omitempty"`
+
+	// +optional
+	Route53Records []Route53Record `json:"route53Records,omitempty"`
+
+	// +optional
+	GlobalAcceleratorEndpoints []GlobalAcceleratorEndpoint `json:"globalAcceleratorEndpoints,omitempty"`
 }
 
 // AwsTarget defines the AWS ELB v2 Target Group Target
@@ -39,16 +48,178 @@ type AwsTarget struct {
 	// +optional
 	Port *int64 `json:"port,omitempty"`
 
+	// Account is the ID of the AWS account the target group lives in. Empty for the account of node-detacher's own credentials
+	// +optional
+	Account string `json:"account,omitempty"`
+
+	// Region is the AWS region the target group lives in. Empty for the region of node-detacher's own AWS session
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// Integration is the integration that discovered the target group, like StaticTargetGroups or DynamicNLBs
+	// +optional
+	Integration string `json:"integration,omitempty"`
+
+	// Sources are Kubernetes resources that the target group was discovered from, like Service/default/envoy,
+	// Ingress/default/web, and TargetGroupBinding/default/envoy
+	// +optional
+	Sources []string `json:"sources,omitempty"`
+
+	// Controller is the Kubernetes controller managing targets of the target group, either aws-load-balancer-controller
+	// or aws-alb-ingress-controller. Empty when targets are managed by node-detacher alone
+	// +optional
+	Controller string `json:"controller,omitempty"`
+
+	// Services are Kubernetes services behind the target group in the form of NAMESPACE/NAME, derived from tags and
+	// sources of the target group
+	// +optional
+	Services []string `json:"services,omitempty"`
+
 	// +optional
 	Detached bool `json:"detached,omitempty"`
+
+	// Phase is either AwaitingController or Deregistering while node-detacher detaches the node, and either
+	// Registering or Healthy while and after node-detacher re-attaches the node
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// ControllerWaitStartedAt is when node-detacher started waiting for the controller to de-register or register the
+	// target, before doing it on its own
+	// +optional
+	ControllerWaitStartedAt *metav1.Time `json:"controllerWaitStartedAt,omitempty"`
+
+	// HealthyAt is when the re-attached target was verified healthy
+	// +optional
+	HealthyAt *metav1.Time `json:"healthyAt,omitempty"`
 }
 
 // AwsLoadBalancer defines the AWS ELB v1 CLB that the load-balancing target is attached to
 type AwsLoadBalancer struct {
 	Name string `json:"name"`
 
+	// Account is the ID of the AWS account the CLB lives in. Empty for the account of node-detacher's own credentials
+	// +optional
+	Account string `json:"account,omitempty"`
+
+	// Region is the AWS region the CLB lives in. Empty for the region of node-detacher's own AWS session
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// Integration is the integration that discovered the CLB, either StaticCLBs or DynamicCLBs
+	// +optional
+	Integration string `json:"integration,omitempty"`
+
+	// Sources are Kubernetes resources that the CLB was discovered from, like Service/default/envoy
+	// +optional
+	Sources []string `json:"sources,omitempty"`
+
+	// Services are Kubernetes services behind the CLB in the form of NAMESPACE/NAME, derived from tags and sources of
+	// the CLB
+	// +optional
+	Services []string `json:"services,omitempty"`
+
 	// +optional
 	Detached bool `json:"detached,omitempty"`
+
+	// Phase is Deregistering while node-detacher detaches the node, and either Registering or Healthy while and after
+	// node-detacher re-attaches the node
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// HealthyAt is when the re-attached target was verified healthy
+	// +optional
+	HealthyAt *metav1.Time `json:"healthyAt,omitempty"`
+}
+
+// ConsulService defines the Consul service instance that is registered with the node's address
+type ConsulService struct {
+	// ID is the ID of the service instance
+	ID string `json:"id"`
+
+	// Name is the name of the service
+	Name string `json:"name"`
+
+	// Node is the name of the Consul node that the service instance is registered to
+	Node string `json:"node"`
+
+	// NodeAddress is the address of the Consul node, used for reaching the Consul agent on the node
+	NodeAddress string `json:"nodeAddress"`
+
+	// +optional
+	Address string `json:"address,omitempty"`
+
+	// +optional
+	Port int `json:"port,omitempty"`
+
+	// +optional
+	Tags []string `json:"tags,omitempty"`
+
+	// +optional
+	Detached bool `json:"detached,omitempty"`
+
+	// Phase is Deregistering while node-detacher detaches the node. The service instance may or may not be detached yet
+	// +optional
+	Phase string `json:"phase,omitempty"`
+}
+
+// Route53Record defines the Route 53 weighted or multivalue answer record set that has the node's IP as one of its values
+type Route53Record struct {
+	HostedZoneID string `json:"hostedZoneID"`
+
+	Name string `json:"name"`
+
+	Type string `json:"type"`
+
+	SetIdentifier string `json:"setIdentifier"`
+
+	// Value is the node's IP contained in the record set
+	Value string `json:"value"`
+
+	// Weight is the original weight of the weighted record set, restored on re-attachment
+	// +optional
+	Weight *int64 `json:"weight,omitempty"`
+
+	// +optional
+	MultiValueAnswer bool `json:"multiValueAnswer,omitempty"`
+
+	TTL int64 `json:"ttl"`
+
+	// +optional
+	HealthCheckID string `json:"healthCheckID,omitempty"`
+
+	// +optional
+	Detached bool `json:"detached,omitempty"`
+
+	// Phase is Deregistering while node-detacher detaches the node. The node IP may or may not be detached from the
+	// record set yet
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// DetachedAt is the time the record set got updated for detachment, used for waiting for the TTL
+	// +optional
+	DetachedAt *metav1.Time `json:"detachedAt,omitempty"`
+}
+
+// GlobalAcceleratorEndpoint defines the AWS Global Accelerator endpoint group that contains the node's EC2 instance as an endpoint
+type GlobalAcceleratorEndpoint struct {
+	EndpointGroupARN string `json:"endpointGroupARN"`
+
+	// EndpointID is the EC2 instance ID of the node
+	EndpointID string `json:"endpointID"`
+
+	// Weight is the original weight of the endpoint, restored on re-attachment
+	// +optional
+	Weight *int64 `json:"weight,omitempty"`
+
+	// +optional
+	ClientIPPreservationEnabled *bool `json:"clientIPPreservationEnabled,omitempty"`
+
+	// +optional
+	Detached bool `json:"detached,omitempty"`
+
+	// Phase is Deregistering while node-detacher detaches the node. The endpoint may or may not be detached yet
+	// +optional
+	Phase string `json:"phase,omitempty"`
 }
 
 // AttachmentStatus defines the observed state of Attachment
@@ -58,6 +229,51 @@ type AttachmentStatus struct {
 	Phase      string      `json:"phase"`
 	Reason     string      `json:"reason"`
 	Message    string      `json:"message"`
+
+	// Drifts is the list of differences found between the attachment and the actual state of load balancers
+	// +optional
+	Drifts []AttachmentDrift `json:"drifts,omitempty"`
+
+	// ServiceImpacts are local endpoints of `externalTrafficPolicy: Local` services removed by the latest detachment of
+	// the node
+	// +optional
+	ServiceImpacts []ServiceImpact `json:"serviceImpacts,omitempty"`
+}
+
+// ServiceImpact describes how many local endpoints of the `externalTrafficPolicy: Local` service a detachment
+// removes, as load balancers send traffic for such services only to nodes with ready local endpoints
+type ServiceImpact struct {
+	// Service is the service in the form of NAMESPACE/NAME
+	Service string `json:"service"`
+
+	// LocalEndpoints is the number of ready endpoints of the service on the node
+	LocalEndpoints int32 `json:"localEndpoints"`
+
+	// ReadyEndpoints is the number of ready endpoints of the service across the cluster, including local ones
+	ReadyEndpoints int32 `json:"readyEndpoints"`
+
+	// Message is the human-readable description of the impact, like
+	// `removes 2 of 5 local endpoints of default/envoy`
+	Message string `json:"message"`
+}
+
+// AttachmentDrift describes the difference between the attachment and the actual state of the load balancer,
+// like the target group having been deleted after the attachment was cached
+type AttachmentDrift struct {
+	// Kind is either AwsTarget or AwsLoadBalancer
+	Kind string `json:"kind"`
+
+	// Name is the ARN of the target group or the name of the CLB
+	Name string `json:"name"`
+
+	// +optional
+	Port *int64 `json:"port,omitempty"`
+
+	Reason string `json:"reason"`
+
+	Message string `json:"message"`
+
+	DetectedAt metav1.Time `json:"detectedAt"`
 }
 
 // +kubebuilder:object:root=true
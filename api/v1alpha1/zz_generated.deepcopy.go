@@ -21,9 +21,26 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AnnotationRule) DeepCopyInto(out *AnnotationRule) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AnnotationRule.
+func (in *AnnotationRule) DeepCopy() *AnnotationRule {
+	if in == nil {
+		return nil
+	}
+	out := new(AnnotationRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Attachment) DeepCopyInto(out *Attachment) {
 	*out = *in
@@ -51,6 +68,27 @@ func (in *Attachment) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AttachmentDrift) DeepCopyInto(out *AttachmentDrift) {
+	*out = *in
+	if in.Port != nil {
+		in, out := &in.Port, &out.Port
+		*out = new(int64)
+		**out = **in
+	}
+	in.DetectedAt.DeepCopyInto(&out.DetectedAt)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AttachmentDrift.
+func (in *AttachmentDrift) DeepCopy() *AttachmentDrift {
+	if in == nil {
+		return nil
+	}
+	out := new(AttachmentDrift)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AttachmentList) DeepCopyInto(out *AttachmentList) {
 	*out = *in
@@ -96,7 +134,30 @@ func (in *AttachmentSpec) DeepCopyInto(out *AttachmentSpec) {
 	if in.AwsLoadBalancers != nil {
 		in, out := &in.AwsLoadBalancers, &out.AwsLoadBalancers
 		*out = make([]AwsLoadBalancer, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ConsulServices != nil {
+		in, out := &in.ConsulServices, &out.ConsulServices
+		*out = make([]ConsulService, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Route53Records != nil {
+		in, out := &in.Route53Records, &out.Route53Records
+		*out = make([]Route53Record, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.GlobalAcceleratorEndpoints != nil {
+		in, out := &in.GlobalAcceleratorEndpoints, &out.GlobalAcceleratorEndpoints
+		*out = make([]GlobalAcceleratorEndpoint, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
 	}
 }
 
@@ -115,6 +176,18 @@ func (in *AttachmentStatus) DeepCopyInto(out *AttachmentStatus) {
 	*out = *in
 	in.CachedAt.DeepCopyInto(&out.CachedAt)
 	in.DetachedAt.DeepCopyInto(&out.DetachedAt)
+	if in.Drifts != nil {
+		in, out := &in.Drifts, &out.Drifts
+		*out = make([]AttachmentDrift, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ServiceImpacts != nil {
+		in, out := &in.ServiceImpacts, &out.ServiceImpacts
+		*out = make([]ServiceImpact, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AttachmentStatus.
@@ -130,6 +203,20 @@ func (in *AttachmentStatus) DeepCopy() *AttachmentStatus {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AwsLoadBalancer) DeepCopyInto(out *AwsLoadBalancer) {
 	*out = *in
+	if in.Sources != nil {
+		in, out := &in.Sources, &out.Sources
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Services != nil {
+		in, out := &in.Services, &out.Services
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.HealthyAt != nil {
+		in, out := &in.HealthyAt, &out.HealthyAt
+		*out = (*in).DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AwsLoadBalancer.
@@ -150,6 +237,24 @@ func (in *AwsTarget) DeepCopyInto(out *AwsTarget) {
 		*out = new(int64)
 		**out = **in
 	}
+	if in.Sources != nil {
+		in, out := &in.Sources, &out.Sources
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Services != nil {
+		in, out := &in.Services, &out.Services
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ControllerWaitStartedAt != nil {
+		in, out := &in.ControllerWaitStartedAt, &out.ControllerWaitStartedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.HealthyAt != nil {
+		in, out := &in.HealthyAt, &out.HealthyAt
+		*out = (*in).DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AwsTarget.
@@ -161,3 +266,424 @@ func (in *AwsTarget) DeepCopy() *AwsTarget {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConsulService) DeepCopyInto(out *ConsulService) {
+	*out = *in
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConsulService.
+func (in *ConsulService) DeepCopy() *ConsulService {
+	if in == nil {
+		return nil
+	}
+	out := new(ConsulService)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DetachExclusions) DeepCopyInto(out *DetachExclusions) {
+	*out = *in
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Taints != nil {
+		in, out := &in.Taints, &out.Taints
+		*out = make([]TaintRule, len(*in))
+		copy(*out, *in)
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make([]AnnotationRule, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DetachExclusions.
+func (in *DetachExclusions) DeepCopy() *DetachExclusions {
+	if in == nil {
+		return nil
+	}
+	out := new(DetachExclusions)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DetachPolicy) DeepCopyInto(out *DetachPolicy) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DetachPolicy.
+func (in *DetachPolicy) DeepCopy() *DetachPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(DetachPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *DetachPolicy) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DetachPolicyList) DeepCopyInto(out *DetachPolicyList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]DetachPolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DetachPolicyList.
+func (in *DetachPolicyList) DeepCopy() *DetachPolicyList {
+	if in == nil {
+		return nil
+	}
+	out := new(DetachPolicyList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *DetachPolicyList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DetachPolicySpec) DeepCopyInto(out *DetachPolicySpec) {
+	*out = *in
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	in.Triggers.DeepCopyInto(&out.Triggers)
+	in.Exclusions.DeepCopyInto(&out.Exclusions)
+	if in.DrainTimeout != nil {
+		in, out := &in.DrainTimeout, &out.DrainTimeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.MaxConcurrentDetachments != nil {
+		in, out := &in.MaxConcurrentDetachments, &out.MaxConcurrentDetachments
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MaxUnavailableLocalEndpoints != nil {
+		in, out := &in.MaxUnavailableLocalEndpoints, &out.MaxUnavailableLocalEndpoints
+		*out = new(intstr.IntOrString)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DetachPolicySpec.
+func (in *DetachPolicySpec) DeepCopy() *DetachPolicySpec {
+	if in == nil {
+		return nil
+	}
+	out := new(DetachPolicySpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DetachTriggers) DeepCopyInto(out *DetachTriggers) {
+	*out = *in
+	if in.Taints != nil {
+		in, out := &in.Taints, &out.Taints
+		*out = make([]TaintRule, len(*in))
+		copy(*out, *in)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]NodeConditionRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make([]AnnotationRule, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DetachTriggers.
+func (in *DetachTriggers) DeepCopy() *DetachTriggers {
+	if in == nil {
+		return nil
+	}
+	out := new(DetachTriggers)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GlobalAcceleratorEndpoint) DeepCopyInto(out *GlobalAcceleratorEndpoint) {
+	*out = *in
+	if in.Weight != nil {
+		in, out := &in.Weight, &out.Weight
+		*out = new(int64)
+		**out = **in
+	}
+	if in.ClientIPPreservationEnabled != nil {
+		in, out := &in.ClientIPPreservationEnabled, &out.ClientIPPreservationEnabled
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GlobalAcceleratorEndpoint.
+func (in *GlobalAcceleratorEndpoint) DeepCopy() *GlobalAcceleratorEndpoint {
+	if in == nil {
+		return nil
+	}
+	out := new(GlobalAcceleratorEndpoint)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeConditionRule) DeepCopyInto(out *NodeConditionRule) {
+	*out = *in
+	if in.For != nil {
+		in, out := &in.For, &out.For
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeConditionRule.
+func (in *NodeConditionRule) DeepCopy() *NodeConditionRule {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeConditionRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Rollout) DeepCopyInto(out *Rollout) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Rollout.
+func (in *Rollout) DeepCopy() *Rollout {
+	if in == nil {
+		return nil
+	}
+	out := new(Rollout)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *Rollout) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutList) DeepCopyInto(out *RolloutList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]Rollout, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutList.
+func (in *RolloutList) DeepCopy() *RolloutList {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *RolloutList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutNode) DeepCopyInto(out *RolloutNode) {
+	*out = *in
+	if in.TargetGroups != nil {
+		in, out := &in.TargetGroups, &out.TargetGroups
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.StartedAt.DeepCopyInto(&out.StartedAt)
+	if in.StepStartedAt != nil {
+		in, out := &in.StepStartedAt, &out.StepStartedAt
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutNode.
+func (in *RolloutNode) DeepCopy() *RolloutNode {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutNode)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutSpec) DeepCopyInto(out *RolloutSpec) {
+	*out = *in
+	if in.MaxUnavailable != nil {
+		in, out := &in.MaxUnavailable, &out.MaxUnavailable
+		*out = new(intstr.IntOrString)
+		**out = **in
+	}
+	if in.MaxUnavailablePerZone != nil {
+		in, out := &in.MaxUnavailablePerZone, &out.MaxUnavailablePerZone
+		*out = new(intstr.IntOrString)
+		**out = **in
+	}
+	if in.MaxUnavailablePerTargetGroup != nil {
+		in, out := &in.MaxUnavailablePerTargetGroup, &out.MaxUnavailablePerTargetGroup
+		*out = new(intstr.IntOrString)
+		**out = **in
+	}
+	if in.PodReadyTimeout != nil {
+		in, out := &in.PodReadyTimeout, &out.PodReadyTimeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutSpec.
+func (in *RolloutSpec) DeepCopy() *RolloutSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutStatus) DeepCopyInto(out *RolloutStatus) {
+	*out = *in
+	if in.Nodes != nil {
+		in, out := &in.Nodes, &out.Nodes
+		*out = make([]RolloutNode, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LastUpdateTime != nil {
+		in, out := &in.LastUpdateTime, &out.LastUpdateTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutStatus.
+func (in *RolloutStatus) DeepCopy() *RolloutStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Route53Record) DeepCopyInto(out *Route53Record) {
+	*out = *in
+	if in.Weight != nil {
+		in, out := &in.Weight, &out.Weight
+		*out = new(int64)
+		**out = **in
+	}
+	if in.DetachedAt != nil {
+		in, out := &in.DetachedAt, &out.DetachedAt
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Route53Record.
+func (in *Route53Record) DeepCopy() *Route53Record {
+	if in == nil {
+		return nil
+	}
+	out := new(Route53Record)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceImpact) DeepCopyInto(out *ServiceImpact) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceImpact.
+func (in *ServiceImpact) DeepCopy() *ServiceImpact {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceImpact)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TaintRule) DeepCopyInto(out *TaintRule) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TaintRule.
+func (in *TaintRule) DeepCopy() *TaintRule {
+	if in == nil {
+		return nil
+	}
+	out := new(TaintRule)
+	in.DeepCopyInto(out)
+	return out
+}
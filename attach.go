@@ -2,82 +2,493 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
 	"github.com/mumoshu/node-detacher/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
 )
 
-func (n *NodeAttachments) attachNodes(nodes []corev1.Node) error {
-	for _, node := range nodes {
-		instanceID, err := getInstanceID(node)
-		if err != nil {
-			return err
-		}
+const (
+	// ReattachPhaseRegistering means the node is registered to the load balancer but not yet verified healthy
+	ReattachPhaseRegistering = "Registering"
+
+	// ReattachPhaseHealthy means the re-attached node is verified healthy
+	ReattachPhaseHealthy = "Healthy"
+
+	CLBInstanceStateOutOfService = "OutOfService"
+)
 
+// attachNodes re-attaches the nodes to everything node-detacher detached them from.
+//
+// Targets and CLBs proceed through the Registering and Healthy phases. A target is marked attached only after it is
+// verified healthy, and the list of targets that aren't healthy yet is returned.
+// When force is true, every remaining target is registered and marked attached regardless of its health.
+func (n *NodeAttachments) attachNodes(nodes []corev1.Node, force bool) ([]string, error) {
+	var pending []string
+
+	for _, node := range nodes {
 		var attachment v1alpha1.Attachment
 
 		ctx := context.Background()
 
 		if err := n.client.Get(ctx, types.NamespacedName{Name: node.Name, Namespace: n.namespace}, &attachment); err != nil {
-			n.Log.Error(err, "Failed to get attachment %q", node.Name)
+			n.Log.Error(err, "Failed to get attachment", "node", node.Name)
 
 			continue
 		}
 
+		instanceID, err := instanceIDOfAttachment(node, attachment.Spec)
+		if err != nil {
+			return nil, err
+		}
+
 		var specUpdates int
 
+		var drifts []v1alpha1.AttachmentDrift
+
+		var (
+			detachedTargets int
+			registering     int
+		)
+
+		for _, tg := range attachment.Spec.AwsTargets {
+			if tg.Detached {
+				detachedTargets++
+
+				if tg.Phase == ReattachPhaseRegistering {
+					registering++
+				}
+			}
+		}
+
+		for _, l := range attachment.Spec.AwsLoadBalancers {
+			if l.Detached && l.Phase == ReattachPhaseRegistering {
+				registering++
+			}
+		}
+
+		if detachedTargets > 0 {
+			// Note that we continue by registering targets of target groups without controllers on our own, while
+			// controllers register the rest in favor of the removal of the exclude-balancer labels
+			if err := n.unlabelExcludeBalancer(node.Name); err != nil {
+				return nil, err
+			}
+		}
+
+		// staged returns true when the registration should be deferred until the targets being registered become healthy
+		staged := func() bool {
+			return !force && n.reattachStageSize > 0 && registering >= n.reattachStageSize
+		}
+
 		for i, tg := range attachment.Spec.AwsTargets {
-			{
-				// Prevents alb-ingress-controller from re-registering the target
-				// i.e. avoids race between node-detacher and the alb-ingress-controller)
-				var latest corev1.Node
+			// Targets that weren't detached by node-detacher are left as-is, so that we never register the node to
+			// target groups it has been deliberately removed from by someone else
+			if !tg.Detached {
+				continue
+			}
+
+			t := &attachment.Spec.AwsTargets[i]
+
+			svc, err := n.awsServices(tg.Account, tg.Region)
+			if err != nil {
+				return nil, err
+			}
 
-				if err := n.client.Get(context.Background(), types.NamespacedName{Name: node.Name}, &latest); err != nil {
-					return err
+			if tg.Phase != ReattachPhaseRegistering {
+				if staged() {
+					pending = append(pending, fmt.Sprintf("%s(staged)", tg.ARN))
+
+					continue
 				}
 
-				// See https://github.com/kubernetes-sigs/aws-alb-ingress-controller/blob/27e5d2a7dc8584123e3997a5dd3d80a58fa7bbd7/internal/ingress/annotations/class/main.go#L52
-				delete(latest.Labels, "alpha.service-controller.kubernetes.io/exclude-balancer")
+				specUpdates++
+
+				if n.awaitsController(tg) {
+					// Registering the node on our own would race with the controller, which may still see the
+					// exclusion label in its cache and de-register the node again
+					now := metav1.Now()
+
+					t.ControllerWaitStartedAt = &now
+				} else if err := n.attachTarget(svc.ELBV2, instanceID, tg); err != nil {
+					if !isAWSDriftError(err) {
+						return nil, err
+					}
 
-				if err := n.client.Update(context.Background(), &latest); err != nil {
-					return err
+					drifts = append(drifts, newAttachmentDrift(AttachmentDriftKindAwsTarget, tg.ARN, tg.Port, err))
+
+					t.Detached = false
+					t.Phase = ""
+
+					continue
 				}
 
-				// Note that we continue by registering the target on our own, instead of waiting for the
-				// alb-ingress-controller to do it for us in favor of the removal of "alpha.service-controller.kubernetes.io/exclude-balancer"
+				t.Phase = ReattachPhaseRegistering
+				registering++
 			}
 
-			if tg.Port != nil {
-				if err := attachInstanceToTG(n.elbv2Svc, tg.ARN, instanceID, *tg.Port); err != nil {
-					return err
+			if t.ControllerWaitStartedAt != nil {
+				registered, err := isTargetRegistered(svc.ELBV2, tg.ARN, instanceID, tg.Port)
+				if err != nil && !isAWSDriftError(err) {
+					return nil, err
+				}
+
+				if err == nil && !registered && !force && n.controllerWaitRemaining(*t, time.Now()) > 0 {
+					pending = append(pending, fmt.Sprintf("%s(awaiting %s)", tg.ARN, tg.Controller))
+
+					continue
 				}
-			} else {
-				if err := attachInstanceToTG(n.elbv2Svc, tg.ARN, instanceID); err != nil {
-					return err
+
+				specUpdates++
+
+				t.ControllerWaitStartedAt = nil
+
+				if err == nil && !registered {
+					n.Log.Info("Timed out waiting for controller to register node. Registering on our own", "node", node.Name, "targetgroup", tg.ARN, "controller", tg.Controller)
+
+					if err := n.attachTarget(svc.ELBV2, instanceID, tg); err != nil {
+						if !isAWSDriftError(err) {
+							return nil, err
+						}
+
+						drifts = append(drifts, newAttachmentDrift(AttachmentDriftKindAwsTarget, tg.ARN, tg.Port, err))
+
+						t.Detached = false
+						t.Phase = ""
+						registering--
+
+						continue
+					}
 				}
 			}
 
+			state, err := getTargetHealthState(svc.ELBV2, tg.ARN, instanceID, tg.Port)
+			if err != nil {
+				if !isAWSDriftError(err) {
+					return nil, err
+				}
+
+				specUpdates++
+
+				drifts = append(drifts, newAttachmentDrift(AttachmentDriftKindAwsTarget, tg.ARN, tg.Port, err))
+
+				t.Detached = false
+				t.Phase = ""
+				registering--
+
+				continue
+			}
+
+			if !force && (state == elbv2.TargetHealthStateEnumInitial || state == elbv2.TargetHealthStateEnumUnhealthy) {
+				pending = append(pending, fmt.Sprintf("%s(%s)", tg.ARN, state))
+
+				continue
+			}
+
+			// Targets in target groups not used by any load balancer never become healthy, hence considered healthy
+			now := metav1.Now()
+
 			specUpdates++
 
-			attachment.Spec.AwsTargets[i].Detached = false
+			t.Detached = false
+			t.Phase = ReattachPhaseHealthy
+			t.HealthyAt = &now
+			registering--
 		}
 
 		for i, l := range attachment.Spec.AwsLoadBalancers {
-			if err := registerInstancesToCLBs(n.elbSvc, l.Name, []string{instanceID}); err != nil {
-				return err
+			if !l.Detached {
+				continue
+			}
+
+			lb := &attachment.Spec.AwsLoadBalancers[i]
+
+			svc, err := n.awsServices(l.Account, l.Region)
+			if err != nil {
+				return nil, err
 			}
 
+			if l.Phase != ReattachPhaseRegistering {
+				if staged() {
+					pending = append(pending, fmt.Sprintf("%s(staged)", l.Name))
+
+					continue
+				}
+
+				specUpdates++
+
+				if err := registerInstancesToCLBs(svc.ELB, l.Name, []string{instanceID}); err != nil {
+					if !isAWSDriftError(err) {
+						return nil, err
+					}
+
+					drifts = append(drifts, newAttachmentDrift(AttachmentDriftKindAwsLoadBalancer, l.Name, nil, err))
+
+					lb.Detached = false
+					lb.Phase = ""
+
+					continue
+				}
+
+				lb.Phase = ReattachPhaseRegistering
+				registering++
+			}
+
+			state, err := getCLBInstanceState(svc.ELB, l.Name, instanceID)
+			if err != nil {
+				if !isAWSDriftError(err) {
+					return nil, err
+				}
+
+				specUpdates++
+
+				drifts = append(drifts, newAttachmentDrift(AttachmentDriftKindAwsLoadBalancer, l.Name, nil, err))
+
+				lb.Detached = false
+				lb.Phase = ""
+				registering--
+
+				continue
+			}
+
+			if !force && state == CLBInstanceStateOutOfService {
+				pending = append(pending, fmt.Sprintf("%s(%s)", l.Name, state))
+
+				continue
+			}
+
+			now := metav1.Now()
+
 			specUpdates++
 
-			attachment.Spec.AwsLoadBalancers[i].Detached = false
+			lb.Detached = false
+			lb.Phase = ReattachPhaseHealthy
+			lb.HealthyAt = &now
+			registering--
+		}
+
+		for i, ep := range attachment.Spec.GlobalAcceleratorEndpoints {
+			if !ep.Detached || n.globalAccelerator == nil {
+				continue
+			}
+
+			if err := n.globalAccelerator.attachEndpoint(ep); err != nil {
+				return nil, err
+			}
+
+			specUpdates++
+
+			attachment.Spec.GlobalAcceleratorEndpoints[i].Detached = false
+			attachment.Spec.GlobalAcceleratorEndpoints[i].Phase = ""
+		}
+
+		for i, svc := range attachment.Spec.ConsulServices {
+			if !svc.Detached || n.consul == nil {
+				continue
+			}
+
+			if err := n.consul.attach(svc); err != nil {
+				return nil, err
+			}
+
+			specUpdates++
+
+			attachment.Spec.ConsulServices[i].Detached = false
+			attachment.Spec.ConsulServices[i].Phase = ""
+		}
+
+		for i, rec := range attachment.Spec.Route53Records {
+			if !rec.Detached || n.route53 == nil {
+				continue
+			}
+
+			if err := n.route53.attachRecord(rec); err != nil {
+				return nil, err
+			}
+
+			specUpdates++
+
+			attachment.Spec.Route53Records[i].Detached = false
+			attachment.Spec.Route53Records[i].Phase = ""
+			attachment.Spec.Route53Records[i].DetachedAt = nil
 		}
 
 		if specUpdates > 0 {
 			if err := n.client.Update(context.Background(), &attachment); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := n.recordDrifts(&attachment, drifts); err != nil {
+			return nil, err
+		}
+	}
+
+	return pending, nil
+}
+
+// attachTarget registers the instance to the target group on the original port, and then verifies that the target
+// is actually registered
+func (n *NodeAttachments) attachTarget(svc elbv2iface.ELBV2API, instanceID string, tg v1alpha1.AwsTarget) error {
+	var ports []int64
+
+	if tg.Port != nil {
+		ports = append(ports, *tg.Port)
+	}
+
+	if n.reattachSlowStart > 0 {
+		if err := enableSlowStart(svc, tg.ARN, n.reattachSlowStart); err != nil {
+			if awsErrorCode(err) != elbv2.ErrCodeInvalidConfigurationRequestException {
 				return err
 			}
+
+			// Slow start isn't supported by target groups of NLBs
+			n.Log.V(1).Info("Skipped enabling slow start", "targetgroup", tg.ARN, "reason", err.Error())
 		}
 	}
 
+	if err := attachInstanceToTG(svc, tg.ARN, instanceID, ports...); err != nil {
+		return err
+	}
+
+	registered, err := isTargetRegistered(svc, tg.ARN, instanceID, tg.Port)
+	if err != nil {
+		return err
+	}
+
+	if !registered {
+		return awserr.New(elbv2.ErrCodeInvalidTargetException, fmt.Sprintf("instance %s is not found in target group %s after registration", instanceID, tg.ARN), nil)
+	}
+
 	return nil
 }
+
+// unlabelExcludeBalancer removes the exclude-balancer labels from the node, only when they were added by node-detacher
+func (n *NodeAttachments) unlabelExcludeBalancer(nodeName string) error {
+	var latest corev1.Node
+
+	if err := n.client.Get(context.Background(), types.NamespacedName{Name: nodeName}, &latest); err != nil {
+		return err
+	}
+
+	var updated bool
+
+	for label, annotation := range excludeBalancerLabels {
+		if _, ok := latest.Annotations[annotation]; !ok {
+			continue
+		}
+
+		delete(latest.Labels, label)
+		delete(latest.Annotations, annotation)
+
+		updated = true
+	}
+
+	if !updated {
+		return nil
+	}
+
+	return n.client.Update(context.Background(), &latest)
+}
+
+// unhealthyWithinRollbackWindow returns the targets and CLBs that became unhealthy within the window since they were
+// verified healthy on re-attachment. watching is true while any of the targets is still within the window.
+//
+// Target groups and CLBs deleted in the meantime are recorded as drifts and no longer watched.
+func (n *NodeAttachments) unhealthyWithinRollbackWindow(node corev1.Node, window time.Duration, now time.Time) (unhealthy []string, watching bool, err error) {
+	var attachment v1alpha1.Attachment
+
+	if err := n.client.Get(context.Background(), types.NamespacedName{Name: node.Name, Namespace: n.namespace}, &attachment); err != nil {
+		return nil, false, client.IgnoreNotFound(err)
+	}
+
+	instanceID, err := instanceIDOfAttachment(node, attachment.Spec)
+	if err != nil {
+		return nil, false, err
+	}
+
+	inWindow := func(detached bool, phase string, healthyAt *metav1.Time) bool {
+		return !detached && phase == ReattachPhaseHealthy && healthyAt != nil && now.Sub(healthyAt.Time) < window
+	}
+
+	var drifts []v1alpha1.AttachmentDrift
+
+	for i, tg := range attachment.Spec.AwsTargets {
+		if !inWindow(tg.Detached, tg.Phase, tg.HealthyAt) {
+			continue
+		}
+
+		watching = true
+
+		svc, err := n.awsServices(tg.Account, tg.Region)
+		if err != nil {
+			return nil, false, err
+		}
+
+		state, err := getTargetHealthState(svc.ELBV2, tg.ARN, instanceID, tg.Port)
+		if err != nil {
+			if !isAWSDriftError(err) {
+				return nil, false, err
+			}
+
+			drifts = append(drifts, newAttachmentDrift(AttachmentDriftKindAwsTarget, tg.ARN, tg.Port, err))
+
+			attachment.Spec.AwsTargets[i].Phase = ""
+			attachment.Spec.AwsTargets[i].HealthyAt = nil
+
+			continue
+		}
+
+		if state == elbv2.TargetHealthStateEnumUnhealthy {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s(%s)", tg.ARN, state))
+		}
+	}
+
+	for i, l := range attachment.Spec.AwsLoadBalancers {
+		if !inWindow(l.Detached, l.Phase, l.HealthyAt) {
+			continue
+		}
+
+		watching = true
+
+		svc, err := n.awsServices(l.Account, l.Region)
+		if err != nil {
+			return nil, false, err
+		}
+
+		state, err := getCLBInstanceState(svc.ELB, l.Name, instanceID)
+		if err != nil {
+			if !isAWSDriftError(err) {
+				return nil, false, err
+			}
+
+			drifts = append(drifts, newAttachmentDrift(AttachmentDriftKindAwsLoadBalancer, l.Name, nil, err))
+
+			attachment.Spec.AwsLoadBalancers[i].Phase = ""
+			attachment.Spec.AwsLoadBalancers[i].HealthyAt = nil
+
+			continue
+		}
+
+		if state == CLBInstanceStateOutOfService {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s(%s)", l.Name, state))
+		}
+	}
+
+	if len(drifts) > 0 {
+		if err := n.client.Update(context.Background(), &attachment); err != nil {
+			return nil, false, err
+		}
+
+		if err := n.recordDrifts(&attachment, drifts); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return unhealthy, watching, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -11,6 +12,12 @@ import (
 	"github.com/aws/aws-sdk-go/service/elb/elbiface"
 	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/globalaccelerator"
+	"github.com/aws/aws-sdk-go/service/globalaccelerator/globalacceleratoriface"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"strconv"
+	"time"
 )
 
 func getIDToCLBs(svc elbiface.ELBAPI, ids []string) (map[string][]string, error) {
@@ -111,6 +118,149 @@ func getIDToTGs(svc elbv2iface.ELBV2API, ids []string) (map[string][]string, map
 	return idToTGs, idToTDs, nil
 }
 
+// getCLBInstances returns IDs of instances registered to the CLB, or nil when the CLB doesn't exist
+func getCLBInstances(svc elbiface.ELBAPI, name string) ([]string, error) {
+	output, err := svc.DescribeLoadBalancers(&elb.DescribeLoadBalancersInput{
+		LoadBalancerNames: []*string{aws.String(name)},
+	})
+	if awsErrorCode(err) == elb.ErrCodeAccessPointNotFoundException {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to get description for CLB %s: %v", name, err)
+	}
+
+	var ids []string
+
+	for _, d := range output.LoadBalancerDescriptions {
+		for _, i := range d.Instances {
+			ids = append(ids, aws.StringValue(i.InstanceId))
+		}
+	}
+
+	return ids, nil
+}
+
+// getTGsOfLoadBalancer returns ARNs of target groups the ALB or NLB forwards traffic to, or nil when the load balancer
+// doesn't exist
+func getTGsOfLoadBalancer(svc elbv2iface.ELBV2API, name string) ([]string, error) {
+	lbs, err := svc.DescribeLoadBalancers(&elbv2.DescribeLoadBalancersInput{
+		Names: []*string{aws.String(name)},
+	})
+	if awsErrorCode(err) == elbv2.ErrCodeLoadBalancerNotFoundException {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to get description for load balancer %s: %v", name, err)
+	}
+
+	var arns []string
+
+	for _, lb := range lbs.LoadBalancers {
+		err := svc.DescribeTargetGroupsPages(&elbv2.DescribeTargetGroupsInput{LoadBalancerArn: lb.LoadBalancerArn}, func(output *elbv2.DescribeTargetGroupsOutput, lastPage bool) bool {
+			for _, tg := range output.TargetGroups {
+				arns = append(arns, aws.StringValue(tg.TargetGroupArn))
+			}
+
+			return !lastPage
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get target groups of load balancer %s: %v", name, err)
+		}
+	}
+
+	return arns, nil
+}
+
+// getInstanceTargets returns targets of the instances registered to the target group, or nil when the target group
+// doesn't exist
+func getInstanceTargets(svc elbv2iface.ELBV2API, tgARN string, instanceIDs []string) (map[string][]elbv2.TargetDescription, error) {
+	output, err := svc.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(tgARN),
+	})
+	if awsErrorCode(err) == elbv2.ErrCodeTargetGroupNotFoundException {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to get targets of target group %s: %v", tgARN, err)
+	}
+
+	ids := map[string]bool{}
+
+	for _, id := range instanceIDs {
+		ids[id] = true
+	}
+
+	idToTDs := map[string][]elbv2.TargetDescription{}
+
+	for _, desc := range output.TargetHealthDescriptions {
+		if id := aws.StringValue(desc.Target.Id); ids[id] {
+			idToTDs[id] = append(idToTDs[id], *desc.Target)
+		}
+	}
+
+	return idToTDs, nil
+}
+
+// getCLBTags returns tags of the CLBs. DescribeTags accepts up to 20 CLBs per call
+func getCLBTags(svc elbiface.ELBAPI, names []string) (map[string]map[string]string, error) {
+	nameToTags := map[string]map[string]string{}
+
+	for start := 0; start < len(names); start += 20 {
+		end := start + 20
+		if end > len(names) {
+			end = len(names)
+		}
+
+		output, err := svc.DescribeTags(&elb.DescribeTagsInput{
+			LoadBalancerNames: aws.StringSlice(names[start:end]),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get tags for CLBs %v: %v", names[start:end], err)
+		}
+
+		for _, d := range output.TagDescriptions {
+			tags := map[string]string{}
+
+			for _, t := range d.Tags {
+				tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+			}
+
+			nameToTags[aws.StringValue(d.LoadBalancerName)] = tags
+		}
+	}
+
+	return nameToTags, nil
+}
+
+// getTGTags returns tags of the target groups. DescribeTags accepts up to 20 target groups per call
+func getTGTags(svc elbv2iface.ELBV2API, arns []string) (map[string]map[string]string, error) {
+	arnToTags := map[string]map[string]string{}
+
+	for start := 0; start < len(arns); start += 20 {
+		end := start + 20
+		if end > len(arns) {
+			end = len(arns)
+		}
+
+		output, err := svc.DescribeTags(&elbv2.DescribeTagsInput{
+			ResourceArns: aws.StringSlice(arns[start:end]),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get tags for target groups %v: %v", arns[start:end], err)
+		}
+
+		for _, d := range output.TagDescriptions {
+			tags := map[string]string{}
+
+			for _, t := range d.Tags {
+				tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+			}
+
+			arnToTags[aws.StringValue(d.ResourceArn)] = tags
+		}
+	}
+
+	return arnToTags, nil
+}
+
 func registerInstancesToCLBs(svc elbiface.ELBAPI, lbName string, instanceIDs []string) error {
 	instances := []*elb.Instance{}
 
@@ -128,22 +278,10 @@ func registerInstancesToCLBs(svc elbiface.ELBAPI, lbName string, instanceIDs []s
 	// API Reference:
 	//
 	// https://docs.aws.amazon.com/elasticloadbalancing/2012-06-01/APIReference/API_RegisterInstancesWithLoadBalancer.html
-	_, err := svc.RegisterInstancesWithLoadBalancer(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-
-			switch aerr.Code() {
-			case autoscaling.ErrCodeResourceContentionFault:
-				return fmt.Errorf("Could not register instances, any resource is in contention, will try in next loop")
-			default:
-				return fmt.Errorf("Unknown aws error when registering instances: %v", aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			return fmt.Errorf("Unknown non-aws error when registering instances: %v", err.Error())
-		}
+	if _, err := svc.RegisterInstancesWithLoadBalancer(input); err != nil {
+		return fmt.Errorf("Unable to register instances to CLB %q: %w", lbName, err)
 	}
+
 	return nil
 }
 
@@ -162,22 +300,10 @@ func deregisterInstancesFromCLBs(svc elbiface.ELBAPI, lbName string, instanceIDs
 	}
 
 	// See https://docs.aws.amazon.com/autoscaling/ec2/APIReference/API_DetachInstances.html for the API spec
-	_, err := svc.DeregisterInstancesFromLoadBalancer(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-
-			switch aerr.Code() {
-			case autoscaling.ErrCodeResourceContentionFault:
-				return fmt.Errorf("Could not deregister instances, any resource is in contention, will try in next loop")
-			default:
-				return fmt.Errorf("Unknown aws error when deregistering instances: %v", aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			return fmt.Errorf("Unknown non-aws error when deregistering instances: %v", err.Error())
-		}
+	if _, err := svc.DeregisterInstancesFromLoadBalancer(input); err != nil {
+		return fmt.Errorf("Unable to deregister instances from CLB %q: %w", lbName, err)
 	}
+
 	return nil
 }
 
@@ -202,96 +328,220 @@ func attachInstanceToTG(svc elbv2iface.ELBV2API, tgName string, instanceID strin
 
 	// See https://docs.aws.amazon.com/elasticloadbalancing/latest/APIReference/API_RegisterTargets.html for the API spec
 	if _, err := svc.RegisterTargets(input); err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-
-			switch aerr.Code() {
-			case autoscaling.ErrCodeResourceContentionFault:
-				return fmt.Errorf("Could not register targets, any resource is in contention, will try in next loop")
-			default:
-				return fmt.Errorf("Unknown aws error when registering targets: %v", aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			return fmt.Errorf("Unknown non-aws error when deregistering targets: %v", err.Error())
-		}
+		return fmt.Errorf("Unable to register targets to target group %q: %w", tgName, err)
 	}
+
 	return nil
 }
 
 func deregisterInstanceFromTG(svc elbv2iface.ELBV2API, tgName string, instanceID string, port int64) error {
-	descs := []*elbv2.TargetDescription{}
-
-	descs = append(descs, &elbv2.TargetDescription{
+	return deregisterTargetsFromTG(svc, tgName, []*elbv2.TargetDescription{{
 		Id:   aws.String(instanceID),
 		Port: aws.Int64(port),
-	})
+	}})
+}
 
+func deregisterInstancesFromTGs(svc elbv2iface.ELBV2API, tgName string, instanceIDs []string) error {
+	descs := []*elbv2.TargetDescription{}
+
+	for _, id := range instanceIDs {
+		descs = append(descs, &elbv2.TargetDescription{
+			Id: aws.String(id),
+		})
+	}
+
+	return deregisterTargetsFromTG(svc, tgName, descs)
+}
+
+func deregisterTargetsFromTG(svc elbv2iface.ELBV2API, tgName string, descs []*elbv2.TargetDescription) error {
 	input := &elbv2.DeregisterTargetsInput{
 		TargetGroupArn: aws.String(tgName),
 		Targets:        descs,
 	}
 
-	// See https://docs.aws.amazon.com/autoscaling/ec2/APIReference/API_DetachInstances.html for the API spec
+	// See https://docs.aws.amazon.com/elasticloadbalancing/latest/APIReference/API_DeregisterTargets.html for the API spec
 	if _, err := svc.DeregisterTargets(input); err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
+		return fmt.Errorf("Unable to deregister targets from target group %q: %w", tgName, err)
+	}
 
-			switch aerr.Code() {
-			case autoscaling.ErrCodeResourceContentionFault:
-				return fmt.Errorf("Could not deregister targets, any resource is in contention, will try in next loop")
-			default:
-				return fmt.Errorf("Unknown aws error when deregistering targets: %v", aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			return fmt.Errorf("Unknown non-aws error when deregistering targets: %v", err.Error())
+	return nil
+}
+
+// awsErrorCode returns the AWS error code of the error, or an empty string for non-AWS errors
+func awsErrorCode(err error) string {
+	var aerr awserr.Error
+
+	if errors.As(err, &aerr) {
+		return aerr.Code()
+	}
+
+	return ""
+}
+
+// isAWSDriftError returns true when the error indicates that the load balancer, the target group, or the target
+// no longer exists, so that retrying never succeeds. Such permanent errors are recorded as drifts in the attachment
+// status instead of being retried.
+func isAWSDriftError(err error) bool {
+	switch awsErrorCode(err) {
+	case elbv2.ErrCodeTargetGroupNotFoundException,
+		elbv2.ErrCodeInvalidTargetException,
+		// LoadBalancerNotFound of both ELB v1 and v2
+		elb.ErrCodeAccessPointNotFoundException,
+		elb.ErrCodeInvalidEndPointException:
+		return true
+	}
+
+	return false
+}
+
+// isTargetRegistered returns true when the target is a member of the target group, regardless of its health
+func isTargetRegistered(svc elbv2iface.ELBV2API, tgARN string, instanceID string, port *int64) (bool, error) {
+	output, err := svc.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(tgARN),
+	})
+	if err != nil {
+		return false, fmt.Errorf("Unable to describe target health for %q: %w", tgARN, err)
+	}
+
+	for _, desc := range output.TargetHealthDescriptions {
+		if aws.StringValue(desc.Target.Id) != instanceID {
+			continue
 		}
+
+		if port != nil && aws.Int64Value(desc.Target.Port) != *port {
+			continue
+		}
+
+		return true, nil
 	}
-	return nil
+
+	return false, nil
 }
 
-func deregisterInstancesFromTGs(svc elbv2iface.ELBV2API, tgName string, instanceIDs []string) error {
-	descs := []*elbv2.TargetDescription{}
+// getRegisteredTargetState returns the health state of the target like `healthy` or `draining`, or empty when the
+// instance isn't registered to the target group
+func getRegisteredTargetState(svc elbv2iface.ELBV2API, tgARN string, instanceID string, port *int64) (string, error) {
+	output, err := svc.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(tgARN),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to describe target health for %q: %w", tgARN, err)
+	}
 
-	for _, id := range instanceIDs {
-		descs = append(descs, &elbv2.TargetDescription{
-			Id: aws.String(id),
-		})
+	for _, desc := range output.TargetHealthDescriptions {
+		if aws.StringValue(desc.Target.Id) != instanceID {
+			continue
+		}
+
+		if port != nil && aws.Int64Value(desc.Target.Port) != *port {
+			continue
+		}
+
+		if desc.TargetHealth == nil {
+			return elbv2.TargetHealthStateEnumUnavailable, nil
+		}
+
+		return aws.StringValue(desc.TargetHealth.State), nil
 	}
 
-	input := &elbv2.DeregisterTargetsInput{
-		TargetGroupArn: aws.String(tgName),
-		Targets:        descs,
+	return "", nil
+}
+
+// getTargetHealthState returns the health state of the target like `healthy` or `initial`
+func getTargetHealthState(svc elbv2iface.ELBV2API, tgARN string, instanceID string, port *int64) (string, error) {
+	output, err := svc.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(tgARN),
+		Targets:        []*elbv2.TargetDescription{{Id: aws.String(instanceID), Port: port}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to describe target health for %q: %w", tgARN, err)
 	}
 
-	// See https://docs.aws.amazon.com/autoscaling/ec2/APIReference/API_DetachInstances.html for the API spec
-	_, err := svc.DeregisterTargets(input)
+	for _, desc := range output.TargetHealthDescriptions {
+		if aws.StringValue(desc.Target.Id) == instanceID && desc.TargetHealth != nil {
+			return aws.StringValue(desc.TargetHealth.State), nil
+		}
+	}
+
+	return elbv2.TargetHealthStateEnumUnused, nil
+}
+
+// getCLBInstanceState returns the state of the instance registered to the CLB like `InService` or `OutOfService`
+func getCLBInstanceState(svc elbiface.ELBAPI, lbName string, instanceID string) (string, error) {
+	output, err := svc.DescribeInstanceHealth(&elb.DescribeInstanceHealthInput{
+		LoadBalancerName: aws.String(lbName),
+		Instances:        []*elb.Instance{{InstanceId: aws.String(instanceID)}},
+	})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
+		return "", fmt.Errorf("Unable to describe instance health for %q: %w", lbName, err)
+	}
 
-			switch aerr.Code() {
-			case autoscaling.ErrCodeResourceContentionFault:
-				return fmt.Errorf("Could not deregister targets, any resource is in contention, will try in next loop")
-			default:
-				return fmt.Errorf("Unknown aws error when deregistering targets: %v", aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			return fmt.Errorf("Unknown non-aws error when deregistering targets: %v", err.Error())
+	for _, s := range output.InstanceStates {
+		if aws.StringValue(s.InstanceId) == instanceID {
+			return aws.StringValue(s.State), nil
+		}
+	}
+
+	return "", nil
+}
+
+// enableSlowStart enables the slow start mode of the target group, so that re-registered targets receive linearly
+// increasing share of traffic. Target groups that already have slow start enabled are left as-is.
+func enableSlowStart(svc elbv2iface.ELBV2API, tgARN string, duration time.Duration) error {
+	const key = "slow_start.duration_seconds"
+
+	output, err := svc.DescribeTargetGroupAttributes(&elbv2.DescribeTargetGroupAttributesInput{
+		TargetGroupArn: aws.String(tgARN),
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to describe target group attributes for %q: %w", tgARN, err)
+	}
+
+	for _, a := range output.Attributes {
+		if aws.StringValue(a.Key) == key && aws.StringValue(a.Value) != "0" {
+			return nil
 		}
 	}
+
+	if _, err := svc.ModifyTargetGroupAttributes(&elbv2.ModifyTargetGroupAttributesInput{
+		TargetGroupArn: aws.String(tgARN),
+		Attributes: []*elbv2.TargetGroupAttribute{
+			{Key: aws.String(key), Value: aws.String(strconv.Itoa(int(duration.Seconds())))},
+		},
+	}); err != nil {
+		return fmt.Errorf("Unable to enable slow start for %q: %w", tgARN, err)
+	}
+
 	return nil
 }
 
-func awsGetServices() (autoscalingiface.AutoScalingAPI, elbiface.ELBAPI, elbv2iface.ELBV2API, error) {
+// awsGetServices returns AWS API clients. ELB and ELB v2 API calls are rate-limited and retried by the limiter,
+// in place of the retries by AWS SDK.
+func awsGetServices(limiter *AWSAPILimiter) (autoscalingiface.AutoScalingAPI, elbiface.ELBAPI, elbv2iface.ELBV2API, error) {
 	sess, err := session.NewSession()
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	noRetries := aws.NewConfig().WithMaxRetries(0)
 	asgSvc := autoscaling.New(sess)
-	elbSvc := elb.New(sess)
-	elbv2Svc := elbv2.New(sess)
+	elbSvc := newLimitedELB(elb.New(sess, noRetries), limiter)
+	elbv2Svc := newLimitedELBV2(elbv2.New(sess, noRetries), limiter)
 	return asgSvc, elbSvc, elbv2Svc, nil
 }
+
+func awsGetRoute53Service() (route53iface.Route53API, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return route53.New(sess), nil
+}
+
+func awsGetGlobalAcceleratorService() (globalacceleratoriface.GlobalAcceleratorAPI, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	// Global Accelerator is a global service whose API is available only in us-west-2
+	return globalaccelerator.New(sess, aws.NewConfig().WithRegion("us-west-2")), nil
+}
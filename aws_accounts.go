@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"strings"
+)
+
+// AWSAccount is an AWS account and region, other than node-detacher's own, whose load balancers nodes are registered
+// to, like a shared networking account fronting the cluster
+type AWSAccount struct {
+	// RoleARN is the IAM role assumed to call AWS APIs in the account. Empty for the account of node-detacher's own
+	// credentials, which is useful for load balancers in another region of the same account.
+	RoleARN string
+
+	// ExternalID is the external ID required by the trust policy of the role, if any
+	ExternalID string
+
+	// Region is the region of load balancers. Defaults to the region of node-detacher's own AWS session
+	Region string
+}
+
+// AccountID returns the ID of the AWS account that the role belongs to, or an empty string for node-detacher's own
+// account
+func (a AWSAccount) AccountID() string {
+	if a.RoleARN == "" {
+		return ""
+	}
+
+	parsed, err := arn.Parse(a.RoleARN)
+	if err != nil {
+		return ""
+	}
+
+	return parsed.AccountID
+}
+
+// ParseAWSAccounts parses `role-arn=ARN,external-id=ID,region=REGION` given via command-line flags into AWS accounts
+func ParseAWSAccounts(specs []string) ([]AWSAccount, error) {
+	var accounts []AWSAccount
+
+	for _, s := range specs {
+		var a AWSAccount
+
+		for _, kv := range strings.Split(s, ",") {
+			pair := strings.SplitN(kv, "=", 2)
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("invalid aws account %q: it must be in the form of role-arn=ARN,external-id=ID,region=REGION", s)
+			}
+
+			switch pair[0] {
+			case "role-arn":
+				if !arn.IsARN(pair[1]) {
+					return nil, fmt.Errorf("invalid role arn in aws account %q", s)
+				}
+
+				a.RoleARN = pair[1]
+			case "external-id":
+				a.ExternalID = pair[1]
+			case "region":
+				a.Region = pair[1]
+			default:
+				return nil, fmt.Errorf("unknown key %q in aws account %q: it must be one of role-arn, external-id, and region", pair[0], s)
+			}
+		}
+
+		if a.RoleARN == "" && a.Region == "" {
+			return nil, fmt.Errorf("invalid aws account %q: either role-arn or region must be specified", s)
+		}
+
+		if a.RoleARN == "" && a.ExternalID != "" {
+			return nil, fmt.Errorf("invalid aws account %q: external-id requires role-arn", s)
+		}
+
+		accounts = append(accounts, a)
+	}
+
+	return accounts, nil
+}
+
+// AWSServices is the set of AWS API clients for load balancers in an AWS account and region
+type AWSServices struct {
+	// Account is the ID of the AWS account. Empty for the account of node-detacher's own credentials
+	Account string
+
+	// Region is the AWS region. Empty for the region of node-detacher's own AWS session
+	Region string
+
+	ELB   elbiface.ELBAPI
+	ELBV2 elbv2iface.ELBV2API
+}
+
+// awsGetAccountServices creates AWS API clients for each account, assuming the role of the account when specified.
+//
+// Each account has its own rate limiter, as AWS API quotas are per account and region.
+func awsGetAccountServices(accounts []AWSAccount, limiter *AWSAPILimiter) ([]*AWSServices, error) {
+	if len(accounts) == 0 {
+		return nil, nil
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	var services []*AWSServices
+
+	for _, a := range accounts {
+		config := aws.NewConfig().WithMaxRetries(0)
+
+		if a.Region != "" {
+			config = config.WithRegion(a.Region)
+		}
+
+		if a.RoleARN != "" {
+			externalID := a.ExternalID
+
+			config = config.WithCredentials(stscreds.NewCredentials(sess, a.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+				if externalID != "" {
+					p.ExternalID = aws.String(externalID)
+				}
+			}))
+		}
+
+		lim := &AWSAPILimiter{
+			QPS:           limiter.QPS,
+			Burst:         limiter.Burst,
+			MaxRetries:    limiter.MaxRetries,
+			MinRetryDelay: limiter.MinRetryDelay,
+			MaxRetryDelay: limiter.MaxRetryDelay,
+		}
+
+		services = append(services, &AWSServices{
+			Account: a.AccountID(),
+			Region:  a.Region,
+			ELB:     newLimitedELB(elb.New(sess, config), lim),
+			ELBV2:   newLimitedELBV2(elbv2.New(sess, config), lim),
+		})
+	}
+
+	return services, nil
+}
+
+// awsServices returns the AWS API clients for load balancers in the account and region.
+// Empty account and region mean the account and region of node-detacher's own AWS session.
+func (n *NodeAttachments) awsServices(account, region string) (*AWSServices, error) {
+	if account == "" && region == "" {
+		return &AWSServices{ELB: n.elbSvc, ELBV2: n.elbv2Svc}, nil
+	}
+
+	for _, s := range n.awsAccounts {
+		if s.Account == account && s.Region == region {
+			return s, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No AWS account configured for account %q and region %q: Please ensure that it is specified via -aws-account", account, region)
+}
+
+// allAWSServices returns AWS API clients for node-detacher's own account and region, followed by ones for all the
+// configured accounts
+func (n *NodeAttachments) allAWSServices() []*AWSServices {
+	return append([]*AWSServices{{ELB: n.elbSvc, ELBV2: n.elbv2Svc}}, n.awsAccounts...)
+}
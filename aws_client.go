@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"golang.org/x/time/rate"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAWSAPIQPS           = 5
+	DefaultAWSAPIBurst         = 10
+	DefaultAWSAPIMaxRetries    = 5
+	DefaultAWSAPIMinRetryDelay = 500 * time.Millisecond
+	DefaultAWSAPIMaxRetryDelay = 20 * time.Second
+)
+
+// AWSAPILimiter rate-limits and retries calls to AWS APIs.
+//
+// Each API like DeregisterTargets has its own token bucket, as AWS API quotas are per API action and shared within
+// the account. Throttled calls and server-side errors are retried with jittered exponential backoff, so that
+// node-detacher backs off instead of exhausting the quota during large scale-downs.
+type AWSAPILimiter struct {
+	// QPS is the number of calls per second allowed for each API
+	QPS float64
+
+	// Burst is the maximum number of calls to each API made at once
+	Burst int
+
+	// MaxRetries is the maximum number of retries of a throttled call, or a call failed due to a server-side error
+	MaxRetries int
+
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+
+	// sleep waits between retries. Replaced in tests
+	sleep func(time.Duration)
+}
+
+func (l *AWSAPILimiter) limiter(api string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limiters == nil {
+		l.limiters = map[string]*rate.Limiter{}
+	}
+
+	lim, ok := l.limiters[api]
+	if !ok {
+		lim = rate.NewLimiter(rate.Limit(l.QPS), l.Burst)
+
+		l.limiters[api] = lim
+	}
+
+	return lim
+}
+
+// retryDelay returns the delay before the retry of the attempt, which is exponential to the attempt with equal jitter
+func (l *AWSAPILimiter) retryDelay(attempt int) time.Duration {
+	d := l.MinRetryDelay << uint(attempt)
+	if d <= 0 || d > l.MaxRetryDelay {
+		d = l.MaxRetryDelay
+	}
+
+	half := int64(d / 2)
+
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// call calls the API once the token for the API is available, and retries it on retryable errors
+func (l *AWSAPILimiter) call(api string, fn func() error) error {
+	sleep := l.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := l.limiter(api).Wait(context.Background()); err != nil {
+			return err
+		}
+
+		err := fn()
+		if err == nil || !isAWSRetryableError(err) || attempt >= l.MaxRetries {
+			return err
+		}
+
+		sleep(l.retryDelay(attempt))
+	}
+}
+
+// isAWSThrottlingError returns true when the call was rejected due to the API rate limit or resource contention
+func isAWSThrottlingError(err error) bool {
+	var aerr awserr.Error
+
+	if !errors.As(err, &aerr) {
+		return false
+	}
+
+	return aerr.Code() == autoscaling.ErrCodeResourceContentionFault || request.IsErrorThrottle(aerr)
+}
+
+// isAWSRetryableError returns true when retrying the failed call may succeed, i.e. on throttling, server-side errors,
+// and connection errors
+func isAWSRetryableError(err error) bool {
+	var aerr awserr.Error
+
+	if !errors.As(err, &aerr) {
+		return false
+	}
+
+	if isAWSThrottlingError(aerr) || request.IsErrorRetryable(aerr) {
+		return true
+	}
+
+	if rerr, ok := aerr.(awserr.RequestFailure); ok && rerr.StatusCode() >= 500 {
+		return true
+	}
+
+	return false
+}
+
+// limitedELB is the ELB API client whose calls are rate-limited and retried by the limiter.
+// Only APIs used by node-detacher are limited.
+type limitedELB struct {
+	elbiface.ELBAPI
+
+	limiter *AWSAPILimiter
+}
+
+func newLimitedELB(svc elbiface.ELBAPI, limiter *AWSAPILimiter) elbiface.ELBAPI {
+	return &limitedELB{ELBAPI: svc, limiter: limiter}
+}
+
+func (s *limitedELB) DescribeLoadBalancers(input *elb.DescribeLoadBalancersInput) (out *elb.DescribeLoadBalancersOutput, err error) {
+	err = s.limiter.call("elb:DescribeLoadBalancers", func() error {
+		out, err = s.ELBAPI.DescribeLoadBalancers(input)
+
+		return err
+	})
+
+	return
+}
+
+// DescribeLoadBalancersPages fetches pages one by one via DescribeLoadBalancers, so that each page is rate-limited
+func (s *limitedELB) DescribeLoadBalancersPages(input *elb.DescribeLoadBalancersInput, fn func(*elb.DescribeLoadBalancersOutput, bool) bool) error {
+	in := *input
+
+	for {
+		out, err := s.DescribeLoadBalancers(&in)
+		if err != nil {
+			return err
+		}
+
+		lastPage := aws.StringValue(out.NextMarker) == ""
+
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+
+		in.Marker = out.NextMarker
+	}
+}
+
+func (s *limitedELB) DescribeTags(input *elb.DescribeTagsInput) (out *elb.DescribeTagsOutput, err error) {
+	err = s.limiter.call("elb:DescribeTags", func() error {
+		out, err = s.ELBAPI.DescribeTags(input)
+
+		return err
+	})
+
+	return
+}
+
+func (s *limitedELB) RegisterInstancesWithLoadBalancer(input *elb.RegisterInstancesWithLoadBalancerInput) (out *elb.RegisterInstancesWithLoadBalancerOutput, err error) {
+	err = s.limiter.call("elb:RegisterInstancesWithLoadBalancer", func() error {
+		out, err = s.ELBAPI.RegisterInstancesWithLoadBalancer(input)
+
+		return err
+	})
+
+	return
+}
+
+func (s *limitedELB) DeregisterInstancesFromLoadBalancer(input *elb.DeregisterInstancesFromLoadBalancerInput) (out *elb.DeregisterInstancesFromLoadBalancerOutput, err error) {
+	err = s.limiter.call("elb:DeregisterInstancesFromLoadBalancer", func() error {
+		out, err = s.ELBAPI.DeregisterInstancesFromLoadBalancer(input)
+
+		return err
+	})
+
+	return
+}
+
+func (s *limitedELB) DescribeInstanceHealth(input *elb.DescribeInstanceHealthInput) (out *elb.DescribeInstanceHealthOutput, err error) {
+	err = s.limiter.call("elb:DescribeInstanceHealth", func() error {
+		out, err = s.ELBAPI.DescribeInstanceHealth(input)
+
+		return err
+	})
+
+	return
+}
+
+// limitedELBV2 is the ELB v2 API client whose calls are rate-limited and retried by the limiter.
+// Only APIs used by node-detacher are limited.
+type limitedELBV2 struct {
+	elbv2iface.ELBV2API
+
+	limiter *AWSAPILimiter
+}
+
+func newLimitedELBV2(svc elbv2iface.ELBV2API, limiter *AWSAPILimiter) elbv2iface.ELBV2API {
+	return &limitedELBV2{ELBV2API: svc, limiter: limiter}
+}
+
+func (s *limitedELBV2) DescribeLoadBalancers(input *elbv2.DescribeLoadBalancersInput) (out *elbv2.DescribeLoadBalancersOutput, err error) {
+	err = s.limiter.call("elbv2:DescribeLoadBalancers", func() error {
+		out, err = s.ELBV2API.DescribeLoadBalancers(input)
+
+		return err
+	})
+
+	return
+}
+
+func (s *limitedELBV2) DescribeTargetGroups(input *elbv2.DescribeTargetGroupsInput) (out *elbv2.DescribeTargetGroupsOutput, err error) {
+	err = s.limiter.call("elbv2:DescribeTargetGroups", func() error {
+		out, err = s.ELBV2API.DescribeTargetGroups(input)
+
+		return err
+	})
+
+	return
+}
+
+// DescribeTargetGroupsPages fetches pages one by one via DescribeTargetGroups, so that each page is rate-limited
+func (s *limitedELBV2) DescribeTargetGroupsPages(input *elbv2.DescribeTargetGroupsInput, fn func(*elbv2.DescribeTargetGroupsOutput, bool) bool) error {
+	in := *input
+
+	for {
+		out, err := s.DescribeTargetGroups(&in)
+		if err != nil {
+			return err
+		}
+
+		lastPage := aws.StringValue(out.NextMarker) == ""
+
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+
+		in.Marker = out.NextMarker
+	}
+}
+
+func (s *limitedELBV2) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (out *elbv2.DescribeTargetHealthOutput, err error) {
+	err = s.limiter.call("elbv2:DescribeTargetHealth", func() error {
+		out, err = s.ELBV2API.DescribeTargetHealth(input)
+
+		return err
+	})
+
+	return
+}
+
+func (s *limitedELBV2) DescribeTags(input *elbv2.DescribeTagsInput) (out *elbv2.DescribeTagsOutput, err error) {
+	err = s.limiter.call("elbv2:DescribeTags", func() error {
+		out, err = s.ELBV2API.DescribeTags(input)
+
+		return err
+	})
+
+	return
+}
+
+func (s *limitedELBV2) RegisterTargets(input *elbv2.RegisterTargetsInput) (out *elbv2.RegisterTargetsOutput, err error) {
+	err = s.limiter.call("elbv2:RegisterTargets", func() error {
+		out, err = s.ELBV2API.RegisterTargets(input)
+
+		return err
+	})
+
+	return
+}
+
+func (s *limitedELBV2) DeregisterTargets(input *elbv2.DeregisterTargetsInput) (out *elbv2.DeregisterTargetsOutput, err error) {
+	err = s.limiter.call("elbv2:DeregisterTargets", func() error {
+		out, err = s.ELBV2API.DeregisterTargets(input)
+
+		return err
+	})
+
+	return
+}
+
+func (s *limitedELBV2) DescribeTargetGroupAttributes(input *elbv2.DescribeTargetGroupAttributesInput) (out *elbv2.DescribeTargetGroupAttributesOutput, err error) {
+	err = s.limiter.call("elbv2:DescribeTargetGroupAttributes", func() error {
+		out, err = s.ELBV2API.DescribeTargetGroupAttributes(input)
+
+		return err
+	})
+
+	return
+}
+
+func (s *limitedELBV2) ModifyTargetGroupAttributes(input *elbv2.ModifyTargetGroupAttributesInput) (out *elbv2.ModifyTargetGroupAttributesOutput, err error) {
+	err = s.limiter.call("elbv2:ModifyTargetGroupAttributes", func() error {
+		out, err = s.ELBV2API.ModifyTargetGroupAttributes(input)
+
+		return err
+	})
+
+	return
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	e2eTargetGroupARN = "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/ingress/0123456789abcdef"
+	e2eCLBName        = "ingress"
+	e2eInstanceID     = "i-0123456789abcdef0"
+)
+
+// awsTestEnv is the namespace and the AWS simulator NodeController under test runs against
+type awsTestEnv struct {
+	ns  *corev1.Namespace
+	aws *fakeAWS
+}
+
+// SetupAWSTest starts NodeController backed by the AWS simulator for each test.
+// configure is called before the controller starts, to configure the controller and populate the simulator.
+func SetupAWSTest(ctx context.Context, configure func(*NodeController, *fakeAWS)) *awsTestEnv {
+	var stopCh chan struct{}
+
+	env := &awsTestEnv{ns: &corev1.Namespace{}}
+
+	BeforeEach(func() {
+		stopCh = make(chan struct{})
+		*env.ns = corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: "testns-" + randStringRunes(5)},
+		}
+
+		err := k8sClient.Create(ctx, env.ns)
+		Expect(err).NotTo(HaveOccurred(), "failed to create test namespace")
+
+		env.aws = newFakeAWS()
+		env.aws.HealthyAfter = time.Hour
+		env.aws.AddTargetGroup(&fakeTargetGroup{ARN: e2eTargetGroupARN, Port: 30080, LoadBalancers: []string{"ingress"}, DeregistrationDelay: time.Hour}, e2eInstanceID)
+		env.aws.AddCLB(e2eCLBName, e2eInstanceID)
+
+		mgr, err := ctrl.NewManager(cfg, ctrl.Options{MetricsBindAddress: "0"})
+		Expect(err).NotTo(HaveOccurred(), "failed to create manager")
+
+		client, err := kubernetes.NewForConfig(mgr.GetConfig())
+		Expect(err).NotTo(HaveOccurred(), "initializing client-go")
+
+		controller := &NodeController{
+			Client:       mgr.GetClient(),
+			CoreV1Client: client.CoreV1(),
+			Scheme:       k8sscheme.Scheme,
+			Log:          logf.Log,
+			AWSEnabled:   true,
+			Namespace:    env.ns.Name,
+			asgSvc:       env.aws.AutoScaling(),
+			elbSvc:       env.aws.ELB(),
+			elbv2Svc:     env.aws.ELBV2(),
+
+			// Retries failed reconciliations sooner than in production to keep tests fast
+			RequeueBaseDelay: 100 * time.Millisecond,
+		}
+
+		configure(controller, env.aws)
+
+		err = controller.SetupWithManager(mgr)
+		Expect(err).NotTo(HaveOccurred(), "failed to setup controller")
+
+		go func() {
+			defer GinkgoRecover()
+
+			err := mgr.Start(stopCh)
+			Expect(err).NotTo(HaveOccurred(), "failed to start manager")
+		}()
+	})
+
+	AfterEach(func() {
+		close(stopCh)
+
+		err := k8sClient.Delete(ctx, env.ns)
+		Expect(err).NotTo(HaveOccurred(), "failed to delete test namespace")
+
+		var nodes corev1.NodeList
+
+		err = k8sClient.List(ctx, &nodes)
+		Expect(err).NotTo(HaveOccurred(), "failed to list test nodes")
+
+		for _, no := range nodes.Items {
+			err := k8sClient.Delete(ctx, &no)
+			Expect(err).NotTo(HaveOccurred(), "failed to delete test node")
+		}
+	})
+
+	return env
+}
+
+var _ = Describe("NodeController with AWS", func() {
+	ctx := context.TODO()
+
+	const name = "aws-node"
+
+	createReadyNode := func() {
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{NodeLabelInstanceID: e2eInstanceID},
+			},
+		}
+
+		err := k8sClient.Create(ctx, node)
+		Expect(err).NotTo(HaveOccurred(), "failed to create test node")
+
+		node.Status.Conditions = []corev1.NodeCondition{{
+			Type:               corev1.NodeReady,
+			Status:             corev1.ConditionTrue,
+			LastHeartbeatTime:  metav1.Now(),
+			LastTransitionTime: metav1.Now(),
+		}}
+
+		err = k8sClient.Status().Update(ctx, node)
+		Expect(err).NotTo(HaveOccurred(), "failed to update test node status")
+	}
+
+	getNode := func() corev1.Node {
+		var node corev1.Node
+
+		err := k8sClient.Get(ctx, types.NamespacedName{Name: name}, &node)
+		Expect(err).NotTo(HaveOccurred(), "failed to get test node")
+
+		return node
+	}
+
+	setUnschedulable := func(unschedulable bool) {
+		Eventually(func() error {
+			node := getNode()
+
+			node.Spec.Unschedulable = unschedulable
+
+			return k8sClient.Update(ctx, &node)
+		}, time.Second*5, time.Millisecond*500).Should(Succeed(), "failed to update test node")
+	}
+
+	getAttachment := func(ns string) func() (*v1alpha1.Attachment, error) {
+		return func() (*v1alpha1.Attachment, error) {
+			var a v1alpha1.Attachment
+
+			if err := k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, &a); err != nil {
+				return nil, err
+			}
+
+			return &a, nil
+		}
+	}
+
+	nodeAnnotation := func(key string) func() string {
+		return func() string {
+			node := getNode()
+
+			return node.Annotations[key]
+		}
+	}
+
+	Context("with static integrations", func() {
+		env := SetupAWSTest(ctx, func(c *NodeController, _ *fakeAWS) {
+			c.AWSIntegrations = staticAWSIntegrations
+		})
+
+		It("caches attachments on startup, detaches, and re-attaches once targets become healthy", func() {
+			createReadyNode()
+
+			Eventually(func() int {
+				a, err := getAttachment(env.ns.Name)()
+				if err != nil {
+					return 0
+				}
+
+				return len(a.Spec.AwsTargets) + len(a.Spec.AwsLoadBalancers)
+			}, time.Second*10, time.Millisecond*500).Should(Equal(2))
+
+			Eventually(func() string {
+				node := getNode()
+
+				return node.Labels[NodeLabelKeyCached]
+			}, time.Second*5, time.Millisecond*500).Should(Equal("true"))
+
+			setUnschedulable(true)
+
+			Eventually(func() string {
+				return env.aws.TargetState(e2eTargetGroupARN, e2eInstanceID)
+			}, time.Second*10, time.Millisecond*500).Should(Equal(elbv2.TargetHealthStateEnumDraining))
+
+			Expect(env.aws.CLBInstanceState(e2eCLBName, e2eInstanceID)).To(BeEmpty())
+
+			Eventually(nodeAnnotation(NodeAnnotationKeyDrained), time.Second*10, time.Millisecond*500).Should(Equal("true"))
+			Expect(nodeAnnotation(NodeAnnotationKeyDetaching)()).To(Equal("true"))
+
+			setUnschedulable(false)
+
+			// Re-registered targets start initial, which defers marking the node as attached
+			Eventually(func() string {
+				return env.aws.TargetState(e2eTargetGroupARN, e2eInstanceID)
+			}, time.Second*10, time.Millisecond*500).Should(Equal(elbv2.TargetHealthStateEnumInitial))
+
+			Consistently(nodeAnnotation(NodeAnnotationKeyDetaching), time.Second*2, time.Millisecond*500).Should(Equal("true"))
+
+			env.aws.Advance(time.Hour)
+
+			Eventually(nodeAnnotation(NodeAnnotationKeyDetaching), time.Second*20, time.Millisecond*500).Should(Equal("false"))
+
+			Expect(env.aws.TargetState(e2eTargetGroupARN, e2eInstanceID)).To(Equal(elbv2.TargetHealthStateEnumHealthy))
+			Expect(env.aws.CLBInstanceState(e2eCLBName, e2eInstanceID)).To(Equal("InService"))
+			Expect(nodeAnnotation(NodeAnnotationKeyReattachFailed)()).To(BeEmpty())
+		})
+
+		It("records the target group deleted in the meantime as a drift and finishes detaching", func() {
+			createReadyNode()
+
+			Eventually(getAttachment(env.ns.Name), time.Second*10, time.Millisecond*500).ShouldNot(BeNil())
+
+			env.aws.RemoveTargetGroup(e2eTargetGroupARN)
+
+			setUnschedulable(true)
+
+			Eventually(func() []string {
+				a, err := getAttachment(env.ns.Name)()
+				if err != nil {
+					return nil
+				}
+
+				var reasons []string
+
+				for _, d := range a.Status.Drifts {
+					reasons = append(reasons, d.Reason)
+				}
+
+				return reasons
+			}, time.Second*10, time.Millisecond*500).Should(ContainElement(elbv2.ErrCodeTargetGroupNotFoundException))
+
+			Eventually(nodeAnnotation(NodeAnnotationKeyDrained), time.Second*10, time.Millisecond*500).Should(Equal("true"))
+			Expect(env.aws.CLBInstanceState(e2eCLBName, e2eInstanceID)).To(BeEmpty())
+		})
+
+		It("retries throttled de-registrations", func() {
+			createReadyNode()
+
+			Eventually(getAttachment(env.ns.Name), time.Second*10, time.Millisecond*500).ShouldNot(BeNil())
+
+			env.aws.Throttle("DeregisterTargets", 3)
+
+			setUnschedulable(true)
+
+			Eventually(func() string {
+				return env.aws.TargetState(e2eTargetGroupARN, e2eInstanceID)
+			}, time.Second*10, time.Millisecond*500).Should(Equal(elbv2.TargetHealthStateEnumDraining))
+
+			Expect(env.aws.Calls("DeregisterTargets")).To(BeNumerically(">=", 4))
+		})
+	})
+
+	Context("with static integrations and a re-attach health timeout", func() {
+		env := SetupAWSTest(ctx, func(c *NodeController, _ *fakeAWS) {
+			c.AWSIntegrations = staticAWSIntegrations
+			c.ReattachHealthTimeout = 2 * time.Second
+		})
+
+		It("gives up waiting for unhealthy targets and records the failure", func() {
+			createReadyNode()
+
+			Eventually(getAttachment(env.ns.Name), time.Second*10, time.Millisecond*500).ShouldNot(BeNil())
+
+			setUnschedulable(true)
+
+			Eventually(nodeAnnotation(NodeAnnotationKeyDrained), time.Second*10, time.Millisecond*500).Should(Equal("true"))
+
+			env.aws.SetTargetUnhealthy(e2eInstanceID, true)
+			env.aws.Advance(time.Hour)
+
+			setUnschedulable(false)
+
+			Eventually(nodeAnnotation(NodeAnnotationKeyReattachFailed), time.Second*20, time.Millisecond*500).ShouldNot(BeEmpty())
+			Eventually(nodeAnnotation(NodeAnnotationKeyDetaching), time.Second*10, time.Millisecond*500).Should(Equal("false"))
+		})
+	})
+
+	Context("with the dynamic NLB integration discovering on detach", func() {
+		env := SetupAWSTest(ctx, func(c *NodeController, aws *fakeAWS) {
+			c.AWSIntegrations = []AWSIntegration{{Kind: AWSIntegrationDynamicNLBs, Discovery: AWSDiscoveryDetach}}
+
+			aws.TagTargetGroup(e2eTargetGroupARN, map[string]string{AWSTagKeyServiceName: "default/ingress"})
+		})
+
+		It("caches attachments only on detach", func() {
+			createReadyNode()
+
+			Consistently(func() bool {
+				_, err := getAttachment(env.ns.Name)()
+
+				return errors.IsNotFound(err)
+			}, time.Second*3, time.Millisecond*500).Should(BeTrue())
+
+			setUnschedulable(true)
+
+			Eventually(func() string {
+				return env.aws.TargetState(e2eTargetGroupARN, e2eInstanceID)
+			}, time.Second*10, time.Millisecond*500).Should(Equal(elbv2.TargetHealthStateEnumDraining))
+
+			a, err := getAttachment(env.ns.Name)()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(a.Spec.AwsTargets).To(HaveLen(1))
+			Expect(a.Spec.AwsTargets[0].Detached).To(BeTrue())
+
+			// CLBs aren't managed via the NLB integration
+			Expect(a.Spec.AwsLoadBalancers).To(BeEmpty())
+			Expect(env.aws.CLBInstanceState(e2eCLBName, e2eInstanceID)).To(Equal("InService"))
+		})
+	})
+})
@@ -0,0 +1,1090 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	fakeAWSErrCodeThrottling = "Throttling"
+
+	fakeAWSDefaultPageSize = 2
+)
+
+// fakeAWS is an in-memory simulator of the ELB, ELBv2, and AutoScaling APIs used by node-detacher.
+//
+// Registered targets and instances start `initial`, and become `healthy` after HealthyAfter, unless the target group
+// isn't used by any load balancer. De-registered targets stay `draining` for the deregistration delay of the target
+// group before they disappear. Every list API is paginated by PageSize, and failures including throttling can be
+// injected per operation.
+type fakeAWS struct {
+	mu sync.Mutex
+
+	// HealthyAfter is how long registered targets and instances stay initial before becoming healthy
+	HealthyAfter time.Duration
+
+	// PageSize is the maximum number of items returned per page
+	PageSize int
+
+	// offset shifts the simulator's clock, so that tests can pass deregistration delays and health checks instantly
+	offset time.Duration
+
+	targetGroups []*fakeTargetGroup
+	clbs         []*fakeCLB
+	asgs         []*fakeASG
+
+	failures      map[string][]error
+	failuresAfter map[string][]error
+	calls         map[string]int
+}
+
+type fakeTargetGroup struct {
+	ARN  string
+	Port int64
+
+	// LoadBalancers is the list of load balancers that forward traffic to the target group. Targets of the target
+	// group without any load balancer are always `unused`
+	LoadBalancers []string
+
+	DeregistrationDelay time.Duration
+
+	// SlowStartUnsupported makes modifying the slow start attribute fail, as target groups of NLBs do
+	SlowStartUnsupported bool
+
+	Attributes map[string]string
+
+	Tags map[string]string
+
+	targets []*fakeTarget
+}
+
+type fakeTarget struct {
+	ID   string
+	Port int64
+
+	RegisteredAt   time.Time
+	DeregisteredAt *time.Time
+
+	// Unhealthy forces the target to fail health checks
+	Unhealthy bool
+}
+
+type fakeCLB struct {
+	Name string
+
+	Tags map[string]string
+
+	instances []*fakeTarget
+}
+
+type fakeASG struct {
+	Name string
+
+	Instances         []string
+	LoadBalancerNames []string
+	TargetGroupARNs   []string
+}
+
+func newFakeAWS() *fakeAWS {
+	return &fakeAWS{
+		PageSize:      fakeAWSDefaultPageSize,
+		failures:      map[string][]error{},
+		failuresAfter: map[string][]error{},
+		calls:         map[string]int{},
+	}
+}
+
+// ELB returns the ELB API backed by the simulator
+func (f *fakeAWS) ELB() elbiface.ELBAPI {
+	return &fakeELB{fakeAWS: f}
+}
+
+// ELBV2 returns the ELBv2 API backed by the simulator
+func (f *fakeAWS) ELBV2() elbv2iface.ELBV2API {
+	return &fakeELBV2{fakeAWS: f}
+}
+
+// AutoScaling returns the AutoScaling API backed by the simulator
+func (f *fakeAWS) AutoScaling() autoscalingiface.AutoScalingAPI {
+	return &fakeAutoScaling{fakeAWS: f}
+}
+
+func (f *fakeAWS) now() time.Time {
+	return time.Now().Add(f.offset)
+}
+
+// Advance moves the simulator's clock forward
+func (f *fakeAWS) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.offset += d
+}
+
+// AddTargetGroup adds the target group with the instances registered as targets, which are already healthy
+func (f *fakeAWS) AddTargetGroup(tg *fakeTargetGroup, instanceIDs ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if tg.Attributes == nil {
+		tg.Attributes = map[string]string{}
+	}
+
+	for _, id := range instanceIDs {
+		tg.targets = append(tg.targets, &fakeTarget{ID: id, Port: tg.Port, RegisteredAt: f.now().Add(-f.HealthyAfter)})
+	}
+
+	f.targetGroups = append(f.targetGroups, tg)
+}
+
+// RemoveTargetGroup deletes the target group, like someone did it outside of node-detacher
+func (f *fakeAWS) RemoveTargetGroup(arn string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, tg := range f.targetGroups {
+		if tg.ARN == arn {
+			f.targetGroups = append(f.targetGroups[:i], f.targetGroups[i+1:]...)
+
+			return
+		}
+	}
+}
+
+// AddCLB adds the CLB with the instances registered, which are already in service
+func (f *fakeAWS) AddCLB(name string, instanceIDs ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lb := &fakeCLB{Name: name}
+
+	for _, id := range instanceIDs {
+		lb.instances = append(lb.instances, &fakeTarget{ID: id, RegisteredAt: f.now().Add(-f.HealthyAfter)})
+	}
+
+	f.clbs = append(f.clbs, lb)
+}
+
+// TagCLB adds the tags to the CLB, like the Kubernetes cloud provider does to CLBs of services
+func (f *fakeAWS) TagCLB(name string, tags map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lb := f.clb(name)
+
+	if lb.Tags == nil {
+		lb.Tags = map[string]string{}
+	}
+
+	for k, v := range tags {
+		lb.Tags[k] = v
+	}
+}
+
+// TagTargetGroup adds the tags to the target group, like Kubernetes controllers do to target groups they manage
+func (f *fakeAWS) TagTargetGroup(arn string, tags map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tg := f.targetGroup(arn)
+
+	if tg.Tags == nil {
+		tg.Tags = map[string]string{}
+	}
+
+	for k, v := range tags {
+		tg.Tags[k] = v
+	}
+}
+
+// AddASG adds the autoscaling group
+func (f *fakeAWS) AddASG(asg *fakeASG) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.asgs = append(f.asgs, asg)
+}
+
+// SetTargetUnhealthy forces the target to fail or pass health checks in every target group and CLB
+func (f *fakeAWS) SetTargetUnhealthy(instanceID string, unhealthy bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, tg := range f.targetGroups {
+		for _, t := range tg.targets {
+			if t.ID == instanceID {
+				t.Unhealthy = unhealthy
+			}
+		}
+	}
+
+	for _, lb := range f.clbs {
+		for _, t := range lb.instances {
+			if t.ID == instanceID {
+				t.Unhealthy = unhealthy
+			}
+		}
+	}
+}
+
+// TargetState returns the health state of the instance in the target group, or an empty string when it isn't
+// registered
+func (f *fakeAWS) TargetState(arn, instanceID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.gc()
+
+	tg := f.targetGroup(arn)
+	if tg == nil {
+		return ""
+	}
+
+	for _, t := range tg.targets {
+		if t.ID == instanceID {
+			return f.targetState(tg, t)
+		}
+	}
+
+	return ""
+}
+
+// CLBInstanceState returns the state of the instance in the CLB, or an empty string when it isn't registered
+func (f *fakeAWS) CLBInstanceState(name, instanceID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lb := f.clb(name)
+	if lb == nil {
+		return ""
+	}
+
+	for _, t := range lb.instances {
+		if t.ID == instanceID {
+			return f.instanceState(t)
+		}
+	}
+
+	return ""
+}
+
+// FailNext makes the next n calls to the operation, like `DeregisterTargets`, fail with the error
+func (f *fakeAWS) FailNext(op string, n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		f.failures[op] = append(f.failures[op], err)
+	}
+}
+
+// FailAfterApplying makes the next n calls to the mutating operation, like `DeregisterTargets`, fail with the error
+// after applying the change, as if the caller crashed or timed out before receiving the response
+func (f *fakeAWS) FailAfterApplying(op string, n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		f.failuresAfter[op] = append(f.failuresAfter[op], err)
+	}
+}
+
+// Throttle makes the next n calls to the operation fail with the throttling error
+func (f *fakeAWS) Throttle(op string, n int) {
+	f.FailNext(op, n, awserr.New(fakeAWSErrCodeThrottling, "Rate exceeded", nil))
+}
+
+// Calls returns the number of calls made to the operation, including failed ones
+func (f *fakeAWS) Calls(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[op]
+}
+
+// call records the call to the operation and returns the injected failure if any. The caller must hold the lock.
+func (f *fakeAWS) call(op string) error {
+	f.calls[op]++
+
+	if errs := f.failures[op]; len(errs) > 0 {
+		f.failures[op] = errs[1:]
+
+		return errs[0]
+	}
+
+	f.gc()
+
+	return nil
+}
+
+// applied returns the failure injected after applying the change made by the operation if any.
+// The caller must hold the lock.
+func (f *fakeAWS) applied(op string) error {
+	if errs := f.failuresAfter[op]; len(errs) > 0 {
+		f.failuresAfter[op] = errs[1:]
+
+		return errs[0]
+	}
+
+	return nil
+}
+
+// gc removes targets that finished draining. The caller must hold the lock.
+func (f *fakeAWS) gc() {
+	now := f.now()
+
+	for _, tg := range f.targetGroups {
+		var targets []*fakeTarget
+
+		for _, t := range tg.targets {
+			if t.DeregisteredAt != nil && !now.Before(t.DeregisteredAt.Add(tg.DeregistrationDelay)) {
+				continue
+			}
+
+			targets = append(targets, t)
+		}
+
+		tg.targets = targets
+	}
+}
+
+func (f *fakeAWS) targetGroup(arn string) *fakeTargetGroup {
+	for _, tg := range f.targetGroups {
+		if tg.ARN == arn {
+			return tg
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeAWS) clb(name string) *fakeCLB {
+	for _, lb := range f.clbs {
+		if lb.Name == name {
+			return lb
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeAWS) targetState(tg *fakeTargetGroup, t *fakeTarget) string {
+	switch {
+	case t.DeregisteredAt != nil:
+		return elbv2.TargetHealthStateEnumDraining
+	case len(tg.LoadBalancers) == 0:
+		return elbv2.TargetHealthStateEnumUnused
+	case f.now().Before(t.RegisteredAt.Add(f.HealthyAfter)):
+		return elbv2.TargetHealthStateEnumInitial
+	case t.Unhealthy:
+		return elbv2.TargetHealthStateEnumUnhealthy
+	}
+
+	return elbv2.TargetHealthStateEnumHealthy
+}
+
+func (f *fakeAWS) instanceState(t *fakeTarget) string {
+	if t.Unhealthy || f.now().Before(t.RegisteredAt.Add(f.HealthyAfter)) {
+		return CLBInstanceStateOutOfService
+	}
+
+	return "InService"
+}
+
+// page returns the range of items in the page starting at the marker, and the marker of the next page
+func (f *fakeAWS) page(marker *string, pageSize *int64, total int) (int, int, *string, error) {
+	start := 0
+
+	if m := aws.StringValue(marker); m != "" {
+		var err error
+
+		if start, err = strconv.Atoi(m); err != nil || start > total {
+			return 0, 0, nil, awserr.New("ValidationError", fmt.Sprintf("invalid marker %q", m), nil)
+		}
+	}
+
+	size := f.PageSize
+
+	if pageSize != nil && int(*pageSize) < size {
+		size = int(*pageSize)
+	}
+
+	end := start + size
+	if end >= total {
+		return start, total, nil, nil
+	}
+
+	return start, end, aws.String(strconv.Itoa(end)), nil
+}
+
+type fakeELB struct {
+	*fakeAWS
+
+	elbiface.ELBAPI
+}
+
+func (f *fakeELB) DescribeLoadBalancers(input *elb.DescribeLoadBalancersInput) (*elb.DescribeLoadBalancersOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeLoadBalancers"); err != nil {
+		return nil, err
+	}
+
+	clbs := f.clbs
+
+	if len(input.LoadBalancerNames) > 0 {
+		clbs = nil
+
+		for _, name := range input.LoadBalancerNames {
+			lb := f.clb(aws.StringValue(name))
+			if lb == nil {
+				return nil, awserr.New(elb.ErrCodeAccessPointNotFoundException, fmt.Sprintf("There is no ACTIVE Load Balancer named '%s'", aws.StringValue(name)), nil)
+			}
+
+			clbs = append(clbs, lb)
+		}
+	}
+
+	start, end, next, err := f.page(input.Marker, input.PageSize, len(clbs))
+	if err != nil {
+		return nil, err
+	}
+
+	output := &elb.DescribeLoadBalancersOutput{NextMarker: next}
+
+	for _, lb := range clbs[start:end] {
+		desc := &elb.LoadBalancerDescription{LoadBalancerName: aws.String(lb.Name)}
+
+		for _, i := range lb.instances {
+			desc.Instances = append(desc.Instances, &elb.Instance{InstanceId: aws.String(i.ID)})
+		}
+
+		output.LoadBalancerDescriptions = append(output.LoadBalancerDescriptions, desc)
+	}
+
+	return output, nil
+}
+
+func (f *fakeELB) DescribeLoadBalancersPages(input *elb.DescribeLoadBalancersInput, fn func(*elb.DescribeLoadBalancersOutput, bool) bool) error {
+	in := *input
+
+	for {
+		output, err := f.DescribeLoadBalancers(&in)
+		if err != nil {
+			return err
+		}
+
+		lastPage := output.NextMarker == nil
+
+		if !fn(output, lastPage) || lastPage {
+			return nil
+		}
+
+		in.Marker = output.NextMarker
+	}
+}
+
+func (f *fakeELB) DescribeTags(input *elb.DescribeTagsInput) (*elb.DescribeTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeTags"); err != nil {
+		return nil, err
+	}
+
+	if len(input.LoadBalancerNames) > 20 {
+		return nil, awserr.New("ValidationError", "Too many load balancer names", nil)
+	}
+
+	output := &elb.DescribeTagsOutput{}
+
+	for _, name := range input.LoadBalancerNames {
+		lb := f.clb(aws.StringValue(name))
+		if lb == nil {
+			return nil, awserr.New(elb.ErrCodeAccessPointNotFoundException, fmt.Sprintf("There is no ACTIVE Load Balancer named '%s'", aws.StringValue(name)), nil)
+		}
+
+		desc := &elb.TagDescription{LoadBalancerName: name}
+
+		for k, v := range lb.Tags {
+			desc.Tags = append(desc.Tags, &elb.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+
+		output.TagDescriptions = append(output.TagDescriptions, desc)
+	}
+
+	return output, nil
+}
+
+func (f *fakeELB) RegisterInstancesWithLoadBalancer(input *elb.RegisterInstancesWithLoadBalancerInput) (*elb.RegisterInstancesWithLoadBalancerOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("RegisterInstancesWithLoadBalancer"); err != nil {
+		return nil, err
+	}
+
+	lb := f.clb(aws.StringValue(input.LoadBalancerName))
+	if lb == nil {
+		return nil, awserr.New(elb.ErrCodeAccessPointNotFoundException, fmt.Sprintf("There is no ACTIVE Load Balancer named '%s'", aws.StringValue(input.LoadBalancerName)), nil)
+	}
+
+	for _, i := range input.Instances {
+		var registered bool
+
+		for _, t := range lb.instances {
+			if t.ID == aws.StringValue(i.InstanceId) {
+				registered = true
+			}
+		}
+
+		if !registered {
+			lb.instances = append(lb.instances, &fakeTarget{ID: aws.StringValue(i.InstanceId), RegisteredAt: f.now()})
+		}
+	}
+
+	if err := f.applied("RegisterInstancesWithLoadBalancer"); err != nil {
+		return nil, err
+	}
+
+	return &elb.RegisterInstancesWithLoadBalancerOutput{}, nil
+}
+
+func (f *fakeELB) DeregisterInstancesFromLoadBalancer(input *elb.DeregisterInstancesFromLoadBalancerInput) (*elb.DeregisterInstancesFromLoadBalancerOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DeregisterInstancesFromLoadBalancer"); err != nil {
+		return nil, err
+	}
+
+	lb := f.clb(aws.StringValue(input.LoadBalancerName))
+	if lb == nil {
+		return nil, awserr.New(elb.ErrCodeAccessPointNotFoundException, fmt.Sprintf("There is no ACTIVE Load Balancer named '%s'", aws.StringValue(input.LoadBalancerName)), nil)
+	}
+
+	deregistered := map[string]bool{}
+
+	for _, i := range input.Instances {
+		deregistered[aws.StringValue(i.InstanceId)] = true
+	}
+
+	var instances []*fakeTarget
+
+	for _, t := range lb.instances {
+		if !deregistered[t.ID] {
+			instances = append(instances, t)
+		}
+	}
+
+	lb.instances = instances
+
+	if err := f.applied("DeregisterInstancesFromLoadBalancer"); err != nil {
+		return nil, err
+	}
+
+	return &elb.DeregisterInstancesFromLoadBalancerOutput{}, nil
+}
+
+func (f *fakeELB) DescribeInstanceHealth(input *elb.DescribeInstanceHealthInput) (*elb.DescribeInstanceHealthOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeInstanceHealth"); err != nil {
+		return nil, err
+	}
+
+	lb := f.clb(aws.StringValue(input.LoadBalancerName))
+	if lb == nil {
+		return nil, awserr.New(elb.ErrCodeAccessPointNotFoundException, fmt.Sprintf("There is no ACTIVE Load Balancer named '%s'", aws.StringValue(input.LoadBalancerName)), nil)
+	}
+
+	output := &elb.DescribeInstanceHealthOutput{}
+
+	for _, t := range lb.instances {
+		if len(input.Instances) > 0 {
+			var requested bool
+
+			for _, i := range input.Instances {
+				if aws.StringValue(i.InstanceId) == t.ID {
+					requested = true
+				}
+			}
+
+			if !requested {
+				continue
+			}
+		}
+
+		output.InstanceStates = append(output.InstanceStates, &elb.InstanceState{
+			InstanceId: aws.String(t.ID),
+			State:      aws.String(f.instanceState(t)),
+		})
+	}
+
+	if len(input.Instances) > 0 && len(output.InstanceStates) == 0 {
+		return nil, awserr.New(elb.ErrCodeInvalidEndPointException, "The specified instances are not registered", nil)
+	}
+
+	return output, nil
+}
+
+type fakeELBV2 struct {
+	*fakeAWS
+
+	elbv2iface.ELBV2API
+}
+
+func (f *fakeELBV2) DescribeTargetGroups(input *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeTargetGroups"); err != nil {
+		return nil, err
+	}
+
+	tgs := f.targetGroups
+
+	if input.LoadBalancerArn != nil {
+		tgs = nil
+
+		for _, tg := range f.targetGroups {
+			for _, lb := range tg.LoadBalancers {
+				if lb == aws.StringValue(input.LoadBalancerArn) {
+					tgs = append(tgs, tg)
+				}
+			}
+		}
+	}
+
+	start, end, next, err := f.page(input.Marker, input.PageSize, len(tgs))
+	if err != nil {
+		return nil, err
+	}
+
+	output := &elbv2.DescribeTargetGroupsOutput{NextMarker: next}
+
+	for _, tg := range tgs[start:end] {
+		g := &elbv2.TargetGroup{TargetGroupArn: aws.String(tg.ARN), Port: aws.Int64(tg.Port)}
+
+		for _, lb := range tg.LoadBalancers {
+			g.LoadBalancerArns = append(g.LoadBalancerArns, aws.String(lb))
+		}
+
+		output.TargetGroups = append(output.TargetGroups, g)
+	}
+
+	return output, nil
+}
+
+// DescribeLoadBalancers describes ALBs and NLBs the target groups are attached to. The fake uses load balancer names
+// as ARNs
+func (f *fakeELBV2) DescribeLoadBalancers(input *elbv2.DescribeLoadBalancersInput) (*elbv2.DescribeLoadBalancersOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeLoadBalancers"); err != nil {
+		return nil, err
+	}
+
+	output := &elbv2.DescribeLoadBalancersOutput{}
+
+	for _, name := range input.Names {
+		var found bool
+
+		for _, tg := range f.targetGroups {
+			for _, lb := range tg.LoadBalancers {
+				if lb == aws.StringValue(name) {
+					found = true
+				}
+			}
+		}
+
+		if !found {
+			return nil, awserr.New(elbv2.ErrCodeLoadBalancerNotFoundException, fmt.Sprintf("Load balancers '[%s]' not found", aws.StringValue(name)), nil)
+		}
+
+		output.LoadBalancers = append(output.LoadBalancers, &elbv2.LoadBalancer{LoadBalancerArn: name, LoadBalancerName: name})
+	}
+
+	return output, nil
+}
+
+func (f *fakeELBV2) DescribeTargetGroupsPages(input *elbv2.DescribeTargetGroupsInput, fn func(*elbv2.DescribeTargetGroupsOutput, bool) bool) error {
+	in := *input
+
+	for {
+		output, err := f.DescribeTargetGroups(&in)
+		if err != nil {
+			return err
+		}
+
+		lastPage := output.NextMarker == nil
+
+		if !fn(output, lastPage) || lastPage {
+			return nil
+		}
+
+		in.Marker = output.NextMarker
+	}
+}
+
+func (f *fakeELBV2) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeTargetHealth"); err != nil {
+		return nil, err
+	}
+
+	tg := f.targetGroup(aws.StringValue(input.TargetGroupArn))
+	if tg == nil {
+		return nil, targetGroupNotFound(input.TargetGroupArn)
+	}
+
+	output := &elbv2.DescribeTargetHealthOutput{}
+
+	describe := func(t *fakeTarget) {
+		output.TargetHealthDescriptions = append(output.TargetHealthDescriptions, &elbv2.TargetHealthDescription{
+			Target:       &elbv2.TargetDescription{Id: aws.String(t.ID), Port: aws.Int64(t.Port)},
+			TargetHealth: &elbv2.TargetHealth{State: aws.String(f.targetState(tg, t))},
+		})
+	}
+
+	if len(input.Targets) == 0 {
+		for _, t := range tg.targets {
+			describe(t)
+		}
+
+		return output, nil
+	}
+
+	for _, d := range input.Targets {
+		port := tg.Port
+		if d.Port != nil {
+			port = *d.Port
+		}
+
+		var found bool
+
+		for _, t := range tg.targets {
+			if t.ID == aws.StringValue(d.Id) && t.Port == port {
+				describe(t)
+
+				found = true
+			}
+		}
+
+		if !found {
+			output.TargetHealthDescriptions = append(output.TargetHealthDescriptions, &elbv2.TargetHealthDescription{
+				Target: &elbv2.TargetDescription{Id: d.Id, Port: aws.Int64(port)},
+				TargetHealth: &elbv2.TargetHealth{
+					State:  aws.String(elbv2.TargetHealthStateEnumUnused),
+					Reason: aws.String(elbv2.TargetHealthReasonEnumTargetNotRegistered),
+				},
+			})
+		}
+	}
+
+	return output, nil
+}
+
+func (f *fakeELBV2) DescribeTags(input *elbv2.DescribeTagsInput) (*elbv2.DescribeTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeTags"); err != nil {
+		return nil, err
+	}
+
+	if len(input.ResourceArns) > 20 {
+		return nil, awserr.New("ValidationError", "Too many resource ARNs", nil)
+	}
+
+	output := &elbv2.DescribeTagsOutput{}
+
+	for _, arn := range input.ResourceArns {
+		tg := f.targetGroup(aws.StringValue(arn))
+		if tg == nil {
+			return nil, targetGroupNotFound(arn)
+		}
+
+		desc := &elbv2.TagDescription{ResourceArn: arn}
+
+		for k, v := range tg.Tags {
+			desc.Tags = append(desc.Tags, &elbv2.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+
+		output.TagDescriptions = append(output.TagDescriptions, desc)
+	}
+
+	return output, nil
+}
+
+func (f *fakeELBV2) RegisterTargets(input *elbv2.RegisterTargetsInput) (*elbv2.RegisterTargetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("RegisterTargets"); err != nil {
+		return nil, err
+	}
+
+	tg := f.targetGroup(aws.StringValue(input.TargetGroupArn))
+	if tg == nil {
+		return nil, targetGroupNotFound(input.TargetGroupArn)
+	}
+
+	for _, d := range input.Targets {
+		if aws.StringValue(d.Id) == "" {
+			return nil, awserr.New(elbv2.ErrCodeInvalidTargetException, "The target ID is required", nil)
+		}
+
+		port := tg.Port
+		if d.Port != nil {
+			port = *d.Port
+		}
+
+		var registered bool
+
+		for _, t := range tg.targets {
+			if t.ID == aws.StringValue(d.Id) && t.Port == port {
+				registered = true
+
+				// Re-registering a draining target cancels the deregistration
+				if t.DeregisteredAt != nil {
+					t.DeregisteredAt = nil
+					t.RegisteredAt = f.now()
+				}
+			}
+		}
+
+		if !registered {
+			tg.targets = append(tg.targets, &fakeTarget{ID: aws.StringValue(d.Id), Port: port, RegisteredAt: f.now()})
+		}
+	}
+
+	if err := f.applied("RegisterTargets"); err != nil {
+		return nil, err
+	}
+
+	return &elbv2.RegisterTargetsOutput{}, nil
+}
+
+func (f *fakeELBV2) DeregisterTargets(input *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DeregisterTargets"); err != nil {
+		return nil, err
+	}
+
+	tg := f.targetGroup(aws.StringValue(input.TargetGroupArn))
+	if tg == nil {
+		return nil, targetGroupNotFound(input.TargetGroupArn)
+	}
+
+	now := f.now()
+
+	for _, d := range input.Targets {
+		port := tg.Port
+		if d.Port != nil {
+			port = *d.Port
+		}
+
+		var registered bool
+
+		for _, t := range tg.targets {
+			if t.ID == aws.StringValue(d.Id) && t.Port == port {
+				registered = true
+
+				if t.DeregisteredAt == nil {
+					t.DeregisteredAt = &now
+				}
+			}
+		}
+
+		if !registered {
+			return nil, awserr.New(elbv2.ErrCodeInvalidTargetException, fmt.Sprintf("The following targets are not registered: '%s:%d'", aws.StringValue(d.Id), port), nil)
+		}
+	}
+
+	f.gc()
+
+	if err := f.applied("DeregisterTargets"); err != nil {
+		return nil, err
+	}
+
+	return &elbv2.DeregisterTargetsOutput{}, nil
+}
+
+func (f *fakeELBV2) DescribeTargetGroupAttributes(input *elbv2.DescribeTargetGroupAttributesInput) (*elbv2.DescribeTargetGroupAttributesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeTargetGroupAttributes"); err != nil {
+		return nil, err
+	}
+
+	tg := f.targetGroup(aws.StringValue(input.TargetGroupArn))
+	if tg == nil {
+		return nil, targetGroupNotFound(input.TargetGroupArn)
+	}
+
+	output := &elbv2.DescribeTargetGroupAttributesOutput{}
+
+	for k, v := range tg.Attributes {
+		output.Attributes = append(output.Attributes, &elbv2.TargetGroupAttribute{Key: aws.String(k), Value: aws.String(v)})
+	}
+
+	return output, nil
+}
+
+func (f *fakeELBV2) ModifyTargetGroupAttributes(input *elbv2.ModifyTargetGroupAttributesInput) (*elbv2.ModifyTargetGroupAttributesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ModifyTargetGroupAttributes"); err != nil {
+		return nil, err
+	}
+
+	tg := f.targetGroup(aws.StringValue(input.TargetGroupArn))
+	if tg == nil {
+		return nil, targetGroupNotFound(input.TargetGroupArn)
+	}
+
+	for _, a := range input.Attributes {
+		if aws.StringValue(a.Key) == "slow_start.duration_seconds" && tg.SlowStartUnsupported {
+			return nil, awserr.New(elbv2.ErrCodeInvalidConfigurationRequestException, "Slow start is not supported by the target group", nil)
+		}
+
+		tg.Attributes[aws.StringValue(a.Key)] = aws.StringValue(a.Value)
+	}
+
+	return &elbv2.ModifyTargetGroupAttributesOutput{}, nil
+}
+
+func targetGroupNotFound(arn *string) error {
+	return awserr.New(elbv2.ErrCodeTargetGroupNotFoundException, fmt.Sprintf("Target groups '%s' not found", aws.StringValue(arn)), nil)
+}
+
+type fakeAutoScaling struct {
+	*fakeAWS
+
+	autoscalingiface.AutoScalingAPI
+}
+
+func (f *fakeAutoScaling) DescribeAutoScalingGroups(input *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeAutoScalingGroups"); err != nil {
+		return nil, err
+	}
+
+	var asgs []*fakeASG
+
+	for _, asg := range f.asgs {
+		if len(input.AutoScalingGroupNames) > 0 {
+			var requested bool
+
+			for _, n := range input.AutoScalingGroupNames {
+				if aws.StringValue(n) == asg.Name {
+					requested = true
+				}
+			}
+
+			if !requested {
+				continue
+			}
+		}
+
+		asgs = append(asgs, asg)
+	}
+
+	start, end, next, err := f.page(input.NextToken, input.MaxRecords, len(asgs))
+	if err != nil {
+		return nil, err
+	}
+
+	output := &autoscaling.DescribeAutoScalingGroupsOutput{NextToken: next}
+
+	for _, asg := range asgs[start:end] {
+		g := &autoscaling.Group{
+			AutoScalingGroupName: aws.String(asg.Name),
+			LoadBalancerNames:    aws.StringSlice(asg.LoadBalancerNames),
+			TargetGroupARNs:      aws.StringSlice(asg.TargetGroupARNs),
+		}
+
+		for _, id := range asg.Instances {
+			g.Instances = append(g.Instances, &autoscaling.Instance{
+				InstanceId:     aws.String(id),
+				LifecycleState: aws.String(autoscaling.LifecycleStateInService),
+				HealthStatus:   aws.String("Healthy"),
+			})
+		}
+
+		output.AutoScalingGroups = append(output.AutoScalingGroups, g)
+	}
+
+	return output, nil
+}
+
+func (f *fakeAutoScaling) DescribeAutoScalingGroupsPages(input *autoscaling.DescribeAutoScalingGroupsInput, fn func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool) error {
+	in := *input
+
+	for {
+		output, err := f.DescribeAutoScalingGroups(&in)
+		if err != nil {
+			return err
+		}
+
+		lastPage := output.NextToken == nil
+
+		if !fn(output, lastPage) || lastPage {
+			return nil
+		}
+
+		in.NextToken = output.NextToken
+	}
+}
+
+func (f *fakeAutoScaling) DescribeAutoScalingInstances(input *autoscaling.DescribeAutoScalingInstancesInput) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DescribeAutoScalingInstances"); err != nil {
+		return nil, err
+	}
+
+	output := &autoscaling.DescribeAutoScalingInstancesOutput{}
+
+	for _, id := range input.InstanceIds {
+		for _, asg := range f.asgs {
+			for _, i := range asg.Instances {
+				if i != aws.StringValue(id) {
+					continue
+				}
+
+				output.AutoScalingInstances = append(output.AutoScalingInstances, &autoscaling.InstanceDetails{
+					AutoScalingGroupName: aws.String(asg.Name),
+					InstanceId:           aws.String(i),
+					LifecycleState:       aws.String(autoscaling.LifecycleStateInService),
+					HealthStatus:         aws.String("Healthy"),
+				})
+			}
+		}
+	}
+
+	return output, nil
+}
@@ -0,0 +1,972 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1alpha1 "k8s.io/api/discovery/v1alpha1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// staticAWSIntegrations discovers target groups and CLBs managed externally to Kubernetes on node creation
+var staticAWSIntegrations = []AWSIntegration{
+	{Kind: AWSIntegrationStaticTargetGroups, Discovery: AWSDiscoveryNodeCreation},
+	{Kind: AWSIntegrationStaticCLBs, Discovery: AWSDiscoveryNodeCreation},
+}
+
+var _ = Describe("AWS simulator", func() {
+	var sim *fakeAWS
+
+	BeforeEach(func() {
+		sim = newFakeAWS()
+		sim.HealthyAfter = 30 * time.Second
+	})
+
+	It("paginates target groups and CLBs", func() {
+		for i := 0; i < 5; i++ {
+			sim.AddTargetGroup(&fakeTargetGroup{ARN: fmt.Sprintf("tg%d", i), Port: 30080, LoadBalancers: []string{"lb"}}, fmt.Sprintf("i-%d", i))
+			sim.AddCLB(fmt.Sprintf("clb%d", i), fmt.Sprintf("i-%d", i))
+		}
+
+		idToTGs, _, err := getIDToTGs(sim.ELBV2(), []string{"i-0", "i-4"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(idToTGs["i-4"]).To(Equal([]string{"tg4"}))
+		Expect(sim.Calls("DescribeTargetGroups")).To(Equal(3))
+
+		idToCLBs, err := getIDToCLBs(sim.ELB(), []string{"i-0", "i-4"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(idToCLBs).To(Equal(map[string][]string{"i-0": {"clb0"}, "i-4": {"clb4"}}))
+		Expect(sim.Calls("DescribeLoadBalancers")).To(Equal(3))
+	})
+
+	It("transitions target health through initial, healthy, draining, and unused", func() {
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "tg", Port: 30080, LoadBalancers: []string{"lb"}, DeregistrationDelay: time.Minute})
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "orphan", Port: 30080})
+
+		Expect(attachInstanceToTG(sim.ELBV2(), "tg", "i-1", 30080)).To(Succeed())
+		Expect(sim.TargetState("tg", "i-1")).To(Equal(elbv2.TargetHealthStateEnumInitial))
+
+		sim.Advance(30 * time.Second)
+		Expect(sim.TargetState("tg", "i-1")).To(Equal(elbv2.TargetHealthStateEnumHealthy))
+
+		sim.SetTargetUnhealthy("i-1", true)
+		Expect(sim.TargetState("tg", "i-1")).To(Equal(elbv2.TargetHealthStateEnumUnhealthy))
+
+		Expect(deregisterInstanceFromTG(sim.ELBV2(), "tg", "i-1", 30080)).To(Succeed())
+		Expect(sim.TargetState("tg", "i-1")).To(Equal(elbv2.TargetHealthStateEnumDraining))
+
+		sim.Advance(time.Minute)
+		Expect(sim.TargetState("tg", "i-1")).To(BeEmpty())
+
+		Expect(attachInstanceToTG(sim.ELBV2(), "orphan", "i-1", 30080)).To(Succeed())
+		Expect(getTargetHealthState(sim.ELBV2(), "orphan", "i-1", nil)).To(Equal(elbv2.TargetHealthStateEnumUnused))
+	})
+
+	It("injects throttling and reports deleted target groups as drifts", func() {
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "tg", Port: 30080, LoadBalancers: []string{"lb"}}, "i-1")
+		sim.Throttle("DeregisterTargets", 1)
+
+		err := deregisterInstanceFromTG(sim.ELBV2(), "tg", "i-1", 30080)
+		Expect(awsErrorCode(err)).To(Equal(fakeAWSErrCodeThrottling))
+		Expect(isAWSDriftError(err)).To(BeFalse())
+
+		Expect(deregisterInstanceFromTG(sim.ELBV2(), "tg", "i-1", 30080)).To(Succeed())
+
+		sim.RemoveTargetGroup("tg")
+
+		err = attachInstanceToTG(sim.ELBV2(), "tg", "i-1", 30080)
+		Expect(isAWSDriftError(err)).To(BeTrue())
+	})
+})
+
+var _ = Describe("AWSAPILimiter", func() {
+	var (
+		sim     *fakeAWS
+		limiter *AWSAPILimiter
+		delays  []time.Duration
+	)
+
+	BeforeEach(func() {
+		sim = newFakeAWS()
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "tg", Port: 30080, LoadBalancers: []string{"lb"}}, "i-1")
+
+		delays = nil
+
+		limiter = &AWSAPILimiter{
+			QPS:           1000,
+			Burst:         1,
+			MaxRetries:    3,
+			MinRetryDelay: time.Second,
+			MaxRetryDelay: 3 * time.Second,
+			sleep: func(d time.Duration) {
+				delays = append(delays, d)
+			},
+		}
+	})
+
+	It("retries throttled calls with jittered exponential backoff", func() {
+		sim.Throttle("DeregisterTargets", 3)
+
+		Expect(deregisterInstanceFromTG(newLimitedELBV2(sim.ELBV2(), limiter), "tg", "i-1", 30080)).To(Succeed())
+		Expect(sim.Calls("DeregisterTargets")).To(Equal(4))
+
+		Expect(delays).To(HaveLen(3))
+		Expect(delays[0]).To(BeNumerically("~", 750*time.Millisecond, 250*time.Millisecond))
+		Expect(delays[1]).To(BeNumerically("~", 1500*time.Millisecond, 500*time.Millisecond))
+		Expect(delays[2]).To(BeNumerically("~", 2250*time.Millisecond, 750*time.Millisecond))
+	})
+
+	It("gives up after max retries", func() {
+		sim.Throttle("DeregisterTargets", 4)
+
+		err := deregisterInstanceFromTG(newLimitedELBV2(sim.ELBV2(), limiter), "tg", "i-1", 30080)
+		Expect(isAWSThrottlingError(err)).To(BeTrue())
+		Expect(sim.Calls("DeregisterTargets")).To(Equal(4))
+	})
+
+	It("retries server-side errors but never permanent errors", func() {
+		sim.FailNext("RegisterTargets", 1, awserr.NewRequestFailure(awserr.New("InternalFailure", "internal failure", nil), 500, "req-1"))
+
+		Expect(attachInstanceToTG(newLimitedELBV2(sim.ELBV2(), limiter), "tg", "i-1", 30080)).To(Succeed())
+		Expect(sim.Calls("RegisterTargets")).To(Equal(2))
+
+		sim.RemoveTargetGroup("tg")
+
+		err := attachInstanceToTG(newLimitedELBV2(sim.ELBV2(), limiter), "tg", "i-1", 30080)
+		Expect(isAWSDriftError(err)).To(BeTrue())
+		Expect(sim.Calls("RegisterTargets")).To(Equal(3))
+	})
+
+	It("rate-limits each page of paginated calls", func() {
+		for i := 0; i < 4; i++ {
+			sim.AddTargetGroup(&fakeTargetGroup{ARN: fmt.Sprintf("tg%d", i), Port: 30080}, "i-2")
+		}
+
+		limiter.QPS = 20
+
+		start := time.Now()
+
+		idToTGs, _, err := getIDToTGs(newLimitedELBV2(sim.ELBV2(), limiter), []string{"i-2"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(idToTGs["i-2"]).To(HaveLen(4))
+
+		// 3 pages of target groups, and 5 target groups to describe health, at 20 calls per second for each API
+		Expect(sim.Calls("DescribeTargetGroups")).To(Equal(3))
+		Expect(time.Since(start)).To(BeNumerically(">=", 3*time.Second/20))
+	})
+})
+
+var _ = Describe("parseELBHostname", func() {
+	It("tells the name, the region and the generation of the load balancer", func() {
+		for hostname, want := range map[string]elbRef{
+			"envoy-nlb-0123456789abcdef.elb.us-west-2.amazonaws.com":      {name: "envoy-nlb", region: "us-west-2", v2: true},
+			"internal-web-alb-123456789.ap-northeast-1.elb.amazonaws.com": {name: "web-alb", region: "ap-northeast-1"},
+			"a1b2c3d4e5f6-123456789.us-east-1.elb.amazonaws.com":          {name: "a1b2c3d4e5f6", region: "us-east-1"},
+		} {
+			got, ok := parseELBHostname(hostname)
+			Expect(ok).To(BeTrue(), hostname)
+			Expect(got).To(Equal(want), hostname)
+		}
+
+		for _, hostname := range []string{"", "example.com", "envoy.default.svc.cluster.local", "d111111abcdef8.cloudfront.net"} {
+			_, ok := parseELBHostname(hostname)
+			Expect(ok).To(BeFalse(), hostname)
+		}
+	})
+})
+
+var _ = Describe("ParseAWSAccounts", func() {
+	It("parses role ARNs, external IDs, and regions", func() {
+		accounts, err := ParseAWSAccounts([]string{
+			"role-arn=arn:aws:iam::123456789012:role/node-detacher,external-id=mycluster,region=us-west-2",
+			"region=eu-west-1",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(accounts).To(Equal([]AWSAccount{
+			{RoleARN: "arn:aws:iam::123456789012:role/node-detacher", ExternalID: "mycluster", Region: "us-west-2"},
+			{Region: "eu-west-1"},
+		}))
+		Expect(accounts[0].AccountID()).To(Equal("123456789012"))
+		Expect(accounts[1].AccountID()).To(BeEmpty())
+	})
+
+	It("rejects invalid accounts", func() {
+		for _, a := range []string{"", "role-arn=node-detacher", "external-id=mycluster", "external-id=mycluster,region=us-west-2", "profile=default"} {
+			_, err := ParseAWSAccounts([]string{a})
+			Expect(err).To(HaveOccurred(), a)
+		}
+	})
+})
+
+var _ = Describe("DeregistrationBatcher", func() {
+	var (
+		sim *fakeAWS
+		svc *AWSServices
+		b   *DeregistrationBatcher
+	)
+
+	BeforeEach(func() {
+		sim = newFakeAWS()
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "tg", Port: 30080, LoadBalancers: []string{"lb"}}, "i-1", "i-2", "i-3")
+		sim.AddCLB("clb", "i-1", "i-2", "i-3")
+
+		svc = &AWSServices{ELB: sim.ELB(), ELBV2: sim.ELBV2()}
+
+		b = &DeregistrationBatcher{
+			Window:  100 * time.Millisecond,
+			MaxSize: DefaultDeregistrationBatchMaxSize,
+		}
+	})
+
+	// deregisterAll de-registers the instances concurrently and returns the results in the order of the instances
+	deregisterAll := func(deregister func(string) error, instanceIDs ...string) []error {
+		var wg sync.WaitGroup
+
+		errs := make([]error, len(instanceIDs))
+
+		for i, id := range instanceIDs {
+			wg.Add(1)
+
+			go func(i int, id string) {
+				defer wg.Done()
+
+				errs[i] = deregister(id)
+			}(i, id)
+		}
+
+		wg.Wait()
+
+		return errs
+	}
+
+	deregisterTarget := func(id string) error {
+		return b.deregisterTarget(svc, "tg", id, nil)
+	}
+
+	It("coalesces concurrent de-registrations from the same target group and CLB into one API call", func() {
+		Expect(deregisterAll(deregisterTarget, "i-1", "i-2", "i-3")).To(Equal([]error{nil, nil, nil}))
+		Expect(sim.Calls("DeregisterTargets")).To(Equal(1))
+
+		for _, id := range []string{"i-1", "i-2", "i-3"} {
+			Expect(sim.TargetState("tg", id)).To(BeEmpty())
+		}
+
+		Expect(deregisterAll(func(id string) error { return b.deregisterCLBInstance(svc, "clb", id) }, "i-1", "i-2")).To(Equal([]error{nil, nil}))
+		Expect(sim.Calls("DeregisterInstancesFromLoadBalancer")).To(Equal(1))
+		Expect(sim.CLBInstanceState("clb", "i-1")).To(BeEmpty())
+		Expect(sim.CLBInstanceState("clb", "i-3")).NotTo(BeEmpty())
+	})
+
+	It("flushes the batch without waiting for the window once it became full", func() {
+		b.Window = time.Hour
+		b.MaxSize = 2
+
+		Expect(deregisterAll(deregisterTarget, "i-1", "i-2")).To(Equal([]error{nil, nil}))
+		Expect(sim.Calls("DeregisterTargets")).To(Equal(1))
+	})
+
+	It("fans the drift out only to the member that actually drifted", func() {
+		errs := deregisterAll(deregisterTarget, "i-1", "i-2", "i-4")
+
+		Expect(errs[0]).NotTo(HaveOccurred())
+		Expect(errs[1]).NotTo(HaveOccurred())
+		Expect(awsErrorCode(errs[2])).To(Equal(elbv2.ErrCodeInvalidTargetException))
+
+		Expect(sim.TargetState("tg", "i-1")).To(BeEmpty())
+		Expect(sim.TargetState("tg", "i-2")).To(BeEmpty())
+	})
+
+	It("calls the API per de-registration when the window is zero", func() {
+		b.Window = 0
+
+		Expect(deregisterAll(deregisterTarget, "i-1", "i-2")).To(Equal([]error{nil, nil}))
+		Expect(sim.Calls("DeregisterTargets")).To(Equal(2))
+	})
+})
+
+var _ = Describe("NodeAttachments", func() {
+	var (
+		sim *fakeAWS
+		n   *NodeAttachments
+	)
+
+	const ns = "kube-system"
+
+	node := corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node1",
+			Labels: map[string]string{NodeLabelInstanceID: "i-1"},
+		},
+	}
+
+	BeforeEach(func() {
+		sim = newFakeAWS()
+		sim.HealthyAfter = 30 * time.Second
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "tg1", Port: 30080, LoadBalancers: []string{"lb"}, DeregistrationDelay: time.Minute}, "i-1")
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "tg2", Port: 30443, LoadBalancers: []string{"lb"}}, "i-1")
+		sim.AddCLB("clb1", "i-1")
+
+		scheme := runtime.NewScheme()
+		Expect(k8sscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+		// As if aws-load-balancer-controller is installed
+		scheme.AddKnownTypeWithName(TargetGroupBindingGVK, &unstructured.Unstructured{})
+		scheme.AddKnownTypeWithName(TargetGroupBindingGVK.GroupVersion().WithKind(TargetGroupBindingGVK.Kind+"List"), &unstructured.UnstructuredList{})
+
+		n = &NodeAttachments{
+			Log:             logf.Log,
+			client:          fake.NewFakeClientWithScheme(scheme, node.DeepCopy()),
+			elbSvc:          sim.ELB(),
+			elbv2Svc:        sim.ELBV2(),
+			asgSvc:          sim.AutoScaling(),
+			integrations:    staticAWSIntegrations,
+			namespace:       ns,
+			deregistrations: &DeregistrationBatcher{},
+		}
+
+		Expect(n.cacheNodeAttachments([]corev1.Node{node})).To(Succeed())
+	})
+
+	getAttachment := func() v1alpha1.Attachment {
+		var a v1alpha1.Attachment
+
+		Expect(n.client.Get(context.Background(), types.NamespacedName{Namespace: ns, Name: node.Name}, &a)).To(Succeed())
+
+		return a
+	}
+
+	It("detaches and re-attaches the node once targets become healthy", func() {
+		a := getAttachment()
+		Expect(a.Spec.AwsTargets).To(HaveLen(2))
+		Expect(a.Spec.AwsLoadBalancers).To(Equal([]v1alpha1.AwsLoadBalancer{{Name: "clb1", Integration: "StaticCLBs"}}))
+
+		processed, err := n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(processed).To(BeTrue())
+		Expect(sim.TargetState("tg1", "i-1")).To(Equal(elbv2.TargetHealthStateEnumDraining))
+		Expect(sim.CLBInstanceState("clb1", "i-1")).To(BeEmpty())
+
+		pending, err := n.attachNodes([]corev1.Node{node}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(ConsistOf("tg1(initial)", "tg2(initial)", "clb1(OutOfService)"))
+
+		sim.Advance(30 * time.Second)
+
+		pending, err = n.attachNodes([]corev1.Node{node}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+
+		for _, t := range getAttachment().Spec.AwsTargets {
+			Expect(t.Detached).To(BeFalse())
+			Expect(t.Phase).To(Equal(ReattachPhaseHealthy))
+		}
+	})
+
+	It("registers targets and CLBs in stages of the stage size", func() {
+		n.reattachStageSize = 1
+
+		_, err := n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Target groups are registered in the order of the attachment, which depends on discovery
+		pending, err := n.attachNodes([]corev1.Node{node}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(Or(
+			ConsistOf("tg1(initial)", "tg2(staged)", "clb1(staged)"),
+			ConsistOf("tg2(initial)", "tg1(staged)", "clb1(staged)"),
+		))
+
+		sim.Advance(30 * time.Second)
+
+		pending, err = n.attachNodes([]corev1.Node{node}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(Or(
+			ConsistOf("tg1(initial)", "clb1(staged)"),
+			ConsistOf("tg2(initial)", "clb1(staged)"),
+		))
+
+		sim.Advance(30 * time.Second)
+
+		pending, err = n.attachNodes([]corev1.Node{node}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(ConsistOf("clb1(OutOfService)"))
+
+		// Forcing registers the rest regardless of stages and health
+		pending, err = n.attachNodes([]corev1.Node{node}, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+	})
+
+	It("enables slow start of target groups supporting it on re-attachment", func() {
+		n.reattachSlowStart = 30 * time.Second
+		sim.targetGroup("tg2").SlowStartUnsupported = true
+
+		_, err := n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = n.attachNodes([]corev1.Node{node}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sim.targetGroup("tg1").Attributes).To(HaveKeyWithValue("slow_start.duration_seconds", "30"))
+		Expect(sim.targetGroup("tg2").Attributes).NotTo(HaveKey("slow_start.duration_seconds"))
+		Expect(sim.TargetState("tg2", "i-1")).To(Equal(elbv2.TargetHealthStateEnumInitial))
+	})
+
+	It("watches re-attached targets within the rollback window across re-caching", func() {
+		_, err := n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = n.attachNodes([]corev1.Node{node}, false)
+		Expect(err).NotTo(HaveOccurred())
+
+		sim.Advance(30 * time.Second)
+
+		pending, err := n.attachNodes([]corev1.Node{node}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(BeEmpty())
+
+		// As the node is un-labeled as cached on re-attachment
+		Expect(n.discoverNodeAttachments([]corev1.Node{node}, n.integrations, false)).To(Succeed())
+
+		for _, t := range getAttachment().Spec.AwsTargets {
+			Expect(t.Phase).To(Equal(ReattachPhaseHealthy))
+			Expect(t.HealthyAt).NotTo(BeNil())
+		}
+
+		now := time.Now()
+
+		unhealthy, watching, err := n.unhealthyWithinRollbackWindow(node, 5*time.Minute, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(watching).To(BeTrue())
+		Expect(unhealthy).To(BeEmpty())
+
+		sim.SetTargetUnhealthy("i-1", true)
+		sim.RemoveTargetGroup("tg2")
+
+		unhealthy, watching, err = n.unhealthyWithinRollbackWindow(node, 5*time.Minute, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(watching).To(BeTrue())
+		Expect(unhealthy).To(ConsistOf("tg1(unhealthy)", "clb1(OutOfService)"))
+
+		a := getAttachment()
+		Expect(a.Status.Drifts).To(HaveLen(1))
+		Expect(a.Status.Drifts[0].Name).To(Equal("tg2"))
+
+		_, watching, err = n.unhealthyWithinRollbackWindow(node, 5*time.Minute, now.Add(10*time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(watching).To(BeFalse())
+	})
+
+	It("records target groups deleted in the meantime as drifts", func() {
+		sim.RemoveTargetGroup("tg2")
+
+		_, err := n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+
+		drifts := getAttachment().Status.Drifts
+		Expect(drifts).To(HaveLen(1))
+		Expect(drifts[0].Name).To(Equal("tg2"))
+		Expect(drifts[0].Reason).To(Equal(elbv2.ErrCodeTargetGroupNotFoundException))
+	})
+
+	It("records the intent to de-register before failing on throttling, and resumes de-registering", func() {
+		sim.Throttle("DeregisterTargets", 1)
+
+		_, err := n.detachNodes([]corev1.Node{node})
+		Expect(err).To(HaveOccurred())
+
+		for _, t := range getAttachment().Spec.AwsTargets {
+			Expect(t.Detached).To(BeTrue())
+			Expect(t.Phase).To(Equal(DetachPhaseDeregistering))
+		}
+
+		_, err = n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sim.TargetState("tg1", "i-1")).To(Equal(elbv2.TargetHealthStateEnumDraining))
+
+		for _, t := range getAttachment().Spec.AwsTargets {
+			Expect(t.Phase).To(BeEmpty())
+		}
+	})
+
+	It("detaches and re-attaches the node with the clients of the account and region each load balancer lives in", func() {
+		shared := newFakeAWS()
+		shared.AddTargetGroup(&fakeTargetGroup{ARN: "shared-tg", Port: 30080, LoadBalancers: []string{"lb"}}, "i-1")
+		shared.AddCLB("clb1", "i-1")
+
+		n.awsAccounts = []*AWSServices{{Account: "123456789012", Region: "us-west-2", ELB: shared.ELB(), ELBV2: shared.ELBV2()}}
+
+		Expect(n.cacheNodeAttachments([]corev1.Node{node})).To(Succeed())
+
+		a := getAttachment()
+		Expect(a.Spec.AwsTargets).To(HaveLen(3))
+		Expect(a.Spec.AwsLoadBalancers).To(Equal([]v1alpha1.AwsLoadBalancer{
+			{Name: "clb1", Integration: "StaticCLBs"},
+			{Name: "clb1", Account: "123456789012", Region: "us-west-2", Integration: "StaticCLBs"},
+		}))
+
+		for _, t := range a.Spec.AwsTargets {
+			if t.ARN == "shared-tg" {
+				Expect(t.Account).To(Equal("123456789012"))
+				Expect(t.Region).To(Equal("us-west-2"))
+			} else {
+				Expect(t.Account).To(BeEmpty())
+			}
+		}
+
+		_, err := n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(shared.TargetState("shared-tg", "i-1")).To(BeEmpty())
+		Expect(shared.CLBInstanceState("clb1", "i-1")).To(BeEmpty())
+		Expect(sim.CLBInstanceState("clb1", "i-1")).To(BeEmpty())
+
+		_, err = n.attachNodes([]corev1.Node{node}, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(shared.TargetState("shared-tg", "i-1")).NotTo(BeEmpty())
+		Expect(shared.CLBInstanceState("clb1", "i-1")).NotTo(BeEmpty())
+		Expect(sim.CLBInstanceState("clb1", "i-1")).NotTo(BeEmpty())
+
+		// The account is no longer configured
+		n.awsAccounts = nil
+
+		_, err = n.detachNodes([]corev1.Node{node})
+		Expect(err).To(MatchError(ContainSubstring("No AWS account configured")))
+	})
+
+	It("discovers static load balancers on node creation and dynamic ones on detach, without mixing them up", func() {
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "nlb-tg", Port: 31080, LoadBalancers: []string{"nlb"}}, "i-1")
+		sim.TagTargetGroup("nlb-tg", map[string]string{AWSTagKeyServiceName: "default/envoy"})
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "alb-tg", Port: 31443, LoadBalancers: []string{"alb"}}, "i-1")
+		sim.TagTargetGroup("alb-tg", map[string]string{AWSTagKeyServiceName: "default/web", AWSTagKeyIngressName: "web"})
+		sim.AddCLB("svc-clb", "i-1")
+		sim.TagCLB("svc-clb", map[string]string{AWSTagKeyServiceName: "default/legacy"})
+
+		n.integrations = []AWSIntegration{
+			{Kind: AWSIntegrationStaticTargetGroups, Discovery: AWSDiscoveryNodeCreation},
+			{Kind: AWSIntegrationStaticCLBs, Discovery: AWSDiscoveryNodeCreation},
+			{Kind: AWSIntegrationDynamicNLBs, Discovery: AWSDiscoveryDetach},
+			{Kind: AWSIntegrationDynamicCLBs, Discovery: AWSDiscoveryDetach},
+		}
+
+		integrationOf := func(a v1alpha1.Attachment) map[string]string {
+			m := map[string]string{}
+
+			for _, t := range a.Spec.AwsTargets {
+				m[t.ARN] = t.Integration
+			}
+
+			for _, l := range a.Spec.AwsLoadBalancers {
+				m[l.Name] = l.Integration
+			}
+
+			return m
+		}
+
+		Expect(n.client.Delete(context.Background(), &v1alpha1.Attachment{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: node.Name}})).To(Succeed())
+		Expect(n.cacheNodeAttachments([]corev1.Node{node})).To(Succeed())
+		Expect(integrationOf(getAttachment())).To(Equal(map[string]string{
+			"tg1":  "StaticTargetGroups",
+			"tg2":  "StaticTargetGroups",
+			"clb1": "StaticCLBs",
+		}))
+
+		// De-registering from static ones must survive the discovery on detach
+		_, err := n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+
+		var cached corev1.Node
+		Expect(n.client.Get(context.Background(), types.NamespacedName{Name: node.Name}, &cached)).To(Succeed())
+		Expect(n.Cached(cached)).To(BeTrue())
+
+		Expect(n.discoverOnDetach(cached)).To(Succeed())
+
+		a := getAttachment()
+		Expect(integrationOf(a)).To(Equal(map[string]string{
+			"tg1":     "StaticTargetGroups",
+			"tg2":     "StaticTargetGroups",
+			"clb1":    "StaticCLBs",
+			"nlb-tg":  "DynamicNLBs",
+			"svc-clb": "DynamicCLBs",
+		}))
+
+		for _, t := range a.Spec.AwsTargets {
+			Expect(t.Detached).To(Equal(t.Integration == "StaticTargetGroups"), t.ARN)
+		}
+
+		Expect(n.client.Get(context.Background(), types.NamespacedName{Name: node.Name}, &cached)).To(Succeed())
+		Expect(cached.Annotations[NodeAnnotationKeyDiscoveredOnDetach]).To(Equal("true"))
+
+		_, err = n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sim.TargetState("nlb-tg", "i-1")).To(BeEmpty())
+		Expect(sim.CLBInstanceState("svc-clb", "i-1")).To(BeEmpty())
+		Expect(sim.TargetState("alb-tg", "i-1")).NotTo(BeEmpty())
+	})
+
+	It("limits integrations to load balancers with the tags", func() {
+		sim.TagTargetGroup("tg2", map[string]string{"team": "edge"})
+
+		n.integrations = []AWSIntegration{
+			{Kind: AWSIntegrationStaticTargetGroups, Discovery: AWSDiscoveryNodeCreation, Tags: map[string]string{"team": "edge"}},
+		}
+
+		Expect(n.discoverNodeAttachments([]corev1.Node{node}, n.integrations, false)).To(Succeed())
+
+		a := getAttachment()
+		Expect(a.Spec.AwsLoadBalancers).To(BeEmpty())
+		Expect(a.Spec.AwsTargets).To(HaveLen(1))
+		Expect(a.Spec.AwsTargets[0].ARN).To(Equal("tg2"))
+	})
+
+	It("derives dynamic load balancers from services, ingresses and target group bindings", func() {
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "nlb-tg", Port: 31080, LoadBalancers: []string{"envoy-nlb"}}, "i-1")
+		sim.TagTargetGroup("nlb-tg", map[string]string{AWSTagKeyServiceName: "default/envoy"})
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "alb-tg", Port: 31443, LoadBalancers: []string{"web-alb"}}, "i-1")
+		sim.TagTargetGroup("alb-tg", map[string]string{AWSTagKeyIngressStack: "default/web"})
+		sim.AddCLB("legacy-clb", "i-1")
+		sim.TagCLB("legacy-clb", map[string]string{AWSTagKeyServiceName: "default/legacy"})
+		// Unknown to Kubernetes, e.g. left behind by a deleted service
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "orphan-tg", Port: 32080, LoadBalancers: []string{"orphan-nlb"}}, "i-1")
+		sim.TagTargetGroup("orphan-tg", map[string]string{AWSTagKeyServiceName: "default/orphan"})
+
+		loadBalancer := func(name, hostname string, annotations map[string]string) *corev1.Service {
+			return &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations},
+				Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+				Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{
+					Ingress: []corev1.LoadBalancerIngress{{Hostname: hostname}},
+				}},
+			}
+		}
+
+		ctx := context.Background()
+
+		for _, obj := range []runtime.Object{
+			loadBalancer("envoy", "envoy-nlb-0123456789abcdef.elb.us-west-2.amazonaws.com", nil),
+			loadBalancer("envoy-ip", "envoy-nlb-0123456789abcdef.elb.us-west-2.amazonaws.com", map[string]string{ServiceAnnotationKeyNLBTargetType: TargetTypeIP}),
+			loadBalancer("legacy", "legacy-clb-123456789.us-west-2.elb.amazonaws.com", nil),
+			&networkingv1beta1.Ingress{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: map[string]string{IngressAnnotationKeyIngressClass: IngressClassALB}},
+				Status: networkingv1beta1.IngressStatus{LoadBalancer: corev1.LoadBalancerStatus{
+					Ingress: []corev1.LoadBalancerIngress{{Hostname: "internal-web-alb-123456789.us-west-2.elb.amazonaws.com"}},
+				}},
+			},
+		} {
+			Expect(n.client.Create(ctx, obj)).To(Succeed())
+		}
+
+		binding := &unstructured.Unstructured{}
+		binding.SetGroupVersionKind(TargetGroupBindingGVK)
+		binding.SetNamespace("default")
+		binding.SetName("web")
+		Expect(unstructured.SetNestedField(binding.Object, "alb-tg", "spec", "targetGroupARN")).To(Succeed())
+		Expect(n.client.Create(ctx, binding)).To(Succeed())
+
+		n.integrations = []AWSIntegration{
+			{Kind: AWSIntegrationALBIngress, Discovery: AWSDiscoveryDetach, Source: AWSSourceKubernetes},
+			{Kind: AWSIntegrationDynamicNLBs, Discovery: AWSDiscoveryDetach, Source: AWSSourceKubernetes},
+			{Kind: AWSIntegrationDynamicCLBs, Discovery: AWSDiscoveryDetach, Source: AWSSourceKubernetes},
+		}
+
+		Expect(n.discoverNodeAttachments([]corev1.Node{node}, n.integrations, true)).To(Succeed())
+
+		a := getAttachment()
+
+		sources := map[string][]string{}
+
+		for _, t := range a.Spec.AwsTargets {
+			sources[t.ARN] = t.Sources
+		}
+
+		for _, l := range a.Spec.AwsLoadBalancers {
+			sources[l.Name] = l.Sources
+		}
+
+		Expect(sources).To(Equal(map[string][]string{
+			"nlb-tg":     {"Service/default/envoy"},
+			"alb-tg":     {"Ingress/default/web", "TargetGroupBinding/default/web"},
+			"legacy-clb": {"Service/default/legacy"},
+		}))
+	})
+
+	It("derives ALBs from v1 ingresses of the class specified by either the annotation or the field", func() {
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "alb-tg", Port: 31443, LoadBalancers: []string{"web-alb"}}, "i-1")
+		sim.TagTargetGroup("alb-tg", map[string]string{AWSTagKeyIngressStack: "default/web"})
+
+		scheme := runtime.NewScheme()
+		Expect(k8sscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+		// As if the cluster serves networking.k8s.io/v1 ingresses
+		scheme.AddKnownTypeWithName(ingressVersions[0], &unstructured.Unstructured{})
+		scheme.AddKnownTypeWithName(ingressVersions[0].GroupVersion().WithKind(ingressVersions[0].Kind+"List"), &unstructured.UnstructuredList{})
+
+		n.client = fake.NewFakeClientWithScheme(scheme, node.DeepCopy())
+
+		Expect(n.cacheNodeAttachments([]corev1.Node{node})).To(Succeed())
+
+		ingress := func(name string, annotations map[string]string, class string) *unstructured.Unstructured {
+			ing := &unstructured.Unstructured{}
+			ing.SetGroupVersionKind(ingressVersions[0])
+			ing.SetNamespace("default")
+			ing.SetName(name)
+			ing.SetAnnotations(annotations)
+
+			if class != "" {
+				Expect(unstructured.SetNestedField(ing.Object, class, "spec", "ingressClassName")).To(Succeed())
+			}
+
+			Expect(unstructured.SetNestedSlice(ing.Object, []interface{}{
+				map[string]interface{}{"hostname": "internal-web-alb-123456789.us-west-2.elb.amazonaws.com"},
+			}, "status", "loadBalancer", "ingress")).To(Succeed())
+
+			return ing
+		}
+
+		ctx := context.Background()
+
+		for _, obj := range []runtime.Object{
+			ingress("web", nil, IngressClassALB),
+			ingress("web-annotated", map[string]string{IngressAnnotationKeyIngressClass: IngressClassALB}, ""),
+			ingress("nginx", nil, "nginx"),
+			ingress("nginx-annotated", map[string]string{IngressAnnotationKeyIngressClass: "nginx"}, IngressClassALB),
+		} {
+			Expect(n.client.Create(ctx, obj)).To(Succeed())
+		}
+
+		n.integrations = []AWSIntegration{
+			{Kind: AWSIntegrationALBIngress, Discovery: AWSDiscoveryDetach, Source: AWSSourceKubernetes},
+		}
+
+		Expect(n.discoverNodeAttachments([]corev1.Node{node}, n.integrations, true)).To(Succeed())
+
+		a := getAttachment()
+		Expect(a.Spec.AwsTargets).To(HaveLen(1))
+		Expect(a.Spec.AwsTargets[0].ARN).To(Equal("alb-tg"))
+		Expect(a.Spec.AwsTargets[0].Sources).To(ConsistOf("Ingress/default/web", "Ingress/default/web-annotated"))
+	})
+
+	It("lets controllers de-register and register the node, falling back to doing it on its own", func() {
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "lbc-tg", Port: 31080, LoadBalancers: []string{"nlb"}}, "i-1")
+		sim.TagTargetGroup("lbc-tg", map[string]string{AWSTagKeyELBV2Cluster: "test", AWSTagKeyServiceStack: "default/envoy"})
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "legacy-tg", Port: 31443, LoadBalancers: []string{"alb"}}, "i-1")
+		sim.TagTargetGroup("legacy-tg", map[string]string{AWSTagKeyIngressName: "web"})
+
+		n.controllerTimeout = time.Minute
+		n.integrations = append([]AWSIntegration{
+			{Kind: AWSIntegrationALBIngress, Discovery: AWSDiscoveryNodeCreation},
+			{Kind: AWSIntegrationDynamicNLBs, Discovery: AWSDiscoveryNodeCreation},
+		}, staticAWSIntegrations...)
+
+		Expect(n.discoverNodeAttachments([]corev1.Node{node}, n.integrations, false)).To(Succeed())
+
+		ctx := context.Background()
+
+		target := func(a *v1alpha1.Attachment, arn string) *v1alpha1.AwsTarget {
+			for i := range a.Spec.AwsTargets {
+				if a.Spec.AwsTargets[i].ARN == arn {
+					return &a.Spec.AwsTargets[i]
+				}
+			}
+
+			Fail("missing target " + arn)
+
+			return nil
+		}
+
+		// expire makes the wait for the controller time out
+		expire := func(arn string) {
+			a := getAttachment()
+
+			past := metav1.NewTime(time.Now().Add(-2 * time.Minute))
+			target(&a, arn).ControllerWaitStartedAt = &past
+
+			Expect(n.client.Update(ctx, &a)).To(Succeed())
+		}
+
+		a := getAttachment()
+		Expect(target(&a, "lbc-tg").Controller).To(Equal(TargetGroupControllerAWSLoadBalancerController))
+		Expect(target(&a, "legacy-tg").Controller).To(Equal(TargetGroupControllerALBIngressController))
+		Expect(target(&a, "tg1").Controller).To(BeEmpty())
+
+		_, err := n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sim.TargetState("tg1", "i-1")).To(Equal(elbv2.TargetHealthStateEnumDraining))
+		Expect(sim.TargetState("lbc-tg", "i-1")).To(Equal(elbv2.TargetHealthStateEnumHealthy))
+		Expect(sim.TargetState("legacy-tg", "i-1")).To(Equal(elbv2.TargetHealthStateEnumHealthy))
+
+		var labeled corev1.Node
+		Expect(n.client.Get(ctx, types.NamespacedName{Name: node.Name}, &labeled)).To(Succeed())
+		Expect(labeled.Labels).To(HaveKey(NodeLabelKeyExcludeBalancer))
+		Expect(labeled.Labels).To(HaveKey(NodeLabelKeyExcludeFromExternalLoadBalancers))
+
+		remaining, err := n.drainRemaining(node)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(remaining).To(Equal(controllerPollInterval))
+
+		// aws-alb-ingress-controller de-registers the node in favor of the label
+		Expect(deregisterInstanceFromTG(sim.ELBV2(), "legacy-tg", "i-1", 31443)).To(Succeed())
+
+		_, err = n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+
+		a = getAttachment()
+		Expect(target(&a, "legacy-tg").Phase).To(BeEmpty())
+		Expect(target(&a, "lbc-tg").Phase).To(Equal(DetachPhaseAwaitingController))
+
+		// aws-load-balancer-controller doesn't
+		expire("lbc-tg")
+
+		_, err = n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sim.TargetState("lbc-tg", "i-1")).To(BeEmpty())
+
+		a = getAttachment()
+		Expect(target(&a, "lbc-tg").Phase).To(BeEmpty())
+		Expect(target(&a, "lbc-tg").Detached).To(BeTrue())
+
+		pending, err := n.attachNodes([]corev1.Node{node}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(ContainElement("lbc-tg(awaiting aws-load-balancer-controller)"))
+		Expect(pending).To(ContainElement("legacy-tg(awaiting aws-alb-ingress-controller)"))
+		Expect(sim.TargetState("lbc-tg", "i-1")).To(BeEmpty())
+		Expect(sim.TargetState("tg2", "i-1")).To(Equal(elbv2.TargetHealthStateEnumInitial))
+
+		var unlabeled corev1.Node
+		Expect(n.client.Get(ctx, types.NamespacedName{Name: node.Name}, &unlabeled)).To(Succeed())
+		Expect(unlabeled.Labels).NotTo(HaveKey(NodeLabelKeyExcludeBalancer))
+		Expect(unlabeled.Labels).NotTo(HaveKey(NodeLabelKeyExcludeFromExternalLoadBalancers))
+
+		// aws-load-balancer-controller registers the node once the label is removed, but aws-alb-ingress-controller doesn't
+		Expect(attachInstanceToTG(sim.ELBV2(), "lbc-tg", "i-1", 31080)).To(Succeed())
+		expire("legacy-tg")
+
+		sim.Advance(30 * time.Second)
+
+		pending, err = n.attachNodes([]corev1.Node{node}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pending).To(ConsistOf("legacy-tg(initial)"))
+		Expect(sim.TargetState("legacy-tg", "i-1")).To(Equal(elbv2.TargetHealthStateEnumInitial))
+
+		a = getAttachment()
+		Expect(target(&a, "lbc-tg").Phase).To(Equal(ReattachPhaseHealthy))
+		Expect(target(&a, "legacy-tg").ControllerWaitStartedAt).To(BeNil())
+	})
+
+	It("re-registers targets the crashed de-registration may have de-registered", func() {
+		sim.FailAfterApplying("DeregisterTargets", 1, fmt.Errorf("connection reset"))
+
+		_, err := n.detachNodes([]corev1.Node{node})
+		Expect(err).To(HaveOccurred())
+		Expect(sim.TargetState("tg1", "i-1")).To(Equal(elbv2.TargetHealthStateEnumDraining))
+
+		_, err = n.attachNodes([]corev1.Node{node}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sim.TargetState("tg1", "i-1")).To(Equal(elbv2.TargetHealthStateEnumInitial))
+	})
+
+	It("skips target groups of local services without local endpoints, and reports the impact on ones with them", func() {
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "busy-tg", Port: 31080, LoadBalancers: []string{"busy-nlb"}}, "i-1")
+		sim.TagTargetGroup("busy-tg", map[string]string{AWSTagKeyServiceName: "default/busy"})
+		sim.AddTargetGroup(&fakeTargetGroup{ARN: "idle-tg", Port: 31443, LoadBalancers: []string{"idle-nlb"}}, "i-1")
+		sim.TagTargetGroup("idle-tg", map[string]string{AWSTagKeyServiceName: "default/idle"})
+
+		ready, notReady := true, false
+
+		endpoint := func(hostname string, ready *bool) discoveryv1alpha1.Endpoint {
+			return discoveryv1alpha1.Endpoint{
+				Addresses:  []string{"10.0.0.1"},
+				Conditions: discoveryv1alpha1.EndpointConditions{Ready: ready},
+				Topology:   map[string]string{corev1.LabelHostname: hostname},
+			}
+		}
+
+		ctx := context.Background()
+
+		for _, obj := range []runtime.Object{
+			&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "busy"},
+				Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyTypeLocal},
+			},
+			&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "idle"},
+				Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyTypeLocal},
+			},
+			&discoveryv1alpha1.EndpointSlice{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "busy-1", Labels: map[string]string{discoveryv1alpha1.LabelServiceName: "busy"}},
+				Endpoints:  []discoveryv1alpha1.Endpoint{endpoint("node1", nil), endpoint("node1", &notReady), endpoint("node2", &ready)},
+			},
+			&discoveryv1alpha1.EndpointSlice{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "idle-1", Labels: map[string]string{discoveryv1alpha1.LabelServiceName: "idle"}},
+				Endpoints:  []discoveryv1alpha1.Endpoint{endpoint("node2", &ready)},
+			},
+		} {
+			Expect(n.client.Create(ctx, obj)).To(Succeed())
+		}
+
+		n.skipTargetsWithoutLocalEndpoints = true
+		n.integrations = append([]AWSIntegration{{Kind: AWSIntegrationDynamicNLBs, Discovery: AWSDiscoveryNodeCreation}}, staticAWSIntegrations...)
+
+		Expect(n.discoverNodeAttachments([]corev1.Node{node}, n.integrations, false)).To(Succeed())
+
+		local, err := n.localEndpointsOfNode(node)
+		Expect(err).NotTo(HaveOccurred())
+
+		impacts := serviceImpactsOf(local)
+		Expect(impacts).To(Equal([]v1alpha1.ServiceImpact{
+			{Service: "default/busy", LocalEndpoints: 1, ReadyEndpoints: 2, Message: "removes 1 of 2 local endpoints of default/busy"},
+		}))
+
+		Expect(n.recordServiceImpacts(node, impacts)).To(Succeed())
+		Expect(getAttachment().Status.ServiceImpacts).To(Equal(impacts))
+
+		_, err = n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sim.TargetState("busy-tg", "i-1")).To(BeEmpty())
+		Expect(sim.TargetState("idle-tg", "i-1")).To(Equal(elbv2.TargetHealthStateEnumHealthy))
+		// Target groups without services are de-registered as usual
+		Expect(sim.TargetState("tg1", "i-1")).To(Equal(elbv2.TargetHealthStateEnumDraining))
+
+		for _, t := range getAttachment().Spec.AwsTargets {
+			switch t.ARN {
+			case "busy-tg":
+				Expect(t.Services).To(Equal([]string{"default/busy"}))
+				Expect(t.Detached).To(BeTrue())
+			case "idle-tg":
+				Expect(t.Services).To(Equal([]string{"default/idle"}))
+				Expect(t.Detached).To(BeFalse())
+			}
+		}
+
+		// Also left registered when detached again within the rollback window after re-attachment
+		attachment := getAttachment()
+
+		for i, t := range attachment.Spec.AwsTargets {
+			if t.ARN == "idle-tg" {
+				healthyAt := metav1.Now()
+
+				attachment.Spec.AwsTargets[i].Phase = ReattachPhaseHealthy
+				attachment.Spec.AwsTargets[i].HealthyAt = &healthyAt
+			}
+		}
+
+		Expect(n.client.Update(ctx, &attachment)).To(Succeed())
+
+		_, err = n.detachNodes([]corev1.Node{node})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sim.TargetState("idle-tg", "i-1")).To(Equal(elbv2.TargetHealthStateEnumHealthy))
+	})
+})
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDeregistrationBatchMaxSize is the default maximum number of targets or instances de-registered in an API call
+	DefaultDeregistrationBatchMaxSize = 20
+
+	deregistrationKindTargetGroup = "targetgroup"
+	deregistrationKindCLB         = "clb"
+)
+
+// DeregistrationBatcher coalesces de-registrations of nodes from the same target group or CLB requested within
+// the window into one API call, so that detaching many nodes at once, e.g. on a large scale-down by
+// cluster-autoscaler, doesn't result in one API call per node per target group.
+//
+// Each caller blocks until the batch it joined is flushed, and receives the result of its own de-registration.
+type DeregistrationBatcher struct {
+	// Window is how long the first de-registration of a batch waits for others to join the batch
+	Window time.Duration
+
+	// MaxSize is the maximum number of targets or instances de-registered in an API call.
+	// The batch is flushed without waiting for the window once it became full.
+	MaxSize int
+
+	mu      sync.Mutex
+	pending map[deregistrationKey]*deregistrationBatch
+}
+
+type deregistrationKey struct {
+	kind string
+
+	account string
+	region  string
+
+	// name is the ARN of the target group or the name of the CLB
+	name string
+}
+
+type deregistrationBatch struct {
+	key     deregistrationKey
+	svc     *AWSServices
+	members []deregistrationMember
+}
+
+type deregistrationMember struct {
+	instanceID string
+	port       *int64
+	result     chan error
+}
+
+// deregisterTarget de-registers the instance from the target group. The target is registered on the port when non-nil,
+// or the default port of the target group otherwise.
+func (b *DeregistrationBatcher) deregisterTarget(svc *AWSServices, arn, instanceID string, port *int64) error {
+	if b.Window <= 0 {
+		if port != nil {
+			return deregisterInstanceFromTG(svc.ELBV2, arn, instanceID, *port)
+		}
+
+		return deregisterInstancesFromTGs(svc.ELBV2, arn, []string{instanceID})
+	}
+
+	return b.add(svc, deregistrationKey{kind: deregistrationKindTargetGroup, account: svc.Account, region: svc.Region, name: arn}, instanceID, port)
+}
+
+// deregisterCLBInstance de-registers the instance from the CLB
+func (b *DeregistrationBatcher) deregisterCLBInstance(svc *AWSServices, lbName, instanceID string) error {
+	if b.Window <= 0 {
+		return deregisterInstancesFromCLBs(svc.ELB, lbName, []string{instanceID})
+	}
+
+	return b.add(svc, deregistrationKey{kind: deregistrationKindCLB, account: svc.Account, region: svc.Region, name: lbName}, instanceID, nil)
+}
+
+func (b *DeregistrationBatcher) add(svc *AWSServices, key deregistrationKey, instanceID string, port *int64) error {
+	result := make(chan error, 1)
+
+	b.mu.Lock()
+
+	if b.pending == nil {
+		b.pending = map[deregistrationKey]*deregistrationBatch{}
+	}
+
+	batch, ok := b.pending[key]
+	if !ok {
+		batch = &deregistrationBatch{key: key, svc: svc}
+
+		b.pending[key] = batch
+
+		time.AfterFunc(b.Window, func() {
+			b.mu.Lock()
+			flush := b.pending[key] == batch
+			if flush {
+				delete(b.pending, key)
+			}
+			b.mu.Unlock()
+
+			if flush {
+				b.flush(batch)
+			}
+		})
+	}
+
+	batch.members = append(batch.members, deregistrationMember{instanceID: instanceID, port: port, result: result})
+
+	maxSize := b.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultDeregistrationBatchMaxSize
+	}
+
+	full := len(batch.members) >= maxSize
+	if full {
+		delete(b.pending, key)
+	}
+
+	b.mu.Unlock()
+
+	if full {
+		go b.flush(batch)
+	}
+
+	return <-result
+}
+
+// flush de-registers all the members of the batch in one API call, and fans the result out to the members.
+//
+// When the call failed due to a drift, like one of the targets being no longer registered, every member is retried
+// individually so that only the members that actually drifted see the error.
+func (b *DeregistrationBatcher) flush(batch *deregistrationBatch) {
+	err := b.deregister(batch, batch.members)
+
+	if err != nil && isAWSDriftError(err) && len(batch.members) > 1 {
+		for _, m := range batch.members {
+			m.result <- b.deregister(batch, []deregistrationMember{m})
+		}
+
+		return
+	}
+
+	for _, m := range batch.members {
+		m.result <- err
+	}
+}
+
+func (b *DeregistrationBatcher) deregister(batch *deregistrationBatch, members []deregistrationMember) error {
+	if batch.key.kind == deregistrationKindCLB {
+		var ids []string
+
+		for _, m := range members {
+			ids = append(ids, m.instanceID)
+		}
+
+		return deregisterInstancesFromCLBs(batch.svc.ELB, batch.key.name, ids)
+	}
+
+	var descs []*elbv2.TargetDescription
+
+	for _, m := range members {
+		descs = append(descs, &elbv2.TargetDescription{
+			Id:   aws.String(m.instanceID),
+			Port: m.port,
+		})
+	}
+
+	return deregisterTargetsFromTG(batch.svc.ELBV2, batch.key.name, descs)
+}
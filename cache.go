@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/elb/elbiface"
-	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
 	"github.com/go-logr/logr"
 	"github.com/mumoshu/node-detacher/api/v1alpha1"
@@ -13,6 +12,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
 )
 
 const (
@@ -28,13 +28,36 @@ func init() {
 type NodeAttachments struct {
 	Log logr.Logger
 
-	client   client.Client
-	asgSvc   autoscalingiface.AutoScalingAPI
-	elbSvc   elbiface.ELBAPI
-	elbv2Svc elbv2iface.ELBV2API
+	client            client.Client
+	asgSvc            autoscalingiface.AutoScalingAPI
+	elbSvc            elbiface.ELBAPI
+	elbv2Svc          elbv2iface.ELBV2API
+	consul            *ConsulClient
+	route53           *Route53Integration
+	globalAccelerator *GlobalAcceleratorIntegration
 
-	shouldHandleCLBs bool
-	shouldHandleTGs  bool
+	// awsAccounts are AWS API clients for load balancers in AWS accounts and regions other than node-detacher's own
+	awsAccounts []*AWSServices
+
+	// deregistrations de-registers nodes from target groups and CLBs, coalescing ones of nodes detached at once
+	deregistrations *DeregistrationBatcher
+
+	// reattachStageSize is the maximum number of targets and CLBs being registered at once on re-attachment
+	reattachStageSize int
+
+	// reattachSlowStart, when non-zero, enables the slow start mode of target groups on re-attachment
+	reattachSlowStart time.Duration
+
+	// controllerTimeout, when non-zero, is how long node-detacher waits for controllers managing target groups to
+	// de-register and register the node, before doing it on its own
+	controllerTimeout time.Duration
+
+	// skipTargetsWithoutLocalEndpoints skips de-registering nodes from target groups and CLBs whose services are all
+	// `externalTrafficPolicy: Local` services without ready endpoints on the node
+	skipTargetsWithoutLocalEndpoints bool
+
+	// integrations are enabled integrations with AWS load balancers
+	integrations []AWSIntegration
 
 	namespace string
 }
@@ -55,19 +78,78 @@ func (n *NodeAttachments) cacheAllNodeAttachments() error {
 	return n.cacheNodeAttachments(nodes.Items)
 }
 
+// cacheNodeAttachments discovers load balancers and other attachments of nodes not cached yet, for integrations that
+// discover on node creation
 func (n *NodeAttachments) cacheNodeAttachments(nodes []corev1.Node) error {
+	var uncached []corev1.Node
+
+	for _, node := range nodes {
+		if !n.Cached(node) {
+			uncached = append(uncached, node)
+		}
+	}
+
+	if len(uncached) == 0 {
+		n.Log.Info(fmt.Sprintf("%d instances has been already labeled with %q", len(nodes), NodeLabelKeyCached))
+
+		return nil
+	}
+
+	return n.discoverNodeAttachments(uncached, awsIntegrationsDiscoveredOn(n.integrations, AWSDiscoveryNodeCreation), false)
+}
+
+// discoverOnDetach discovers load balancers of the node being detached, for integrations that discover on detach.
+//
+// The node not cached yet, e.g. due to AWS API errors on node creation, gets all the attachments discovered at once.
+// Otherwise, load balancers discovered on node creation are kept along with ones discovered on detach.
+func (n *NodeAttachments) discoverOnDetach(node corev1.Node) error {
+	ctx := context.Background()
+
+	var attachment v1alpha1.Attachment
+
+	if n.Cached(node) {
+		if err := n.client.Get(ctx, types.NamespacedName{Namespace: n.namespace, Name: node.Name}, &attachment); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	if attachment.Name == "" {
+		return n.discoverNodeAttachments([]corev1.Node{node}, n.integrations, true)
+	}
+
+	integrations := awsIntegrationsDiscoveredOn(n.integrations, AWSDiscoveryDetach)
+
+	instanceID, err := getInstanceID(node)
+	if err != nil {
+		return err
+	}
+
+	instanceToCLBs, instanceToTargets, err := n.discoverAWSLoadBalancers([]string{instanceID}, integrations)
+	if err != nil {
+		return err
+	}
+
+	mergeDiscoveredOnDetach(&attachment.Spec, integrations, instanceToCLBs[instanceID], instanceToTargets[instanceID])
+
+	if err := n.client.Update(ctx, &attachment); err != nil {
+		return err
+	}
+
+	return n.labelCached(node.Name, true)
+}
+
+// discoverNodeAttachments discovers load balancers handled by the integrations and other attachments of the nodes, and
+// replaces attachments of the nodes with them
+func (n *NodeAttachments) discoverNodeAttachments(nodes []corev1.Node, integrations []AWSIntegration, onDetach bool) error {
 	nodeToInstance := map[string]string{}
 
 	var instanceIDs []string
 
 	for _, node := range nodes {
-		if n.Cached(node) {
-			continue
-		}
-
 		instanceID, err := getInstanceID(node)
 		if err != nil {
-			return err
+			// Nodes outside of EC2 are attached only to Consul services and Route 53 records
+			continue
 		}
 
 		nodeToInstance[node.Name] = instanceID
@@ -75,35 +157,48 @@ func (n *NodeAttachments) cacheNodeAttachments(nodes []corev1.Node) error {
 		instanceIDs = append(instanceIDs, instanceID)
 	}
 
-	if len(instanceIDs) == 0 {
-		n.Log.Info(fmt.Sprintf("%d instances has been already labeled with %q", len(nodes), NodeLabelKeyCached))
-
-		return nil
-	}
-
 	//instanceToASGs, err := getIdToASGs(n.asgSvc, instanceIDs)
 	//if err != nil {
 	//	return err
 	//}
 
-	var instanceToCLBs map[string][]string
+	var (
+		instanceToCLBs    map[string][]v1alpha1.AwsLoadBalancer
+		instanceToTargets map[string][]v1alpha1.AwsTarget
+	)
 
-	if n.shouldHandleCLBs {
+	if len(instanceIDs) > 0 {
 		var err error
 
-		instanceToCLBs, err = getIDToCLBs(n.elbSvc, instanceIDs)
+		instanceToCLBs, instanceToTargets, err = n.discoverAWSLoadBalancers(instanceIDs, integrations)
+		if err != nil {
+			return err
+		}
+	}
+
+	var instanceToGAEndpoints map[string][]v1alpha1.GlobalAcceleratorEndpoint
+
+	if n.globalAccelerator != nil {
+		var err error
 
+		instanceToGAEndpoints, err = n.globalAccelerator.getIDToEndpoints(instanceIDs)
 		if err != nil {
 			return err
 		}
 	}
 
-	var instanceToTDs map[string]map[string][]elbv2.TargetDescription
+	var ipToRoute53Records map[string][]v1alpha1.Route53Record
+
+	if n.route53 != nil {
+		var ips []string
+
+		for _, node := range nodes {
+			ips = append(ips, getNodeIPs(node)...)
+		}
 
-	if n.shouldHandleTGs {
 		var err error
 
-		_, instanceToTDs, err = getIDToTGs(n.elbv2Svc, instanceIDs)
+		ipToRoute53Records, err = n.route53.getIPToRecords(ips)
 		if err != nil {
 			return err
 		}
@@ -118,24 +213,27 @@ func (n *NodeAttachments) cacheNodeAttachments(nodes []corev1.Node) error {
 
 		instance := nodeToInstance[node.Name]
 		//asgs := instanceToASGs[instance]
-		clbs := instanceToCLBs[instance]
-		tds := instanceToTDs[instance]
 
 		ctx := context.Background()
 
-		for arn, tds := range tds {
-			for _, td := range tds {
-				attachment.Spec.AwsTargets = append(attachment.Spec.AwsTargets, v1alpha1.AwsTarget{
-					ARN:  arn,
-					Port: td.Port,
-				})
+		attachment.Spec.AwsTargets = instanceToTargets[instance]
+		attachment.Spec.AwsLoadBalancers = instanceToCLBs[instance]
+
+		attachment.Spec.GlobalAcceleratorEndpoints = instanceToGAEndpoints[instance]
+
+		if n.consul != nil {
+			if ip := getNodeInternalIP(node); ip != "" {
+				services, err := n.consul.getNodeServices(ip)
+				if err != nil {
+					return err
+				}
+
+				attachment.Spec.ConsulServices = services
 			}
 		}
 
-		for _, clb := range clbs {
-			attachment.Spec.AwsLoadBalancers = append(attachment.Spec.AwsLoadBalancers, v1alpha1.AwsLoadBalancer{
-				Name: clb,
-			})
+		for _, ip := range getNodeIPs(node) {
+			attachment.Spec.Route53Records = append(attachment.Spec.Route53Records, ipToRoute53Records[ip]...)
 		}
 
 		if err := n.client.Create(ctx, &attachment); err != nil {
@@ -152,6 +250,9 @@ func (n *NodeAttachments) cacheNodeAttachments(nodes []corev1.Node) error {
 				return err
 			}
 
+			// Keeps the state of re-attachment, so that re-caching the re-attached node never ends the rollback window
+			keepAttachmentState(&attachment.Spec, latestAttachment.Spec)
+
 			latestAttachment.Spec = attachment.Spec
 
 			if err := n.client.Update(ctx, &latestAttachment); err != nil {
@@ -159,21 +260,151 @@ func (n *NodeAttachments) cacheNodeAttachments(nodes []corev1.Node) error {
 			}
 		}
 
-		var latestNode corev1.Node
-
-		if err := n.client.Get(ctx, types.NamespacedName{Name: node.Name}, &latestNode); err != nil {
+		if err := n.labelCached(node.Name, onDetach); err != nil {
 			return err
 		}
 
-		latestNode.Labels[NodeLabelKeyCached] = "true"
-		latestNode.Annotations[NodeAnnotationKeyDetaching] = "true"
+		n.Log.Info("Sucessfully labeled node", "node", node.Name)
+	}
+
+	return nil
+}
+
+// keepAttachmentState copies the state of detachment and re-attachment of targets and CLBs from the previous spec to
+// the re-discovered ones of the same target group and port, or the same CLB
+func keepAttachmentState(spec *v1alpha1.AttachmentSpec, prev v1alpha1.AttachmentSpec) {
+	type clbKey struct{ name, account, region string }
+
+	type targetKey struct {
+		arn, account, region string
+		port                 int64
+	}
+
+	targetKeyOf := func(t v1alpha1.AwsTarget) targetKey {
+		k := targetKey{arn: t.ARN, account: t.Account, region: t.Region}
+
+		if t.Port != nil {
+			k.port = *t.Port
+		}
+
+		return k
+	}
+
+	prevTargets := map[targetKey]v1alpha1.AwsTarget{}
+
+	for _, t := range prev.AwsTargets {
+		prevTargets[targetKeyOf(t)] = t
+	}
+
+	for i, t := range spec.AwsTargets {
+		p, ok := prevTargets[targetKeyOf(t)]
+		if !ok {
+			continue
+		}
+
+		spec.AwsTargets[i].Detached = p.Detached
+		spec.AwsTargets[i].Phase = p.Phase
+		spec.AwsTargets[i].HealthyAt = p.HealthyAt
+		spec.AwsTargets[i].ControllerWaitStartedAt = p.ControllerWaitStartedAt
+	}
+
+	prevCLBs := map[clbKey]v1alpha1.AwsLoadBalancer{}
+
+	for _, l := range prev.AwsLoadBalancers {
+		prevCLBs[clbKey{l.Name, l.Account, l.Region}] = l
+	}
+
+	for i, l := range spec.AwsLoadBalancers {
+		p, ok := prevCLBs[clbKey{l.Name, l.Account, l.Region}]
+		if !ok {
+			continue
+		}
+
+		spec.AwsLoadBalancers[i].Detached = p.Detached
+		spec.AwsLoadBalancers[i].Phase = p.Phase
+		spec.AwsLoadBalancers[i].HealthyAt = p.HealthyAt
+	}
+}
+
+// rediscoverOnDetach discovers Consul services and Route 53 records of the node again, and adds ones missing in the
+// attachment. Service instances may be registered, and the node IP may be added to record sets, after the attachment
+// was cached. Ones already in the attachment are kept as-is along with their state of detachment.
+func (n *NodeAttachments) rediscoverOnDetach(node corev1.Node, spec *v1alpha1.AttachmentSpec) error {
+	if n.consul != nil {
+		if ip := getNodeInternalIP(node); ip != "" {
+			services, err := n.consul.getNodeServices(ip)
+			if err != nil {
+				return err
+			}
+
+			type key struct{ node, id string }
+
+			known := map[key]bool{}
+
+			for _, s := range spec.ConsulServices {
+				known[key{s.Node, s.ID}] = true
+			}
+
+			for _, s := range services {
+				if !known[key{s.Node, s.ID}] {
+					spec.ConsulServices = append(spec.ConsulServices, s)
+				}
+			}
+		}
+	}
+
+	if n.route53 != nil {
+		ips := getNodeIPs(node)
 
-		if err := n.client.Update(ctx, &latestNode); err != nil {
+		ipToRecords, err := n.route53.getIPToRecords(ips)
+		if err != nil {
 			return err
 		}
 
-		n.Log.Info("Sucessfully labeled node", "node", latestNode.Name)
+		type key struct{ zone, name, typ, setID, value string }
+
+		known := map[key]bool{}
+
+		for _, r := range spec.Route53Records {
+			known[key{r.HostedZoneID, r.Name, r.Type, r.SetIdentifier, r.Value}] = true
+		}
+
+		for _, ip := range ips {
+			for _, r := range ipToRecords[ip] {
+				if !known[key{r.HostedZoneID, r.Name, r.Type, r.SetIdentifier, r.Value}] {
+					spec.Route53Records = append(spec.Route53Records, r)
+				}
+			}
+		}
 	}
 
 	return nil
 }
+
+// labelCached labels the node as cached, and annotates it when load balancers are discovered on detach so that they
+// are discovered only once per detachment
+func (n *NodeAttachments) labelCached(nodeName string, onDetach bool) error {
+	var latestNode corev1.Node
+
+	if err := n.client.Get(context.Background(), types.NamespacedName{Name: nodeName}, &latestNode); err != nil {
+		return err
+	}
+
+	if latestNode.Labels == nil {
+		latestNode.Labels = map[string]string{}
+	}
+
+	// Note that caching never marks the node as detaching. Otherwise the next reconciliation re-attaches the
+	// schedulable node, which un-labels it for re-caching, forever.
+	latestNode.Labels[NodeLabelKeyCached] = "true"
+
+	if onDetach {
+		if latestNode.Annotations == nil {
+			latestNode.Annotations = map[string]string{}
+		}
+
+		latestNode.Annotations[NodeAnnotationKeyDiscoveredOnDetach] = "true"
+	}
+
+	return n.client.Update(context.Background(), &latestNode)
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	chaosTargetGroupARN = "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/chaos/0123456789abcdef"
+	chaosCLBName        = "chaos"
+
+	// chaosSettleRounds is the number of times every node is reconciled to let the controller converge
+	chaosSettleRounds = 10
+)
+
+// errChaosCrash is returned by AWS API calls that "crashed" the controller after the change was applied
+var errChaosCrash = errors.New("controller crashed before receiving the response")
+
+// chaosEnv is the cluster, the AWS simulator, and the controller a chaos scenario runs against.
+//
+// Unlike SetupAWSTest, the controller is reconciled synchronously by the scenario, so that the scenario is able to
+// interleave reconciliations with actions of cluster-autoscaler, operators, and AWS at exact points in time.
+type chaosEnv struct {
+	ctx    context.Context
+	client client.Client
+	coreV1 corev1client.CoreV1Interface
+	aws    *fakeAWS
+	ns     string
+
+	controller *NodeController
+
+	// rollbackWindow and warmup are given to every controller, including the ones restarted after crashes
+	rollbackWindow time.Duration
+	warmup         time.Duration
+
+	// nodes maps the name of each node to its instance ID
+	nodes map[string]string
+
+	deleted map[string]bool
+}
+
+// chaosStep is an event in the timeline of a chaos scenario
+type chaosStep struct {
+	desc string
+	do   func(*chaosEnv)
+}
+
+// chaosScenario is a timeline of chaos steps.
+// After the last step, the controller is let converge and the invariants are asserted.
+type chaosScenario struct {
+	desc  string
+	steps []chaosStep
+}
+
+func newChaosEnv(ctx context.Context, c client.Client, coreV1 corev1client.CoreV1Interface, ns string, nodes ...string) *chaosEnv {
+	env := &chaosEnv{
+		ctx:     ctx,
+		client:  c,
+		coreV1:  coreV1,
+		aws:     newFakeAWS(),
+		ns:      ns,
+		nodes:   map[string]string{},
+		deleted: map[string]bool{},
+	}
+
+	env.aws.HealthyAfter = 30 * time.Second
+
+	var instanceIDs []string
+
+	for i, name := range nodes {
+		instanceID := fmt.Sprintf("i-%017d", i)
+
+		env.nodes[name] = instanceID
+		instanceIDs = append(instanceIDs, instanceID)
+
+		env.createReadyNode(name, instanceID)
+	}
+
+	env.aws.AddTargetGroup(&fakeTargetGroup{ARN: chaosTargetGroupARN, Port: 30080, LoadBalancers: []string{"chaos"}, DeregistrationDelay: time.Minute}, instanceIDs...)
+	env.aws.AddCLB(chaosCLBName, instanceIDs...)
+
+	env.crash()
+
+	return env
+}
+
+func (env *chaosEnv) createReadyNode(name, instanceID string) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{NodeLabelInstanceID: instanceID},
+		},
+	}
+
+	Expect(env.client.Create(env.ctx, node)).To(Succeed(), "failed to create test node")
+
+	node.Status.Conditions = []corev1.NodeCondition{{
+		Type:               corev1.NodeReady,
+		Status:             corev1.ConditionTrue,
+		LastHeartbeatTime:  metav1.Now(),
+		LastTransitionTime: metav1.Now(),
+	}}
+
+	Expect(env.client.Status().Update(env.ctx, node)).To(Succeed(), "failed to update test node status")
+}
+
+// crash replaces the controller with a new one, losing everything the previous one had in memory
+func (env *chaosEnv) crash() {
+	env.controller = &NodeController{
+		Client:          env.client,
+		CoreV1Client:    env.coreV1,
+		Log:             logf.Log.WithName("chaos"),
+		recorder:        &record.FakeRecorder{},
+		AWSEnabled:      true,
+		AWSIntegrations: staticAWSIntegrations,
+		Namespace:       env.ns,
+		asgSvc:          env.aws.AutoScaling(),
+		elbSvc:          env.aws.ELB(),
+		elbv2Svc:        env.aws.ELBV2(),
+
+		ReattachRollbackWindow: env.rollbackWindow,
+		ReattachWarmup:         env.warmup,
+	}
+}
+
+func (env *chaosEnv) reconcile(name string) error {
+	_, err := env.controller.reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: name}})
+
+	return err
+}
+
+// settle reconciles every node, including deleted ones, until the controller converges.
+// The simulated AWS clock advances between rounds so that targets finish draining and become healthy.
+func (env *chaosEnv) settle() {
+	var errs []error
+
+	for i := 0; i < chaosSettleRounds; i++ {
+		errs = nil
+
+		for name := range env.nodes {
+			if err := env.reconcile(name); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+
+		env.aws.Advance(time.Minute)
+	}
+
+	Expect(errs).To(BeEmpty(), "controller didn't converge")
+}
+
+func (env *chaosEnv) getNode(name string) corev1.Node {
+	var node corev1.Node
+
+	Expect(env.client.Get(env.ctx, types.NamespacedName{Name: name}, &node)).To(Succeed(), "failed to get test node")
+
+	return node
+}
+
+func (env *chaosEnv) updateNode(name string, f func(*corev1.Node)) {
+	node := env.getNode(name)
+
+	f(&node)
+
+	Expect(env.client.Update(env.ctx, &node)).To(Succeed(), "failed to update test node")
+}
+
+// assertInvariants asserts that every remaining node is either registered exactly where it started, or fully
+// detached, with no stuck taints or annotations.
+func (env *chaosEnv) assertInvariants() {
+	for name, instanceID := range env.nodes {
+		if env.deleted[name] {
+			continue
+		}
+
+		node := env.getNode(name)
+
+		var a v1alpha1.Attachment
+
+		Expect(env.client.Get(env.ctx, types.NamespacedName{Namespace: env.ns, Name: name}, &a)).To(Succeed(), "failed to get attachment of %s", name)
+
+		var tainted bool
+
+		for _, t := range node.Spec.Taints {
+			if t.Key == NodeTaintKeyDetaching {
+				tainted = true
+			}
+		}
+
+		if legacyDetachTriggered(node) {
+			Expect(node.Annotations[NodeAnnotationKeyDetaching]).To(Equal("true"), "%s: detaching annotation", name)
+			Expect(node.Annotations[NodeAnnotationKeyDrained]).To(Equal("true"), "%s: drained annotation", name)
+			Expect(tainted).To(BeTrue(), "%s: detaching taint", name)
+
+			Expect(env.aws.TargetState(chaosTargetGroupARN, instanceID)).To(Or(BeEmpty(), Equal(elbv2.TargetHealthStateEnumDraining)), "%s: target", name)
+			Expect(env.aws.CLBInstanceState(chaosCLBName, instanceID)).To(BeEmpty(), "%s: CLB instance", name)
+
+			for _, t := range a.Spec.AwsTargets {
+				Expect(t.Detached).To(BeTrue(), "%s: detached target %s", name, t.ARN)
+				Expect(t.Phase).To(BeEmpty(), "%s: phase of target %s", name, t.ARN)
+			}
+
+			for _, l := range a.Spec.AwsLoadBalancers {
+				Expect(l.Detached).To(BeTrue(), "%s: detached CLB %s", name, l.Name)
+				Expect(l.Phase).To(BeEmpty(), "%s: phase of CLB %s", name, l.Name)
+			}
+
+			continue
+		}
+
+		Expect(node.Annotations[NodeAnnotationKeyDetaching]).NotTo(Equal("true"), "%s: detaching annotation", name)
+		Expect(node.Annotations).NotTo(HaveKey(NodeAnnotationKeyDrained), "%s: drained annotation", name)
+		Expect(node.Annotations).NotTo(HaveKey(NodeAnnotationKeyReattachFailed), "%s: reattach-failed annotation", name)
+		Expect(node.Labels).NotTo(HaveKey(NodeLabelKeyExcludeBalancer), "%s: exclude-balancer label", name)
+		Expect(tainted).To(BeFalse(), "%s: detaching taint", name)
+
+		Expect(env.aws.TargetState(chaosTargetGroupARN, instanceID)).To(Equal(elbv2.TargetHealthStateEnumHealthy), "%s: target", name)
+		Expect(env.aws.CLBInstanceState(chaosCLBName, instanceID)).To(Equal("InService"), "%s: CLB instance", name)
+
+		for _, t := range a.Spec.AwsTargets {
+			Expect(t.Detached).To(BeFalse(), "%s: detached target %s", name, t.ARN)
+		}
+
+		for _, l := range a.Spec.AwsLoadBalancers {
+			Expect(l.Detached).To(BeFalse(), "%s: detached CLB %s", name, l.Name)
+		}
+	}
+}
+
+func (env *chaosEnv) run(s chaosScenario) {
+	for _, step := range s.steps {
+		By(step.desc)
+
+		step.do(env)
+	}
+
+	By("letting the controller converge")
+
+	env.settle()
+
+	env.assertInvariants()
+}
+
+func settle() chaosStep {
+	return chaosStep{"controller converges", func(env *chaosEnv) { env.settle() }}
+}
+
+// reconcileOnce reconciles the node once, ignoring the error as injected failures are expected to fail it
+func reconcileOnce(name string) chaosStep {
+	return chaosStep{fmt.Sprintf("controller reconciles %s once", name), func(env *chaosEnv) { _ = env.reconcile(name) }}
+}
+
+func crash() chaosStep {
+	return chaosStep{"controller crashes and restarts", func(env *chaosEnv) { env.crash() }}
+}
+
+func taintByCA(name string) chaosStep {
+	return chaosStep{fmt.Sprintf("cluster-autoscaler taints %s to scale it down", name), func(env *chaosEnv) {
+		env.updateNode(name, func(node *corev1.Node) {
+			node.Spec.Taints = append(node.Spec.Taints, corev1.Taint{
+				Key:    NodeTaintToBeDeletedByCA,
+				Value:  fmt.Sprintf("%d", time.Now().Unix()),
+				Effect: corev1.TaintEffectNoSchedule,
+			})
+		})
+	}}
+}
+
+func untaintByCA(name string) chaosStep {
+	return chaosStep{fmt.Sprintf("cluster-autoscaler cancels the scale-down by removing the taint from %s", name), func(env *chaosEnv) {
+		env.updateNode(name, func(node *corev1.Node) {
+			var taints []corev1.Taint
+
+			for _, t := range node.Spec.Taints {
+				if t.Key != NodeTaintToBeDeletedByCA {
+					taints = append(taints, t)
+				}
+			}
+
+			node.Spec.Taints = taints
+		})
+	}}
+}
+
+func cordon(name string, unschedulable bool) chaosStep {
+	desc := fmt.Sprintf("operator cordons %s", name)
+	if !unschedulable {
+		desc = fmt.Sprintf("operator uncordons %s", name)
+	}
+
+	return chaosStep{desc, func(env *chaosEnv) {
+		env.updateNode(name, func(node *corev1.Node) {
+			node.Spec.Unschedulable = unschedulable
+		})
+	}}
+}
+
+func throttle(op string, n int) chaosStep {
+	return chaosStep{fmt.Sprintf("AWS throttles %d %s calls", n, op), func(env *chaosEnv) { env.aws.Throttle(op, n) }}
+}
+
+// crashAfterApplying makes the next call to the mutating operation crash the controller after AWS applied the change
+func crashAfterApplying(op string) chaosStep {
+	return chaosStep{fmt.Sprintf("controller crashes right after calling %s", op), func(env *chaosEnv) {
+		env.aws.FailAfterApplying(op, 1, errChaosCrash)
+	}}
+}
+
+func deleteNode(name string) chaosStep {
+	return chaosStep{fmt.Sprintf("%s is deleted", name), func(env *chaosEnv) {
+		node := env.getNode(name)
+
+		Expect(env.client.Delete(env.ctx, &node)).To(Succeed(), "failed to delete test node")
+
+		env.deleted[name] = true
+	}}
+}
+
+var chaosScenarios = []chaosScenario{
+	{
+		desc:  "CA scales down the node",
+		steps: []chaosStep{taintByCA("node1")},
+	},
+	{
+		desc:  "CA cancels the scale-down after the node is detached",
+		steps: []chaosStep{taintByCA("node1"), settle(), untaintByCA("node1")},
+	},
+	{
+		desc: "controller crashes after de-registering the target, then CA cancels the scale-down",
+		steps: []chaosStep{
+			crashAfterApplying("DeregisterTargets"),
+			taintByCA("node1"),
+			reconcileOnce("node1"),
+			crash(),
+			untaintByCA("node1"),
+		},
+	},
+	{
+		desc: "controller crashes after de-registering from the CLB, then CA cancels the scale-down",
+		steps: []chaosStep{
+			crashAfterApplying("DeregisterInstancesFromLoadBalancer"),
+			taintByCA("node1"),
+			reconcileOnce("node1"),
+			crash(),
+			untaintByCA("node1"),
+		},
+	},
+	{
+		desc: "controller crashes after de-registering the target, then resumes detaching",
+		steps: []chaosStep{
+			crashAfterApplying("DeregisterTargets"),
+			taintByCA("node1"),
+			reconcileOnce("node1"),
+			crash(),
+		},
+	},
+	{
+		desc: "controller crashes while re-attaching",
+		steps: []chaosStep{
+			taintByCA("node1"),
+			settle(),
+			crashAfterApplying("RegisterTargets"),
+			untaintByCA("node1"),
+			reconcileOnce("node1"),
+			crash(),
+		},
+	},
+	{
+		desc: "CA scales down the node again while it is being re-attached",
+		steps: []chaosStep{
+			taintByCA("node1"),
+			settle(),
+			untaintByCA("node1"),
+			reconcileOnce("node1"),
+			taintByCA("node1"),
+		},
+	},
+	{
+		desc: "AWS throttles de-registrations and registrations",
+		steps: []chaosStep{
+			throttle("DeregisterTargets", 3),
+			throttle("DeregisterInstancesFromLoadBalancer", 2),
+			taintByCA("node1"),
+			settle(),
+			throttle("RegisterTargets", 3),
+			throttle("DescribeTargetHealth", 2),
+			untaintByCA("node1"),
+		},
+	},
+	{
+		desc: "node is deleted in the middle of detaching",
+		steps: []chaosStep{
+			crashAfterApplying("DeregisterTargets"),
+			taintByCA("node1"),
+			reconcileOnce("node1"),
+			deleteNode("node1"),
+		},
+	},
+	{
+		desc: "operator uncordons the node CA is scaling down",
+		steps: []chaosStep{
+			cordon("node1", true),
+			reconcileOnce("node1"),
+			taintByCA("node1"),
+			cordon("node1", false),
+			settle(),
+			untaintByCA("node1"),
+		},
+	},
+}
+
+var _ = Describe("Chaos", func() {
+	ctx := context.TODO()
+
+	var ns *corev1.Namespace
+
+	BeforeEach(func() {
+		ns = &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: "testns-" + randStringRunes(5)},
+		}
+
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed(), "failed to create test namespace")
+	})
+
+	AfterEach(func() {
+		Expect(k8sClient.Delete(ctx, ns)).To(Succeed(), "failed to delete test namespace")
+
+		var nodes corev1.NodeList
+
+		Expect(k8sClient.List(ctx, &nodes)).To(Succeed(), "failed to list test nodes")
+
+		for _, no := range nodes.Items {
+			Expect(k8sClient.Delete(ctx, &no)).To(Succeed(), "failed to delete test node")
+		}
+	})
+
+	It("completes rolling back the re-attachment the controller crashed in the middle of", func() {
+		env := newChaosEnv(ctx, k8sClient, clientset.CoreV1(), ns.Name, "node1", "node2")
+
+		env.rollbackWindow = 10 * time.Minute
+		env.crash()
+
+		instanceID := env.nodes["node1"]
+
+		for _, step := range []chaosStep{taintByCA("node1"), settle(), untaintByCA("node1"), settle()} {
+			By(step.desc)
+
+			step.do(env)
+		}
+
+		Expect(env.aws.TargetState(chaosTargetGroupARN, instanceID)).To(Equal(elbv2.TargetHealthStateEnumHealthy))
+
+		By("the re-attached node failing health checks within the rollback window")
+
+		env.aws.SetTargetUnhealthy(instanceID, true)
+
+		// The CLB is de-registered after the target group, so that nothing is left to watch once this crashes
+		env.aws.FailAfterApplying("DeregisterInstancesFromLoadBalancer", 1, errChaosCrash)
+
+		Expect(env.reconcile("node1")).To(HaveOccurred())
+
+		node := env.getNode("node1")
+		Expect(node.Annotations).To(HaveKeyWithValue(NodeAnnotationKeyDetaching, "true"))
+		Expect(node.Annotations).To(HaveKey(NodeAnnotationKeyReattachFailed))
+
+		By("controller restarting and warming up the node")
+
+		env.warmup = 10 * time.Minute
+		env.crash()
+
+		Expect(env.reconcile("node1")).To(Succeed())
+
+		Expect(env.aws.TargetState(chaosTargetGroupARN, instanceID)).To(Or(BeEmpty(), Equal(elbv2.TargetHealthStateEnumDraining)))
+		Expect(env.aws.CLBInstanceState(chaosCLBName, instanceID)).To(BeEmpty())
+
+		var a v1alpha1.Attachment
+
+		Expect(env.client.Get(env.ctx, types.NamespacedName{Namespace: env.ns, Name: "node1"}, &a)).To(Succeed())
+
+		for _, l := range a.Spec.AwsLoadBalancers {
+			Expect(l.Detached).To(BeTrue())
+			Expect(l.Phase).To(BeEmpty())
+		}
+
+		By("the node passing health checks and warming up")
+
+		env.aws.SetTargetUnhealthy(instanceID, false)
+
+		env.warmup = 0
+		env.crash()
+
+		env.settle()
+
+		Expect(env.getNode("node1").Annotations[NodeAnnotationKeyDetaching]).To(Equal("false"))
+		Expect(env.aws.TargetState(chaosTargetGroupARN, instanceID)).To(Equal(elbv2.TargetHealthStateEnumHealthy))
+		Expect(env.aws.CLBInstanceState(chaosCLBName, instanceID)).To(Equal("InService"))
+	})
+
+	for _, s := range chaosScenarios {
+		s := s
+
+		It(s.desc, func() {
+			env := newChaosEnv(ctx, k8sClient, clientset.CoreV1(), ns.Name, "node1", "node2")
+
+			env.run(s)
+		})
+	}
+})
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	"io/ioutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"os"
+	"reflect"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"time"
+)
+
+const (
+	ConfigAPIVersion = "node-detacher.variant.run/v1alpha1"
+	ConfigKind       = "Config"
+)
+
+// Config is the configuration of node-detacher, loaded from the YAML file specified via -config, typically mounted
+// from a ConfigMap, and command-line flags.
+//
+// Every field has the command-line flag of the same meaning. Flags explicitly specified on the command-line override
+// the file, so that the file can be managed by GitOps while a flag can still be used for a quick override.
+//
+// Fields marked as reloadable take effect on change of the file without restarting node-detacher.
+// Changes to any other field are logged and take effect on the next restart.
+type Config struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// Name is the name of this node-detacher, specified in the annotation node-detacher.variant.run/managed-by
+	Name string `json:"name,omitempty"`
+
+	// Namespace is the namespace to watch resources for
+	Namespace string `json:"namespace,omitempty"`
+
+	SyncPeriod     metav1.Duration `json:"syncPeriod,omitempty"`
+	MetricsAddr    string          `json:"metricsAddr,omitempty"`
+	LeaderElection bool            `json:"leaderElection,omitempty"`
+	LogLevel       string          `json:"logLevel,omitempty"`
+
+	// DebugAddr is the address the debug endpoint binds to. The effective configuration is served at /debug/config
+	DebugAddr string `json:"debugAddr,omitempty"`
+
+	AWS               AWSConfig               `json:"aws"`
+	GlobalAccelerator GlobalAcceleratorConfig `json:"globalAccelerator"`
+	Route53           Route53Config           `json:"route53"`
+	Consul            ConsulConfig            `json:"consul"`
+	XDS               XDSConfig               `json:"xds"`
+	Karpenter         KarpenterConfig         `json:"karpenter"`
+	NodeConditions    NodeConditionsConfig    `json:"nodeConditions"`
+	DaemonSets        DaemonSetsConfig        `json:"daemonSets"`
+	Workloads         WorkloadsConfig         `json:"workloads"`
+	PodWebhook        PodWebhookConfig        `json:"podWebhook"`
+	Rollout           RolloutConfig           `json:"rollout"`
+	Reattach          ReattachConfig          `json:"reattach"`
+	Concurrency       ConcurrencyConfig       `json:"concurrency"`
+}
+
+type AWSConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// ALBIngress, DynamicCLBs, DynamicNLBs, StaticCLBs, and StaticTargetGroups configure integrations with respective
+	// kinds of load balancers independently of each other. Reloadable.
+	ALBIngress         AWSIntegrationConfig `json:"albIngress"`
+	DynamicCLBs        AWSIntegrationConfig `json:"dynamicCLBs"`
+	DynamicNLBs        AWSIntegrationConfig `json:"dynamicNLBs"`
+	StaticCLBs         AWSIntegrationConfig `json:"staticCLBs"`
+	StaticTargetGroups AWSIntegrationConfig `json:"staticTargetGroups"`
+
+	// Accounts is the list of `role-arn=ARN[,external-id=ID][,region=REGION]`
+	Accounts []string `json:"accounts,omitempty"`
+
+	APIQPS        float64 `json:"apiQPS,omitempty"`
+	APIBurst      int     `json:"apiBurst,omitempty"`
+	APIMaxRetries int     `json:"apiMaxRetries,omitempty"`
+
+	// ControllerTimeout is how long node-detacher waits for aws-load-balancer-controller and aws-alb-ingress-controller
+	// to de-register and register nodes. Reloadable
+	ControllerTimeout metav1.Duration `json:"controllerTimeout,omitempty"`
+
+	// SkipTargetsWithoutLocalEndpoints skips de-registering nodes from target groups and CLBs whose services are all
+	// `externalTrafficPolicy: Local` services without ready endpoints on the node. Reloadable
+	SkipTargetsWithoutLocalEndpoints bool `json:"skipTargetsWithoutLocalEndpoints,omitempty"`
+}
+
+// AWSIntegrationConfig configures an integration with a kind of AWS load balancers
+type AWSIntegrationConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Discovery is when load balancers are discovered, either NodeCreation or Detach
+	Discovery string `json:"discovery,omitempty"`
+
+	// Source is where load balancers are discovered from, either AWS or Kubernetes
+	Source string `json:"source,omitempty"`
+
+	// Tags is the list of `KEY=VALUE`, limiting the integration to load balancers tagged with all of them
+	Tags []string `json:"tags,omitempty"`
+}
+
+type GlobalAcceleratorConfig struct {
+	Enabled    bool   `json:"enabled"`
+	DetachMode string `json:"detachMode,omitempty"`
+}
+
+type Route53Config struct {
+	HostedZoneIDs []string `json:"hostedZoneIDs,omitempty"`
+
+	// HostedZoneTags is the list of `KEY=VALUE`
+	HostedZoneTags []string `json:"hostedZoneTags,omitempty"`
+}
+
+type ConsulConfig struct {
+	Addr string `json:"addr,omitempty"`
+
+	// Token is the Consul ACL token. Prefer the CONSUL_HTTP_TOKEN envvar over writing it in the file
+	Token string `json:"token,omitempty"`
+
+	Mode string `json:"mode,omitempty"`
+}
+
+type XDSConfig struct {
+	Addr string `json:"addr,omitempty"`
+
+	// Clusters is the list of `NAME=PORT`
+	Clusters []string `json:"clusters,omitempty"`
+}
+
+type KarpenterConfig struct {
+	// Enabled is reloadable
+	Enabled bool `json:"enabled"`
+}
+
+// NodeConditionsConfig is reloadable
+type NodeConditionsConfig struct {
+	// Rules is the list of `TYPE=STATUS[:DURATION]`
+	Rules []string `json:"rules,omitempty"`
+
+	WithoutCordon bool `json:"withoutCordon,omitempty"`
+}
+
+type DaemonSetsConfig struct {
+	// Names, Selector, and AnnotationSelector select target daemonsets. Reloadable.
+	Names              []string `json:"names,omitempty"`
+	Selector           string   `json:"selector,omitempty"`
+	AnnotationSelector string   `json:"annotationSelector,omitempty"`
+
+	Manage     bool `json:"manage,omitempty"`
+	ManagePods bool `json:"managePods,omitempty"`
+}
+
+type WorkloadsConfig struct {
+	Manage      bool   `json:"manage,omitempty"`
+	PodSelector string `json:"podSelector,omitempty"`
+}
+
+type PodWebhookConfig struct {
+	Enabled        bool            `json:"enabled,omitempty"`
+	Selector       string          `json:"selector,omitempty"`
+	PreStopAddr    string          `json:"preStopAddr,omitempty"`
+	PreStopHost    string          `json:"preStopHost,omitempty"`
+	PreStopTimeout metav1.Duration `json:"preStopTimeout,omitempty"`
+}
+
+// RolloutConfig is reloadable
+type RolloutConfig struct {
+	MaxUnavailable               string          `json:"maxUnavailable,omitempty"`
+	MaxUnavailablePerZone        string          `json:"maxUnavailablePerZone,omitempty"`
+	MaxUnavailablePerTargetGroup string          `json:"maxUnavailablePerTargetGroup,omitempty"`
+	PodReadyTimeout              metav1.Duration `json:"podReadyTimeout,omitempty"`
+}
+
+// ReattachConfig is reloadable
+type ReattachConfig struct {
+	Warmup         metav1.Duration `json:"warmup,omitempty"`
+	HealthTimeout  metav1.Duration `json:"healthTimeout,omitempty"`
+	StageSize      int             `json:"stageSize,omitempty"`
+	SlowStart      metav1.Duration `json:"slowStart,omitempty"`
+	RollbackWindow metav1.Duration `json:"rollbackWindow,omitempty"`
+}
+
+type ConcurrencyConfig struct {
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles,omitempty"`
+
+	// DeregistrationBatchWindow, DeregistrationBatchMaxSize, RequeueBaseDelay, and RequeueMaxDelay are reloadable
+	DeregistrationBatchWindow  metav1.Duration `json:"deregistrationBatchWindow,omitempty"`
+	DeregistrationBatchMaxSize int             `json:"deregistrationBatchMaxSize,omitempty"`
+	RequeueBaseDelay           metav1.Duration `json:"requeueBaseDelay,omitempty"`
+	RequeueMaxDelay            metav1.Duration `json:"requeueMaxDelay,omitempty"`
+}
+
+// DefaultConfig returns the configuration used when neither the file nor flags specify otherwise
+func DefaultConfig() *Config {
+	return &Config{
+		APIVersion:  ConfigAPIVersion,
+		Kind:        ConfigKind,
+		Name:        "node-detacher",
+		SyncPeriod:  metav1.Duration{Duration: 10 * time.Second},
+		MetricsAddr: ":8080",
+		LogLevel:    "info",
+		AWS: AWSConfig{
+			Enabled:            true,
+			ALBIngress:         AWSIntegrationConfig{Discovery: string(AWSDiscoveryDetach), Source: string(AWSSourceKubernetes)},
+			DynamicCLBs:        AWSIntegrationConfig{Discovery: string(AWSDiscoveryDetach), Source: string(AWSSourceKubernetes)},
+			DynamicNLBs:        AWSIntegrationConfig{Discovery: string(AWSDiscoveryDetach), Source: string(AWSSourceKubernetes)},
+			StaticCLBs:         AWSIntegrationConfig{Enabled: true, Discovery: string(AWSDiscoveryNodeCreation), Source: string(AWSSourceAWS)},
+			StaticTargetGroups: AWSIntegrationConfig{Enabled: true, Discovery: string(AWSDiscoveryNodeCreation), Source: string(AWSSourceAWS)},
+			APIQPS:             DefaultAWSAPIQPS,
+			APIBurst:           DefaultAWSAPIBurst,
+			APIMaxRetries:      DefaultAWSAPIMaxRetries,
+			ControllerTimeout:  metav1.Duration{Duration: DefaultAWSControllerTimeout},
+		},
+		GlobalAccelerator: GlobalAcceleratorConfig{
+			DetachMode: GlobalAcceleratorDetachModeWeight,
+		},
+		Consul: ConsulConfig{
+			Token: os.Getenv("CONSUL_HTTP_TOKEN"),
+			Mode:  ConsulModeMaintenance,
+		},
+		PodWebhook: PodWebhookConfig{
+			PreStopTimeout: metav1.Duration{Duration: 5 * time.Minute},
+		},
+		Rollout: RolloutConfig{
+			MaxUnavailable:  "1",
+			PodReadyTimeout: metav1.Duration{Duration: 5 * time.Minute},
+		},
+		Reattach: ReattachConfig{
+			HealthTimeout: metav1.Duration{Duration: 5 * time.Minute},
+		},
+		Concurrency: ConcurrencyConfig{
+			MaxConcurrentReconciles:    1,
+			DeregistrationBatchMaxSize: DefaultDeregistrationBatchMaxSize,
+			RequeueBaseDelay:           metav1.Duration{Duration: DefaultRequeueBaseDelay},
+			RequeueMaxDelay:            metav1.Duration{Duration: DefaultRequeueMaxDelay},
+		},
+	}
+}
+
+// BindFlags defines command-line flags in the flag set, each of which sets the field of the config
+func (c *Config) BindFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.SyncPeriod.Duration, "sync-period", c.SyncPeriod.Duration, "The period in seconds between each forceful iteration over all the nodes")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "The address the metric endpoint binds to.")
+	fs.BoolVar(&c.AWS.Enabled, "enable-aws", c.AWS.Enabled,
+		"Enable AWS support including ELB v1, ELB v2(target group) integrations. Also specify enable-(static|dynamic)(alb|clb|nlb)-integration flags for detailed configuration")
+	fs.Var((*StringSlice)(&c.AWS.Accounts), "aws-account", "Specifies the AWS account and region, other than node-detacher's own, whose load balancers nodes are registered to. The role is assumed to call AWS APIs in the account. Omit role-arn for another region of node-detacher's own account. This flag can be specified multiple times.\nExample: --aws-account role-arn=arn:aws:iam::123456789012:role/node-detacher,external-id=mycluster,region=us-west-2 (`role-arn=ARN[,external-id=ID][,region=REGION]`)")
+	fs.Float64Var(&c.AWS.APIQPS, "aws-api-qps", c.AWS.APIQPS, "The number of calls per second node-detacher makes to each ELB and ELB v2 API, like DeregisterTargets")
+	fs.IntVar(&c.AWS.APIBurst, "aws-api-burst", c.AWS.APIBurst, "The maximum number of calls node-detacher makes to each ELB and ELB v2 API at once")
+	fs.DurationVar(&c.AWS.ControllerTimeout.Duration, "aws-controller-timeout", c.AWS.ControllerTimeout.Duration, "How long node-detacher waits for aws-load-balancer-controller and aws-alb-ingress-controller to de-register and register nodes once it labels and unlabels them, before doing it on its own. Zero de-registers and registers nodes immediately")
+	fs.BoolVar(&c.AWS.SkipTargetsWithoutLocalEndpoints, "aws-skip-targets-without-local-endpoints", c.AWS.SkipTargetsWithoutLocalEndpoints, "Skip de-registering nodes from target groups and CLBs whose services are all externalTrafficPolicy=Local services without ready endpoints on the node, as load balancers never send them traffic")
+	fs.IntVar(&c.AWS.APIMaxRetries, "aws-api-max-retries", c.AWS.APIMaxRetries, "The maximum number of retries of throttled ELB and ELB v2 API calls, and calls failed due to server-side errors. Retries are made with jittered exponential backoff")
+	fs.BoolVar(&c.LeaderElection, "enable-leader-election", c.LeaderElection,
+		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
+	fs.BoolVar(&c.AWS.ALBIngress.Enabled, "enable-alb-ingress-integration", c.AWS.ALBIngress.Enabled,
+		"Enable aws-alb-ingress-controller integration\nPossible values are `[true|false]`",
+	)
+	fs.BoolVar(&c.AWS.DynamicCLBs.Enabled, "enable-dynamic-clb-integration", c.AWS.DynamicCLBs.Enabled,
+		"Enable integration with classical load balancers (a.k.a ELB v1) managed by \"type: LoadBalancer\" services\nPossible values are `[true|false]`",
+	)
+	fs.BoolVar(&c.AWS.DynamicNLBs.Enabled, "enable-dynamic-nlb-integration", c.AWS.DynamicNLBs.Enabled,
+		"Enable integration with network load balancers (a.k.a ELB v2 NLB) managed by \"type: LoadBalancer\" services\nPossible values are `[true|false]`",
+	)
+	fs.BoolVar(&c.AWS.StaticCLBs.Enabled, "enable-static-clb-integration", c.AWS.StaticCLBs.Enabled,
+		"Enable integration with classical load balancers (a.k.a ELB v1) managed externally to Kubernetes, e.g. by Terraform or CloudFormation\nPossible values are `[true|false]`",
+	)
+	fs.BoolVar(&c.AWS.StaticTargetGroups.Enabled, "enable-static-tg-integration", c.AWS.StaticTargetGroups.Enabled,
+		"Enable integration with application load balancers and network load balancers (a.k.a ELB v2 ALBs and NLBs) managed externally to Kubernetes, e.g. by Terraform or CloudFormation.\nPossible values are `[true|false]`")
+	c.AWS.ALBIngress.bindFlags(fs, "alb-ingress", "aws-alb-ingress-controller")
+	c.AWS.DynamicCLBs.bindFlags(fs, "dynamic-clb", "dynamic CLB")
+	c.AWS.DynamicNLBs.bindFlags(fs, "dynamic-nlb", "dynamic NLB")
+	c.AWS.StaticCLBs.bindFlags(fs, "static-clb", "static CLB")
+	c.AWS.StaticTargetGroups.bindFlags(fs, "static-tg", "static target group")
+	fs.Var((*StringSlice)(&c.DaemonSets.Names), "daemonset", "Specifies target daemonsets to be processed by node-detacher. Used only when either -manage-daemonsets or -manage-daemonset-pods is enabled. This flag can be specified multiple times to target two or more daemonsets.\nExample: --daemonset contour --daemonset anotherns/nginx-ingress --daemonset ingress/* (`[NAMESPACE/]NAME|NAMESPACE/*`)")
+	fs.StringVar(&c.DaemonSets.Selector, "daemonset-selector", c.DaemonSets.Selector, "The label selector of target daemonsets in any namespace, like `app.kubernetes.io/part-of=ingress`")
+	fs.StringVar(&c.DaemonSets.AnnotationSelector, "daemonset-annotation-selector", c.DaemonSets.AnnotationSelector, "The selector of target daemonsets in any namespace by annotations rather than labels, like `example.com/ingress=true`")
+	fs.BoolVar(&c.DaemonSets.ManagePods, "manage-daemonset-pods", c.DaemonSets.ManagePods,
+		"Detaches the node when one of the daemonset pods on the pod started terminating. Also specify `--daemonsets` or annotate daemonsets with node-detaher.variant.run/managed-by=NAME")
+	fs.BoolVar(&c.Workloads.Manage, "manage-workload-pods", c.Workloads.Manage,
+		"Detaches the node when one of the pods of deployments and statefulsets on the node started terminating, and re-attaches it once the replacement pod became ready. Intended for hostNetwork pods pinned per node. Also specify --workload-pod-selector or annotate deployments and statefulsets with node-detacher.variant.run/managed-by=NAME")
+	fs.StringVar(&c.Workloads.PodSelector, "workload-pod-selector", c.Workloads.PodSelector, "The label selector of deployment and statefulset pods managed via -manage-workload-pods, like `app=envoy`")
+	fs.BoolVar(&c.DaemonSets.Manage, "manage-daemonsets", c.DaemonSets.Manage,
+		"Rolls the targeted daemonset with RollingUpdate.Policy set to OnDelete when it became OUTDATED, by detaching nodes, replacing pods, and re-attaching nodes in batches limited by -rollout-max-unavailable(-per-zone|-per-target-group). Also specify --daemonsets to limit the daemonsets which triggers rolls, or annotate daemonsets with node-detacher.variant.run/managed-by=NAME")
+	fs.StringVar(&c.Name, "name", c.Name, "NAME of this node-detacher, used to distinguish one of node-detacher instances and specified in the annotation node-detacher.variant.run/managed-by")
+	fs.StringVar(&c.Namespace, "namespace", c.Namespace, "NAMESPACE to watch resources for")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Log level. Must be one of debug, info, warn, error")
+	fs.StringVar(&c.XDS.Addr, "xds-addr", c.XDS.Addr, "The address the xDS(REST-JSON EDS) server binds to, like `:18000`. The xDS server is disabled when empty")
+	fs.Var((*StringSlice)(&c.XDS.Clusters), "xds-cluster", "Specifies the Envoy cluster whose endpoints are nodes listening on the node port. Used only when -xds-addr is set. This flag can be specified multiple times.\nExample: --xds-cluster ingress=30080 (`NAME=PORT`)")
+	fs.StringVar(&c.Consul.Addr, "consul-addr", c.Consul.Addr, "The URL of the Consul HTTP API, like `http://consul.service.consul:8500`. Enables detaching service instances registered in Consul with the node's address when set")
+	fs.StringVar(&c.Consul.Token, "consul-token", c.Consul.Token, "The Consul ACL token. Defaults to the value of CONSUL_HTTP_TOKEN envvar")
+	fs.StringVar(&c.Consul.Mode, "consul-mode", c.Consul.Mode, "How service instances are detached from Consul. maintenance puts them into the maintenance mode via the Consul agent on the node, and deregister deregisters them from the catalog.\nPossible values are `[maintenance|deregister]`")
+	fs.Var((*StringSlice)(&c.Route53.HostedZoneIDs), "route53-hosted-zone-id", "Enables detaching the node's IP from Route 53 weighted and multivalue answer record sets in the hosted zone. This flag can be specified multiple times.\nExample: --route53-hosted-zone-id Z1D633PJN98FT9 (`ID`)")
+	fs.Var((*StringSlice)(&c.Route53.HostedZoneTags), "route53-hosted-zone-tag", "Enables detaching the node's IP from Route 53 weighted and multivalue answer record sets in hosted zones tagged with all the specified tags. This flag can be specified multiple times.\nExample: --route53-hosted-zone-tag team=edge (`KEY=VALUE`)")
+	fs.BoolVar(&c.GlobalAccelerator.Enabled, "enable-global-accelerator-integration", c.GlobalAccelerator.Enabled,
+		"Enable integration with AWS Global Accelerator endpoint groups that contain the node's EC2 instance as an endpoint\nPossible values are `[true|false]`",
+	)
+	fs.StringVar(&c.GlobalAccelerator.DetachMode, "global-accelerator-detach-mode", c.GlobalAccelerator.DetachMode, "How the node's EC2 instance is detached from Global Accelerator endpoint groups. weight sets the endpoint weight to 0, and remove removes the endpoint from the group.\nPossible values are `[weight|remove]`")
+	fs.Var((*StringSlice)(&c.NodeConditions.Rules), "detach-on-node-condition", "Detaches the node when the node condition has been in the status for the duration, like ones set by node-problem-detector. This flag can be specified multiple times.\nExample: --detach-on-node-condition KernelDeadlock=True:5m --detach-on-node-condition ReadonlyFilesystem=True (`TYPE=STATUS[:DURATION]`)")
+	fs.BoolVar(&c.NodeConditions.WithoutCordon, "detach-on-node-condition-without-cordon", c.NodeConditions.WithoutCordon,
+		"Only detaches the node from load balancers on node conditions specified via -detach-on-node-condition, without tainting the node nor deleting pods on it. The node is re-attached once the condition clears")
+	fs.BoolVar(&c.Karpenter.Enabled, "enable-karpenter-integration", c.Karpenter.Enabled,
+		"Detaches nodes being disrupted by Karpenter, i.e. tainted with karpenter.sh/disrupted, or karpenter.sh/disruption before v1, or whose NodeClaim is being deleted, and keeps their node objects with a finalizer until they are detached and drained\nPossible values are `[true|false]`",
+	)
+	fs.DurationVar(&c.Reattach.Warmup.Duration, "reattach-warmup", c.Reattach.Warmup.Duration, "How long to wait after the node became Ready before re-attaching it to load balancers")
+	fs.DurationVar(&c.Reattach.HealthTimeout.Duration, "reattach-health-timeout", c.Reattach.HealthTimeout.Duration, "How long to wait for re-attached targets to become healthy before marking the node as attached and removing the detaching taint anyway. 0 means waiting forever")
+	fs.IntVar(&c.Reattach.StageSize, "reattach-stage-size", c.Reattach.StageSize, "The maximum number of target groups and CLBs the node is registered to at once on re-attachment. The next stage starts after the targets of the previous stage become healthy. 0 means registering to all at once")
+	fs.DurationVar(&c.Reattach.SlowStart.Duration, "reattach-slow-start", c.Reattach.SlowStart.Duration, "Enables the slow start mode with the duration on target groups without slow start on re-attachment, so that re-attached targets receive gradually increasing share of traffic")
+	fs.DurationVar(&c.Reattach.RollbackWindow.Duration, "reattach-rollback-window", c.Reattach.RollbackWindow.Duration, "Detaches the node again when any of the re-attached targets becomes unhealthy within the window after re-attachment. 0 disables rollbacks")
+	fs.IntVar(&c.Concurrency.MaxConcurrentReconciles, "max-concurrent-reconciles", c.Concurrency.MaxConcurrentReconciles, "The maximum number of nodes reconciled at once. Increase along with -deregistration-batch-window to detach many nodes at once faster")
+	fs.DurationVar(&c.Concurrency.DeregistrationBatchWindow.Duration, "deregistration-batch-window", c.Concurrency.DeregistrationBatchWindow.Duration, "How long to wait for other nodes being detached concurrently before de-registering the node from a target group or CLB, so that de-registrations are coalesced into one API call. 0 disables batching")
+	fs.IntVar(&c.Concurrency.DeregistrationBatchMaxSize, "deregistration-batch-max-size", c.Concurrency.DeregistrationBatchMaxSize, "The maximum number of targets or instances de-registered in one API call")
+	fs.DurationVar(&c.Concurrency.RequeueBaseDelay.Duration, "requeue-base-delay", c.Concurrency.RequeueBaseDelay.Duration, "How long to wait before retrying the node failed to be reconciled. The delay doubles on each consecutive failure of the node")
+	fs.DurationVar(&c.Concurrency.RequeueMaxDelay.Duration, "requeue-max-delay", c.Concurrency.RequeueMaxDelay.Duration, "The maximum delay before retrying the node failed to be reconciled")
+	fs.StringVar(&c.Rollout.MaxUnavailable, "rollout-max-unavailable", c.Rollout.MaxUnavailable, "The default maximum number or percentage of nodes detached at once for rolling daemonsets managed via -manage-daemonsets, like `25%`")
+	fs.StringVar(&c.Rollout.MaxUnavailablePerZone, "rollout-max-unavailable-per-zone", c.Rollout.MaxUnavailablePerZone, "The default maximum number or percentage of nodes in each zone detached at once for rolling daemonsets, like `1`. Unlimited when empty")
+	fs.StringVar(&c.Rollout.MaxUnavailablePerTargetGroup, "rollout-max-unavailable-per-target-group", c.Rollout.MaxUnavailablePerTargetGroup, "The default maximum number or percentage of nodes in each target group detached at once for rolling daemonsets, like `10%`. Unlimited when empty")
+	fs.DurationVar(&c.Rollout.PodReadyTimeout.Duration, "rollout-pod-ready-timeout", c.Rollout.PodReadyTimeout.Duration, "The default of how long to wait for the replacement daemonset pod to become ready before pausing the rollout. 0 means waiting forever")
+	fs.BoolVar(&c.PodWebhook.Enabled, "enable-pod-webhook", c.PodWebhook.Enabled,
+		"Enables the mutating webhook that injects the node-attached readiness gate and the preStop hook blocking until the node is drained into pods selected by -pod-webhook-selector or annotated with node-detacher.variant.run/inject=true. Requires -prestop-addr and -prestop-host")
+	fs.StringVar(&c.PodWebhook.Selector, "pod-webhook-selector", c.PodWebhook.Selector, "The label selector of pods injected by the pod webhook, like `app=contour`")
+	fs.StringVar(&c.PodWebhook.PreStopAddr, "prestop-addr", c.PodWebhook.PreStopAddr, "The address the preStop server for pods injected by the pod webhook binds to, like `:8082`. The preStop server is disabled when empty")
+	fs.StringVar(&c.PodWebhook.PreStopHost, "prestop-host", c.PodWebhook.PreStopHost, "The host kubelet calls the preStop server at, like the cluster IP of the node-detacher service `10.100.0.82`")
+	fs.DurationVar(&c.PodWebhook.PreStopTimeout.Duration, "prestop-timeout", c.PodWebhook.PreStopTimeout.Duration, "The maximum duration the preStop hook blocks waiting for the node to be drained")
+	fs.StringVar(&c.DebugAddr, "debug-addr", c.DebugAddr, "The address the debug endpoint binds to, like `:8081`. The effective configuration is served at /debug/config. Disabled when empty")
+}
+
+// bindFlags defines flags for the discovery timing, the source, and the scope of the integration, like
+// -static-tg-discovery, -static-tg-source and -static-tg-tag
+func (c *AWSIntegrationConfig) bindFlags(fs *flag.FlagSet, prefix, name string) {
+	fs.StringVar(&c.Discovery, prefix+"-discovery", c.Discovery, fmt.Sprintf("When load balancers handled by the %s integration are discovered, either on node creation or on detach.\nPossible values are `[NodeCreation|Detach]`", name))
+	fs.StringVar(&c.Source, prefix+"-source", c.Source, fmt.Sprintf("Where load balancers handled by the %s integration are discovered from. AWS scans all the load balancers, and Kubernetes queries only ones referenced by services, ingresses and TargetGroupBindings.\nPossible values are `[AWS|Kubernetes]`", name))
+	fs.Var((*StringSlice)(&c.Tags), prefix+"-tag", fmt.Sprintf("Limits the %s integration to load balancers tagged with all the specified tags. This flag can be specified multiple times.\nExample: --%s-tag team=edge (`KEY=VALUE`)", name, prefix))
+}
+
+// LoadConfig loads the configuration from the YAML file, and then overrides it with flags explicitly specified in
+// the flag set. The defaults are used for fields specified in neither of them.
+func LoadConfig(path string, flags *flag.FlagSet) (*Config, error) {
+	c := DefaultConfig()
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read config %q: %w", path, err)
+		}
+
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("Unable to parse config %q: %w", path, err)
+		}
+	}
+
+	if flags != nil {
+		if err := c.override(flags); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config %q: %w", path, err)
+	}
+
+	return c, nil
+}
+
+// override sets fields of the config bound to flags explicitly specified in the flag set
+func (c *Config) override(flags *flag.FlagSet) error {
+	overrides := flag.NewFlagSet("overrides", flag.ContinueOnError)
+
+	c.BindFlags(overrides)
+
+	var err error
+
+	flags.Visit(func(f *flag.Flag) {
+		o := overrides.Lookup(f.Name)
+		if o == nil || err != nil {
+			// Not a config flag, like -config and -kubeconfig
+			return
+		}
+
+		// The flag specified multiple times replaces the list in the file, rather than appending to it
+		if ss, ok := f.Value.(*StringSlice); ok {
+			*o.Value.(*StringSlice) = append(StringSlice{}, *ss...)
+
+			return
+		}
+
+		if setErr := o.Value.Set(f.Value.String()); setErr != nil {
+			err = fmt.Errorf("Unable to override config with flag -%s: %w", f.Name, setErr)
+		}
+	})
+
+	return err
+}
+
+// Validate returns an error when any of the fields is invalid
+func (c *Config) Validate() error {
+	if c.APIVersion != ConfigAPIVersion {
+		return fmt.Errorf("unsupported apiVersion %q: it must be %s", c.APIVersion, ConfigAPIVersion)
+	}
+
+	if c.Kind != ConfigKind {
+		return fmt.Errorf("unsupported kind %q: it must be %s", c.Kind, ConfigKind)
+	}
+
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error", "dpanic", "panic", "fatal":
+	default:
+		return fmt.Errorf("unknown log level %q: it must be one of debug, info, warn, error", c.LogLevel)
+	}
+
+	if _, err := ParseAWSAccounts(c.AWS.Accounts); err != nil {
+		return err
+	}
+
+	if _, err := c.awsIntegrations(); err != nil {
+		return err
+	}
+
+	if c.AWS.APIQPS <= 0 {
+		return fmt.Errorf("invalid aws.apiQPS %v: it must be positive", c.AWS.APIQPS)
+	}
+
+	if c.AWS.APIBurst <= 0 {
+		return fmt.Errorf("invalid aws.apiBurst %d: it must be positive", c.AWS.APIBurst)
+	}
+
+	if _, err := c.route53HostedZoneTags(); err != nil {
+		return err
+	}
+
+	if c.Consul.Addr != "" {
+		if err := c.consulClient().validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.GlobalAccelerator.Enabled {
+		if err := (&GlobalAcceleratorIntegration{DetachMode: c.GlobalAccelerator.DetachMode}).validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.XDS.Addr != "" {
+		if _, err := ParseXDSClusters(c.XDS.Clusters); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.nodeConditionRules(); err != nil {
+		return err
+	}
+
+	if _, err := c.daemonSetTargets(""); err != nil {
+		return err
+	}
+
+	if c.Workloads.PodSelector != "" {
+		if _, err := labels.Parse(c.Workloads.PodSelector); err != nil {
+			return fmt.Errorf("invalid workload pod selector %q: %w", c.Workloads.PodSelector, err)
+		}
+	}
+
+	if c.PodWebhook.Enabled {
+		if c.PodWebhook.PreStopAddr == "" || c.PodWebhook.PreStopHost == "" {
+			return fmt.Errorf("-prestop-addr and -prestop-host are required by the pod webhook")
+		}
+
+		if c.PodWebhook.Selector != "" {
+			if _, err := labels.Parse(c.PodWebhook.Selector); err != nil {
+				return fmt.Errorf("invalid pod webhook selector %q: %w", c.PodWebhook.Selector, err)
+			}
+		}
+	}
+
+	if _, _, _, err := c.rolloutMaxUnavailable(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// awsIntegrations returns enabled integrations with AWS load balancers
+func (c *Config) awsIntegrations() ([]AWSIntegration, error) {
+	var integrations []AWSIntegration
+
+	for _, i := range []struct {
+		kind   AWSIntegrationKind
+		config AWSIntegrationConfig
+	}{
+		{AWSIntegrationStaticTargetGroups, c.AWS.StaticTargetGroups},
+		{AWSIntegrationStaticCLBs, c.AWS.StaticCLBs},
+		{AWSIntegrationALBIngress, c.AWS.ALBIngress},
+		{AWSIntegrationDynamicNLBs, c.AWS.DynamicNLBs},
+		{AWSIntegrationDynamicCLBs, c.AWS.DynamicCLBs},
+	} {
+		discovery, err := ParseAWSDiscovery(i.config.Discovery)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s integration: %w", i.kind, err)
+		}
+
+		source, err := ParseAWSSource(i.config.Source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s integration: %w", i.kind, err)
+		}
+
+		if source == AWSSourceKubernetes && (i.kind == AWSIntegrationStaticTargetGroups || i.kind == AWSIntegrationStaticCLBs) {
+			return nil, fmt.Errorf("invalid %s integration: static load balancers are unknown to Kubernetes and must be discovered from %s", i.kind, AWSSourceAWS)
+		}
+
+		tags, err := ParseAWSIntegrationTags(i.config.Tags)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s integration: %w", i.kind, err)
+		}
+
+		if i.config.Enabled {
+			integrations = append(integrations, AWSIntegration{Kind: i.kind, Discovery: discovery, Source: source, Tags: tags})
+		}
+	}
+
+	return integrations, nil
+}
+
+func (c *Config) route53HostedZoneTags() (map[string]string, error) {
+	tags := map[string]string{}
+
+	for _, kv := range c.Route53.HostedZoneTags {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid hosted zone tag %q: it must be in the form of KEY=VALUE", kv)
+		}
+
+		tags[pair[0]] = pair[1]
+	}
+
+	return tags, nil
+}
+
+func (c *Config) consulClient() *ConsulClient {
+	return &ConsulClient{
+		Address: c.Consul.Addr,
+		Token:   c.Consul.Token,
+		Mode:    c.Consul.Mode,
+	}
+}
+
+func (c *Config) nodeConditionRules() ([]v1alpha1.NodeConditionRule, error) {
+	return ParseNodeConditionRules(c.NodeConditions.Rules, c.NodeConditions.WithoutCordon)
+}
+
+func (c *Config) daemonSetTargets(defaultNamespace string) (*DaemonSetTargets, error) {
+	return ParseDaemonSetTargets(c.Name, defaultNamespace, c.DaemonSets.Names, c.DaemonSets.Selector, c.DaemonSets.AnnotationSelector)
+}
+
+func (c *Config) rolloutMaxUnavailable() (maxUnavailable, perZone, perTargetGroup *intstr.IntOrString, err error) {
+	if maxUnavailable, err = ParseMaxUnavailable(c.Rollout.MaxUnavailable); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid rollout max unavailable: %w", err)
+	}
+
+	if perZone, err = ParseMaxUnavailable(c.Rollout.MaxUnavailablePerZone); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid rollout max unavailable per zone: %w", err)
+	}
+
+	if perTargetGroup, err = ParseMaxUnavailable(c.Rollout.MaxUnavailablePerTargetGroup); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid rollout max unavailable per target group: %w", err)
+	}
+
+	return maxUnavailable, perZone, perTargetGroup, nil
+}
+
+// withoutReloadable returns the copy of the config whose reloadable fields are cleared
+func (c Config) withoutReloadable() Config {
+	c.AWS.ALBIngress, c.AWS.DynamicCLBs, c.AWS.DynamicNLBs = AWSIntegrationConfig{}, AWSIntegrationConfig{}, AWSIntegrationConfig{}
+	c.AWS.StaticCLBs, c.AWS.StaticTargetGroups = AWSIntegrationConfig{}, AWSIntegrationConfig{}
+	c.AWS.ControllerTimeout = metav1.Duration{}
+	c.AWS.SkipTargetsWithoutLocalEndpoints = false
+	c.Karpenter = KarpenterConfig{}
+	c.NodeConditions = NodeConditionsConfig{}
+	c.DaemonSets.Names, c.DaemonSets.Selector, c.DaemonSets.AnnotationSelector = nil, "", ""
+	c.Rollout = RolloutConfig{}
+	c.Reattach = ReattachConfig{}
+	c.Concurrency = ConcurrencyConfig{MaxConcurrentReconciles: c.Concurrency.MaxConcurrentReconciles}
+
+	return c
+}
+
+// RequiresRestart returns true when the change from the config to the other requires restarting node-detacher
+func (c *Config) RequiresRestart(other *Config) bool {
+	return !reflect.DeepEqual(c.withoutReloadable(), other.withoutReloadable())
+}
+
+// Redacted returns the copy of the config without secrets, suitable for logging and serving
+func (c Config) Redacted() Config {
+	if c.Consul.Token != "" {
+		c.Consul.Token = "REDACTED"
+	}
+
+	return c
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		dir, err = ioutil.TempDir("", "node-detacher-config")
+		Expect(err).NotTo(HaveOccurred())
+
+		path = filepath.Join(dir, "config.yaml")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	write := func(content string) {
+		Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+	}
+
+	flags := func(args ...string) *flag.FlagSet {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		DefaultConfig().BindFlags(fs)
+		Expect(fs.Parse(args)).To(Succeed())
+
+		return fs
+	}
+
+	It("loads the file over defaults, and explicitly specified flags over the file", func() {
+		write(`apiVersion: node-detacher.variant.run/v1alpha1
+kind: Config
+syncPeriod: 30s
+aws:
+  enabled: true
+  staticCLBs:
+    enabled: false
+  dynamicNLBs:
+    enabled: true
+    discovery: NodeCreation
+    tags:
+    - team=edge
+  accounts:
+  - region=us-west-2
+daemonSets:
+  names:
+  - ingress/contour
+concurrency:
+  maxConcurrentReconciles: 5
+`)
+
+		c, err := LoadConfig(path, flags("-max-concurrent-reconciles", "10", "-daemonset", "edge/envoy"))
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(c.SyncPeriod.Duration).To(Equal(30 * time.Second))
+		Expect(c.AWS.StaticCLBs.Enabled).To(BeFalse())
+		Expect(c.AWS.StaticTargetGroups.Enabled).To(BeTrue())
+		Expect(c.AWS.StaticCLBs.Discovery).To(Equal("NodeCreation"))
+		Expect(c.AWS.Accounts).To(Equal([]string{"region=us-west-2"}))
+		Expect(c.MetricsAddr).To(Equal(":8080"))
+		Expect(c.Concurrency.MaxConcurrentReconciles).To(Equal(10))
+		Expect(c.DaemonSets.Names).To(Equal([]string{"edge/envoy"}))
+
+		integrations, err := c.awsIntegrations()
+		Expect(err).NotTo(HaveOccurred())
+		// Dynamic integrations other than the enabled one are disabled by default
+		Expect(integrations).To(HaveLen(2))
+		Expect(integrations).To(ContainElement(AWSIntegration{Kind: AWSIntegrationDynamicNLBs, Discovery: AWSDiscoveryNodeCreation, Source: AWSSourceKubernetes, Tags: map[string]string{"team": "edge"}}))
+	})
+
+	It("rejects unknown fields, unsupported versions, and invalid values", func() {
+		for _, content := range []string{
+			"apiVersion: node-detacher.variant.run/v1alpha1\nkind: Config\nsyncPeriodd: 30s\n",
+			"apiVersion: node-detacher.variant.run/v2\nkind: Config\n",
+			"apiVersion: node-detacher.variant.run/v1alpha1\nkind: Config\nlogLevel: verbose\n",
+			"apiVersion: node-detacher.variant.run/v1alpha1\nkind: Config\nrollout:\n  maxUnavailable: abc\n",
+			"apiVersion: node-detacher.variant.run/v1alpha1\nkind: Config\nnodeConditions:\n  rules:\n  - KernelDeadlock\n",
+			"apiVersion: node-detacher.variant.run/v1alpha1\nkind: Config\naws:\n  albIngress:\n    discovery: OnDelete\n",
+			"apiVersion: node-detacher.variant.run/v1alpha1\nkind: Config\naws:\n  apiQPS: 0\n",
+			"apiVersion: node-detacher.variant.run/v1alpha1\nkind: Config\naws:\n  apiQPS: -1\n",
+			"apiVersion: node-detacher.variant.run/v1alpha1\nkind: Config\naws:\n  apiBurst: 0\n",
+		} {
+			write(content)
+
+			_, err := LoadConfig(path, nil)
+			Expect(err).To(HaveOccurred(), content)
+		}
+	})
+
+	It("tells changes to non-reloadable fields", func() {
+		c := DefaultConfig()
+
+		reloadable := DefaultConfig()
+		reloadable.AWS.StaticCLBs.Enabled = false
+		reloadable.AWS.ControllerTimeout.Duration = 2 * time.Minute
+		reloadable.AWS.SkipTargetsWithoutLocalEndpoints = true
+		reloadable.Reattach.SlowStart.Duration = time.Minute
+		reloadable.Concurrency.DeregistrationBatchWindow.Duration = 2 * time.Second
+		Expect(c.RequiresRestart(reloadable)).To(BeFalse())
+
+		restart := DefaultConfig()
+		restart.Concurrency.MaxConcurrentReconciles = 10
+		Expect(c.RequiresRestart(restart)).To(BeTrue())
+	})
+
+	It("applies reloaded configs, keeps the last valid one, and serves the effective one", func() {
+		write("apiVersion: node-detacher.variant.run/v1alpha1\nkind: Config\nconsul:\n  addr: http://localhost:8500\n  token: secret\n")
+
+		c, err := LoadConfig(path, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		var applied []*Config
+
+		w := &ConfigWatcher{
+			Path: path,
+			Log:  ctrl.Log.WithName("config"),
+			Appliers: []func(*Config) error{
+				func(c *Config) error {
+					applied = append(applied, c)
+
+					return nil
+				},
+			},
+		}
+
+		w.Init(c)
+
+		w.reload()
+		Expect(applied).To(BeEmpty())
+
+		write("apiVersion: node-detacher.variant.run/v1alpha1\nkind: Config\nconsul:\n  addr: http://localhost:8500\n  token: secret\nreattach:\n  slowStart: 1m\n")
+		w.reload()
+		Expect(applied).To(HaveLen(1))
+		Expect(applied[0].Reattach.SlowStart.Duration).To(Equal(time.Minute))
+
+		write("apiVersion: node-detacher.variant.run/v1alpha1\nkind: Config\nreattach:\n  slowStart: one minute\n")
+		w.reload()
+		Expect(applied).To(HaveLen(1))
+
+		rec := httptest.NewRecorder()
+		w.ServeHTTP(rec, httptest.NewRequest("GET", ConfigDebugPath, nil))
+
+		var status ConfigStatus
+		Expect(json.Unmarshal(rec.Body.Bytes(), &status)).To(Succeed())
+		Expect(status.LastError).NotTo(BeEmpty())
+		Expect(status.RestartRequired).To(BeFalse())
+		Expect(status.Config.Reattach.SlowStart.Duration).To(Equal(time.Minute))
+		Expect(status.Config.Consul.Token).To(Equal("REDACTED"))
+	})
+
+	It("reloads the config changed before starting on every replica", func() {
+		write("apiVersion: node-detacher.variant.run/v1alpha1\nkind: Config\n")
+
+		c, err := LoadConfig(path, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		w := &ConfigWatcher{Path: path, Log: ctrl.Log.WithName("config")}
+
+		w.Init(c)
+
+		var runnable manager.Runnable = w
+
+		le, ok := runnable.(manager.LeaderElectionRunnable)
+		Expect(ok).To(BeTrue())
+		Expect(le.NeedLeaderElection()).To(BeFalse())
+
+		// Changed while waiting for caches to sync, or for the leadership before
+		write("apiVersion: node-detacher.variant.run/v1alpha1\nkind: Config\nreattach:\n  slowStart: 1m\n")
+
+		stop := make(chan struct{})
+
+		errCh := make(chan error, 1)
+
+		go func() {
+			errCh <- w.Start(stop)
+		}()
+
+		Eventually(func() time.Duration {
+			return w.Status().Config.Reattach.SlowStart.Duration
+		}).Should(Equal(time.Minute))
+
+		close(stop)
+
+		Eventually(errCh).Should(Receive(BeNil()))
+	})
+})
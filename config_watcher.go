@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/go-logr/logr"
+	"gopkg.in/fsnotify.v1"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	ConfigDebugPath = "/debug/config"
+)
+
+// ConfigWatcher reloads the config file on change, and serves the effective config on the debug endpoint.
+//
+// The file is watched via its directory, so that updates to the file mounted from a ConfigMap, which are made by
+// swapping symlinks, are noticed. The reloaded config is validated before being applied, and the invalid config is
+// never applied so that node-detacher keeps running with the last valid config.
+//
+// Every replica reloads and serves the config regardless of leader election, so that the debug endpoint is reachable
+// on any replica, and the replica taking over the leadership runs with the latest config.
+type ConfigWatcher struct {
+	// Path is the path to the config file. Reloading is disabled when empty
+	Path string
+
+	// Flags is the flag set whose explicitly specified flags override the file
+	Flags *flag.FlagSet
+
+	// Addr is the address the debug endpoint binds to. The debug endpoint is disabled when empty
+	Addr string
+
+	Log logr.Logger
+
+	// Appliers apply reloadable settings of the reloaded config to controllers
+	Appliers []func(*Config) error
+
+	mu sync.Mutex
+
+	// started is the config node-detacher started with
+	started *Config
+
+	// current is the last valid config
+	current *Config
+
+	loadedAt  time.Time
+	lastError string
+}
+
+// ConfigStatus is served on the debug endpoint
+type ConfigStatus struct {
+	Path     string    `json:"path,omitempty"`
+	LoadedAt time.Time `json:"loadedAt"`
+
+	// LastError is the error of the last reload, if any. The last valid config is kept in effect on error
+	LastError string `json:"lastError,omitempty"`
+
+	// RestartRequired is true when any of non-reloadable fields of the config has been changed since the start.
+	// Such changes take effect on the next restart
+	RestartRequired bool `json:"restartRequired"`
+
+	Config Config `json:"config"`
+}
+
+// Init sets the config node-detacher started with
+func (w *ConfigWatcher) Init(c *Config) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.started = c
+	w.current = c
+	w.loadedAt = time.Now()
+}
+
+// Status returns the effective config along with the status of reloads
+func (w *ConfigWatcher) Status() ConfigStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return ConfigStatus{
+		Path:            w.Path,
+		LoadedAt:        w.loadedAt,
+		LastError:       w.lastError,
+		RestartRequired: w.started.RequiresRestart(w.current),
+		Config:          w.current.Redacted(),
+	}
+}
+
+// reload loads the config file, and applies it when it is valid and changed
+func (w *ConfigWatcher) reload() {
+	c, err := LoadConfig(w.Path, w.Flags)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err != nil {
+		w.Log.Error(err, "Failed to reload config. Keeping the last valid config")
+
+		w.lastError = err.Error()
+
+		return
+	}
+
+	w.lastError = ""
+
+	if reflect.DeepEqual(c, w.current) {
+		return
+	}
+
+	for _, apply := range w.Appliers {
+		if err := apply(c); err != nil {
+			w.Log.Error(err, "Failed to apply reloaded config")
+
+			w.lastError = err.Error()
+		}
+	}
+
+	w.current = c
+	w.loadedAt = time.Now()
+
+	if w.started.RequiresRestart(c) {
+		w.Log.Info("Reloaded config. Changes to non-reloadable fields take effect on the next restart", "path", w.Path)
+	} else {
+		w.Log.Info("Reloaded config", "path", w.Path)
+	}
+}
+
+func (w *ConfigWatcher) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(w.Status()); err != nil {
+		w.Log.Error(err, "Failed to serve config")
+	}
+}
+
+// Start implements manager.Runnable so that the config is reloaded and served along with controllers
+func (w *ConfigWatcher) Start(stop <-chan struct{}) error {
+	errCh := make(chan error, 1)
+
+	if w.Addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle(ConfigDebugPath, w)
+
+		srv := &http.Server{Addr: w.Addr, Handler: mux}
+
+		go func() {
+			w.Log.Info("Starting debug server", "addr", w.Addr)
+
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				errCh <- err
+			}
+		}()
+
+		defer srv.Shutdown(context.Background())
+	}
+
+	if w.Path != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+
+		defer watcher.Close()
+
+		if err := watcher.Add(filepath.Dir(w.Path)); err != nil {
+			return err
+		}
+
+		// The file may have changed since it was loaded on startup, while waiting for caches to sync.
+		// Reloaded once the directory is watched, so that no change is missed in between
+		w.reload()
+
+		go func() {
+			for {
+				select {
+				case _, ok := <-watcher.Events:
+					if !ok {
+						return
+					}
+
+					// Any change in the directory may be an update to the file, like ConfigMap's symlink swaps.
+					// Unchanged configs are never applied.
+					w.reload()
+				case err, ok := <-watcher.Errors:
+					if !ok {
+						return
+					}
+
+					w.Log.Error(err, "Failed to watch config", "path", w.Path)
+				}
+			}
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-stop:
+		return nil
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable so that the config is reloaded and served on every
+// replica
+func (w *ConfigWatcher) NeedLeaderElection() bool {
+	return false
+}
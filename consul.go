@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+const (
+	// ConsulModeMaintenance puts the service instance into the maintenance mode via the Consul agent on the node,
+	// so that the instance is kept registered but excluded from DNS and health-filtered queries
+	ConsulModeMaintenance = "maintenance"
+
+	// ConsulModeDeregister deregisters the service instance from the catalog, and registers it again on re-attachment.
+	// Use this only for service instances registered directly to the catalog, as the Consul agent re-registers
+	// any service instance that it manages on the next anti-entropy sync.
+	ConsulModeDeregister = "deregister"
+
+	ConsulMaintenanceReason = "Node is being detached by node-detacher"
+)
+
+// ConsulClient talks to the Consul HTTP API for discovering, detaching and re-attaching the node's service instances
+type ConsulClient struct {
+	// Address is the URL of the Consul HTTP API, like `http://consul.service.consul:8500`
+	Address string
+
+	// Token is the ACL token sent along with every request
+	Token string
+
+	// Mode is either `maintenance` or `deregister`
+	Mode string
+
+	HTTPClient *http.Client
+}
+
+type consulCatalogNode struct {
+	Node    string
+	Address string
+}
+
+type consulAgentService struct {
+	ID      string
+	Service string
+	Tags    []string
+	Address string
+	Port    int
+}
+
+type consulNodeServices struct {
+	Node     *consulCatalogNode
+	Services map[string]consulAgentService
+}
+
+type consulCatalogRegistration struct {
+	Node           string
+	Address        string
+	Service        *consulAgentService `json:",omitempty"`
+	SkipNodeUpdate bool                `json:",omitempty"`
+}
+
+type consulCatalogDeregistration struct {
+	Node      string
+	ServiceID string
+}
+
+func (c *ConsulClient) validate() error {
+	if _, err := url.Parse(c.Address); err != nil {
+		return fmt.Errorf("invalid consul address %q: %w", c.Address, err)
+	}
+
+	switch c.Mode {
+	case ConsulModeMaintenance, ConsulModeDeregister:
+	default:
+		return fmt.Errorf("unsupported consul mode %q: it must be either %q or %q", c.Mode, ConsulModeMaintenance, ConsulModeDeregister)
+	}
+
+	return nil
+}
+
+// getNodeServices returns all the service instances registered to any Consul node whose address is the node IP
+func (c *ConsulClient) getNodeServices(nodeIP string) ([]v1alpha1.ConsulService, error) {
+	var nodes []consulCatalogNode
+
+	if err := c.do(http.MethodGet, c.Address, "/v1/catalog/nodes", nil, nil, &nodes); err != nil {
+		return nil, err
+	}
+
+	var services []v1alpha1.ConsulService
+
+	for _, n := range nodes {
+		if n.Address != nodeIP {
+			continue
+		}
+
+		var nodeServices consulNodeServices
+
+		if err := c.do(http.MethodGet, c.Address, "/v1/catalog/node/"+url.PathEscape(n.Node), nil, nil, &nodeServices); err != nil {
+			return nil, err
+		}
+
+		ids := make([]string, 0, len(nodeServices.Services))
+		for id := range nodeServices.Services {
+			ids = append(ids, id)
+		}
+
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			s := nodeServices.Services[id]
+
+			services = append(services, v1alpha1.ConsulService{
+				ID:          s.ID,
+				Name:        s.Service,
+				Node:        n.Node,
+				NodeAddress: n.Address,
+				Address:     s.Address,
+				Port:        s.Port,
+				Tags:        s.Tags,
+			})
+		}
+	}
+
+	return services, nil
+}
+
+func (c *ConsulClient) detach(svc v1alpha1.ConsulService) error {
+	switch c.Mode {
+	case ConsulModeDeregister:
+		return c.do(http.MethodPut, c.Address, "/v1/catalog/deregister", nil, consulCatalogDeregistration{
+			Node:      svc.Node,
+			ServiceID: svc.ID,
+		}, nil)
+	default:
+		return c.setMaintenance(svc, true)
+	}
+}
+
+func (c *ConsulClient) attach(svc v1alpha1.ConsulService) error {
+	switch c.Mode {
+	case ConsulModeDeregister:
+		return c.do(http.MethodPut, c.Address, "/v1/catalog/register", nil, consulCatalogRegistration{
+			Node:    svc.Node,
+			Address: svc.NodeAddress,
+			Service: &consulAgentService{
+				ID:      svc.ID,
+				Service: svc.Name,
+				Tags:    svc.Tags,
+				Address: svc.Address,
+				Port:    svc.Port,
+			},
+			SkipNodeUpdate: true,
+		}, nil)
+	default:
+		return c.setMaintenance(svc, false)
+	}
+}
+
+// setMaintenance toggles the maintenance mode of the service instance.
+// The request is sent to the Consul agent on the node, as the maintenance mode is local to the agent managing the instance.
+func (c *ConsulClient) setMaintenance(svc v1alpha1.ConsulService, enable bool) error {
+	agent, err := c.agentAddress(svc.NodeAddress)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("enable", fmt.Sprintf("%t", enable))
+
+	if enable {
+		query.Set("reason", ConsulMaintenanceReason)
+	}
+
+	return c.do(http.MethodPut, agent, "/v1/agent/service/maintenance/"+url.PathEscape(svc.ID), query, nil, nil)
+}
+
+// agentAddress returns the URL of the Consul agent running on the node, assuming that the agent listens on
+// the same scheme and port as the configured Consul address
+func (c *ConsulClient) agentAddress(nodeAddress string) (string, error) {
+	u, err := url.Parse(c.Address)
+	if err != nil {
+		return "", err
+	}
+
+	if port := u.Port(); port != "" {
+		u.Host = fmt.Sprintf("%s:%s", nodeAddress, port)
+	} else {
+		u.Host = nodeAddress
+	}
+
+	return u.String(), nil
+}
+
+func (c *ConsulClient) do(method, address, path string, query url.Values, in, out interface{}) error {
+	var body bytes.Buffer
+
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	u := address + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, &body)
+	if err != nil {
+		return err
+	}
+
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("consul request %s %s failed: %w", method, u, err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(res.Body)
+
+		return fmt.Errorf("consul request %s %s failed with status %d: %s", method, u, res.StatusCode, string(msg))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			return fmt.Errorf("decoding consul response for %s %s: %w", method, u, err)
+		}
+	}
+
+	return nil
+}
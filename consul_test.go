@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type consulStub struct {
+	mu       sync.Mutex
+	requests []string
+	bodies   []string
+
+	// registered are service instances registered to ip-10-0-0-1 in addition to web-30080
+	registered map[string]consulAgentService
+
+	// failDeregister makes deregistrations fail like an unreachable Consul server
+	failDeregister bool
+}
+
+func (s *consulStub) register(svc consulAgentService) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.registered == nil {
+		s.registered = map[string]consulAgentService{}
+	}
+
+	s.registered[svc.ID] = svc
+}
+
+func (s *consulStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+	s.bodies = append(s.bodies, strings.TrimSpace(string(body)))
+	s.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/v1/catalog/deregister":
+		s.mu.Lock()
+		fail := s.failDeregister
+		s.mu.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	case "/v1/catalog/nodes":
+		_ = json.NewEncoder(w).Encode([]consulCatalogNode{
+			{Node: "ip-10-0-0-1", Address: "10.0.0.1"},
+			{Node: "ip-10-0-0-2", Address: "10.0.0.2"},
+		})
+	case "/v1/catalog/node/ip-10-0-0-1":
+		services := map[string]consulAgentService{
+			"web-30080": {ID: "web-30080", Service: "web", Port: 30080, Tags: []string{"nodeport"}},
+		}
+
+		s.mu.Lock()
+		for id, svc := range s.registered {
+			services[id] = svc
+		}
+		s.mu.Unlock()
+
+		_ = json.NewEncoder(w).Encode(consulNodeServices{
+			Node:     &consulCatalogNode{Node: "ip-10-0-0-1", Address: "10.0.0.1"},
+			Services: services,
+		})
+	}
+}
+
+var _ = Describe("ConsulClient", func() {
+	var (
+		stub   *consulStub
+		server *httptest.Server
+	)
+
+	BeforeEach(func() {
+		stub = &consulStub{}
+		server = httptest.NewServer(stub)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should discover service instances registered with the node address", func() {
+		c := &ConsulClient{Address: server.URL, Mode: ConsulModeDeregister}
+
+		services, err := c.getNodeServices("10.0.0.1")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(services).To(HaveLen(1))
+		Expect(services[0].ID).To(Equal("web-30080"))
+		Expect(services[0].Name).To(Equal("web"))
+		Expect(services[0].Node).To(Equal("ip-10-0-0-1"))
+		Expect(services[0].NodeAddress).To(Equal("10.0.0.1"))
+		Expect(services[0].Port).To(Equal(30080))
+	})
+
+	It("should deregister and re-register service instances in the deregister mode", func() {
+		c := &ConsulClient{Address: server.URL, Mode: ConsulModeDeregister, Token: "secret"}
+
+		services, err := c.getNodeServices("10.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(c.detach(services[0])).To(Succeed())
+		Expect(c.attach(services[0])).To(Succeed())
+
+		Expect(stub.requests[len(stub.requests)-2:]).To(Equal([]string{
+			"PUT /v1/catalog/deregister",
+			"PUT /v1/catalog/register",
+		}))
+		Expect(stub.bodies[len(stub.bodies)-2]).To(Equal(`{"Node":"ip-10-0-0-1","ServiceID":"web-30080"}`))
+		Expect(stub.bodies[len(stub.bodies)-1]).To(ContainSubstring(`"SkipNodeUpdate":true`))
+	})
+
+	It("should build the agent address from the node address in the maintenance mode", func() {
+		c := &ConsulClient{Address: "http://consul.service.consul:8500", Mode: ConsulModeMaintenance}
+
+		addr, err := c.agentAddress("10.0.0.1")
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(addr).To(Equal("http://10.0.0.1:8500"))
+	})
+
+	Context("reconciling nodes outside of EC2", func() {
+		var (
+			ctx        context.Context
+			c          client.Client
+			controller *NodeController
+		)
+
+		BeforeEach(func() {
+			scheme := runtime.NewScheme()
+			Expect(k8sscheme.AddToScheme(scheme)).To(Succeed())
+			Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+
+			ctx = context.Background()
+
+			c = fake.NewFakeClientWithScheme(scheme, &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+				Status: corev1.NodeStatus{
+					Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.1"}},
+				},
+			})
+
+			controller = &NodeController{
+				Client:       c,
+				CoreV1Client: kubefake.NewSimpleClientset().CoreV1(),
+				Log:          logf.Log.WithName("consul"),
+				recorder:     &record.FakeRecorder{},
+				Namespace:    "default",
+				Consul:       &ConsulClient{Address: server.URL, Mode: ConsulModeDeregister},
+			}
+		})
+
+		reconcile := func() error {
+			_, err := controller.reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: "node1"}})
+
+			return err
+		}
+
+		getAttachment := func() v1alpha1.Attachment {
+			var attachment v1alpha1.Attachment
+
+			Expect(c.Get(ctx, types.NamespacedName{Namespace: "default", Name: "node1"}, &attachment)).To(Succeed())
+
+			return attachment
+		}
+
+		cordon := func() {
+			var node corev1.Node
+
+			Expect(c.Get(ctx, types.NamespacedName{Name: "node1"}, &node)).To(Succeed())
+
+			node.Spec.Unschedulable = true
+
+			Expect(c.Update(ctx, &node)).To(Succeed())
+		}
+
+		It("should detach service instances registered after caching", func() {
+			Expect(reconcile()).To(Succeed())
+
+			Expect(getAttachment().Spec.ConsulServices).To(HaveLen(1))
+
+			stub.register(consulAgentService{ID: "api-30081", Service: "api", Port: 30081})
+
+			cordon()
+
+			Expect(reconcile()).To(Succeed())
+
+			services := getAttachment().Spec.ConsulServices
+			Expect(services).To(HaveLen(2))
+
+			for _, svc := range services {
+				Expect(svc.Detached).To(BeTrue(), "service %s", svc.ID)
+			}
+
+			Expect(stub.bodies).To(ContainElement(`{"Node":"ip-10-0-0-1","ServiceID":"web-30080"}`))
+			Expect(stub.bodies).To(ContainElement(`{"Node":"ip-10-0-0-1","ServiceID":"api-30081"}`))
+		})
+
+		It("should record the detach intent before deregistering and resume it after a failure", func() {
+			Expect(reconcile()).To(Succeed())
+
+			stub.mu.Lock()
+			stub.failDeregister = true
+			stub.mu.Unlock()
+
+			cordon()
+
+			Expect(reconcile()).NotTo(Succeed())
+
+			services := getAttachment().Spec.ConsulServices
+			Expect(services).To(HaveLen(1))
+			Expect(services[0].Detached).To(BeTrue())
+			Expect(services[0].Phase).To(Equal(DetachPhaseDeregistering))
+
+			stub.mu.Lock()
+			stub.failDeregister = false
+			stub.mu.Unlock()
+
+			Expect(reconcile()).To(Succeed())
+
+			services = getAttachment().Spec.ConsulServices
+			Expect(services[0].Detached).To(BeTrue())
+			Expect(services[0].Phase).To(BeEmpty())
+
+			stub.mu.Lock()
+			defer stub.mu.Unlock()
+
+			var deregistrations int
+
+			for _, r := range stub.requests {
+				if r == "PUT /v1/catalog/deregister" {
+					deregistrations++
+				}
+			}
+
+			Expect(deregistrations).To(Equal(2))
+		})
+	})
+})
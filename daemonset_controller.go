@@ -20,13 +20,16 @@ import (
 	"context"
 	"fmt"
 	"github.com/go-logr/logr"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/tools/record"
 	"math"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"strconv"
+	"sync"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
@@ -51,96 +54,66 @@ type DaemonsetController struct {
 	Log      logr.Logger
 	recorder record.EventRecorder
 
-	// DaemonSets is the list of daemonsets whose item is either "NAME" or "NAMESPACE/NAME" of the target daemonset.
-	//
-	// For example, let's say you'd like node-detacher deployed in kube-system to detach the node which is running the target
-	// pod and when the pod becomes `Terminating` state.
-	//
-	// When the pod is named `contour-<hash>` and it is managed by the daemonset named `contour` in namespace
-	// `kube-system`, you'd specifyc the daemonsets list as:
-	//
-	//  --daemonsets contour`
-	//
-	// If you'd like to deploy `contour` in another namespace that is different from where `node-detacher` is deployed
-	// to - e.g. `ingress` namespace - you'd specify the list as:
-	//
-	// --daemonsets ingress/contour
-	DaemonSets []string
-
-	// Namespace is the default namespace to watch for daemonset pods
-	Namespace string
-}
-
-func (r *DaemonsetController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	ctx := context.Background()
+	// Targets resolves the daemonsets to be rolled
+	Targets *DaemonSetTargets
 
-	log := r.Log.WithValues("pod", req.NamespacedName)
-
-	namespaces, daemonsetNames := CalculateTargets(r.DaemonSets)
+	// Namespace is the namespace to look for attachments of nodes being rolled
+	Namespace string
 
-	dsNamespace := req.Namespace
+	// MaxUnavailable, MaxUnavailablePerZone, and MaxUnavailablePerTargetGroup are the defaults of the rollouts
+	// created for daemonsets
+	MaxUnavailable               *intstr.IntOrString
+	MaxUnavailablePerZone        *intstr.IntOrString
+	MaxUnavailablePerTargetGroup *intstr.IntOrString
 
-	// Try to list daemonsets only when there's no concrete list of target daemonsets specified.
-	// This gives you an option no not poke K8s API on each reconcilation loop
-	if r.Name != "" && len(r.DaemonSets) == 0 {
-		var dsList appsv1.DaemonSetList
+	// PodReadyTimeout is the default of how long to wait for the replacement pod to become ready before pausing the rollout
+	PodReadyTimeout *metav1.Duration
 
-		if err := r.List(ctx, &dsList, client.InNamespace(dsNamespace), client.MatchingFields{DaemonSetFieldManagedBy: r.Name}); err != nil {
-			return ctrl.Result{}, err
-		}
+	// configMu is held while reconciling, so that reloading the config never changes the defaults in the middle of
+	// reconciliations
+	configMu sync.RWMutex
+}
 
-		for _, ds := range dsList.Items {
-			namespaces[ds.GetNamespace()] = true
-			daemonsetNames[ds.GetName()] = true
-		}
-	}
+func (r *DaemonsetController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	r.configMu.RLock()
+	defer r.configMu.RUnlock()
 
-	_, nsTargeted := namespaces[dsNamespace]
-	if !nsTargeted {
-		log.Info("Skipping this pod. Only pods in one of target namespaces are reconciled by me.")
+	ctx := context.Background()
 
-		return ctrl.Result{}, nil
-	}
+	log := r.Log.WithValues("daemonset", req.NamespacedName)
 
 	var ds appsv1.DaemonSet
 
 	if err := r.Client.Get(ctx, req.NamespacedName, &ds); err != nil {
-		log.Error(err, "Failed getting pod owner")
-
-		return ctrl.Result{}, err
+		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	if ds.Spec.UpdateStrategy.Type != appsv1.OnDeleteDaemonSetStrategyType {
+	if !r.Targets.Matches(&ds) {
+		log.V(1).Info("Skipping this daemonset. Only target daemonsets are reconciled by me.")
+
 		return ctrl.Result{}, nil
 	}
 
-	if ds.Status.DesiredNumberScheduled <= ds.Status.UpdatedNumberScheduled {
-		// All the daemonset pods are up-to-date. Nothing to do
+	if ds.Spec.UpdateStrategy.Type != appsv1.OnDeleteDaemonSetStrategyType {
 		return ctrl.Result{}, nil
 	}
 
-	var podList corev1.PodList
+	rollout, err := r.getOrCreateRollout(ctx, &ds)
+	if err != nil {
+		log.Error(err, "Failed getting rollout")
 
-	if err := r.List(ctx, &podList, client.MatchingFields{PodFieldOwnerDaemonSet: ds.Name}); err != nil {
-		return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+		return ctrl.Result{}, err
 	}
 
-	for _, pod := range podList.Items {
-		if GetPodTemplateGeneration(pod.GetObjectMeta()) < ds.Generation {
-			// Immediately marks for termination, but defer terminate until we detach the node first
-			if GetAnnotation(pod.GetObjectMeta(), PodAnnotationDetaching) != r.Name {
-				newPod := pod.DeepCopy()
-
-				SetAnnotation(newPod.GetObjectMeta(), PodAnnotationDetaching, r.Name)
+	var podList corev1.PodList
 
-				if err := r.Patch(ctx, newPod, client.MergeFrom(&pod)); err != nil {
-					return ctrl.Result{RequeueAfter: 1 * time.Second}, err
-				}
-			}
-		}
+	if err := r.List(ctx, &podList, client.InNamespace(ds.Namespace), client.MatchingFields{PodFieldOwnerDaemonSet: ds.Name}); err != nil {
+		return ctrl.Result{RequeueAfter: 1 * time.Second}, err
 	}
 
-	return ctrl.Result{}, nil
+	// Rather than marking all the outdated pods for termination at once, nodes are detached, updated, and re-attached
+	// in batches within the maxUnavailable limits
+	return r.progressRollout(ctx, log, &ds, rollout, podList.Items)
 }
 
 func SetAnnotation(meta metav1.Object, key string, value string) {
@@ -172,6 +145,24 @@ func GetPodTemplateGeneration(meta metav1.Object) int64 {
 	return math.MaxInt64
 }
 
+// ApplyConfig updates the defaults of rollouts on reload of the config
+func (r *DaemonsetController) ApplyConfig(c *Config) error {
+	maxUnavailable, perZone, perTargetGroup, err := c.rolloutMaxUnavailable()
+	if err != nil {
+		return err
+	}
+
+	r.configMu.Lock()
+	defer r.configMu.Unlock()
+
+	r.MaxUnavailable = maxUnavailable
+	r.MaxUnavailablePerZone = perZone
+	r.MaxUnavailablePerTargetGroup = perTargetGroup
+	r.PodReadyTimeout = &metav1.Duration{Duration: c.Rollout.PodReadyTimeout.Duration}
+
+	return nil
+}
+
 func (r *DaemonsetController) SetupWithManager(mgr ctrl.Manager) error {
 	r.recorder = mgr.GetEventRecorderFor(r.Name)
 
@@ -192,7 +183,9 @@ func (r *DaemonsetController) SetupWithManager(mgr ctrl.Manager) error {
 	}
 
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Pod{}).
+		For(&appsv1.DaemonSet{}).
+		Owns(&corev1.Pod{}).
+		Owns(&v1alpha1.Rollout{}).
+		WithEventFilter(daemonSetPredicate(r.Targets)).
 		Complete(r)
-
 }
@@ -2,20 +2,30 @@ package main
 
 import (
 	"context"
+	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/mumoshu/node-detacher/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sync"
+	"time"
+)
+
+const (
+	// DetachPhaseDeregistering means node-detacher is going to de-register, or is de-registering, the node from the
+	// load balancer. The node may or may not be registered to the load balancer yet.
+	DetachPhaseDeregistering = "Deregistering"
+
+	// DetachPhaseAwaitingController means node-detacher is waiting for the controller managing the target group to
+	// de-register the node, in favor of the exclusion label. The node is de-registered by node-detacher once it times out.
+	DetachPhaseAwaitingController = "AwaitingController"
 )
 
 func (n *NodeAttachments) detachNodes(unschedulableNodes []corev1.Node) (bool, error) {
 	var processed int
 
 	for _, node := range unschedulableNodes {
-		instanceID, err := getInstanceID(node)
-		if err != nil {
-			return false, err
-		}
-
 		var attachment v1alpha1.Attachment
 
 		ctx := context.Background()
@@ -26,69 +36,409 @@ func (n *NodeAttachments) detachNodes(unschedulableNodes []corev1.Node) (bool, e
 			continue
 		}
 
-		var specUpdates int
+		instanceID, err := instanceIDOfAttachment(node, attachment.Spec)
+		if err != nil {
+			return false, err
+		}
+
+		// Consul services and Route 53 records aren't discovered on detach along with load balancers, but may have been
+		// registered after the attachment was cached
+		if err := n.rediscoverOnDetach(node, &attachment.Spec); err != nil {
+			return false, err
+		}
+
+		// Record the intent to de-register before calling AWS APIs, so that a crash in the middle of de-registrations
+		// never leaves the node de-registered from load balancers without node-detacher knowing about it.
+		// attachNodes re-registers targets and CLBs that are still Deregistering, as they may be de-registered already.
+		var (
+			intents int
+			resumed = map[string]bool{}
+			now     = metav1.Now()
+			local   map[string]localEndpoints
+		)
+
+		if n.skipTargetsWithoutLocalEndpoints {
+			local, err = n.localEndpointsOfNode(node)
+			if err != nil {
+				return false, err
+			}
+		}
 
+		// Note that targets and CLBs being re-registered are de-registered again
 		for i, t := range attachment.Spec.AwsTargets {
-			if t.Detached {
+			if t.Detached && t.Phase == "" {
+				continue
+			}
+
+			if t.Phase == DetachPhaseDeregistering {
+				resumed[t.ARN] = true
+
+				continue
+			}
+
+			awaiting := t.Phase == DetachPhaseAwaitingController
+
+			// Left registered, so that re-attaching the node never touches the target. That includes the target being
+			// re-registered, or watched within the rollback window, when it's detached again
+			if !t.Detached && !awaiting && hasNoLocalEndpoints(t.Services, local) {
+				n.Log.Info("Skipped de-registering node from target group without local endpoints", "node", node.Name, "targetgroup", t.ARN, "services", t.Services)
+
+				continue
+			}
+
+			if awaiting {
+				if n.controllerWaitRemaining(t, now.Time) > 0 {
+					continue
+				}
+
+				n.Log.Info("Timed out waiting for controller to de-register node. De-registering on our own", "node", node.Name, "targetgroup", t.ARN, "controller", t.Controller)
+			}
+
+			intents++
+
+			target := &attachment.Spec.AwsTargets[i]
+
+			target.Detached = true
+			target.HealthyAt = nil
+
+			if n.awaitsController(t) && !awaiting {
+				target.Phase = DetachPhaseAwaitingController
+				target.ControllerWaitStartedAt = &now
+			} else {
+				target.Phase = DetachPhaseDeregistering
+				target.ControllerWaitStartedAt = nil
+			}
+		}
+
+		for i, l := range attachment.Spec.AwsLoadBalancers {
+			if l.Detached && l.Phase == "" || l.Phase == DetachPhaseDeregistering {
+				continue
+			}
+
+			if !l.Detached && hasNoLocalEndpoints(l.Services, local) {
+				n.Log.Info("Skipped de-registering node from CLB without local endpoints", "node", node.Name, "clb", l.Name, "services", l.Services)
+
 				continue
 			}
 
-			// Prevents alb-ingress-controller from re-registering the target
-			// i.e. avoids race between node-detacher and the alb-ingress-controller)
-			var latest corev1.Node
+			intents++
 
-			if err := n.client.Get(context.Background(), types.NamespacedName{Name: node.Name}, &latest); err != nil {
+			attachment.Spec.AwsLoadBalancers[i].Detached = true
+			attachment.Spec.AwsLoadBalancers[i].Phase = DetachPhaseDeregistering
+			attachment.Spec.AwsLoadBalancers[i].HealthyAt = nil
+		}
+
+		// Endpoints, service instances and record sets still Deregistering after a crash are detached again, as
+		// detaching them is idempotent
+		if n.globalAccelerator != nil {
+			for i, ep := range attachment.Spec.GlobalAcceleratorEndpoints {
+				if ep.Detached {
+					continue
+				}
+
+				intents++
+
+				attachment.Spec.GlobalAcceleratorEndpoints[i].Detached = true
+				attachment.Spec.GlobalAcceleratorEndpoints[i].Phase = DetachPhaseDeregistering
+			}
+		}
+
+		if n.consul != nil {
+			for i, svc := range attachment.Spec.ConsulServices {
+				if svc.Detached {
+					continue
+				}
+
+				intents++
+
+				attachment.Spec.ConsulServices[i].Detached = true
+				attachment.Spec.ConsulServices[i].Phase = DetachPhaseDeregistering
+			}
+		}
+
+		if n.route53 != nil {
+			for i, rec := range attachment.Spec.Route53Records {
+				if rec.Detached {
+					continue
+				}
+
+				intents++
+
+				attachment.Spec.Route53Records[i].Detached = true
+				attachment.Spec.Route53Records[i].Phase = DetachPhaseDeregistering
+			}
+		}
+
+		if intents > 0 {
+			if err := n.client.Update(ctx, &attachment); err != nil {
 				return false, err
 			}
+		}
+
+		var specUpdates int
 
-			// See https://github.com/kubernetes-sigs/aws-alb-ingress-controller/blob/27e5d2a7dc8584123e3997a5dd3d80a58fa7bbd7/internal/ingress/annotations/class/main.go#L52
-			latest.Labels["alpha.service-controller.kubernetes.io/exclude-balancer"] = "true"
+		var drifts []v1alpha1.AttachmentDrift
 
-			if err := n.client.Update(context.Background(), &latest); err != nil {
+		labels := map[string]bool{}
+
+		for _, t := range attachment.Spec.AwsTargets {
+			if t.Phase == DetachPhaseDeregistering || t.Phase == DetachPhaseAwaitingController {
+				labels[excludeBalancerLabelOf(t.Controller)] = true
+			}
+		}
+
+		if len(labels) > 0 {
+			// Prevents controllers from re-registering the target
+			// i.e. avoids race between node-detacher and the controller)
+			//
+			// Note that we continue by de-registering targets of target groups without controllers, and ones whose
+			// controllers didn't de-register the node in time, on our own.
+			if err := n.labelExcludeBalancer(node.Name, labels); err != nil {
 				return false, err
 			}
+		}
+
+		// The node is detached from the target once its controller starts draining the target
+		for i, t := range attachment.Spec.AwsTargets {
+			if t.Phase != DetachPhaseAwaitingController {
+				continue
+			}
 
-			// Note that we continue by de-registering the target on our own, instead of waiting for the
-			// alb-ingress-controller to do it for us in favor of "alpha.service-controller.kubernetes.io/exclude-balancer"
-			// just to start de-registering the target earlier.
+			svc, err := n.awsServices(t.Account, t.Region)
+			if err != nil {
+				return false, err
+			}
 
-			if t.Port != nil {
-				if err := deregisterInstanceFromTG(n.elbv2Svc, t.ARN, instanceID, *t.Port); err != nil {
+			state, err := getRegisteredTargetState(svc.ELBV2, t.ARN, instanceID, t.Port)
+			if err != nil {
+				if !isAWSDriftError(err) {
 					return false, err
 				}
-			} else {
-				if err := deregisterInstancesFromTGs(n.elbv2Svc, t.ARN, []string{instanceID}); err != nil {
+
+				drifts = append(drifts, newAttachmentDrift(AttachmentDriftKindAwsTarget, t.ARN, t.Port, err))
+			} else if state != "" && state != elbv2.TargetHealthStateEnumDraining {
+				continue
+			}
+
+			specUpdates++
+
+			attachment.Spec.AwsTargets[i].Phase = ""
+			attachment.Spec.AwsTargets[i].ControllerWaitStartedAt = nil
+		}
+
+		// De-register the node from all the target groups and CLBs at once, so that the de-registrations are coalesced
+		// with ones of other nodes being detached at the same time
+		var (
+			wg      sync.WaitGroup
+			tgErrs  = make([]error, len(attachment.Spec.AwsTargets))
+			clbErrs = make([]error, len(attachment.Spec.AwsLoadBalancers))
+		)
+
+		for i, t := range attachment.Spec.AwsTargets {
+			if t.Phase != DetachPhaseDeregistering {
+				continue
+			}
+
+			wg.Add(1)
+
+			go func(i int, t v1alpha1.AwsTarget) {
+				defer wg.Done()
+
+				svc, err := n.awsServices(t.Account, t.Region)
+				if err != nil {
+					tgErrs[i] = err
+
+					return
+				}
+
+				tgErrs[i] = n.deregistrations.deregisterTarget(svc, t.ARN, instanceID, t.Port)
+			}(i, t)
+		}
+
+		for i, l := range attachment.Spec.AwsLoadBalancers {
+			if l.Phase != DetachPhaseDeregistering {
+				continue
+			}
+
+			wg.Add(1)
+
+			go func(i int, l v1alpha1.AwsLoadBalancer) {
+				defer wg.Done()
+
+				svc, err := n.awsServices(l.Account, l.Region)
+				if err != nil {
+					clbErrs[i] = err
+
+					return
+				}
+
+				clbErrs[i] = n.deregistrations.deregisterCLBInstance(svc, l.Name, instanceID)
+			}(i, l)
+		}
+
+		wg.Wait()
+
+		for i, t := range attachment.Spec.AwsTargets {
+			if t.Phase != DetachPhaseDeregistering {
+				continue
+			}
+
+			err := tgErrs[i]
+
+			// The target de-registered before the crash may have already finished draining
+			if resumed[t.ARN] && awsErrorCode(err) == elbv2.ErrCodeInvalidTargetException {
+				err = nil
+			}
+
+			if err != nil {
+				if !isAWSDriftError(err) {
 					return false, err
 				}
+
+				drifts = append(drifts, newAttachmentDrift(AttachmentDriftKindAwsTarget, t.ARN, t.Port, err))
 			}
 
 			specUpdates++
 
-			attachment.Spec.AwsTargets[i].Detached = true
+			attachment.Spec.AwsTargets[i].Phase = ""
 		}
 
 		for i, l := range attachment.Spec.AwsLoadBalancers {
-			if l.Detached {
+			if l.Phase != DetachPhaseDeregistering {
 				continue
 			}
 
-			if err := deregisterInstancesFromCLBs(n.elbSvc, l.Name, []string{instanceID}); err != nil {
+			if err := clbErrs[i]; err != nil {
+				if !isAWSDriftError(err) {
+					return false, err
+				}
+
+				drifts = append(drifts, newAttachmentDrift(AttachmentDriftKindAwsLoadBalancer, l.Name, nil, err))
+			}
+
+			specUpdates++
+
+			attachment.Spec.AwsLoadBalancers[i].Phase = ""
+		}
+
+		for i, ep := range attachment.Spec.GlobalAcceleratorEndpoints {
+			if ep.Phase != DetachPhaseDeregistering || n.globalAccelerator == nil {
+				continue
+			}
+
+			if err := n.globalAccelerator.detachEndpoint(ep); err != nil {
 				return false, err
 			}
 
 			specUpdates++
 
-			attachment.Spec.AwsLoadBalancers[i].Detached = true
+			attachment.Spec.GlobalAcceleratorEndpoints[i].Phase = ""
+		}
+
+		for i, svc := range attachment.Spec.ConsulServices {
+			if svc.Phase != DetachPhaseDeregistering || n.consul == nil {
+				continue
+			}
+
+			if err := n.consul.detach(svc); err != nil {
+				return false, err
+			}
+
+			specUpdates++
+
+			attachment.Spec.ConsulServices[i].Phase = ""
+		}
+
+		for i, rec := range attachment.Spec.Route53Records {
+			if rec.Phase != DetachPhaseDeregistering || n.route53 == nil {
+				continue
+			}
+
+			if err := n.route53.detachRecord(rec); err != nil {
+				return false, err
+			}
+
+			specUpdates++
+
+			now := metav1.Now()
+
+			attachment.Spec.Route53Records[i].Phase = ""
+			attachment.Spec.Route53Records[i].DetachedAt = &now
 		}
 
 		if specUpdates > 0 {
 			if err := n.client.Update(ctx, &attachment); err != nil {
 				return false, err
 			}
+		}
 
+		if intents > 0 || specUpdates > 0 {
 			processed++
 		}
+
+		if err := n.recordDrifts(&attachment, drifts); err != nil {
+			return false, err
+		}
 	}
 
 	return processed > 0, nil
 }
+
+// labelExcludeBalancer adds the exclude-balancer labels to the node, remembering that they were added by us
+func (n *NodeAttachments) labelExcludeBalancer(nodeName string, labels map[string]bool) error {
+	var latest corev1.Node
+
+	if err := n.client.Get(context.Background(), types.NamespacedName{Name: nodeName}, &latest); err != nil {
+		return err
+	}
+
+	if latest.Labels == nil {
+		latest.Labels = map[string]string{}
+	}
+
+	if latest.Annotations == nil {
+		latest.Annotations = map[string]string{}
+	}
+
+	var updated bool
+
+	for label := range labels {
+		if _, ok := latest.Labels[label]; ok {
+			// Already labeled by either us or someone else
+			continue
+		}
+
+		latest.Labels[label] = "true"
+		latest.Annotations[excludeBalancerLabels[label]] = "true"
+
+		updated = true
+	}
+
+	if !updated {
+		return nil
+	}
+
+	return n.client.Update(context.Background(), &latest)
+}
+
+// drainRemaining returns how long we need to wait until the node can be considered drained, even after all the
+// de-registrations are done. For example, DNS resolvers may keep returning the node IP until the record's TTL passes.
+// Controllers may also have yet to de-register the node from target groups they manage.
+func (n *NodeAttachments) drainRemaining(node corev1.Node) (time.Duration, error) {
+	var attachment v1alpha1.Attachment
+
+	if err := n.client.Get(context.Background(), types.NamespacedName{Name: node.Name, Namespace: n.namespace}, &attachment); err != nil {
+		return 0, client.IgnoreNotFound(err)
+	}
+
+	now := time.Now()
+
+	remaining := route53DrainRemaining(attachment.Spec.Route53Records, now)
+
+	// Targets awaiting controllers are checked again until they are de-registered
+	if r := n.controllerPollRemaining(attachment.Spec.AwsTargets, now); r > remaining {
+		remaining = r
+	}
+
+	return remaining, nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+	"time"
+)
+
+// +kubebuilder:rbac:groups=node-detacher.variant.run,resources=detachpolicies,verbs=get;list;watch
+
+// listDetachPolicies returns all the detach policies sorted by name.
+// It returns nil without an error when the DetachPolicy CRD is not installed, so that node-detacher keeps working
+// with the legacy triggers.
+func listDetachPolicies(ctx context.Context, c client.Client) ([]v1alpha1.DetachPolicy, error) {
+	var list v1alpha1.DetachPolicyList
+
+	if err := c.List(ctx, &list); err != nil {
+		if meta.IsNoMatchError(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	policies := list.Items
+
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+
+	return policies, nil
+}
+
+func matchLabelSelector(selector *metav1.LabelSelector, node corev1.Node) (bool, error) {
+	if selector == nil {
+		return true, nil
+	}
+
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false, err
+	}
+
+	return s.Matches(labels.Set(node.Labels)), nil
+}
+
+// selectDetachPolicy returns the first policy in the name order whose node selector matches the node,
+// or nil when no policy selects the node
+func selectDetachPolicy(policies []v1alpha1.DetachPolicy, node corev1.Node) (*v1alpha1.DetachPolicy, error) {
+	for i := range policies {
+		p := &policies[i]
+
+		matched, err := matchLabelSelector(p.Spec.NodeSelector, node)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node selector in detach policy %q: %w", p.Name, err)
+		}
+
+		if matched {
+			return p, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// isMasterNode returns true when the node is tainted as a master node, which is never detached
+func isMasterNode(node corev1.Node) bool {
+	for _, t := range node.Spec.Taints {
+		if t.Key == "node-role.kubernetes.io/master" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// neverDetachedReason returns why NodeController never detaches the node, even when it is annotated to be detached,
+// or an empty string when the node can be detached
+func neverDetachedReason(policies []v1alpha1.DetachPolicy, node corev1.Node) (string, error) {
+	if isMasterNode(node) {
+		return "master node", nil
+	}
+
+	if len(policies) == 0 {
+		return "", nil
+	}
+
+	policy, err := selectDetachPolicy(policies, node)
+	if err != nil {
+		return "", err
+	}
+
+	if policy == nil {
+		return "not selected by any detach policy", nil
+	}
+
+	reason, excluded, err := detachPolicyExcludes(policy, node)
+	if err != nil {
+		return "", err
+	}
+
+	if excluded {
+		return fmt.Sprintf("excluded by detach policy %s: %s", policy.Name, reason), nil
+	}
+
+	return "", nil
+}
+
+// lookupNeverDetachedReason is neverDetachedReason according to the detach policies in the cluster
+func lookupNeverDetachedReason(ctx context.Context, c client.Client, node corev1.Node) (string, error) {
+	policies, err := listDetachPolicies(ctx, c)
+	if err != nil {
+		return "", err
+	}
+
+	return neverDetachedReason(policies, node)
+}
+
+func matchTaintRules(rules []v1alpha1.TaintRule, node corev1.Node) (string, bool) {
+	for _, r := range rules {
+		for _, t := range node.Spec.Taints {
+			if t.Key == r.Key && (r.Effect == "" || t.Effect == r.Effect) {
+				return fmt.Sprintf("taint %s:%s", t.Key, t.Effect), true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func matchAnnotationRules(rules []v1alpha1.AnnotationRule, node corev1.Node) (string, bool) {
+	for _, r := range rules {
+		v, ok := node.Annotations[r.Key]
+		if ok && (r.Value == "" || v == r.Value) {
+			return fmt.Sprintf("annotation %s=%s", r.Key, v), true
+		}
+	}
+
+	return "", false
+}
+
+// detachTrigger is the result of evaluating detach triggers against the node
+type detachTrigger struct {
+	// reason describes the rule that triggered the detach
+	reason string
+
+	// noCordon is true when the node should only be detached from load balancers, without being tainted nor drained
+	noCordon bool
+
+	// recheckAfter is how long until a pending trigger fires, like a node condition that hasn't been in the status
+	// for long enough
+	recheckAfter time.Duration
+}
+
+func (t *detachTrigger) recheckNoLaterThan(d time.Duration) {
+	if d > 0 && (t.recheckAfter == 0 || d < t.recheckAfter) {
+		t.recheckAfter = d
+	}
+}
+
+func matchNodeConditionRules(rules []v1alpha1.NodeConditionRule, node corev1.Node, now time.Time) (detachTrigger, bool) {
+	var pending detachTrigger
+
+	for _, r := range rules {
+		for _, c := range node.Status.Conditions {
+			if c.Type != r.Type || c.Status != r.Status {
+				continue
+			}
+
+			if r.For != nil {
+				if remaining := c.LastTransitionTime.Add(r.For.Duration).Sub(now); remaining > 0 {
+					pending.recheckNoLaterThan(remaining)
+
+					continue
+				}
+			}
+
+			return detachTrigger{reason: fmt.Sprintf("condition %s=%s", c.Type, c.Status), noCordon: r.NoCordon}, true
+		}
+	}
+
+	return pending, false
+}
+
+// ParseNodeConditionRules parses `TYPE=STATUS[:DURATION]` given via command-line flags into node condition rules
+func ParseNodeConditionRules(specs []string, noCordon bool) ([]v1alpha1.NodeConditionRule, error) {
+	var rules []v1alpha1.NodeConditionRule
+
+	for _, spec := range specs {
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid node condition %q: it must be in the form of TYPE=STATUS[:DURATION]", spec)
+		}
+
+		rule := v1alpha1.NodeConditionRule{
+			Type:     corev1.NodeConditionType(kv[0]),
+			NoCordon: noCordon,
+		}
+
+		statusAndDuration := strings.SplitN(kv[1], ":", 2)
+
+		switch status := corev1.ConditionStatus(statusAndDuration[0]); status {
+		case corev1.ConditionTrue, corev1.ConditionFalse, corev1.ConditionUnknown:
+			rule.Status = status
+		default:
+			return nil, fmt.Errorf("invalid status in node condition %q: it must be one of True, False, or Unknown", spec)
+		}
+
+		if len(statusAndDuration) == 2 {
+			d, err := time.ParseDuration(statusAndDuration[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration in node condition %q: %w", spec, err)
+			}
+
+			rule.For = &metav1.Duration{Duration: d}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// detachPolicyExcludes returns the reason why the node must never be detached, if any
+func detachPolicyExcludes(policy *v1alpha1.DetachPolicy, node corev1.Node) (string, bool, error) {
+	ex := policy.Spec.Exclusions
+
+	if ex.NodeSelector != nil {
+		matched, err := matchLabelSelector(ex.NodeSelector, node)
+		if err != nil {
+			return "", false, fmt.Errorf("invalid exclusion node selector in detach policy %q: %w", policy.Name, err)
+		}
+
+		if matched {
+			return "node selector", true, nil
+		}
+	}
+
+	if reason, ok := matchTaintRules(ex.Taints, node); ok {
+		return reason, true, nil
+	}
+
+	if reason, ok := matchAnnotationRules(ex.Annotations, node); ok {
+		return reason, true, nil
+	}
+
+	return "", false, nil
+}
+
+// detachPolicyTriggered returns the trigger that fired according to the policy, if any
+func detachPolicyTriggered(policy *v1alpha1.DetachPolicy, node corev1.Node, now time.Time) (detachTrigger, bool) {
+	t := policy.Spec.Triggers
+
+	if t.Cordon && node.Spec.Unschedulable {
+		return detachTrigger{reason: "cordon"}, true
+	}
+
+	if reason, ok := matchTaintRules(t.Taints, node); ok {
+		return detachTrigger{reason: reason}, true
+	}
+
+	trigger, ok := matchNodeConditionRules(t.Conditions, node, now)
+	if ok {
+		return trigger, true
+	}
+
+	if reason, ok := matchAnnotationRules(t.Annotations, node); ok {
+		return detachTrigger{reason: reason}, true
+	}
+
+	return trigger, false
+}
+
+// legacyDetachTriggered returns true when the node should be detached when there's no DetachPolicy.
+// Taints whose keys start with any of extraIgnoredTaintPrefixes aren't considered as custom taints.
+//
+// Note:
+// - Node becomes Unschedulable when cordoned
+// - Node should be considered unschedulable when it is already tained by CA for scale down
+// - Node should be considered unschedulable when it is already tained by node-detacher for detachment
+func legacyDetachTriggered(node corev1.Node, extraIgnoredTaintPrefixes ...string) bool {
+	var toBeDeletedByCA bool
+
+	var hasAnyCustomTaint bool
+
+	var hasAnyK8sTaint bool
+
+	NodeTaintKeyK8sNode := "node.kubernetes.io/"
+
+	ignoredTaintPrefixes := []string{
+		NodeTaintToBeDeletedByCA,
+		NodeTaintKeyDetaching,
+		NodeTaintKeyK8sNode,
+	}
+
+	ignoredTaintPrefixes = append(ignoredTaintPrefixes, extraIgnoredTaintPrefixes...)
+
+	for _, taint := range node.Spec.Taints {
+		// Cluster Autoscaler tries to make the node unschedulable by adding a taint whose key is
+		// `ToBeDeletedByClusterAutoscaler`.
+		//
+		// References:
+		//
+		// MarkToBeDeleted:
+		// https://github.com/kubernetes/autoscaler/blob/7ecf51e4bfab24b6d9c6520d8a851052e5a447fb/cluster-autoscaler/utils/deletetaint/delete.go#L59-L62
+		//
+		// ScaleDown.deleteNode:
+		// https://github.com/kubernetes/autoscaler/blob/af1dd84305d3c6bebd22373a7bcf7aebad5a91f5/cluster-autoscaler/core/scale_down.go#L1109-L1112
+		if taint.Key == NodeTaintToBeDeletedByCA {
+			toBeDeletedByCA = true
+		}
+
+		if strings.HasPrefix(taint.Key, NodeTaintKeyK8sNode) {
+			hasAnyK8sTaint = true
+		}
+
+		ignored := false
+		for _, key := range ignoredTaintPrefixes {
+			if strings.HasPrefix(taint.Key, key) {
+				ignored = true
+			}
+		}
+
+		if !ignored {
+			hasAnyCustomTaint = true
+		}
+	}
+
+	return node.Spec.Unschedulable || toBeDeletedByCA || hasAnyK8sTaint || hasAnyCustomTaint
+}
+
+// countDetachingNodes returns the number of nodes selected by the policy that are being detached
+func countDetachingNodes(ctx context.Context, c client.Reader, policies []v1alpha1.DetachPolicy, policy *v1alpha1.DetachPolicy) (int, error) {
+	var nodes corev1.NodeList
+
+	if err := c.List(ctx, &nodes); err != nil {
+		return 0, err
+	}
+
+	var count int
+
+	for _, n := range nodes.Items {
+		if n.Annotations[NodeAnnotationKeyDetaching] != "true" {
+			continue
+		}
+
+		p, err := selectDetachPolicy(policies, n)
+		if err != nil {
+			return 0, err
+		}
+
+		if p != nil && p.Name == policy.Name {
+			count++
+		}
+	}
+
+	return count, nil
+}
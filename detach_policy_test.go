@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// staleCacheClient lists nodes as of when it is created, like an informer cache that has yet to see later updates
+type staleCacheClient struct {
+	client.Client
+
+	nodes corev1.NodeList
+}
+
+func (c *staleCacheClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	if nodes, ok := list.(*corev1.NodeList); ok {
+		c.nodes.DeepCopyInto(nodes)
+
+		return nil
+	}
+
+	return c.Client.List(ctx, list, opts...)
+}
+
+var _ = Describe("DetachPolicy", func() {
+	gpuNodeTaint := corev1.Taint{Key: "nvidia.com/gpu", Effect: corev1.TaintEffectNoSchedule}
+
+	policies := []v1alpha1.DetachPolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "b-default"},
+			Spec: v1alpha1.DetachPolicySpec{
+				Triggers: v1alpha1.DetachTriggers{
+					Cordon: true,
+					Taints: []v1alpha1.TaintRule{{Key: NodeTaintToBeDeletedByCA}},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "a-ingress"},
+			Spec: v1alpha1.DetachPolicySpec{
+				NodeSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "ingress"}},
+				Triggers: v1alpha1.DetachTriggers{
+					Conditions:  []v1alpha1.NodeConditionRule{{Type: "KernelDeadlock", Status: corev1.ConditionTrue}},
+					Annotations: []v1alpha1.AnnotationRule{{Key: "example.com/retire"}},
+				},
+				Exclusions: v1alpha1.DetachExclusions{
+					Annotations: []v1alpha1.AnnotationRule{{Key: "example.com/keep", Value: "true"}},
+				},
+			},
+		},
+	}
+
+	It("keeps legacy behavior of treating any custom taint as a trigger", func() {
+		Expect(legacyDetachTriggered(corev1.Node{})).To(BeFalse())
+		Expect(legacyDetachTriggered(corev1.Node{Spec: corev1.NodeSpec{Taints: []corev1.Taint{gpuNodeTaint}}})).To(BeTrue())
+	})
+
+	It("ignores taints with extra ignored prefixes in legacy mode", func() {
+		node := corev1.Node{Spec: corev1.NodeSpec{Taints: []corev1.Taint{{Key: "karpenter.sh/unregistered", Effect: corev1.TaintEffectNoExecute}}}}
+
+		Expect(legacyDetachTriggered(node)).To(BeTrue())
+		Expect(legacyDetachTriggered(node, KarpenterTaintKeyPrefix)).To(BeFalse())
+	})
+
+	It("selects the first matching policy in the name order", func() {
+		sorted := []v1alpha1.DetachPolicy{policies[1], policies[0]}
+
+		ingress := corev1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"role": "ingress"}}}
+
+		p, err := selectDetachPolicy(sorted, ingress)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Name).To(Equal("a-ingress"))
+
+		p, err = selectDetachPolicy(sorted, corev1.Node{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Name).To(Equal("b-default"))
+	})
+
+	It("doesn't trigger on unrelated taints", func() {
+		node := corev1.Node{Spec: corev1.NodeSpec{Taints: []corev1.Taint{gpuNodeTaint}}}
+
+		_, triggered := detachPolicyTriggered(&policies[0], node, time.Now())
+		Expect(triggered).To(BeFalse())
+
+		node.Spec.Unschedulable = true
+
+		trigger, triggered := detachPolicyTriggered(&policies[0], node, time.Now())
+		Expect(triggered).To(BeTrue())
+		Expect(trigger.reason).To(Equal("cordon"))
+	})
+
+	It("triggers on node conditions and annotations unless excluded", func() {
+		node := corev1.Node{
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{{Type: "KernelDeadlock", Status: corev1.ConditionTrue}},
+			},
+		}
+
+		_, triggered := detachPolicyTriggered(&policies[1], node, time.Now())
+		Expect(triggered).To(BeTrue())
+
+		node.Annotations = map[string]string{"example.com/keep": "true"}
+
+		_, excluded, err := detachPolicyExcludes(&policies[1], node)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(excluded).To(BeTrue())
+	})
+
+	It("triggers on node conditions only after they have been in the status for the duration", func() {
+		rules, err := ParseNodeConditionRules([]string{"KernelDeadlock=True:5m", "ReadonlyFilesystem=True"}, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(HaveLen(2))
+		Expect(rules[0].For.Duration).To(Equal(5 * time.Minute))
+		Expect(rules[1].For).To(BeNil())
+
+		now := time.Now()
+
+		node := corev1.Node{
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{
+					{Type: "KernelDeadlock", Status: corev1.ConditionTrue, LastTransitionTime: metav1.NewTime(now.Add(-2 * time.Minute))},
+				},
+			},
+		}
+
+		trigger, triggered := matchNodeConditionRules(rules, node, now)
+		Expect(triggered).To(BeFalse())
+		Expect(trigger.recheckAfter).To(Equal(3 * time.Minute))
+
+		trigger, triggered = matchNodeConditionRules(rules, node, now.Add(3*time.Minute))
+		Expect(triggered).To(BeTrue())
+		Expect(trigger.noCordon).To(BeTrue())
+
+		_, err = ParseNodeConditionRules([]string{"KernelDeadlock=Yes"}, false)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("postpones detaching nodes that would remove too many local endpoints along with nodes being detached", func() {
+		scheme := runtime.NewScheme()
+		Expect(k8sscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		const ns = "kube-system"
+
+		detaching := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{NodeAnnotationKeyDetaching: "true"}}}
+		node := corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}}
+
+		attachment := &v1alpha1.Attachment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "node1"},
+			Status: v1alpha1.AttachmentStatus{
+				ServiceImpacts: []v1alpha1.ServiceImpact{{Service: "default/envoy", LocalEndpoints: 2, ReadyEndpoints: 6}},
+			},
+		}
+
+		c := fake.NewFakeClientWithScheme(scheme, detaching, node.DeepCopy(), attachment)
+
+		maxUnavailable := intstr.FromString("50%")
+
+		policy := policies[0].DeepCopy()
+		policy.Spec.MaxUnavailableLocalEndpoints = &maxUnavailable
+
+		check := func(impacts ...v1alpha1.ServiceImpact) string {
+			svc, err := checkLocalEndpointBudget(context.Background(), c, ns, policies, policy, node, impacts)
+			Expect(err).NotTo(HaveOccurred())
+
+			return svc
+		}
+
+		Expect(check(v1alpha1.ServiceImpact{Service: "default/envoy", LocalEndpoints: 1, ReadyEndpoints: 6})).To(BeEmpty())
+		Expect(check(v1alpha1.ServiceImpact{Service: "default/envoy", LocalEndpoints: 2, ReadyEndpoints: 6})).To(Equal("default/envoy"))
+		// No other node removes endpoints of the service
+		Expect(check(v1alpha1.ServiceImpact{Service: "default/web", LocalEndpoints: 3, ReadyEndpoints: 3})).To(BeEmpty())
+	})
+
+	It("counts nodes being detached from the API server rather than the stale cache", func() {
+		scheme := runtime.NewScheme()
+		Expect(k8sscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		ctx := context.Background()
+
+		maxConcurrent := int32(1)
+
+		policy := policies[0].DeepCopy()
+		policy.Spec.MaxConcurrentDetachments = &maxConcurrent
+
+		api := fake.NewFakeClientWithScheme(scheme,
+			policy,
+			&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}, Spec: corev1.NodeSpec{Unschedulable: true}},
+			&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}, Spec: corev1.NodeSpec{Unschedulable: true}},
+		)
+
+		cache := &staleCacheClient{Client: api}
+		Expect(api.List(ctx, &cache.nodes)).To(Succeed())
+
+		controller := &NodeController{
+			Client:       cache,
+			CoreV1Client: kubefake.NewSimpleClientset().CoreV1(),
+			Log:          logf.Log.WithName("detach-policy"),
+			recorder:     &record.FakeRecorder{},
+			Namespace:    "default",
+			apiReader:    api,
+		}
+
+		detaching := func(name string) bool {
+			var node corev1.Node
+
+			Expect(api.Get(ctx, types.NamespacedName{Name: name}, &node)).To(Succeed())
+
+			return node.Annotations[NodeAnnotationKeyDetaching] == "true"
+		}
+
+		_, err := controller.reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: "node1"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(detaching("node1")).To(BeTrue())
+
+		res, err := controller.reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: "node2"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.RequeueAfter).To(BeNumerically(">", 0))
+		Expect(detaching("node2")).To(BeFalse())
+	})
+})
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	AttachmentDriftKindAwsTarget       = "AwsTarget"
+	AttachmentDriftKindAwsLoadBalancer = "AwsLoadBalancer"
+
+	// maxAttachmentDrifts is the number of the latest drifts kept in the attachment status
+	maxAttachmentDrifts = 10
+)
+
+func newAttachmentDrift(kind, name string, port *int64, err error) v1alpha1.AttachmentDrift {
+	reason := awsErrorCode(err)
+	if reason == "" {
+		reason = "Unknown"
+	}
+
+	return v1alpha1.AttachmentDrift{
+		Kind:       kind,
+		Name:       name,
+		Port:       port,
+		Reason:     reason,
+		Message:    err.Error(),
+		DetectedAt: metav1.Now(),
+	}
+}
+
+// recordDrifts reports the drifts found while detaching or re-attaching the node in the attachment status,
+// so that a target group deleted in the meantime doesn't fail the whole reconciliation
+func (n *NodeAttachments) recordDrifts(attachment *v1alpha1.Attachment, drifts []v1alpha1.AttachmentDrift) error {
+	if len(drifts) == 0 {
+		return nil
+	}
+
+	for _, d := range drifts {
+		n.Log.Info("Detected drift", "attachment", attachment.Name, "kind", d.Kind, "name", d.Name, "reason", d.Reason, "message", d.Message)
+	}
+
+	if attachment.Status.CachedAt.IsZero() {
+		attachment.Status.CachedAt = attachment.CreationTimestamp
+	}
+
+	attachment.Status.Drifts = append(attachment.Status.Drifts, drifts...)
+
+	if over := len(attachment.Status.Drifts) - maxAttachmentDrifts; over > 0 {
+		attachment.Status.Drifts = attachment.Status.Drifts[over:]
+	}
+
+	return n.client.Status().Update(context.Background(), attachment)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Drifts", func() {
+	var (
+		c client.Client
+		n *NodeAttachments
+	)
+
+	BeforeEach(func() {
+		scheme := runtime.NewScheme()
+		Expect(k8sscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		c = fake.NewFakeClientWithScheme(scheme, &v1alpha1.Attachment{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1", Namespace: "default"},
+		})
+
+		n = &NodeAttachments{Log: logf.Log.WithName("drift"), client: c, namespace: "default"}
+	})
+
+	getAttachment := func() v1alpha1.Attachment {
+		var a v1alpha1.Attachment
+
+		Expect(c.Get(context.Background(), types.NamespacedName{Name: "node1", Namespace: "default"}, &a)).To(Succeed())
+
+		return a
+	}
+
+	It("considers missing target groups and load balancers and invalid targets as drifts", func() {
+		for _, code := range []string{
+			elbv2.ErrCodeTargetGroupNotFoundException,
+			elbv2.ErrCodeInvalidTargetException,
+			elb.ErrCodeAccessPointNotFoundException,
+			elb.ErrCodeInvalidEndPointException,
+		} {
+			err := awserr.New(code, "gone", nil)
+
+			Expect(isAWSDriftError(err)).To(BeTrue(), code)
+			Expect(newAttachmentDrift(AttachmentDriftKindAwsTarget, "tg", nil, err).Reason).To(Equal(code))
+		}
+
+		Expect(isAWSDriftError(awserr.New("Throttling", "rate exceeded", nil))).To(BeFalse())
+		Expect(isAWSDriftError(fmt.Errorf("connection reset"))).To(BeFalse())
+		Expect(newAttachmentDrift(AttachmentDriftKindAwsTarget, "tg", nil, fmt.Errorf("connection reset")).Reason).To(Equal("Unknown"))
+	})
+
+	It("records drifts of invalid targets and missing target groups in the attachment status", func() {
+		a := getAttachment()
+
+		Expect(n.recordDrifts(&a, []v1alpha1.AttachmentDrift{
+			newAttachmentDrift(AttachmentDriftKindAwsTarget, "tg-1", nil, awserr.New(elbv2.ErrCodeInvalidTargetException, "the instance is terminated", nil)),
+			newAttachmentDrift(AttachmentDriftKindAwsTarget, "tg-2", nil, awserr.New(elbv2.ErrCodeTargetGroupNotFoundException, "not found", nil)),
+		})).To(Succeed())
+
+		drifts := getAttachment().Status.Drifts
+		Expect(drifts).To(HaveLen(2))
+		Expect(drifts[0].Reason).To(Equal(elbv2.ErrCodeInvalidTargetException))
+		Expect(drifts[1].Reason).To(Equal(elbv2.ErrCodeTargetGroupNotFoundException))
+
+		a = getAttachment()
+
+		// Nothing to record
+		Expect(n.recordDrifts(&a, nil)).To(Succeed())
+		Expect(getAttachment().Status.Drifts).To(HaveLen(2))
+	})
+
+	It("keeps only the latest drifts", func() {
+		for i := 0; i < maxAttachmentDrifts+2; i++ {
+			a := getAttachment()
+
+			drift := newAttachmentDrift(AttachmentDriftKindAwsTarget, fmt.Sprintf("tg-%d", i), nil, awserr.New(elbv2.ErrCodeTargetGroupNotFoundException, "not found", nil))
+
+			Expect(n.recordDrifts(&a, []v1alpha1.AttachmentDrift{drift})).To(Succeed())
+		}
+
+		drifts := getAttachment().Status.Drifts
+		Expect(drifts).To(HaveLen(maxAttachmentDrifts))
+		Expect(drifts[0].Name).To(Equal("tg-2"))
+		Expect(drifts[maxAttachmentDrifts-1].Name).To(Equal(fmt.Sprintf("tg-%d", maxAttachmentDrifts+1)))
+	})
+})
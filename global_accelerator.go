@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/globalaccelerator"
+	"github.com/aws/aws-sdk-go/service/globalaccelerator/globalacceleratoriface"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	"sync"
+)
+
+const (
+	// GlobalAcceleratorDetachModeWeight sets the weight of the endpoint to 0 on detachment
+	GlobalAcceleratorDetachModeWeight = "weight"
+
+	// GlobalAcceleratorDetachModeRemove removes the endpoint from the endpoint group on detachment
+	GlobalAcceleratorDetachModeRemove = "remove"
+)
+
+// GlobalAcceleratorIntegration discovers, detaches and re-attaches AWS Global Accelerator endpoints whose endpoint IDs
+// are node's EC2 instance IDs.
+type GlobalAcceleratorIntegration struct {
+	Svc globalacceleratoriface.GlobalAcceleratorAPI
+
+	// DetachMode is either `weight` or `remove`
+	DetachMode string
+
+	mu sync.Mutex
+
+	// groupLocks are held while changing endpoint groups, keyed by the endpoint group ARN
+	groupLocks map[string]*sync.Mutex
+}
+
+func (g *GlobalAcceleratorIntegration) validate() error {
+	switch g.DetachMode {
+	case GlobalAcceleratorDetachModeWeight, GlobalAcceleratorDetachModeRemove:
+		return nil
+	default:
+		return fmt.Errorf("unsupported global accelerator detach mode %q: it must be either %q or %q", g.DetachMode, GlobalAcceleratorDetachModeWeight, GlobalAcceleratorDetachModeRemove)
+	}
+}
+
+func (g *GlobalAcceleratorIntegration) listEndpointGroups() ([]*globalaccelerator.EndpointGroup, error) {
+	var accelerators []*globalaccelerator.Accelerator
+
+	{
+		input := &globalaccelerator.ListAcceleratorsInput{}
+
+		for {
+			output, err := g.Svc.ListAccelerators(input)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to list accelerators: %v", err)
+			}
+
+			accelerators = append(accelerators, output.Accelerators...)
+
+			if output.NextToken == nil {
+				break
+			}
+
+			input.NextToken = output.NextToken
+		}
+	}
+
+	var listeners []*globalaccelerator.Listener
+
+	for _, a := range accelerators {
+		input := &globalaccelerator.ListListenersInput{AcceleratorArn: a.AcceleratorArn}
+
+		for {
+			output, err := g.Svc.ListListeners(input)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to list listeners of accelerator %q: %v", aws.StringValue(a.AcceleratorArn), err)
+			}
+
+			listeners = append(listeners, output.Listeners...)
+
+			if output.NextToken == nil {
+				break
+			}
+
+			input.NextToken = output.NextToken
+		}
+	}
+
+	var groups []*globalaccelerator.EndpointGroup
+
+	for _, l := range listeners {
+		input := &globalaccelerator.ListEndpointGroupsInput{ListenerArn: l.ListenerArn}
+
+		for {
+			output, err := g.Svc.ListEndpointGroups(input)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to list endpoint groups of listener %q: %v", aws.StringValue(l.ListenerArn), err)
+			}
+
+			groups = append(groups, output.EndpointGroups...)
+
+			if output.NextToken == nil {
+				break
+			}
+
+			input.NextToken = output.NextToken
+		}
+	}
+
+	return groups, nil
+}
+
+// getIDToEndpoints returns Global Accelerator endpoints for the EC2 instances, keyed by the instance ID
+func (g *GlobalAcceleratorIntegration) getIDToEndpoints(ids []string) (map[string][]v1alpha1.GlobalAcceleratorEndpoint, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	idMap := map[string]bool{}
+	for _, id := range ids {
+		idMap[id] = true
+	}
+
+	groups, err := g.listEndpointGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	idToEndpoints := map[string][]v1alpha1.GlobalAcceleratorEndpoint{}
+
+	for _, group := range groups {
+		for _, desc := range group.EndpointDescriptions {
+			id := aws.StringValue(desc.EndpointId)
+
+			if !idMap[id] {
+				continue
+			}
+
+			idToEndpoints[id] = append(idToEndpoints[id], v1alpha1.GlobalAcceleratorEndpoint{
+				EndpointGroupARN:            aws.StringValue(group.EndpointGroupArn),
+				EndpointID:                  id,
+				Weight:                      desc.Weight,
+				ClientIPPreservationEnabled: desc.ClientIPPreservationEnabled,
+			})
+		}
+	}
+
+	return idToEndpoints, nil
+}
+
+// lockEndpointGroup serializes changes to the endpoint group across concurrent reconciliations, and returns the
+// function to unlock it
+func (g *GlobalAcceleratorIntegration) lockEndpointGroup(arn string) func() {
+	g.mu.Lock()
+
+	if g.groupLocks == nil {
+		g.groupLocks = map[string]*sync.Mutex{}
+	}
+
+	l, ok := g.groupLocks[arn]
+	if !ok {
+		l = &sync.Mutex{}
+		g.groupLocks[arn] = l
+	}
+
+	g.mu.Unlock()
+
+	l.Lock()
+
+	return l.Unlock
+}
+
+// updateEndpoint replaces the endpoint configuration in the endpoint group, or adds the endpoint when it is missing.
+// UpdateEndpointGroup replaces all the endpoints in the group, so we need to keep other endpoints as-is. The caller
+// must lock the endpoint group so that concurrent updates never overwrite each other.
+func (g *GlobalAcceleratorIntegration) updateEndpoint(ep v1alpha1.GlobalAcceleratorEndpoint, config *globalaccelerator.EndpointConfiguration) error {
+	output, err := g.Svc.DescribeEndpointGroup(&globalaccelerator.DescribeEndpointGroupInput{
+		EndpointGroupArn: aws.String(ep.EndpointGroupARN),
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to describe endpoint group %q: %v", ep.EndpointGroupARN, err)
+	}
+
+	var (
+		configs []*globalaccelerator.EndpointConfiguration
+		found   bool
+	)
+
+	for _, desc := range output.EndpointGroup.EndpointDescriptions {
+		if aws.StringValue(desc.EndpointId) == ep.EndpointID {
+			found = true
+
+			configs = append(configs, config)
+
+			continue
+		}
+
+		configs = append(configs, &globalaccelerator.EndpointConfiguration{
+			EndpointId:                  desc.EndpointId,
+			Weight:                      desc.Weight,
+			ClientIPPreservationEnabled: desc.ClientIPPreservationEnabled,
+		})
+	}
+
+	if !found {
+		// Added without replacing other endpoints, which may have been added or removed outside of node-detacher
+		if _, err := g.Svc.AddEndpoints(&globalaccelerator.AddEndpointsInput{
+			EndpointGroupArn:       aws.String(ep.EndpointGroupARN),
+			EndpointConfigurations: []*globalaccelerator.EndpointConfiguration{config},
+		}); err != nil {
+			return fmt.Errorf("Unable to add endpoint %q to endpoint group %q: %v", ep.EndpointID, ep.EndpointGroupARN, err)
+		}
+
+		return nil
+	}
+
+	if _, err := g.Svc.UpdateEndpointGroup(&globalaccelerator.UpdateEndpointGroupInput{
+		EndpointGroupArn:       aws.String(ep.EndpointGroupARN),
+		EndpointConfigurations: configs,
+	}); err != nil {
+		return fmt.Errorf("Unable to update endpoint group %q: %v", ep.EndpointGroupARN, err)
+	}
+
+	return nil
+}
+
+// removeEndpoint removes the endpoint from the endpoint group, without replacing other endpoints
+func (g *GlobalAcceleratorIntegration) removeEndpoint(ep v1alpha1.GlobalAcceleratorEndpoint) error {
+	if _, err := g.Svc.RemoveEndpoints(&globalaccelerator.RemoveEndpointsInput{
+		EndpointGroupArn: aws.String(ep.EndpointGroupARN),
+		EndpointIdentifiers: []*globalaccelerator.EndpointIdentifier{
+			{
+				EndpointId:                  aws.String(ep.EndpointID),
+				ClientIPPreservationEnabled: ep.ClientIPPreservationEnabled,
+			},
+		},
+	}); err != nil {
+		if awsErrorCode(err) == globalaccelerator.ErrCodeEndpointNotFoundException {
+			// Already removed
+			return nil
+		}
+
+		return fmt.Errorf("Unable to remove endpoint %q from endpoint group %q: %v", ep.EndpointID, ep.EndpointGroupARN, err)
+	}
+
+	return nil
+}
+
+// detachEndpoint sets the weight of the endpoint to 0, or removes the endpoint from the endpoint group
+func (g *GlobalAcceleratorIntegration) detachEndpoint(ep v1alpha1.GlobalAcceleratorEndpoint) error {
+	defer g.lockEndpointGroup(ep.EndpointGroupARN)()
+
+	if g.DetachMode == GlobalAcceleratorDetachModeRemove {
+		return g.removeEndpoint(ep)
+	}
+
+	return g.updateEndpoint(ep, &globalaccelerator.EndpointConfiguration{
+		EndpointId:                  aws.String(ep.EndpointID),
+		Weight:                      aws.Int64(0),
+		ClientIPPreservationEnabled: ep.ClientIPPreservationEnabled,
+	})
+}
+
+// attachEndpoint restores the endpoint with the original weight, adding it back when it has been removed
+func (g *GlobalAcceleratorIntegration) attachEndpoint(ep v1alpha1.GlobalAcceleratorEndpoint) error {
+	defer g.lockEndpointGroup(ep.EndpointGroupARN)()
+
+	return g.updateEndpoint(ep, &globalaccelerator.EndpointConfiguration{
+		EndpointId:                  aws.String(ep.EndpointID),
+		Weight:                      ep.Weight,
+		ClientIPPreservationEnabled: ep.ClientIPPreservationEnabled,
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/globalaccelerator"
+	"github.com/aws/aws-sdk-go/service/globalaccelerator/globalacceleratoriface"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeGlobalAccelerator simulates endpoint groups of Global Accelerator. DescribeEndpointGroup takes a while so that
+// concurrent read-modify-write cycles interleave.
+type fakeGlobalAccelerator struct {
+	globalacceleratoriface.GlobalAcceleratorAPI
+
+	mu sync.Mutex
+
+	// weights are weights of endpoints keyed by the endpoint group ARN and the endpoint ID
+	weights map[string]map[string]int64
+}
+
+func (f *fakeGlobalAccelerator) DescribeEndpointGroup(input *globalaccelerator.DescribeEndpointGroupInput) (*globalaccelerator.DescribeEndpointGroupOutput, error) {
+	f.mu.Lock()
+
+	group := &globalaccelerator.EndpointGroup{EndpointGroupArn: input.EndpointGroupArn}
+
+	for id, w := range f.weights[aws.StringValue(input.EndpointGroupArn)] {
+		group.EndpointDescriptions = append(group.EndpointDescriptions, &globalaccelerator.EndpointDescription{
+			EndpointId: aws.String(id),
+			Weight:     aws.Int64(w),
+		})
+	}
+
+	f.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	return &globalaccelerator.DescribeEndpointGroupOutput{EndpointGroup: group}, nil
+}
+
+func (f *fakeGlobalAccelerator) UpdateEndpointGroup(input *globalaccelerator.UpdateEndpointGroupInput) (*globalaccelerator.UpdateEndpointGroupOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	weights := map[string]int64{}
+
+	for _, c := range input.EndpointConfigurations {
+		weights[aws.StringValue(c.EndpointId)] = aws.Int64Value(c.Weight)
+	}
+
+	f.weights[aws.StringValue(input.EndpointGroupArn)] = weights
+
+	return &globalaccelerator.UpdateEndpointGroupOutput{}, nil
+}
+
+func (f *fakeGlobalAccelerator) AddEndpoints(input *globalaccelerator.AddEndpointsInput) (*globalaccelerator.AddEndpointsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, c := range input.EndpointConfigurations {
+		f.weights[aws.StringValue(input.EndpointGroupArn)][aws.StringValue(c.EndpointId)] = aws.Int64Value(c.Weight)
+	}
+
+	return &globalaccelerator.AddEndpointsOutput{}, nil
+}
+
+func (f *fakeGlobalAccelerator) RemoveEndpoints(input *globalaccelerator.RemoveEndpointsInput) (*globalaccelerator.RemoveEndpointsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	weights := f.weights[aws.StringValue(input.EndpointGroupArn)]
+
+	for _, id := range input.EndpointIdentifiers {
+		if _, ok := weights[aws.StringValue(id.EndpointId)]; !ok {
+			return nil, awserr.New(globalaccelerator.ErrCodeEndpointNotFoundException, "endpoint not found", nil)
+		}
+	}
+
+	for _, id := range input.EndpointIdentifiers {
+		delete(weights, aws.StringValue(id.EndpointId))
+	}
+
+	return &globalaccelerator.RemoveEndpointsOutput{}, nil
+}
+
+var _ = Describe("GlobalAcceleratorIntegration", func() {
+	const groupARN = "arn:aws:globalaccelerator::123456789012:accelerator/a/listener/l/endpoint-group/g"
+
+	var (
+		svc *fakeGlobalAccelerator
+		ids []string
+	)
+
+	BeforeEach(func() {
+		svc = &fakeGlobalAccelerator{weights: map[string]map[string]int64{groupARN: {}}}
+
+		ids = nil
+
+		for i := 0; i < 10; i++ {
+			id := fmt.Sprintf("i-%d", i)
+
+			ids = append(ids, id)
+			svc.weights[groupARN][id] = 128
+		}
+	})
+
+	endpointOf := func(id string) v1alpha1.GlobalAcceleratorEndpoint {
+		return v1alpha1.GlobalAcceleratorEndpoint{EndpointGroupARN: groupARN, EndpointID: id, Weight: aws.Int64(128)}
+	}
+
+	// concurrently runs the function for every endpoint, like reconciliations of nodes in the same endpoint group
+	concurrently := func(f func(v1alpha1.GlobalAcceleratorEndpoint) error) {
+		var wg sync.WaitGroup
+
+		for _, id := range ids {
+			wg.Add(1)
+
+			go func(ep v1alpha1.GlobalAcceleratorEndpoint) {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				Expect(f(ep)).To(Succeed())
+			}(endpointOf(id))
+		}
+
+		wg.Wait()
+	}
+
+	It("never loses concurrent weight updates to the same endpoint group", func() {
+		g := &GlobalAcceleratorIntegration{Svc: svc, DetachMode: GlobalAcceleratorDetachModeWeight}
+
+		concurrently(g.detachEndpoint)
+
+		for _, id := range ids {
+			Expect(svc.weights[groupARN]).To(HaveKeyWithValue(id, int64(0)))
+		}
+
+		concurrently(g.attachEndpoint)
+
+		for _, id := range ids {
+			Expect(svc.weights[groupARN]).To(HaveKeyWithValue(id, int64(128)))
+		}
+	})
+
+	It("removes and adds back only the endpoint of the node", func() {
+		g := &GlobalAcceleratorIntegration{Svc: svc, DetachMode: GlobalAcceleratorDetachModeRemove}
+
+		concurrently(g.detachEndpoint)
+
+		Expect(svc.weights[groupARN]).To(BeEmpty())
+
+		// Removing an already removed endpoint is a no-op
+		Expect(g.detachEndpoint(endpointOf("i-0"))).To(Succeed())
+
+		// Added outside of node-detacher while the nodes are detached
+		svc.weights[groupARN]["i-external"] = 255
+
+		concurrently(g.attachEndpoint)
+
+		Expect(svc.weights[groupARN]).To(HaveLen(len(ids) + 1))
+		Expect(svc.weights[groupARN]).To(HaveKeyWithValue("i-0", int64(128)))
+		Expect(svc.weights[groupARN]).To(HaveKeyWithValue("i-external", int64(255)))
+	})
+})
@@ -3,14 +3,18 @@ module github.com/mumoshu/node-detacher
 go 1.13
 
 require (
-	github.com/aws/aws-sdk-go v1.29.19
+	github.com/aws/aws-sdk-go v1.44.125
 	github.com/go-logr/logr v0.1.0
 	github.com/onsi/ginkgo v1.8.0
 	github.com/onsi/gomega v1.5.0
+	github.com/stretchr/testify v1.4.0 // indirect
 	go.uber.org/zap v1.9.1
+	golang.org/x/time v0.0.0-20181108054448-85acf8d2951c
+	gopkg.in/fsnotify.v1 v1.4.7
 	k8s.io/api v0.0.0-20190918155943-95b840bb6a1f
 	k8s.io/apimachinery v0.0.0-20190913080033-27d36303b655
 	k8s.io/client-go v0.0.0-20190918160344-1fbdaa4c8d90
 	k8s.io/klog v0.4.0
 	sigs.k8s.io/controller-runtime v0.4.0
+	sigs.k8s.io/yaml v1.1.0
 )
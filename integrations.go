@@ -0,0 +1,443 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	"strings"
+)
+
+// AWSIntegrationKind is the kind of AWS load balancers an integration handles.
+//
+// Every target group and CLB is handled by at most one integration, determined by tags that Kubernetes controllers add
+// to load balancers they manage, so that static and dynamic load balancers of the same node never conflict.
+type AWSIntegrationKind string
+
+const (
+	// AWSIntegrationStaticTargetGroups handles target groups of ALBs and NLBs managed externally to Kubernetes, e.g.
+	// by Terraform or CloudFormation
+	AWSIntegrationStaticTargetGroups AWSIntegrationKind = "StaticTargetGroups"
+
+	// AWSIntegrationStaticCLBs handles CLBs managed externally to Kubernetes
+	AWSIntegrationStaticCLBs AWSIntegrationKind = "StaticCLBs"
+
+	// AWSIntegrationALBIngress handles target groups managed by aws-alb-ingress-controller and
+	// aws-load-balancer-controller for ingresses.
+	//
+	// The desired node-to-targetgroup relationship can't be determined until the node is detached, as the controller
+	// keeps registering and de-registering nodes. So it is usually discovered on detach.
+	AWSIntegrationALBIngress AWSIntegrationKind = "ALBIngress"
+
+	// AWSIntegrationDynamicNLBs handles target groups of NLBs managed via `type: LoadBalancer` services
+	AWSIntegrationDynamicNLBs AWSIntegrationKind = "DynamicNLBs"
+
+	// AWSIntegrationDynamicCLBs handles CLBs managed via `type: LoadBalancer` services
+	AWSIntegrationDynamicCLBs AWSIntegrationKind = "DynamicCLBs"
+)
+
+const (
+	// AWSTagKeyServiceName is added by the Kubernetes cloud provider to CLBs and NLB target groups of services
+	AWSTagKeyServiceName = "kubernetes.io/service-name"
+
+	// AWSTagKeyIngressName is added by aws-alb-ingress-controller to target groups of ingresses
+	AWSTagKeyIngressName = "kubernetes.io/ingress-name"
+
+	// AWSTagKeyIngressStack and AWSTagKeyServiceStack are added by aws-load-balancer-controller to target groups of
+	// ingresses and services respectively
+	AWSTagKeyIngressStack = "ingress.k8s.aws/stack"
+	AWSTagKeyServiceStack = "service.k8s.aws/stack"
+
+	// AWSTagKeyNamespace is added by aws-alb-ingress-controller along with the service name tag, which lacks the
+	// namespace
+	AWSTagKeyNamespace = "kubernetes.io/namespace"
+)
+
+// AWSDiscovery is when an integration discovers load balancers the node is registered to
+type AWSDiscovery string
+
+const (
+	// AWSDiscoveryNodeCreation discovers load balancers on node creation, and on node-detacher's startup for all
+	// the nodes. Suitable for load balancers whose node-to-load-balancer relationship is static
+	AWSDiscoveryNodeCreation AWSDiscovery = "NodeCreation"
+
+	// AWSDiscoveryDetach discovers load balancers on detach, as the relationship changes along with pods and services
+	AWSDiscoveryDetach AWSDiscovery = "Detach"
+)
+
+// AWSSource is where an integration discovers load balancers the node is registered to from
+type AWSSource string
+
+const (
+	// AWSSourceAWS discovers load balancers by scanning all the load balancers via AWS APIs
+	AWSSourceAWS AWSSource = "AWS"
+
+	// AWSSourceKubernetes discovers load balancers referenced by services of `type: LoadBalancer`, ingresses, and
+	// TargetGroupBindings, so that only the load balancers managed via Kubernetes are queried
+	AWSSourceKubernetes AWSSource = "Kubernetes"
+)
+
+// AWSIntegration is an integration with a kind of AWS load balancers, configured independently of other integrations
+type AWSIntegration struct {
+	Kind AWSIntegrationKind
+
+	// Discovery is when load balancers handled by the integration are discovered
+	Discovery AWSDiscovery
+
+	// Source is where load balancers are discovered from. Empty for AWS
+	Source AWSSource
+
+	// Tags limits the scope of the integration to load balancers tagged with all the tags. Empty for all
+	Tags map[string]string
+}
+
+// handlesTargetGroups returns true when the integration handles target groups rather than CLBs
+func (i AWSIntegration) handlesTargetGroups() bool {
+	return i.Kind != AWSIntegrationStaticCLBs && i.Kind != AWSIntegrationDynamicCLBs
+}
+
+// inScope returns true when the load balancer with the tags is in the scope of the integration
+func (i AWSIntegration) inScope(tags map[string]string) bool {
+	for k, v := range i.Tags {
+		if tags[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// classifyCLB returns the kind of integration that handles the CLB with the tags
+func classifyCLB(tags map[string]string) AWSIntegrationKind {
+	if _, ok := tags[AWSTagKeyServiceName]; ok {
+		return AWSIntegrationDynamicCLBs
+	}
+
+	return AWSIntegrationStaticCLBs
+}
+
+// classifyTargetGroup returns the kind of integration that handles the target group with the tags.
+// Note that aws-alb-ingress-controller adds the service name tag to target groups of ingresses, too.
+func classifyTargetGroup(tags map[string]string) AWSIntegrationKind {
+	if _, ok := tags[AWSTagKeyIngressName]; ok {
+		return AWSIntegrationALBIngress
+	}
+
+	if _, ok := tags[AWSTagKeyIngressStack]; ok {
+		return AWSIntegrationALBIngress
+	}
+
+	if _, ok := tags[AWSTagKeyServiceName]; ok {
+		return AWSIntegrationDynamicNLBs
+	}
+
+	if _, ok := tags[AWSTagKeyServiceStack]; ok {
+		return AWSIntegrationDynamicNLBs
+	}
+
+	return AWSIntegrationStaticTargetGroups
+}
+
+// servicesFromTags returns Kubernetes services behind the load balancer or the target group with the tags, in the form
+// of NAMESPACE/NAME
+func servicesFromTags(tags map[string]string) []string {
+	var services []string
+
+	if name := tags[AWSTagKeyServiceName]; strings.Contains(name, "/") {
+		services = append(services, name)
+	} else if ns := tags[AWSTagKeyNamespace]; name != "" && ns != "" {
+		services = append(services, ns+"/"+name)
+	}
+
+	if stack := tags[AWSTagKeyServiceStack]; stack != "" {
+		services = append(services, stack)
+	}
+
+	return uniqueSorted(services)
+}
+
+// findAWSIntegration returns the integration of the kind whose scope includes the load balancer with the tags
+func findAWSIntegration(integrations []AWSIntegration, kind AWSIntegrationKind, tags map[string]string) *AWSIntegration {
+	for i := range integrations {
+		if integrations[i].Kind == kind && integrations[i].inScope(tags) {
+			return &integrations[i]
+		}
+	}
+
+	return nil
+}
+
+// awsIntegrationsDiscoveredOn returns integrations that discover load balancers at the timing
+func awsIntegrationsDiscoveredOn(integrations []AWSIntegration, discovery AWSDiscovery) []AWSIntegration {
+	var on []AWSIntegration
+
+	for _, i := range integrations {
+		if i.Discovery == discovery {
+			on = append(on, i)
+		}
+	}
+
+	return on
+}
+
+// ParseAWSDiscovery parses the discovery timing given via command-line flags
+func ParseAWSDiscovery(s string) (AWSDiscovery, error) {
+	switch d := AWSDiscovery(s); d {
+	case AWSDiscoveryNodeCreation, AWSDiscoveryDetach:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown discovery %q: it must be either %s or %s", s, AWSDiscoveryNodeCreation, AWSDiscoveryDetach)
+	}
+}
+
+// ParseAWSSource parses the source of discovery given via command-line flags
+func ParseAWSSource(s string) (AWSSource, error) {
+	switch src := AWSSource(s); src {
+	case "":
+		return AWSSourceAWS, nil
+	case AWSSourceAWS, AWSSourceKubernetes:
+		return src, nil
+	default:
+		return "", fmt.Errorf("unknown source %q: it must be either %s or %s", s, AWSSourceAWS, AWSSourceKubernetes)
+	}
+}
+
+// ParseAWSIntegrationTags parses `KEY=VALUE` given via command-line flags into tags
+func ParseAWSIntegrationTags(kvs []string) (map[string]string, error) {
+	tags := map[string]string{}
+
+	for _, kv := range kvs {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid tag %q: it must be in the form of KEY=VALUE", kv)
+		}
+
+		tags[pair[0]] = pair[1]
+	}
+
+	return tags, nil
+}
+
+// discoverAWSLoadBalancers returns target groups and CLBs each instance is registered to, which are handled by any of
+// the integrations.
+//
+// Load balancers of integrations sourced from Kubernetes are derived from Kubernetes resources, and the others are
+// discovered by scanning load balancers via AWS APIs.
+func (n *NodeAttachments) discoverAWSLoadBalancers(instanceIDs []string, integrations []AWSIntegration) (map[string][]v1alpha1.AwsLoadBalancer, map[string][]v1alpha1.AwsTarget, error) {
+	var viaAWS, viaKubernetes []AWSIntegration
+
+	for _, i := range integrations {
+		if i.Source == AWSSourceKubernetes {
+			viaKubernetes = append(viaKubernetes, i)
+		} else {
+			viaAWS = append(viaAWS, i)
+		}
+	}
+
+	instanceToCLBs, instanceToTargets, err := n.scanAWSLoadBalancers(instanceIDs, viaAWS)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(viaKubernetes) > 0 {
+		k8sCLBs, k8sTargets, err := n.discoverAWSLoadBalancersViaKubernetes(instanceIDs, viaKubernetes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for id, clbs := range k8sCLBs {
+			instanceToCLBs[id] = append(instanceToCLBs[id], clbs...)
+		}
+
+		for id, targets := range k8sTargets {
+			instanceToTargets[id] = append(instanceToTargets[id], targets...)
+		}
+	}
+
+	if err := n.markBoundTargetGroups(instanceToTargets); err != nil {
+		return nil, nil, err
+	}
+
+	return instanceToCLBs, instanceToTargets, nil
+}
+
+// scanAWSLoadBalancers returns target groups and CLBs each instance is registered to, which are handled by any of
+// the integrations, by scanning all the load balancers.
+//
+// Load balancers may live in any of node-detacher's own account and the configured accounts and regions.
+func (n *NodeAttachments) scanAWSLoadBalancers(instanceIDs []string, integrations []AWSIntegration) (map[string][]v1alpha1.AwsLoadBalancer, map[string][]v1alpha1.AwsTarget, error) {
+	var handlesCLBs, handlesTGs bool
+
+	for _, i := range integrations {
+		if i.handlesTargetGroups() {
+			handlesTGs = true
+		} else {
+			handlesCLBs = true
+		}
+	}
+
+	instanceToCLBs := map[string][]v1alpha1.AwsLoadBalancer{}
+
+	instanceToTargets := map[string][]v1alpha1.AwsTarget{}
+
+	for _, svc := range n.allAWSServices() {
+		if handlesCLBs {
+			idToCLBs, err := getIDToCLBs(svc.ELB, instanceIDs)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			var names []string
+
+			seen := map[string]bool{}
+
+			for _, clbs := range idToCLBs {
+				for _, clb := range clbs {
+					if !seen[clb] {
+						seen[clb] = true
+						names = append(names, clb)
+					}
+				}
+			}
+
+			clbToTags, err := getCLBTags(svc.ELB, names)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			for id, clbs := range idToCLBs {
+				for _, clb := range clbs {
+					tags := clbToTags[clb]
+
+					i := findAWSIntegration(integrations, classifyCLB(tags), tags)
+					if i == nil {
+						continue
+					}
+
+					instanceToCLBs[id] = append(instanceToCLBs[id], v1alpha1.AwsLoadBalancer{
+						Name:        clb,
+						Account:     svc.Account,
+						Region:      svc.Region,
+						Integration: string(i.Kind),
+						Services:    servicesFromTags(tags),
+					})
+				}
+			}
+		}
+
+		if handlesTGs {
+			_, idToTDs, err := getIDToTGs(svc.ELBV2, instanceIDs)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			var arns []string
+
+			seen := map[string]bool{}
+
+			for _, tgs := range idToTDs {
+				for arn := range tgs {
+					if !seen[arn] {
+						seen[arn] = true
+						arns = append(arns, arn)
+					}
+				}
+			}
+
+			tgToTags, err := getTGTags(svc.ELBV2, arns)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			for id, tgs := range idToTDs {
+				for arn, tds := range tgs {
+					tags := tgToTags[arn]
+
+					i := findAWSIntegration(integrations, classifyTargetGroup(tags), tags)
+					if i == nil {
+						continue
+					}
+
+					for _, td := range tds {
+						instanceToTargets[id] = append(instanceToTargets[id], v1alpha1.AwsTarget{
+							ARN:         arn,
+							Port:        td.Port,
+							Account:     svc.Account,
+							Region:      svc.Region,
+							Integration: string(i.Kind),
+							Controller:  classifyTargetGroupController(tags),
+							Services:    servicesFromTags(tags),
+						})
+					}
+				}
+			}
+		}
+	}
+
+	return instanceToCLBs, instanceToTargets, nil
+}
+
+// mergeDiscoveredOnDetach merges target groups and CLBs discovered on detach into the attachment.
+//
+// Ones discovered on detach previously are replaced, unless the node is already being de-registered from them.
+// Ones discovered on node creation are kept as is, so that static and dynamic load balancers of the node coexist.
+func mergeDiscoveredOnDetach(spec *v1alpha1.AttachmentSpec, integrations []AWSIntegration, clbs []v1alpha1.AwsLoadBalancer, targets []v1alpha1.AwsTarget) {
+	onDetach := map[string]bool{}
+
+	for _, i := range integrations {
+		onDetach[string(i.Kind)] = true
+	}
+
+	type clbKey struct{ name, account, region string }
+
+	type targetKey struct {
+		arn, account, region string
+		port                 int64
+	}
+
+	var (
+		mergedCLBs    []v1alpha1.AwsLoadBalancer
+		mergedTargets []v1alpha1.AwsTarget
+		existingCLBs  = map[clbKey]bool{}
+		existingTGs   = map[targetKey]bool{}
+	)
+
+	for _, l := range spec.AwsLoadBalancers {
+		if onDetach[l.Integration] && !l.Detached {
+			continue
+		}
+
+		existingCLBs[clbKey{l.Name, l.Account, l.Region}] = true
+		mergedCLBs = append(mergedCLBs, l)
+	}
+
+	for _, l := range clbs {
+		if !existingCLBs[clbKey{l.Name, l.Account, l.Region}] {
+			mergedCLBs = append(mergedCLBs, l)
+		}
+	}
+
+	portOf := func(t v1alpha1.AwsTarget) int64 {
+		if t.Port == nil {
+			return 0
+		}
+
+		return *t.Port
+	}
+
+	for _, t := range spec.AwsTargets {
+		if onDetach[t.Integration] && !t.Detached {
+			continue
+		}
+
+		existingTGs[targetKey{t.ARN, t.Account, t.Region, portOf(t)}] = true
+		mergedTargets = append(mergedTargets, t)
+	}
+
+	for _, t := range targets {
+		if !existingTGs[targetKey{t.ARN, t.Account, t.Region, portOf(t)}] {
+			mergedTargets = append(mergedTargets, t)
+		}
+	}
+
+	spec.AwsLoadBalancers = mergedCLBs
+	spec.AwsTargets = mergedTargets
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sort"
+	"strings"
+)
+
+// +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch
+// +kubebuilder:rbac:groups=elbv2.k8s.aws,resources=targetgroupbindings,verbs=get;list;watch
+
+const (
+	// ServiceAnnotationKeyNLBTargetType and IngressAnnotationKeyTargetType set to `ip` make load balancers forward
+	// traffic directly to pods rather than nodes, which are never registered to load balancers
+	ServiceAnnotationKeyNLBTargetType = "service.beta.kubernetes.io/aws-load-balancer-nlb-target-type"
+	IngressAnnotationKeyTargetType    = "alb.ingress.kubernetes.io/target-type"
+
+	IngressAnnotationKeyIngressClass = "kubernetes.io/ingress.class"
+	IngressClassALB                  = "alb"
+
+	TargetTypeIP = "ip"
+)
+
+// ingressVersions are the versions of Ingress to list in the order of preference. Kubernetes 1.22 and greater
+// serves only v1, and 1.18 and lower serves only v1beta1
+var ingressVersions = []schema.GroupVersionKind{
+	{Group: "networking.k8s.io", Version: "v1", Kind: "Ingress"},
+	{Group: "networking.k8s.io", Version: "v1beta1", Kind: "Ingress"},
+}
+
+// TargetGroupBindingGVK is the kind of aws-load-balancer-controller's custom resource binding a target group to
+// a service
+var TargetGroupBindingGVK = schema.GroupVersionKind{Group: "elbv2.k8s.aws", Version: "v1beta1", Kind: "TargetGroupBinding"}
+
+// elbRef is the reference to a load balancer from the status of a service or an ingress
+type elbRef struct {
+	// name is the name of the load balancer
+	name string
+
+	// region is the AWS region of the load balancer
+	region string
+
+	// v2 is true for ALBs and NLBs, and false for CLBs
+	v2 bool
+
+	source string
+
+	// service is the service behind the load balancer in the form of NAMESPACE/NAME. Empty for ingresses
+	service string
+}
+
+// tgRef is the reference to a target group from a TargetGroupBinding
+type tgRef struct {
+	arn     string
+	source  string
+	service string
+}
+
+// parseELBHostname returns the load balancer the DNS name in the status of a service or an ingress points to.
+//
+// CLBs and ALBs are named like `[internal-]NAME-ID.REGION.elb.amazonaws.com`, and NLBs are named like
+// `[internal-]NAME-ID.elb.REGION.amazonaws.com`.
+func parseELBHostname(hostname string) (ref elbRef, ok bool) {
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 5 || labels[len(labels)-2] != "amazonaws" && labels[len(labels)-3] != "amazonaws" {
+		return ref, false
+	}
+
+	first := strings.TrimPrefix(labels[0], "internal-")
+
+	i := strings.LastIndex(first, "-")
+	if i <= 0 {
+		return ref, false
+	}
+
+	ref.name = first[:i]
+
+	switch {
+	case labels[1] == "elb":
+		ref.v2 = true
+		ref.region = labels[2]
+	case labels[2] == "elb":
+		ref.region = labels[1]
+	default:
+		return ref, false
+	}
+
+	return ref, true
+}
+
+// kubernetesLoadBalancerRefs returns load balancers and target groups nodes may be registered to, referenced by
+// services of `type: LoadBalancer`, ALB ingresses, and TargetGroupBindings.
+//
+// Ones forwarding traffic directly to pods are omitted, as nodes are never registered to them.
+func (n *NodeAttachments) kubernetesLoadBalancerRefs() ([]elbRef, []tgRef, error) {
+	ctx := context.Background()
+
+	var elbs []elbRef
+
+	var services corev1.ServiceList
+
+	if err := n.client.List(ctx, &services); err != nil {
+		return nil, nil, fmt.Errorf("Unable to list services: %w", err)
+	}
+
+	for _, svc := range services.Items {
+		if svc.Spec.Type != corev1.ServiceTypeLoadBalancer || svc.Annotations[ServiceAnnotationKeyNLBTargetType] == TargetTypeIP {
+			continue
+		}
+
+		for _, ing := range svc.Status.LoadBalancer.Ingress {
+			if ref, ok := parseELBHostname(ing.Hostname); ok {
+				ref.source = fmt.Sprintf("Service/%s/%s", svc.Namespace, svc.Name)
+				ref.service = svc.Namespace + "/" + svc.Name
+				elbs = append(elbs, ref)
+			}
+		}
+	}
+
+	ingresses, err := n.listIngresses(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, ingress := range ingresses {
+		if ingressClass(ingress) != IngressClassALB || ingress.GetAnnotations()[IngressAnnotationKeyTargetType] == TargetTypeIP {
+			continue
+		}
+
+		lbs, _, _ := unstructured.NestedSlice(ingress.Object, "status", "loadBalancer", "ingress")
+
+		for _, lb := range lbs {
+			hostname, _ := lb.(map[string]interface{})["hostname"].(string)
+
+			if ref, ok := parseELBHostname(hostname); ok {
+				// ALBs share the DNS name format with CLBs
+				ref.v2 = true
+				ref.source = fmt.Sprintf("Ingress/%s/%s", ingress.GetNamespace(), ingress.GetName())
+				elbs = append(elbs, ref)
+			}
+		}
+	}
+
+	tgs, err := n.targetGroupBindingRefs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return elbs, tgs, nil
+}
+
+// listIngresses returns ingresses of the most preferred version served by the cluster, so that ones served in
+// multiple versions are never listed twice
+func (n *NodeAttachments) listIngresses(ctx context.Context) ([]unstructured.Unstructured, error) {
+	for _, gvk := range ingressVersions {
+		var ingresses unstructured.UnstructuredList
+
+		ingresses.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+
+		if err := n.client.List(ctx, &ingresses); err != nil {
+			if meta.IsNoMatchError(err) || runtime.IsNotRegisteredError(err) {
+				continue
+			}
+
+			return nil, fmt.Errorf("Unable to list ingresses: %w", err)
+		}
+
+		return ingresses.Items, nil
+	}
+
+	return nil, nil
+}
+
+// ingressClass returns the class of the ingress, preferring the deprecated annotation over `spec.ingressClassName`
+// as Kubernetes does
+func ingressClass(ingress unstructured.Unstructured) string {
+	if class, ok := ingress.GetAnnotations()[IngressAnnotationKeyIngressClass]; ok {
+		return class
+	}
+
+	class, _, _ := unstructured.NestedString(ingress.Object, "spec", "ingressClassName")
+
+	return class
+}
+
+// targetGroupBindingRefs returns target groups bound to services via TargetGroupBindings, whose targets are
+// registered and de-registered by aws-load-balancer-controller.
+//
+// Bindings of `targetType: ip` are omitted, as nodes are never registered to them.
+func (n *NodeAttachments) targetGroupBindingRefs() ([]tgRef, error) {
+	var bindings unstructured.UnstructuredList
+
+	bindings.SetGroupVersionKind(TargetGroupBindingGVK.GroupVersion().WithKind(TargetGroupBindingGVK.Kind + "List"))
+
+	if err := n.client.List(context.Background(), &bindings); err != nil {
+		// aws-load-balancer-controller isn't installed
+		if meta.IsNoMatchError(err) || runtime.IsNotRegisteredError(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Unable to list target group bindings: %w", err)
+	}
+
+	var tgs []tgRef
+
+	for _, b := range bindings.Items {
+		tgARN, _, _ := unstructured.NestedString(b.Object, "spec", "targetGroupARN")
+		targetType, _, _ := unstructured.NestedString(b.Object, "spec", "targetType")
+		serviceName, _, _ := unstructured.NestedString(b.Object, "spec", "serviceRef", "name")
+
+		if tgARN == "" || targetType == TargetTypeIP {
+			continue
+		}
+
+		ref := tgRef{arn: tgARN, source: fmt.Sprintf("TargetGroupBinding/%s/%s", b.GetNamespace(), b.GetName())}
+
+		if serviceName != "" {
+			ref.service = b.GetNamespace() + "/" + serviceName
+		}
+
+		tgs = append(tgs, ref)
+	}
+
+	return tgs, nil
+}
+
+// awsServicesOfRegion returns AWS API clients for load balancers in the region of node-detacher's own account
+func (n *NodeAttachments) awsServicesOfRegion(region string) *AWSServices {
+	for _, s := range n.awsAccounts {
+		if s.Account == "" && s.Region == region {
+			return s
+		}
+	}
+
+	return &AWSServices{ELB: n.elbSvc, ELBV2: n.elbv2Svc}
+}
+
+// awsServicesOfARN returns AWS API clients for the resource, which may live in any of the configured accounts
+func (n *NodeAttachments) awsServicesOfARN(resourceARN string) *AWSServices {
+	parsed, err := arn.Parse(resourceARN)
+	if err != nil {
+		return &AWSServices{ELB: n.elbSvc, ELBV2: n.elbv2Svc}
+	}
+
+	for _, s := range n.awsAccounts {
+		if s.Account == parsed.AccountID && (s.Region == "" || s.Region == parsed.Region) {
+			return s
+		}
+	}
+
+	return n.awsServicesOfRegion(parsed.Region)
+}
+
+// discoverAWSLoadBalancersViaKubernetes returns target groups and CLBs each instance is registered to, which are
+// handled by any of the integrations, derived from Kubernetes resources rather than scanning all the load balancers.
+//
+// Each target group and CLB records the Kubernetes resources it was derived from.
+func (n *NodeAttachments) discoverAWSLoadBalancersViaKubernetes(instanceIDs []string, integrations []AWSIntegration) (map[string][]v1alpha1.AwsLoadBalancer, map[string][]v1alpha1.AwsTarget, error) {
+	elbRefs, tgRefs, err := n.kubernetesLoadBalancerRefs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Load balancers are keyed by their account and region, too, as names are unique only within a region
+	type key struct{ account, region, name string }
+
+	var (
+		services = map[key]*AWSServices{}
+		sources  = map[key][]string{}
+		k8sSvcs  = map[key][]string{}
+		clbs     []key
+		tgs      []key
+	)
+
+	add := func(keys []key, svc *AWSServices, name, source, k8sSvc string) []key {
+		k := key{svc.Account, svc.Region, name}
+
+		if _, ok := sources[k]; !ok {
+			services[k] = svc
+			keys = append(keys, k)
+		}
+
+		sources[k] = append(sources[k], source)
+
+		if k8sSvc != "" {
+			k8sSvcs[k] = append(k8sSvcs[k], k8sSvc)
+		}
+
+		return keys
+	}
+
+	for _, ref := range elbRefs {
+		svc := n.awsServicesOfRegion(ref.region)
+
+		if !ref.v2 {
+			clbs = add(clbs, svc, ref.name, ref.source, ref.service)
+
+			continue
+		}
+
+		arns, err := getTGsOfLoadBalancer(svc.ELBV2, ref.name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, a := range arns {
+			tgs = add(tgs, svc, a, ref.source, ref.service)
+		}
+	}
+
+	for _, ref := range tgRefs {
+		tgs = add(tgs, n.awsServicesOfARN(ref.arn), ref.arn, ref.source, ref.service)
+	}
+
+	instanceToCLBs := map[string][]v1alpha1.AwsLoadBalancer{}
+
+	instanceToTargets := map[string][]v1alpha1.AwsTarget{}
+
+	ids := map[string]bool{}
+
+	for _, id := range instanceIDs {
+		ids[id] = true
+	}
+
+	for _, k := range clbs {
+		svc := services[k]
+
+		registered, err := getCLBInstances(svc.ELB, k.name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var instances []string
+
+		for _, id := range registered {
+			if ids[id] {
+				instances = append(instances, id)
+			}
+		}
+
+		if len(instances) == 0 {
+			continue
+		}
+
+		clbToTags, err := getCLBTags(svc.ELB, []string{k.name})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tags := clbToTags[k.name]
+
+		i := findAWSIntegration(integrations, classifyCLB(tags), tags)
+		if i == nil {
+			continue
+		}
+
+		for _, id := range instances {
+			instanceToCLBs[id] = append(instanceToCLBs[id], v1alpha1.AwsLoadBalancer{
+				Name:        k.name,
+				Account:     k.account,
+				Region:      k.region,
+				Integration: string(i.Kind),
+				Sources:     uniqueSorted(sources[k]),
+				Services:    uniqueSorted(append(k8sSvcs[k], servicesFromTags(tags)...)),
+			})
+		}
+	}
+
+	for _, k := range tgs {
+		svc := services[k]
+
+		idToTDs, err := getInstanceTargets(svc.ELBV2, k.name, instanceIDs)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(idToTDs) == 0 {
+			continue
+		}
+
+		tgToTags, err := getTGTags(svc.ELBV2, []string{k.name})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tags := tgToTags[k.name]
+
+		i := findAWSIntegration(integrations, classifyTargetGroup(tags), tags)
+		if i == nil {
+			continue
+		}
+
+		for id, tds := range idToTDs {
+			for _, td := range tds {
+				instanceToTargets[id] = append(instanceToTargets[id], v1alpha1.AwsTarget{
+					ARN:         k.name,
+					Port:        td.Port,
+					Account:     k.account,
+					Region:      k.region,
+					Integration: string(i.Kind),
+					Sources:     uniqueSorted(sources[k]),
+					Controller:  classifyTargetGroupController(tags),
+					Services:    uniqueSorted(append(k8sSvcs[k], servicesFromTags(tags)...)),
+				})
+			}
+		}
+	}
+
+	return instanceToCLBs, instanceToTargets, nil
+}
+
+// uniqueSorted returns the sorted strings without duplicates
+func uniqueSorted(ss []string) []string {
+	seen := map[string]bool{}
+
+	var u []string
+
+	for _, s := range ss {
+		if !seen[s] {
+			seen[s] = true
+			u = append(u, s)
+		}
+	}
+
+	sort.Strings(u)
+
+	return u
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// KarpenterTaintKeyDisrupted is the taint Karpenter v1 adds to the node it is going to disrupt, e.g. on consolidation,
+	// drift, or expiration
+	KarpenterTaintKeyDisrupted = "karpenter.sh/disrupted"
+
+	// KarpenterTaintKeyDisruption is the taint Karpenter adds to the node it is going to disrupt before v1, along with
+	// v1beta1 NodeClaims
+	KarpenterTaintKeyDisruption = "karpenter.sh/disruption"
+
+	// KarpenterTaintKeyPrefix is the prefix of taints managed by Karpenter, like `karpenter.sh/unregistered` that is
+	// set on every node on startup and therefore must not be considered as a detach trigger
+	KarpenterTaintKeyPrefix = "karpenter.sh/"
+
+	KarpenterLabelKeyNodePool = "karpenter.sh/nodepool"
+
+	// NodeFinalizerDetach keeps the Karpenter-managed node object until node-detacher finishes detaching and draining
+	// it, so that the node is never forgotten in the middle of a detach. It doesn't delay the termination of the
+	// instance, which Karpenter's own finalizer does before releasing the node object.
+	NodeFinalizerDetach = "node-detacher.variant.run/detach"
+
+	KarpenterEventReasonNodeDetaching = "NodeDetaching"
+	KarpenterEventReasonNodeDetached  = "NodeDetached"
+
+	KarpenterEventReasonWaitingForDrain = "WaitingForDrain"
+)
+
+var (
+	karpenterNodeClaimGVK = schema.GroupVersionKind{Group: "karpenter.sh", Version: "v1", Kind: "NodeClaim"}
+
+	// karpenterNodeClaimVersions are the NodeClaim versions served by Karpenter v1 and earlier releases, in the order
+	// of preference
+	karpenterNodeClaimVersions = []string{"v1", "v1beta1"}
+)
+
+// +kubebuilder:rbac:groups=karpenter.sh,resources=nodeclaims,verbs=get;list;watch
+
+func isKarpenterNode(node corev1.Node) bool {
+	_, ok := node.Labels[KarpenterLabelKeyNodePool]
+
+	return ok
+}
+
+func isKarpenterDisruptionTaint(t corev1.Taint) bool {
+	return t.Key == KarpenterTaintKeyDisrupted || t.Key == KarpenterTaintKeyDisruption
+}
+
+func hasNodeFinalizer(node corev1.Node) bool {
+	for _, f := range node.Finalizers {
+		if f == NodeFinalizerDetach {
+			return true
+		}
+	}
+
+	return false
+}
+
+func removeNodeFinalizer(node *corev1.Node) {
+	var finalizers []string
+
+	for _, f := range node.Finalizers {
+		if f != NodeFinalizerDetach {
+			finalizers = append(finalizers, f)
+		}
+	}
+
+	node.Finalizers = finalizers
+}
+
+// getKarpenterNodeClaim returns the NodeClaim whose status.nodeName is the node, or nil when there's none or
+// Karpenter isn't installed
+func (r *NodeController) getKarpenterNodeClaim(ctx context.Context, nodeName string) (*unstructured.Unstructured, error) {
+	gvk := r.nodeClaimGVK
+
+	if gvk.Empty() {
+		gvk = karpenterNodeClaimGVK
+	}
+
+	var list unstructured.UnstructuredList
+
+	list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+
+	var reader client.Reader = r.Client
+
+	if r.nodeClaims != nil {
+		reader = r.nodeClaims
+	}
+
+	if err := reader.List(ctx, &list); err != nil {
+		if meta.IsNoMatchError(err) || runtime.IsNotRegisteredError(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("listing nodeclaims: %w", err)
+	}
+
+	for i := range list.Items {
+		nc := &list.Items[i]
+
+		name, _, err := unstructured.NestedString(nc.Object, "status", "nodeName")
+		if err != nil {
+			continue
+		}
+
+		if name == nodeName {
+			return nc, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// nodeClaimToNode enqueues the node of the NodeClaim, so that the deletion of the NodeClaim triggers a detach
+func nodeClaimToNode(o handler.MapObject) []reconcile.Request {
+	u, ok := o.Object.(*unstructured.Unstructured)
+	if !ok {
+		return nil
+	}
+
+	name, _, _ := unstructured.NestedString(u.Object, "status", "nodeName")
+	if name == "" {
+		return nil
+	}
+
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: name}}}
+}
+
+// karpenterTriggered returns the detach trigger when Karpenter is disrupting the node, along with the NodeClaim
+// of the node if any
+func (r *NodeController) karpenterTriggered(ctx context.Context, node corev1.Node) (detachTrigger, *unstructured.Unstructured, bool, error) {
+	nodeClaim, err := r.getKarpenterNodeClaim(ctx, node.Name)
+	if err != nil {
+		return detachTrigger{}, nil, false, err
+	}
+
+	for _, t := range node.Spec.Taints {
+		if isKarpenterDisruptionTaint(t) {
+			return detachTrigger{reason: fmt.Sprintf("karpenter taint %s=%s", t.Key, t.Value)}, nodeClaim, true, nil
+		}
+	}
+
+	if node.DeletionTimestamp != nil {
+		return detachTrigger{reason: "karpenter node deletion"}, nodeClaim, true, nil
+	}
+
+	if nodeClaim != nil && nodeClaim.GetDeletionTimestamp() != nil {
+		return detachTrigger{reason: fmt.Sprintf("karpenter nodeclaim %s deletion", nodeClaim.GetName())}, nodeClaim, true, nil
+	}
+
+	return detachTrigger{}, nodeClaim, false, nil
+}
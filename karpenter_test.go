@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeNodeClaims serves NodeClaims like the informer cache does
+type fakeNodeClaims struct {
+	client.Reader
+
+	items []unstructured.Unstructured
+
+	// listed is the kind of the list last read
+	listed schema.GroupVersionKind
+}
+
+func (f *fakeNodeClaims) List(_ context.Context, list runtime.Object, _ ...client.ListOption) error {
+	f.listed = list.GetObjectKind().GroupVersionKind()
+
+	list.(*unstructured.UnstructuredList).Items = f.items
+
+	return nil
+}
+
+func newNodeClaim(name, nodeName string, deleting bool) unstructured.Unstructured {
+	var nc unstructured.Unstructured
+
+	nc.SetGroupVersionKind(karpenterNodeClaimGVK)
+	nc.SetName(name)
+
+	if deleting {
+		now := metav1.Now()
+
+		nc.SetDeletionTimestamp(&now)
+	}
+
+	Expect(unstructured.SetNestedField(nc.Object, nodeName, "status", "nodeName")).To(Succeed())
+
+	return nc
+}
+
+var _ = Describe("Karpenter", func() {
+	var (
+		ctx        context.Context
+		c          client.Client
+		nodeClaims *fakeNodeClaims
+		controller *NodeController
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		scheme := runtime.NewScheme()
+		Expect(k8sscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		c = fake.NewFakeClientWithScheme(scheme)
+		nodeClaims = &fakeNodeClaims{}
+
+		controller = &NodeController{
+			Client:                      c,
+			CoreV1Client:                kubefake.NewSimpleClientset().CoreV1(),
+			Log:                         logf.Log.WithName("karpenter"),
+			recorder:                    &record.FakeRecorder{},
+			Namespace:                   "default",
+			KarpenterIntegrationEnabled: true,
+			nodeClaims:                  nodeClaims,
+		}
+	})
+
+	reconcile := func() {
+		_, err := controller.reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: "node1"}})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	getNode := func() corev1.Node {
+		var node corev1.Node
+
+		Expect(c.Get(ctx, types.NamespacedName{Name: "node1"}, &node)).To(Succeed())
+
+		return node
+	}
+
+	It("adds the finalizer to nodes managed by Karpenter", func() {
+		Expect(c.Create(ctx, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{KarpenterLabelKeyNodePool: "default"}},
+		})).To(Succeed())
+
+		reconcile()
+
+		Expect(hasNodeFinalizer(getNode())).To(BeTrue())
+	})
+
+	It("releases nodes being deleted once detached and drained", func() {
+		now := metav1.Now()
+
+		Expect(c.Create(ctx, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "node1",
+				Labels:            map[string]string{KarpenterLabelKeyNodePool: "default"},
+				Finalizers:        []string{NodeFinalizerDetach},
+				DeletionTimestamp: &now,
+			},
+		})).To(Succeed())
+
+		Eventually(func() bool {
+			reconcile()
+
+			return hasNodeFinalizer(getNode())
+		}, 5*time.Second, 10*time.Millisecond).Should(BeFalse())
+
+		Expect(getNode().Annotations).To(HaveKeyWithValue(NodeAnnotationKeyDrained, "true"))
+	})
+
+	It("releases nodes being deleted after the integration is disabled", func() {
+		controller.KarpenterIntegrationEnabled = false
+
+		now := metav1.Now()
+
+		Expect(c.Create(ctx, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "node1",
+				Labels:            map[string]string{KarpenterLabelKeyNodePool: "default"},
+				Finalizers:        []string{NodeFinalizerDetach},
+				DeletionTimestamp: &now,
+			},
+		})).To(Succeed())
+
+		reconcile()
+
+		Expect(hasNodeFinalizer(getNode())).To(BeFalse())
+	})
+
+	It("detaches nodes whose NodeClaims are being deleted", func() {
+		Expect(c.Create(ctx, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{KarpenterLabelKeyNodePool: "default"}},
+		})).To(Succeed())
+
+		nodeClaims.items = []unstructured.Unstructured{newNodeClaim("nodeclaim1", "node1", false)}
+
+		reconcile()
+
+		Expect(getNode().Annotations).NotTo(HaveKey(NodeAnnotationKeyDetaching))
+
+		nodeClaims.items = []unstructured.Unstructured{newNodeClaim("nodeclaim1", "node1", true)}
+
+		reconcile()
+
+		Expect(getNode().Annotations).To(HaveKeyWithValue(NodeAnnotationKeyDetaching, "true"))
+	})
+
+	It("detaches nodes tainted on disruption by Karpenter v1", func() {
+		Expect(c.Create(ctx, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{KarpenterLabelKeyNodePool: "default"}},
+			Spec: corev1.NodeSpec{
+				Taints: []corev1.Taint{{Key: KarpenterTaintKeyDisrupted, Effect: corev1.TaintEffectNoSchedule}},
+			},
+		})).To(Succeed())
+
+		reconcile()
+
+		Expect(getNode().Annotations).To(HaveKeyWithValue(NodeAnnotationKeyDetaching, "true"))
+		Expect(nodeClaims.listed).To(Equal(schema.GroupVersionKind{Group: "karpenter.sh", Version: "v1", Kind: "NodeClaimList"}))
+	})
+
+	It("detaches nodes tainted on disruption by Karpenter before v1 along with v1beta1 NodeClaims", func() {
+		controller.nodeClaimGVK = schema.GroupVersionKind{Group: "karpenter.sh", Version: "v1beta1", Kind: "NodeClaim"}
+
+		Expect(c.Create(ctx, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{KarpenterLabelKeyNodePool: "default"}},
+			Spec: corev1.NodeSpec{
+				Taints: []corev1.Taint{{Key: KarpenterTaintKeyDisruption, Value: "disrupting", Effect: corev1.TaintEffectNoSchedule}},
+			},
+		})).To(Succeed())
+
+		reconcile()
+
+		Expect(getNode().Annotations).To(HaveKeyWithValue(NodeAnnotationKeyDetaching, "true"))
+		Expect(nodeClaims.listed).To(Equal(schema.GroupVersionKind{Group: "karpenter.sh", Version: "v1beta1", Kind: "NodeClaimList"}))
+	})
+
+	It("doesn't detach nodes on other Karpenter taints", func() {
+		Expect(c.Create(ctx, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{KarpenterLabelKeyNodePool: "default"}},
+			Spec: corev1.NodeSpec{
+				Taints: []corev1.Taint{{Key: "karpenter.sh/unregistered", Effect: corev1.TaintEffectNoExecute}},
+			},
+		})).To(Succeed())
+
+		reconcile()
+
+		Expect(getNode().Annotations).NotTo(HaveKey(NodeAnnotationKeyDetaching))
+	})
+
+	It("maps NodeClaims to their nodes", func() {
+		nc := newNodeClaim("nodeclaim1", "node1", true)
+
+		Expect(nodeClaimToNode(handler.MapObject{Meta: &nc, Object: &nc})).To(ConsistOf(ctrl.Request{NamespacedName: types.NamespacedName{Name: "node1"}}))
+
+		unregistered := newNodeClaim("nodeclaim2", "", false)
+
+		Expect(nodeClaimToNode(handler.MapObject{Meta: &unregistered, Object: &unregistered})).To(BeEmpty())
+	})
+})
@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
+	"time"
 )
 
 func getInstanceID(node corev1.Node) (string, error) {
@@ -15,3 +17,38 @@ func getInstanceID(node corev1.Node) (string, error) {
 
 	return instanceID, nil
 }
+
+// instanceIDOfAttachment returns the EC2 instance ID of the node, which is empty for the node outside of EC2 attached
+// only to Consul services and Route 53 records
+func instanceIDOfAttachment(node corev1.Node, spec v1alpha1.AttachmentSpec) (string, error) {
+	instanceID, err := getInstanceID(node)
+	if err != nil && (len(spec.AwsTargets) > 0 || len(spec.AwsLoadBalancers) > 0 || len(spec.GlobalAcceleratorEndpoints) > 0) {
+		return "", err
+	}
+
+	return instanceID, nil
+}
+
+// getNodeIPs returns the node's internal and external IPs
+func getNodeIPs(node corev1.Node) []string {
+	var ips []string
+
+	for _, a := range node.Status.Addresses {
+		if a.Type == corev1.NodeInternalIP || a.Type == corev1.NodeExternalIP {
+			ips = append(ips, a.Address)
+		}
+	}
+
+	return ips
+}
+
+// nodeReadySince returns true along with the last transition time when the node's Ready condition is True
+func nodeReadySince(node corev1.Node) (bool, time.Time) {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue, c.LastTransitionTime.Time
+		}
+	}
+
+	return false, time.Time{}
+}
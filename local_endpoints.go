@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1alpha1 "k8s.io/api/discovery/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strings"
+)
+
+// +kubebuilder:rbac:groups=core,resources=endpoints,verbs=get;list;watch
+// +kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
+
+// localEndpoints is the number of ready endpoints of an `externalTrafficPolicy: Local` service on a node, and across
+// the cluster
+type localEndpoints struct {
+	local int
+	ready int
+}
+
+// localEndpointsOfNode returns ready endpoints of every `externalTrafficPolicy: Local` service, keyed by
+// NAMESPACE/NAME, counting ones on the node.
+//
+// Endpoints are read from EndpointSlices, falling back to Endpoints for services without EndpointSlices, e.g. when the
+// EndpointSlice API isn't enabled in the cluster.
+func (n *NodeAttachments) localEndpointsOfNode(node corev1.Node) (map[string]localEndpoints, error) {
+	ctx := context.Background()
+
+	var services corev1.ServiceList
+
+	if err := n.client.List(ctx, &services); err != nil {
+		return nil, fmt.Errorf("Unable to list services: %w", err)
+	}
+
+	result := map[string]localEndpoints{}
+
+	for _, svc := range services.Items {
+		if svc.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal {
+			result[svc.Namespace+"/"+svc.Name] = localEndpoints{}
+		}
+	}
+
+	if len(result) == 0 {
+		return result, nil
+	}
+
+	hostname := node.Labels[corev1.LabelHostname]
+	if hostname == "" {
+		hostname = node.Name
+	}
+
+	sliced := map[string]bool{}
+
+	var slices discoveryv1alpha1.EndpointSliceList
+
+	if err := n.client.List(ctx, &slices); err != nil {
+		if !meta.IsNoMatchError(err) && !runtime.IsNotRegisteredError(err) {
+			return nil, fmt.Errorf("Unable to list endpoint slices: %w", err)
+		}
+	}
+
+	for _, slice := range slices.Items {
+		svc := slice.Namespace + "/" + slice.Labels[discoveryv1alpha1.LabelServiceName]
+
+		e, ok := result[svc]
+		if !ok {
+			continue
+		}
+
+		sliced[svc] = true
+
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+
+			e.ready++
+
+			if ep.Topology[corev1.LabelHostname] == hostname {
+				e.local++
+			}
+		}
+
+		result[svc] = e
+	}
+
+	for svc, e := range result {
+		if sliced[svc] {
+			continue
+		}
+
+		nsName := strings.SplitN(svc, "/", 2)
+
+		var endpoints corev1.Endpoints
+
+		if err := n.client.Get(ctx, types.NamespacedName{Namespace: nsName[0], Name: nsName[1]}, &endpoints); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+
+			return nil, fmt.Errorf("Unable to get endpoints %s: %w", svc, err)
+		}
+
+		for _, subset := range endpoints.Subsets {
+			for _, addr := range subset.Addresses {
+				e.ready++
+
+				if addr.NodeName != nil && *addr.NodeName == node.Name {
+					e.local++
+				}
+			}
+		}
+
+		result[svc] = e
+	}
+
+	return result, nil
+}
+
+// serviceImpactsOf returns local endpoints of `externalTrafficPolicy: Local` services that detaching the node removes,
+// sorted by service
+func serviceImpactsOf(endpoints map[string]localEndpoints) []v1alpha1.ServiceImpact {
+	var impacts []v1alpha1.ServiceImpact
+
+	for svc, e := range endpoints {
+		if e.local == 0 {
+			continue
+		}
+
+		impacts = append(impacts, v1alpha1.ServiceImpact{
+			Service:        svc,
+			LocalEndpoints: int32(e.local),
+			ReadyEndpoints: int32(e.ready),
+			Message:        fmt.Sprintf("removes %d of %d local endpoints of %s", e.local, e.ready, svc),
+		})
+	}
+
+	sort.Slice(impacts, func(i, j int) bool {
+		return impacts[i].Service < impacts[j].Service
+	})
+
+	return impacts
+}
+
+// recordServiceImpacts records the impact of detaching the node in the status of its attachment
+func (n *NodeAttachments) recordServiceImpacts(node corev1.Node, impacts []v1alpha1.ServiceImpact) error {
+	ctx := context.Background()
+
+	var attachment v1alpha1.Attachment
+
+	if err := n.client.Get(ctx, types.NamespacedName{Namespace: n.namespace, Name: node.Name}, &attachment); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if len(impacts) == 0 && len(attachment.Status.ServiceImpacts) == 0 {
+		return nil
+	}
+
+	if attachment.Status.CachedAt.IsZero() {
+		attachment.Status.CachedAt = attachment.CreationTimestamp
+	}
+
+	attachment.Status.ServiceImpacts = impacts
+
+	return n.client.Status().Update(ctx, &attachment)
+}
+
+// hasNoLocalEndpoints returns true when all the services behind the target group or the CLB are
+// `externalTrafficPolicy: Local` services without ready endpoints on the node.
+// Load balancers already consider the node unhealthy for such services, which makes de-registering it pointless.
+func hasNoLocalEndpoints(services []string, endpoints map[string]localEndpoints) bool {
+	if len(services) == 0 {
+		return false
+	}
+
+	for _, svc := range services {
+		e, ok := endpoints[svc]
+		if !ok || e.local > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkLocalEndpointBudget returns the service whose local endpoints would exceed the policy's
+// maxUnavailableLocalEndpoints when the node is detached along with other nodes being detached, or empty when the node
+// can be detached
+func checkLocalEndpointBudget(ctx context.Context, c client.Reader, namespace string, policies []v1alpha1.DetachPolicy, policy *v1alpha1.DetachPolicy, node corev1.Node, impacts []v1alpha1.ServiceImpact) (string, error) {
+	if policy.Spec.MaxUnavailableLocalEndpoints == nil || len(impacts) == 0 {
+		return "", nil
+	}
+
+	var nodes corev1.NodeList
+
+	if err := c.List(ctx, &nodes); err != nil {
+		return "", err
+	}
+
+	removed := map[string]int{}
+
+	for _, other := range nodes.Items {
+		if other.Name == node.Name || other.Annotations[NodeAnnotationKeyDetaching] != "true" {
+			continue
+		}
+
+		p, err := selectDetachPolicy(policies, other)
+		if err != nil {
+			return "", err
+		}
+
+		if p == nil || p.Name != policy.Name {
+			continue
+		}
+
+		var attachment v1alpha1.Attachment
+
+		if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: other.Name}, &attachment); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+
+			return "", err
+		}
+
+		for _, i := range attachment.Status.ServiceImpacts {
+			removed[i.Service] += int(i.LocalEndpoints)
+		}
+	}
+
+	for _, i := range impacts {
+		if removed[i.Service] == 0 {
+			continue
+		}
+
+		max, err := resolveMaxUnavailable(policy.Spec.MaxUnavailableLocalEndpoints, int(i.ReadyEndpoints))
+		if err != nil {
+			return "", err
+		}
+
+		if removed[i.Service]+int(i.LocalEndpoints) > max {
+			return i.Service, nil
+		}
+	}
+
+	return "", nil
+}
@@ -23,13 +23,18 @@ import (
 	zap2 "go.uber.org/zap"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
+	"net"
 	"os"
+	"strconv"
 	"time"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -70,70 +75,38 @@ func main() {
 		panic(err)
 	}
 
-	var (
-		syncPeriod           time.Duration
-		metricsAddr          string
-		enableLeaderElection bool
-
-		aws         bool
-		albIngress  bool
-		dynamicCLBs bool
-		dynamicNLBs bool
-		staticCLBs  bool
-		staticTGs   bool
-
-		daemonsets StringSlice
-
-		manageDaemonSets    bool
-		manageDaemonSetPods bool
-
-		name string
-
-		namespace string
-
-		logLevel string
-	)
-
-	flag.DurationVar(&syncPeriod, "sync-period", 10*time.Second, "The period in seconds between each forceful iteration over all the nodes")
-	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
-	flag.BoolVar(&aws, "enable-aws", true,
-		"Enable AWS support including ELB v1, ELB v2(target group) integrations. Also specify enable-(static|dynamic)(alb|clb|nlb)-integration flags for detailed configuration")
-	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
-		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
-	flag.BoolVar(&albIngress, "enable-alb-ingress-integration", true,
-		"Enable aws-alb-ingress-controller integration\nPossible values are `[true|false]`",
-	)
-	flag.BoolVar(&dynamicCLBs, "enable-dynamic-clb-integration", true,
-		"Enable integration with classical load balancers (a.k.a ELB v1) managed by \"type: LoadBalancer\" services\nPossible values are `[true|false]`",
-	)
-	flag.BoolVar(&dynamicNLBs, "enable-dynamic-nlb-integration", true,
-		"Enable integration with network load balancers (a.k.a ELB v2 NLB) managed by \"type: LoadBalancer\" services\nPossible values are `[true|false]`",
-	)
-	flag.BoolVar(&staticCLBs, "enable-static-clb-integration", true,
-		"Enable integration with classical load balancers (a.k.a ELB v1) managed externally to Kubernetes, e.g. by Terraform or CloudFormation\nPossible values are `[true|false]`",
-	)
-	flag.BoolVar(&staticTGs, "enable-static-tg-integration", true,
-		"Enable integration with application load balancers and network load balancers (a.k.a ELB v2 ALBs and NLBs) managed externally to Kubernetes, e.g. by Terraform or CloudFormation.\nPossible values are `[true|false]`")
-	flag.Var(&daemonsets, "daemonset", "Specifies target daemonsets to be processed by node-detacher. Used only when either -manage-daemonsets or -manage-daemonset-pods is enabled. This flag can be specified multiple times to target two or more daemonsets.\nExample: --daemonsets contour --daemonsets anotherns/nginx-ingress (`[NAMESPACE/]NAME`)")
-	flag.BoolVar(&manageDaemonSetPods, "manage-daemonset-pods", false,
-		"Detaches the node when one of the daemonset pods on the pod started terminating. Also specify `--daemonsets` or annotate daemonsets with node-detaher.variant.run/managed-by=NAME")
-	flag.BoolVar(&manageDaemonSets, "manage-daemonsets", false,
-		"Detaches the node one by one when the targeted daemonset with RollingUpdate.Policy set to OnDelete became OUTDATED. Also specify --daemonsets to limit the daemonsets which triggers rolls, or annotate daemonsets with node-detacher.variant.run/managed-by=NAME")
-	flag.StringVar(&name, "name", "node-detacher", "NAME of this node-detacher, used to distinguish one of node-detacher instances and specified in the annotation node-detacher.variant.run/managed-by")
-	flag.StringVar(&namespace, "namespace", "", "NAMESPACE to watch resources for")
-	flag.StringVar(&logLevel, "log-level", "info", "Log level. Must be one of debug, info, warn, error")
+	var configPath string
+
+	flagConfig := DefaultConfig()
+	flagConfig.BindFlags(flag.CommandLine)
+
+	flag.StringVar(&configPath, "config", "", "The path to the YAML config file, typically mounted from a ConfigMap. Changes to the file are reloaded without restarting. Flags explicitly specified override the file")
 	flag.Parse()
 
+	cfg, err := LoadConfig(configPath, flag.CommandLine)
+
+	logLevel := flagConfig.LogLevel
+	if err == nil {
+		logLevel = cfg.LogLevel
+	}
+
 	ctrl.SetLogger(zap.New(func(o *zap.Options) {
 		o.Development = true
 		lvl := zap2.NewAtomicLevelAt(stringToZapLogLevel(logLevel))
 		o.Level = &lvl
 	}))
 
+	if err != nil {
+		setupLog.Error(err, "Invalid config")
+		os.Exit(1)
+	}
+
+	syncPeriod := cfg.SyncPeriod.Duration
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
-		MetricsBindAddress: metricsAddr,
-		LeaderElection:     enableLeaderElection,
+		MetricsBindAddress: cfg.MetricsAddr,
+		LeaderElection:     cfg.LeaderElection,
 		SyncPeriod:         &syncPeriod,
 		Port:               9443,
 	})
@@ -143,20 +116,40 @@ func main() {
 	}
 
 	// get the AWS sessions
-	asgSvc, elbSvc, elbv2Svc, err := awsGetServices()
+	limiter := &AWSAPILimiter{
+		QPS:           cfg.AWS.APIQPS,
+		Burst:         cfg.AWS.APIBurst,
+		MaxRetries:    cfg.AWS.APIMaxRetries,
+		MinRetryDelay: DefaultAWSAPIMinRetryDelay,
+		MaxRetryDelay: DefaultAWSAPIMaxRetryDelay,
+	}
+
+	asgSvc, elbSvc, elbv2Svc, err := awsGetServices(limiter)
 	if err != nil {
 		setupLog.Error(err, "Unable to create an AWS session")
 		os.Exit(1)
 	}
 
+	accounts, err := ParseAWSAccounts(cfg.AWS.Accounts)
+	if err != nil {
+		setupLog.Error(err, "Unable to parse -aws-account")
+		os.Exit(1)
+	}
+
+	accountServices, err := awsGetAccountServices(accounts, limiter)
+	if err != nil {
+		setupLog.Error(err, "Unable to create AWS sessions for accounts")
+		os.Exit(1)
+	}
+
 	ns := os.Getenv("POD_NAMESPACE")
 
 	if os.Getenv("WATCH_NAMESPACE") != "" {
 		ns = os.Getenv("WATCH_NAMESPACE")
 	}
 
-	if namespace != "" {
-		ns = namespace
+	if cfg.Namespace != "" {
+		ns = cfg.Namespace
 	}
 
 	config := mgr.GetConfig()
@@ -167,22 +160,120 @@ func main() {
 		os.Exit(1)
 	}
 
+	var xdsServer *XDSServer
+
+	if cfg.XDS.Addr != "" {
+		clusters, err := ParseXDSClusters(cfg.XDS.Clusters)
+		if err != nil {
+			setupLog.Error(err, "Invalid xDS clusters")
+			os.Exit(1)
+		}
+
+		xdsServer = &XDSServer{
+			Addr:     cfg.XDS.Addr,
+			Clusters: clusters,
+			Client:   mgr.GetClient(),
+			Log:      ctrl.Log.WithName("xds"),
+		}
+
+		if err := mgr.Add(xdsServer); err != nil {
+			setupLog.Error(err, "unable to add xDS server")
+			os.Exit(1)
+		}
+	}
+
+	var consul *ConsulClient
+
+	if cfg.Consul.Addr != "" {
+		consul = cfg.consulClient()
+	}
+
+	var route53Integration *Route53Integration
+
+	if len(cfg.Route53.HostedZoneIDs) > 0 || len(cfg.Route53.HostedZoneTags) > 0 {
+		tags, err := cfg.route53HostedZoneTags()
+		if err != nil {
+			setupLog.Error(err, "Invalid Route 53 configuration")
+			os.Exit(1)
+		}
+
+		route53Svc, err := awsGetRoute53Service()
+		if err != nil {
+			setupLog.Error(err, "Unable to create an AWS session for Route 53")
+			os.Exit(1)
+		}
+
+		route53Integration = &Route53Integration{
+			Svc:            route53Svc,
+			HostedZoneIDs:  cfg.Route53.HostedZoneIDs,
+			HostedZoneTags: tags,
+		}
+	}
+
+	var globalAcceleratorIntegration *GlobalAcceleratorIntegration
+
+	if cfg.GlobalAccelerator.Enabled {
+		gaSvc, err := awsGetGlobalAcceleratorService()
+		if err != nil {
+			setupLog.Error(err, "Unable to create an AWS session for Global Accelerator")
+			os.Exit(1)
+		}
+
+		globalAcceleratorIntegration = &GlobalAcceleratorIntegration{
+			Svc:        gaSvc,
+			DetachMode: cfg.GlobalAccelerator.DetachMode,
+		}
+
+		if err := globalAcceleratorIntegration.validate(); err != nil {
+			setupLog.Error(err, "Invalid Global Accelerator configuration")
+			os.Exit(1)
+		}
+	}
+
+	nodeConditionTriggers, err := ParseNodeConditionRules(cfg.NodeConditions.Rules, cfg.NodeConditions.WithoutCordon)
+	if err != nil {
+		setupLog.Error(err, "Invalid node condition triggers")
+		os.Exit(1)
+	}
+
+	awsIntegrations, err := cfg.awsIntegrations()
+	if err != nil {
+		setupLog.Error(err, "Invalid AWS integrations")
+		os.Exit(1)
+	}
+
 	nodeController := NodeController{
-		Name:                                name,
+		Name:                                cfg.Name,
 		Client:                              mgr.GetClient(),
+		apiReader:                           mgr.GetAPIReader(),
 		CoreV1Client:                        client.CoreV1(),
 		Log:                                 ctrl.Log.WithName("controllers").WithName("Node"),
 		Scheme:                              mgr.GetScheme(),
-		AWSEnabled:                          aws,
-		ALBIngressIntegrationEnabled:        albIngress,
-		DynamicNLBIntegrationEnabled:        dynamicNLBs,
-		DynamicCLBIntegrationEnabled:        dynamicCLBs,
-		StaticTargetGroupIntegrationEnabled: staticTGs,
-		StaticCLBIntegrationEnabled:         staticCLBs,
+		AWSEnabled:                          cfg.AWS.Enabled,
+		AWSIntegrations:                     awsIntegrations,
 		Namespace:                           ns,
 		asgSvc:                              asgSvc,
 		elbSvc:                              elbSvc,
 		elbv2Svc:                            elbv2Svc,
+		awsAccounts:                         accountServices,
+		Consul:                              consul,
+		Route53:                             route53Integration,
+		GlobalAccelerator:                   globalAcceleratorIntegration,
+		XDSServer:                           xdsServer,
+		NodeConditionTriggers:               nodeConditionTriggers,
+		KarpenterIntegrationEnabled:         cfg.Karpenter.Enabled,
+		ReattachWarmup:                      cfg.Reattach.Warmup.Duration,
+		ReattachHealthTimeout:               cfg.Reattach.HealthTimeout.Duration,
+		ReattachStageSize:                   cfg.Reattach.StageSize,
+		ReattachSlowStart:                   cfg.Reattach.SlowStart.Duration,
+		AWSControllerTimeout:                cfg.AWS.ControllerTimeout.Duration,
+		AWSSkipTargetsWithoutLocalEndpoints: cfg.AWS.SkipTargetsWithoutLocalEndpoints,
+		ReattachRollbackWindow:              cfg.Reattach.RollbackWindow.Duration,
+		RequeueBaseDelay:                    cfg.Concurrency.RequeueBaseDelay.Duration,
+		RequeueMaxDelay:                     cfg.Concurrency.RequeueMaxDelay.Duration,
+		MaxConcurrentReconciles:             cfg.Concurrency.MaxConcurrentReconciles,
+		DeregistrationBatchWindow:           cfg.Concurrency.DeregistrationBatchWindow.Duration,
+		DeregistrationBatchMaxSize:          cfg.Concurrency.DeregistrationBatchMaxSize,
 	}
 
 	if err = nodeController.SetupWithManager(mgr); err != nil {
@@ -190,16 +281,107 @@ func main() {
 		os.Exit(1)
 	}
 
+	if cfg.PodWebhook.Enabled {
+		if cfg.PodWebhook.PreStopAddr == "" || cfg.PodWebhook.PreStopHost == "" {
+			setupLog.Error(fmt.Errorf("-prestop-addr and -prestop-host are required"), "Invalid pod webhook configuration")
+			os.Exit(1)
+		}
+
+		_, port, err := net.SplitHostPort(cfg.PodWebhook.PreStopAddr)
+		if err != nil {
+			setupLog.Error(err, "Invalid preStop address")
+			os.Exit(1)
+		}
+
+		preStopPort, err := strconv.Atoi(port)
+		if err != nil {
+			setupLog.Error(err, "Invalid preStop port")
+			os.Exit(1)
+		}
+
+		var selector labels.Selector
+
+		if cfg.PodWebhook.Selector != "" {
+			selector, err = labels.Parse(cfg.PodWebhook.Selector)
+			if err != nil {
+				setupLog.Error(err, "Invalid pod webhook selector")
+				os.Exit(1)
+			}
+		}
+
+		mgr.GetWebhookServer().Register("/mutate-v1-pod", &webhook.Admission{Handler: &PodMutator{
+			Log:         ctrl.Log.WithName("webhooks").WithName("Pod"),
+			Selector:    selector,
+			PreStopHost: cfg.PodWebhook.PreStopHost,
+			PreStopPort: preStopPort,
+		}})
+	}
+
+	if cfg.PodWebhook.PreStopAddr != "" {
+		preStopServer := &PreStopServer{
+			Addr:         cfg.PodWebhook.PreStopAddr,
+			Client:       mgr.GetClient(),
+			Log:          ctrl.Log.WithName("prestop"),
+			Timeout:      cfg.PodWebhook.PreStopTimeout.Duration,
+			PollInterval: 1 * time.Second,
+		}
+
+		if err := mgr.Add(preStopServer); err != nil {
+			setupLog.Error(err, "unable to add preStop server")
+			os.Exit(1)
+		}
+	}
+
+	daemonsetTargets, err := cfg.daemonSetTargets(ns)
+	if err != nil {
+		setupLog.Error(err, "Invalid target daemonsets")
+		os.Exit(1)
+	}
+
+	configWatcher := &ConfigWatcher{
+		Path:  configPath,
+		Flags: flag.CommandLine,
+		Addr:  cfg.DebugAddr,
+		Log:   ctrl.Log.WithName("config"),
+		Appliers: []func(*Config) error{
+			nodeController.ApplyConfig,
+			func(c *Config) error {
+				targets, err := c.daemonSetTargets(ns)
+				if err != nil {
+					return err
+				}
+
+				daemonsetTargets.Update(targets)
+
+				return nil
+			},
+		},
+	}
+
+	configWatcher.Init(cfg)
+
 	// Our daemonsets support has the ability to mark outdated daemonset's pods to be detached.
 	// This requires the daemonset pod reconciler to be enabled, hence this block enables the daemonset pod reconciler
 	// when only the daemonset reconciler is explicitly required.
-	if manageDaemonSets || manageDaemonSetPods {
+	if cfg.DaemonSets.Manage || cfg.DaemonSets.ManagePods || cfg.Workloads.Manage || cfg.PodWebhook.Enabled {
+		var selector labels.Selector
+
+		if cfg.Workloads.PodSelector != "" {
+			selector, err = labels.Parse(cfg.Workloads.PodSelector)
+			if err != nil {
+				setupLog.Error(err, "Invalid workload pod selector")
+				os.Exit(1)
+			}
+		}
+
 		podController := PodController{
-			Name:       name,
-			Client:     mgr.GetClient(),
-			Log:        ctrl.Log.WithName("controllers").WithName("Pod"),
-			DaemonSets: daemonsets,
-			Namespace:  ns,
+			Name:                cfg.Name,
+			Client:              mgr.GetClient(),
+			Log:                 ctrl.Log.WithName("controllers").WithName("Pod"),
+			Targets:             daemonsetTargets,
+			ManageWorkloads:     cfg.Workloads.Manage,
+			WorkloadPodSelector: selector,
+			SyncReadinessGates:  cfg.PodWebhook.Enabled,
 		}
 
 		if err = podController.SetupWithManager(mgr); err != nil {
@@ -208,19 +390,38 @@ func main() {
 		}
 	}
 
-	if manageDaemonSets {
+	if cfg.DaemonSets.Manage {
+		maxUnavailable, maxUnavailablePerZone, maxUnavailablePerTargetGroup, err := cfg.rolloutMaxUnavailable()
+		if err != nil {
+			setupLog.Error(err, "Invalid rollout configuration")
+			os.Exit(1)
+		}
+
 		daemonsetController := DaemonsetController{
-			Name:       name,
-			Client:     mgr.GetClient(),
-			Log:        ctrl.Log.WithName("controllers").WithName("DaemonSet"),
-			DaemonSets: daemonsets,
-			Namespace:  ns,
+			Name:                         cfg.Name,
+			Client:                       mgr.GetClient(),
+			Log:                          ctrl.Log.WithName("controllers").WithName("DaemonSet"),
+			Targets:                      daemonsetTargets,
+			Namespace:                    ns,
+			MaxUnavailable:               maxUnavailable,
+			MaxUnavailablePerZone:        maxUnavailablePerZone,
+			MaxUnavailablePerTargetGroup: maxUnavailablePerTargetGroup,
+			PodReadyTimeout:              &metav1.Duration{Duration: cfg.Rollout.PodReadyTimeout.Duration},
 		}
 
 		if err = daemonsetController.SetupWithManager(mgr); err != nil {
 			setupLog.Error(err, "unable to create controller", "controller", "Pod")
 			os.Exit(1)
 		}
+
+		configWatcher.Appliers = append(configWatcher.Appliers, daemonsetController.ApplyConfig)
+	}
+
+	if configPath != "" || cfg.DebugAddr != "" {
+		if err := mgr.Add(configWatcher); err != nil {
+			setupLog.Error(err, "unable to add config watcher")
+			os.Exit(1)
+		}
 	}
 
 	// +kubebuilder:scaffold:builder
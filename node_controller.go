@@ -24,19 +24,34 @@ import (
 	"github.com/aws/aws-sdk-go/service/elb/elbiface"
 	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
 	"github.com/go-logr/logr"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"strings"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 )
 
+const (
+	DefaultRequeueBaseDelay = 1 * time.Second
+	DefaultRequeueMaxDelay  = 5 * time.Minute
+)
+
 const (
 	NodeLabelInstanceID                  = "alpha.eksctl.io/instance-id"
 	NodeTaintKeyDetaching                = "node-detacher.variant.run/detaching"
@@ -46,14 +61,49 @@ const (
 	NodeAnnotationKeyDetachmentTimestamp = "node-detacher.variant.run/detachment-timestamp"
 	NodeAnnotationKeyAttachmentTimestamp = "node-detacher.variant.run/attachment-timestamp"
 
+	// NodeAnnotationKeyReattachmentStartedTimestamp is set when node-detacher re-registered the node to load balancers
+	// and started waiting for targets to become healthy
+	NodeAnnotationKeyReattachmentStartedTimestamp = "node-detacher.variant.run/reattachment-started-timestamp"
+
+	// NodeAnnotationKeyDrained is set once the detached node is drained, i.e. the drain period after de-registering
+	// the node from load balancers passed
+	NodeAnnotationKeyDrained = "node-detacher.variant.run/drained"
+
+	// NodeAnnotationKeyReattachFailed is set with the reason when re-attached targets didn't become healthy in time or
+	// became unhealthy within the rollback window. It is cleared when the node is detached again.
+	NodeAnnotationKeyReattachFailed = "node-detacher.variant.run/reattach-failed"
+
+	// NodeLabelKeyExcludeBalancer prevents alb-ingress-controller from re-registering the node as a target.
+	// See https://github.com/kubernetes-sigs/aws-alb-ingress-controller/blob/27e5d2a7dc8584123e3997a5dd3d80a58fa7bbd7/internal/ingress/annotations/class/main.go#L52
+	NodeLabelKeyExcludeBalancer = "alpha.service-controller.kubernetes.io/exclude-balancer"
+
+	// NodeAnnotationKeyExcludeBalancerLabeled is set when node-detacher added the exclude-balancer label, so that
+	// we never remove the label set by someone else on re-attachment
+	NodeAnnotationKeyExcludeBalancerLabeled = "node-detacher.variant.run/exclude-balancer-labeled"
+
+	// NodeLabelKeyExcludeFromExternalLoadBalancers prevents aws-load-balancer-controller from re-registering the node
+	// as a target
+	NodeLabelKeyExcludeFromExternalLoadBalancers = "node.kubernetes.io/exclude-from-external-load-balancers"
+
+	// NodeAnnotationKeyExcludeFromExternalLoadBalancersLabeled is set when node-detacher added the
+	// exclude-from-external-load-balancers label
+	NodeAnnotationKeyExcludeFromExternalLoadBalancersLabeled = "node-detacher.variant.run/exclude-from-external-load-balancers-labeled"
+
+	// NodeAnnotationKeyDiscoveredOnDetach is set once load balancers of integrations discovering on detach are
+	// discovered for the detachment, and removed on re-attachment
+	NodeAnnotationKeyDiscoveredOnDetach = "node-detacher.variant.run/discovered-on-detach"
+
 	DaemonSetAnnotationKeyManagedBy     = "node-detacher.variant.run/managed-by"
 	PodAnnotationKeyPodDeletionPriority = "node-detacher.variant.run/deletion-priority"
-	DaemonSetFieldManagedBy             = ".managedby"
 
 	PodAnnotationDisableEviction = "node-detacher.variant.run/disable-eviction"
 
 	NodeConditionTypeNodeBeingDetached = corev1.NodeConditionType("NodeBeingDetached")
 	NodeEventReasonNodeBeingDetached   = "NodeBeingDetached"
+
+	// NodeEventReasonLocalEndpointsRemoved is emitted for each `externalTrafficPolicy: Local` service with ready
+	// endpoints on the node being detached
+	NodeEventReasonLocalEndpointsRemoved = "LocalEndpointsRemoved"
 )
 
 // +kubebuilder:rbac:groups=node-detacher.variant.run,resources=attachments,verbs=get;list;watch;create;update;patch;delete
@@ -74,33 +124,19 @@ type NodeController struct {
 	Scheme          *runtime.Scheme
 	nodeAttachments *NodeAttachments
 
-	// AWS enables AWS support including ELB v1, ELB v2(target group) integrations. Also specify enable-(static|dynamic)(alb|clb|nlb)-integration flags for detailed configuration
-	AWSEnabled bool
-
-	// ALBIngressIntegrationEnabled is set to true when node-detacher should interoperate with
-	// aws-alb-ingress-controller(https://github.com/kubernetes-sigs/aws-alb-ingress-controller)
-	//
-	// When enabled, node-detacher behaves as follows:
-	// - Stop labeling all nodes on startup because the desired node-to-targetgroup relationship can't be determined
-	//   until the node becomes Unschedulable.
-	// - Stop labeling the node on creation due to the same reason as the above
-	ALBIngressIntegrationEnabled bool
-
-	// DynamicNLBIntegrationEnabled is set to true when node-detacher should interoperate with
-	// NLBs managed via `type: LoadBalancer` services
-	DynamicNLBIntegrationEnabled bool
+	// nodeClaims reads Karpenter NodeClaims from the informer cache, as reads of unstructured objects via the client
+	// bypass the cache. Nil when Karpenter isn't installed on startup, in which case the client is used
+	nodeClaims client.Reader
 
-	// DynamicCLBIntegrationEnabled is set to true when node-detacher should interoperate with
-	// CLBs managed via `type: LoadBalancer` services
-	DynamicCLBIntegrationEnabled bool
+	// nodeClaimGVK is the version of NodeClaims served by the installed Karpenter release, or empty for the latest one
+	nodeClaimGVK schema.GroupVersionKind
 
-	// StaticTargetGroupIntegrationEnabled is set to true when node-detacher should interoperate with
-	// target groups managed externally to Kubernetes (e.g. via Terraform or CloudFormation)
-	StaticTargetGroupIntegrationEnabled bool
+	// AWS enables AWS support including ELB v1, ELB v2(target group) integrations. Also specify enable-(static|dynamic)(alb|clb|nlb)-integration flags for detailed configuration
+	AWSEnabled bool
 
-	// StaticCLBIntegrationEnabled is set to true when node-detacher should interoperate with
-	// CLBs managed externally to Kubernetes (e.g. via Terraform or CloudFormation)
-	StaticCLBIntegrationEnabled bool
+	// AWSIntegrations are enabled integrations with AWS load balancers, each of which handles a kind of load balancers
+	// and discovers ones the node is registered to either on node creation or on detach
+	AWSIntegrations []AWSIntegration
 
 	// DaemonSets is the list of daemonsets whose item is either "NAME" or "NAMESPACE/NAME" of the target daemonset.
 	//
@@ -131,75 +167,311 @@ type NodeController struct {
 	elbSvc   elbiface.ELBAPI
 	elbv2Svc elbv2iface.ELBV2API
 
-	synced bool
+	// awsAccounts are AWS API clients for load balancers in AWS accounts and regions other than node-detacher's own
+	awsAccounts []*AWSServices
+
+	initOnce sync.Once
+	syncOnce sync.Once
+
+	// configMu is held while reconciling, so that reloading the config never changes settings in the middle of
+	// reconciliations
+	configMu sync.RWMutex
+
+	// detachMu serializes starting detaches, so that concurrent reconciliations never exceed the max concurrent
+	// detachments of detach policies
+	detachMu sync.Mutex
+
+	// apiReader reads nodes and attachments straight from the API server while starting detaches.
+	// The informer cache may not yet include detaches started by the previous reconciliation, which makes concurrent
+	// reconciliations exceed the max concurrent detachments and the max unavailable local endpoints of detach policies.
+	// The client is used when nil
+	apiReader client.Reader
 
 	CoreV1Client v1.CoreV1Interface
+
+	// GlobalAccelerator, when non-nil, enables detaching the node's EC2 instance from AWS Global Accelerator endpoint groups
+	GlobalAccelerator *GlobalAcceleratorIntegration
+
+	// Route53, when non-nil, enables detaching the node's IP from Route 53 weighted and multivalue answer record sets
+	Route53 *Route53Integration
+
+	// Consul, when non-nil, enables detaching the node's service instances registered in Consul
+	Consul *ConsulClient
+
+	// NodeConditionTriggers is the list of node conditions that trigger a detach in addition to DetachPolicy or
+	// the default triggers. Typically used for integrating with node-problem-detector.
+	NodeConditionTriggers []v1alpha1.NodeConditionRule
+
+	// ReattachWarmup is how long node-detacher waits after the node became Ready before re-attaching it
+	ReattachWarmup time.Duration
+
+	// ReattachHealthTimeout is how long node-detacher waits for re-attached targets to become healthy before marking
+	// the node as attached anyway. Zero means waiting forever.
+	ReattachHealthTimeout time.Duration
+
+	// ReattachStageSize is the maximum number of target groups and CLBs the node is being registered to at once on
+	// re-attachment. Zero means registering to all at once.
+	ReattachStageSize int
+
+	// ReattachSlowStart, when non-zero, enables the slow start mode of target groups with the duration on re-attachment
+	ReattachSlowStart time.Duration
+
+	// AWSControllerTimeout, when non-zero, is how long node-detacher waits for aws-load-balancer-controller and
+	// aws-alb-ingress-controller to de-register and register the node, before doing it on its own.
+	// Zero means de-registering and registering the node immediately.
+	AWSControllerTimeout time.Duration
+
+	// AWSSkipTargetsWithoutLocalEndpoints skips de-registering the node from target groups and CLBs whose services are
+	// all `externalTrafficPolicy: Local` services without ready endpoints on the node
+	AWSSkipTargetsWithoutLocalEndpoints bool
+
+	// ReattachRollbackWindow, when non-zero, makes node-detacher detach the node again when any of re-attached targets
+	// becomes unhealthy within the window
+	ReattachRollbackWindow time.Duration
+
+	// RequeueBaseDelay is how long node-detacher waits before retrying the node failed to be reconciled.
+	// The delay doubles on each consecutive failure of the node, up to RequeueMaxDelay.
+	RequeueBaseDelay time.Duration
+	RequeueMaxDelay  time.Duration
+
+	// MaxConcurrentReconciles is the maximum number of nodes reconciled at once. Defaults to 1.
+	MaxConcurrentReconciles int
+
+	// DeregistrationBatchWindow, when non-zero, coalesces de-registrations of nodes from the same target group or
+	// CLB made within the window into one API call. Effective only when MaxConcurrentReconciles is greater than 1.
+	DeregistrationBatchWindow time.Duration
+
+	// DeregistrationBatchMaxSize is the maximum number of targets or instances de-registered in an API call
+	DeregistrationBatchMaxSize int
+
+	requeueBackoff workqueue.RateLimiter
+
+	// KarpenterIntegrationEnabled is set to true when node-detacher should detach nodes being disrupted by Karpenter,
+	// holding their termination with a finalizer until they are detached and drained
+	KarpenterIntegrationEnabled bool
+
+	// XDSServer, when non-nil, is notified of every detach and attach decision so that Envoy-based fronts can see
+	// the node's endpoints flip between DRAINING and HEALTHY
+	XDSServer *XDSServer
 }
 
-// staticMode returns true when node-detacher's static mode is enabled.
+// discoversOn returns true when any of integrations discovers load balancers at the timing
+func (r *NodeController) discoversOn(discovery AWSDiscovery) bool {
+	return len(awsIntegrationsDiscoveredOn(r.AWSIntegrations, discovery)) > 0
+}
+
+// discoversOnNodeCreation returns true when node attachments are discovered on node creation.
 //
-// In static mode, node-to-clb and/or node-to-targetgroup relationship is static and can be known at the time of the
-// node being created.
-func (r *NodeController) staticMode() bool {
-	return !r.dynamicMode()
+// Consul services, Route 53 records, and Global Accelerator endpoints are discovered along with load balancers,
+// which is on detach only when every integration discovers on detach.
+func (r *NodeController) discoversOnNodeCreation() bool {
+	return r.discoversOn(AWSDiscoveryNodeCreation) || !r.discoversOn(AWSDiscoveryDetach)
+}
+
+// Reconcile reconciles the node, and requeues it with the per-node exponential backoff on failure.
+//
+// Failures aren't returned to controller-runtime, whose rate limiter retries as early as 5ms after the first failure.
+// That would exhaust the account's AWS API quota during large scale-downs.
+func (r *NodeController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	r.configMu.RLock()
+	defer r.configMu.RUnlock()
+
+	r.initOnce.Do(r.init)
+
+	res, err := r.reconcile(req)
+	if err != nil {
+		delay := r.requeueBackoff.When(req.Name)
+
+		r.Log.Error(err, "Failed to reconcile node", "node", req.Name, "requeueAfter", delay.String(), "throttled", isAWSThrottlingError(err))
+
+		return ctrl.Result{RequeueAfter: delay}, nil
+	}
+
+	r.requeueBackoff.Forget(req.Name)
+
+	return res, nil
 }
 
-func (r *NodeController) dynamicMode() bool {
-	return r.ALBIngressIntegrationEnabled || r.DynamicNLBIntegrationEnabled || r.DynamicCLBIntegrationEnabled
+// init initializes the controller on the first reconciliation, which may be made concurrently for many nodes
+func (r *NodeController) init() {
+	r.nodeAttachments = &NodeAttachments{
+		Log:               ctrl.Log.WithName("models").WithName("NodeAttachments"),
+		client:            r.Client,
+		asgSvc:            r.asgSvc,
+		elbSvc:            r.elbSvc,
+		elbv2Svc:          r.elbv2Svc,
+		awsAccounts:       r.awsAccounts,
+		consul:            r.Consul,
+		route53:           r.Route53,
+		globalAccelerator: r.GlobalAccelerator,
+		namespace:         r.Namespace,
+		deregistrations:   &DeregistrationBatcher{},
+	}
+
+	r.configure()
 }
 
-func (r *NodeController) shouldHandleTargetGroups() bool {
-	return r.StaticCLBIntegrationEnabled || r.ALBIngressIntegrationEnabled || r.DynamicNLBIntegrationEnabled
+// configure propagates settings of the controller to its components
+func (r *NodeController) configure() {
+	r.nodeAttachments.integrations = r.AWSIntegrations
+	r.nodeAttachments.reattachStageSize = r.ReattachStageSize
+	r.nodeAttachments.reattachSlowStart = r.ReattachSlowStart
+	r.nodeAttachments.controllerTimeout = r.AWSControllerTimeout
+	r.nodeAttachments.skipTargetsWithoutLocalEndpoints = r.AWSSkipTargetsWithoutLocalEndpoints
+	r.nodeAttachments.deregistrations.Window = r.DeregistrationBatchWindow
+	r.nodeAttachments.deregistrations.MaxSize = r.DeregistrationBatchMaxSize
+
+	base, max := r.RequeueBaseDelay, r.RequeueMaxDelay
+
+	if base <= 0 {
+		base = DefaultRequeueBaseDelay
+	}
+
+	if max <= 0 {
+		max = DefaultRequeueMaxDelay
+	}
+
+	r.requeueBackoff = workqueue.NewItemExponentialFailureRateLimiter(base, max)
 }
 
-func (r *NodeController) shouldHandleCLBs() bool {
-	return r.StaticCLBIntegrationEnabled || r.DynamicCLBIntegrationEnabled
+// ApplyConfig updates the reloadable settings of the controller on reload of the config.
+// Note that the backoff of nodes failing to be reconciled is reset.
+func (r *NodeController) ApplyConfig(c *Config) error {
+	triggers, err := c.nodeConditionRules()
+	if err != nil {
+		return err
+	}
+
+	integrations, err := c.awsIntegrations()
+	if err != nil {
+		return err
+	}
+
+	r.configMu.Lock()
+	defer r.configMu.Unlock()
+
+	r.AWSIntegrations = integrations
+	r.KarpenterIntegrationEnabled = c.Karpenter.Enabled
+	r.NodeConditionTriggers = triggers
+	r.ReattachWarmup = c.Reattach.Warmup.Duration
+	r.ReattachHealthTimeout = c.Reattach.HealthTimeout.Duration
+	r.ReattachStageSize = c.Reattach.StageSize
+	r.ReattachSlowStart = c.Reattach.SlowStart.Duration
+	r.AWSControllerTimeout = c.AWS.ControllerTimeout.Duration
+	r.AWSSkipTargetsWithoutLocalEndpoints = c.AWS.SkipTargetsWithoutLocalEndpoints
+	r.ReattachRollbackWindow = c.Reattach.RollbackWindow.Duration
+	r.DeregistrationBatchWindow = c.Concurrency.DeregistrationBatchWindow.Duration
+	r.DeregistrationBatchMaxSize = c.Concurrency.DeregistrationBatchMaxSize
+	r.RequeueBaseDelay = c.Concurrency.RequeueBaseDelay.Duration
+	r.RequeueMaxDelay = c.Concurrency.RequeueMaxDelay.Duration
+
+	if r.nodeAttachments != nil {
+		r.configure()
+	}
+
+	return nil
 }
 
-func (r *NodeController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+func (r *NodeController) reconcile(req ctrl.Request) (ctrl.Result, error) {
+	r.initOnce.Do(r.init)
+
 	ctx := context.Background()
 
 	log := r.Log.WithValues("node", req.NamespacedName)
 
-	if r.nodeAttachments == nil {
-		r.nodeAttachments = &NodeAttachments{
-			Log:              ctrl.Log.WithName("models").WithName("NodeAttachments"),
-			client:           r.Client,
-			asgSvc:           r.asgSvc,
-			elbSvc:           r.elbSvc,
-			elbv2Svc:         r.elbv2Svc,
-			shouldHandleCLBs: r.shouldHandleCLBs(),
-			shouldHandleTGs:  r.shouldHandleTargetGroups(),
-			namespace:        r.Namespace,
-		}
-	}
-
 	var node corev1.Node
 
 	if err := r.Get(ctx, req.NamespacedName, &node); err != nil {
-		log.Error(err, "Failed to get node %q", req.Name)
+		log.Error(err, "Failed to get node")
+
+		if errors.IsNotFound(err) && r.XDSServer != nil {
+			r.XDSServer.RemoveNode(req.Name)
+		}
 
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	manageAttachment := r.AWSEnabled // || r.GCPEnabled
+	// Published before skipping nodes never detached, e.g. master nodes and nodes not selected by any detach policy
+	if r.XDSServer != nil {
+		r.XDSServer.SyncNode(node)
+	}
+
+	karpenterNode := r.KarpenterIntegrationEnabled && isKarpenterNode(node)
+
+	if karpenterNode && node.DeletionTimestamp == nil && !hasNodeFinalizer(node) {
+		node.Finalizers = append(node.Finalizers, NodeFinalizerDetach)
+
+		if err := r.Update(ctx, &node); err != nil {
+			log.Error(err, "Failed to add finalizer to node")
+
+			return ctrl.Result{}, err
+		}
+	}
+
+	// The finalizer may be left on the node once the Karpenter integration is disabled, or the node is no longer managed by
+	// Karpenter. Released so that the node can still be deleted
+	if !karpenterNode && node.DeletionTimestamp != nil && hasNodeFinalizer(node) {
+		removeNodeFinalizer(&node)
+
+		if err := r.Update(ctx, &node); err != nil {
+			log.Error(err, "Failed to remove finalizer from node")
+
+			return ctrl.Result{}, err
+		}
+
+		log.Info("Released node no longer managed via Karpenter for termination")
+
+		return ctrl.Result{}, nil
+	}
+
+	var nodeClaim *unstructured.Unstructured
+
+	// releaseNode lets Karpenter terminate the node being deleted, once node-detacher is done with it
+	releaseNode := func() error {
+		if node.DeletionTimestamp == nil || !hasNodeFinalizer(node) {
+			return nil
+		}
+
+		updated := node.DeepCopy()
+
+		removeNodeFinalizer(updated)
+
+		if err := r.Update(ctx, updated); err != nil {
+			log.Error(err, "Failed to remove finalizer from node")
+
+			return err
+		}
+
+		log.Info("Released node for termination")
+
+		if nodeClaim != nil {
+			r.recorder.Event(nodeClaim, corev1.EventTypeNormal, KarpenterEventReasonNodeDetached, fmt.Sprintf("node-detacher finished detaching node %s", node.Name))
+		}
+
+		return nil
+	}
+
+	awsNode := r.AWSEnabled // || r.GCPEnabled
 	// Do detach from ASG only on AWS
 	if _, err := getInstanceID(node); err != nil {
-		manageAttachment = false
+		awsNode = false
 	}
 
-	if manageAttachment {
-		if !r.synced && r.staticMode() {
-			log.Info("Labeling all nodes on startup")
+	// Consul services and Route 53 records are found by node IPs, so that nodes outside of EC2 are detached from them, too
+	manageAttachment := awsNode || r.Consul != nil || r.Route53 != nil
 
-			if err := r.nodeAttachments.cacheAllNodeAttachments(); err != nil {
-				log.Error(err, "Unable to label all nodes")
-			}
+	if manageAttachment {
+		if r.discoversOnNodeCreation() {
+			r.syncOnce.Do(func() {
+				log.Info("Labeling all nodes on startup")
 
-			r.synced = true
+				if err := r.nodeAttachments.cacheAllNodeAttachments(); err != nil {
+					log.Error(err, "Unable to label all nodes")
+				}
+			})
 		}
 
-		if r.staticMode() && !r.nodeAttachments.Cached(node) {
+		if (r.discoversOnNodeCreation() || !awsNode) && !r.nodeAttachments.Cached(node) {
 			log.Info("Labeling node on init", "node", node.Name)
 
 			if err := r.nodeAttachments.cacheNodeAttachments([]corev1.Node{node}); err != nil {
@@ -208,24 +480,14 @@ func (r *NodeController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		}
 	}
 
-	var isMasterNode bool
-
-	for _, t := range node.Spec.Taints {
-		if t.Key == "node-role.kubernetes.io/master" {
-			isMasterNode = true
-
-			break
-		}
-	}
-
-	if isMasterNode {
+	if isMasterNode(node) {
 		log.Info("Skipped master node")
 
-		return ctrl.Result{}, nil
+		return ctrl.Result{}, releaseNode()
 	}
 
 	var (
-		nodeBeingDetached bool
+		nodeBeingDetached   bool
 		nodeRequireDetached bool
 	)
 
@@ -247,67 +509,116 @@ func (r *NodeController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		}
 	}
 
-	var toBeDeletedByCA bool
+	policies, err := listDetachPolicies(ctx, r.Client)
+	if err != nil {
+		log.Error(err, "Failed to list detach policies")
 
-	var hasAnyCustomTaint bool
+		return ctrl.Result{}, err
+	}
 
-	var hasAnyK8sTaint bool
+	var (
+		policy          *v1alpha1.DetachPolicy
+		trigger         detachTrigger
+		detachTriggered bool
+	)
 
-	NodeTaintKeyK8sNode := "node.kubernetes.io/"
+	now := time.Now()
 
-	ignoredTaintPrefixes := []string{
-		NodeTaintToBeDeletedByCA,
-		NodeTaintKeyDetaching,
-		NodeTaintKeyK8sNode,
-	}
+	if len(policies) == 0 {
+		var ignoredTaintPrefixes []string
 
-	for _, taint := range node.Spec.Taints {
-		// Cluster Autoscaler tries to make the node unschedulable by adding a taint whose key is
-		// `ToBeDeletedByClusterAutoscaler`.
-		//
-		// References:
-		//
-		// MarkToBeDeleted:
-		// https://github.com/kubernetes/autoscaler/blob/7ecf51e4bfab24b6d9c6520d8a851052e5a447fb/cluster-autoscaler/utils/deletetaint/delete.go#L59-L62
-		//
-		// ScaleDown.deleteNode:
-		// https://github.com/kubernetes/autoscaler/blob/af1dd84305d3c6bebd22373a7bcf7aebad5a91f5/cluster-autoscaler/core/scale_down.go#L1109-L1112
-		if taint.Key == NodeTaintToBeDeletedByCA {
-			toBeDeletedByCA = true
+		if r.KarpenterIntegrationEnabled {
+			// Karpenter's disruption taints, `karpenter.sh/disrupted` or `karpenter.sh/disruption` before v1, are handled
+			// below. Other Karpenter taints like `karpenter.sh/unregistered` aren't termination signals.
+			ignoredTaintPrefixes = append(ignoredTaintPrefixes, KarpenterTaintKeyPrefix)
 		}
 
-		if strings.HasPrefix(taint.Key, NodeTaintKeyK8sNode) {
-			hasAnyK8sTaint = true
+		detachTriggered = legacyDetachTriggered(node, ignoredTaintPrefixes...)
+	} else {
+		policy, err = selectDetachPolicy(policies, node)
+		if err != nil {
+			log.Error(err, "Failed to select detach policy")
+
+			return ctrl.Result{}, err
 		}
 
-		ignored := false
-		for _, key := range ignoredTaintPrefixes {
-			if strings.HasPrefix(taint.Key, key) {
-				ignored = true
-			}
+		if policy == nil {
+			log.V(1).Info("Skipped node not selected by any detach policy")
+
+			return ctrl.Result{}, releaseNode()
+		}
+
+		log = log.WithValues("policy", policy.Name)
+
+		reason, excluded, err := detachPolicyExcludes(policy, node)
+		if err != nil {
+			log.Error(err, "Failed to evaluate detach policy exclusions")
+
+			return ctrl.Result{}, err
+		}
+
+		if excluded {
+			log.V(1).Info("Skipped node excluded by detach policy", "reason", reason)
+
+			return ctrl.Result{}, releaseNode()
 		}
 
-		if !ignored {
-			hasAnyCustomTaint = true
+		trigger, detachTriggered = detachPolicyTriggered(policy, node, now)
+	}
+
+	if !detachTriggered {
+		conditionTrigger, triggered := matchNodeConditionRules(r.NodeConditionTriggers, node, now)
+		if triggered {
+			trigger, detachTriggered = conditionTrigger, true
+		} else {
+			trigger.recheckNoLaterThan(conditionTrigger.recheckAfter)
+		}
+	}
+
+	if karpenterNode {
+		karpenterTrigger, nc, triggered, err := r.karpenterTriggered(ctx, node)
+		if err != nil {
+			log.Error(err, "Failed to evaluate karpenter disruption")
+
+			return ctrl.Result{}, err
+		}
+
+		nodeClaim = nc
+
+		// Karpenter is going to terminate the node. Overrides any other trigger so that the node is fully drained.
+		if triggered {
+			trigger, detachTriggered = karpenterTrigger, true
 		}
 	}
 
-	// Note:
-	// - Node becomes Unschedulable when cordoned
-	// - Node should be considered unschedulable when it is already tained by CA for scale down
-	// - Node should be considered unschedulable when it is already tained by node-detacher for detachment
-	nodeIsSchedulable := !node.Spec.Unschedulable && !toBeDeletedByCA && !hasAnyK8sTaint && !hasAnyCustomTaint &&!nodeRequireDetached
+	if detachTriggered && trigger.reason != "" {
+		log.Info("Detach triggered", "reason", trigger.reason, "noCordon", trigger.noCordon)
+	}
+
+	nodeIsSchedulable := !detachTriggered && !nodeRequireDetached
+
+	// noCordon is true when the node is detached only from load balancers, leaving the node schedulable and
+	// pods running, so that the node can be re-attached as soon as the trigger clears.
+	// The node detached for replacing pods is never tainted either, so that the replacement pod is scheduled.
+	noCordon := detachTriggered && trigger.noCordon && !nodeRequireDetached || !detachTriggered && isDetachedForPodReplacement(node)
 
 	detachNode := func() (*ctrl.Result, error) {
 		if !manageAttachment {
 			return nil, nil
 		}
 
-		if r.dynamicMode() {
-			log.Info("Labeling node on detach", "node", node.Name)
+		if awsNode && r.discoversOn(AWSDiscoveryDetach) && node.Annotations[NodeAnnotationKeyDiscoveredOnDetach] != "true" {
+			log.Info("Discovering load balancers on detach", "node", node.Name)
 
-			if err := r.nodeAttachments.cacheNodeAttachments([]corev1.Node{node}); err != nil {
-				log.Error(err, "Unable to label node")
+			if err := r.nodeAttachments.discoverOnDetach(node); err != nil {
+				log.Error(err, "Unable to discover load balancers on detach")
+
+				return &ctrl.Result{}, err
+			}
+
+			// Discovery updates the node, which makes our copy stale
+			if err := r.Get(ctx, types.NamespacedName{Name: node.Name}, &node); err != nil {
+				return &ctrl.Result{}, err
 			}
 		}
 
@@ -318,13 +629,7 @@ func (r *NodeController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		if err != nil {
 			log.Error(err, "Failed to detach nodes")
 
-			return &ctrl.Result{RequeueAfter: 1 * time.Second}, err
-		}
-
-		if err != nil {
-			log.Error(err, "Failed to detach nodes")
-
-			return &ctrl.Result{RequeueAfter: 1 * time.Second}, err
+			return &ctrl.Result{}, err
 		}
 
 		if !processed {
@@ -335,12 +640,51 @@ func (r *NodeController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	}
 
 	deleteDSPods := func() (*ctrl.Result, error) {
-		if nodeRequireDetached {
+		if nodeRequireDetached || noCordon {
 			return nil, nil
 		}
 
 		if err := DeletePods(r.Client, r.CoreV1Client, log, node); err != nil {
-			return &ctrl.Result{RequeueAfter: 1 * time.Second}, err
+			return &ctrl.Result{}, err
+		}
+
+		return nil, nil
+	}
+
+	// waitForDrain defers deleting pods until the node is considered drained.
+	// For example, DNS resolvers may keep returning the node IP until the TTL of the record passes.
+	waitForDrain := func() (*ctrl.Result, error) {
+		if !manageAttachment {
+			return nil, nil
+		}
+
+		remaining, err := r.nodeAttachments.drainRemaining(node)
+		if err != nil {
+			log.Error(err, "Failed to determine remaining drain time")
+
+			return &ctrl.Result{}, err
+		}
+
+		if policy != nil && policy.Spec.DrainTimeout != nil {
+			var elapsed time.Duration
+
+			if ts, err := time.Parse(time.RFC3339, node.Annotations[NodeAnnotationKeyDetachmentTimestamp]); err == nil {
+				elapsed = time.Since(ts)
+			}
+
+			if timeout := policy.Spec.DrainTimeout.Duration - elapsed; remaining > timeout {
+				remaining = timeout
+			}
+		}
+
+		if remaining > 0 {
+			log.Info("Waiting for the node to be drained", "remaining", remaining.String())
+
+			if nodeClaim != nil {
+				r.recorder.Event(nodeClaim, corev1.EventTypeNormal, KarpenterEventReasonWaitingForDrain, fmt.Sprintf("node-detacher is waiting %s for node %s to be drained", remaining.Round(time.Second), node.Name))
+			}
+
+			return &ctrl.Result{RequeueAfter: remaining}, nil
 		}
 
 		return nil, nil
@@ -351,6 +695,10 @@ func (r *NodeController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 			return r, err
 		}
 
+		if r, err := waitForDrain(); r != nil || err != nil {
+			return r, err
+		}
+
 		if r, err := deleteDSPods(); err != nil {
 			return r, err
 		}
@@ -376,27 +724,193 @@ func (r *NodeController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		//
 		// See StaticAutoscaler.cleanUpIfRequired for more information on how CA cancels a scale-down after crash:
 		// https://github.com/kubernetes/autoscaler/blob/dbbd4572af2b666d32e582bf88c4239163706f8c/cluster-autoscaler/core/static_autoscaler.go#L170-L190
-		if err := r.nodeAttachments.attachNodes([]corev1.Node{node}); err != nil {
+		pending, err := r.nodeAttachments.attachNodes([]corev1.Node{node}, false)
+		if err != nil {
 			log.Error(err, "Failed to reattach nodes")
 
-			return &ctrl.Result{RequeueAfter: 5 * time.Second}, err
+			return &ctrl.Result{}, err
 		}
 
-		return nil, nil
+		if len(pending) == 0 {
+			return nil, nil
+		}
+
+		// Defer marking the node as attached until the re-registered targets pass health checks, or the timeout passes
+		started, err := time.Parse(time.RFC3339, node.Annotations[NodeAnnotationKeyReattachmentStartedTimestamp])
+		if err != nil {
+			started = now
+
+			updated := node.DeepCopy()
+
+			updated.Annotations[NodeAnnotationKeyReattachmentStartedTimestamp] = started.Format(time.RFC3339)
+
+			if err := r.Update(ctx, updated); err != nil {
+				return &ctrl.Result{}, err
+			}
+
+			node = *updated
+		}
+
+		if r.ReattachHealthTimeout > 0 && now.Sub(started) >= r.ReattachHealthTimeout {
+			log.Info("Gave up waiting for targets to become healthy", "pending", pending)
+
+			reason := fmt.Sprintf("Targets didn't become healthy within %s: %v", r.ReattachHealthTimeout, pending)
+
+			r.recorder.Event(&node, corev1.EventTypeWarning, "ReattachHealthTimeout", reason)
+
+			updated := node.DeepCopy()
+
+			updated.Annotations[NodeAnnotationKeyReattachFailed] = reason
+
+			if err := r.Update(ctx, updated); err != nil {
+				return &ctrl.Result{}, err
+			}
+
+			node = *updated
+
+			if _, err := r.nodeAttachments.attachNodes([]corev1.Node{node}, true); err != nil {
+				log.Error(err, "Failed to reattach nodes")
+
+				return &ctrl.Result{}, err
+			}
+
+			return nil, nil
+		}
+
+		log.Info("Waiting for targets to become healthy", "pending", pending)
+
+		return &ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+	}
+
+	// rollbackIfUnhealthy re-detaches the node when any of the re-attached targets fails health checks within
+	// the rollback window, so that a flapping node doesn't keep receiving traffic
+	rollbackIfUnhealthy := func() (*ctrl.Result, error) {
+		if !manageAttachment || r.ReattachRollbackWindow <= 0 {
+			return nil, nil
+		}
+
+		unhealthy, watching, err := r.nodeAttachments.unhealthyWithinRollbackWindow(node, r.ReattachRollbackWindow, now)
+		if err != nil {
+			log.Error(err, "Failed to check target health within rollback window")
+
+			return &ctrl.Result{}, err
+		}
+
+		if !watching {
+			return nil, nil
+		}
+
+		if len(unhealthy) == 0 {
+			return &ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+		}
+
+		log.Info("Rolling back re-attachment of unhealthy node", "unhealthy", unhealthy)
+
+		// Marked as being detached before detaching anything, like detaching the node on a trigger.
+		// The rollback is completed by completeRollback in case node-detacher crashes or fails in the middle of it
+		updated := node.DeepCopy()
+
+		updated.Annotations[NodeAnnotationKeyDetaching] = "true"
+		updated.Annotations[NodeAnnotationKeyDetachmentTimestamp] = now.Format(time.RFC3339)
+		delete(updated.Annotations, NodeAnnotationKeyAttachmentTimestamp)
+		delete(updated.Annotations, NodeAnnotationKeyDrained)
+
+		reason := fmt.Sprintf("Detached node again as targets became unhealthy within %s after re-attachment: %v", r.ReattachRollbackWindow, unhealthy)
+
+		updated.Annotations[NodeAnnotationKeyReattachFailed] = reason
+
+		taintNode(updated, r.Name)
+
+		if err := r.Update(ctx, updated); err != nil {
+			return &ctrl.Result{}, err
+		}
+
+		node = *updated
+
+		if _, err := r.nodeAttachments.detachNodes([]corev1.Node{node}); err != nil {
+			log.Error(err, "Failed to detach nodes")
+
+			return &ctrl.Result{}, err
+		}
+
+		r.recorder.Event(&node, corev1.EventTypeWarning, "ReattachRolledBack", reason)
+
+		return &ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+
+	// completeRollback detaches the node rolled back by rollbackIfUnhealthy again while it waits to be re-attached, as
+	// node-detacher may have crashed or failed after marking the node as being detached and before detaching it.
+	// Detaching the node is idempotent, and resumes de-registrations whose intents are recorded.
+	completeRollback := func() error {
+		if !manageAttachment {
+			return nil
+		}
+
+		if _, rolledBack := node.Annotations[NodeAnnotationKeyReattachFailed]; !rolledBack {
+			return nil
+		}
+
+		if _, reattaching := node.Annotations[NodeAnnotationKeyReattachmentStartedTimestamp]; reattaching {
+			return nil
+		}
+
+		if _, err := r.nodeAttachments.detachNodes([]corev1.Node{node}); err != nil {
+			log.Error(err, "Failed to complete rolling back re-attachment")
+
+			return err
+		}
+
+		return nil
+	}
+
+	publishEndpoint := func(draining bool) {
+		if r.XDSServer != nil {
+			r.XDSServer.SetNodeEndpoint(node, draining)
+		}
 	}
 
 	if nodeBeingDetached {
 		log.Info("Node is already being detached")
 
 		if nodeIsSchedulable {
+			// The node may be schedulable but not yet ready to serve traffic, e.g. right after being rebooted by kured
+			ready, readySince := nodeReadySince(node)
+			if !ready {
+				log.Info("Waiting for node to become Ready before re-attaching")
+
+				if err := completeRollback(); err != nil {
+					return ctrl.Result{}, err
+				}
+
+				return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+			}
+
+			// Also warm up after a rollback, as the node may have been Ready for long
+			if ts, err := time.Parse(time.RFC3339, node.Annotations[NodeAnnotationKeyDetachmentTimestamp]); err == nil && ts.After(readySince) {
+				readySince = ts
+			}
+
+			if remaining := readySince.Add(r.ReattachWarmup).Sub(now); remaining > 0 {
+				log.Info("Warming up node before re-attaching", "remaining", remaining.String())
+
+				if err := completeRollback(); err != nil {
+					return ctrl.Result{}, err
+				}
+
+				return ctrl.Result{RequeueAfter: remaining}, nil
+			}
+
 			log.Info("Node is now schedulable. Re-attaching...")
 
-			if r, err := attachNode(); err != nil {
+			if r, err := attachNode(); r != nil || err != nil {
 				return *r, err
 			}
 
 			updated := node.DeepCopy()
 
+			delete(updated.Annotations, NodeAnnotationKeyReattachmentStartedTimestamp)
+			delete(updated.Annotations, NodeAnnotationKeyDrained)
+
 			updated.Annotations[NodeAnnotationKeyDetaching] = "false"
 
 			updated.Annotations[NodeAnnotationKeyAttachmentTimestamp] = time.Now().Format(time.RFC3339)
@@ -411,6 +925,7 @@ func (r *NodeController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 			})
 
 			updated.Labels[NodeLabelKeyCached] = "false"
+			delete(updated.Annotations, NodeAnnotationKeyDiscoveredOnDetach)
 
 			untaintNode(updated)
 
@@ -420,14 +935,47 @@ func (r *NodeController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 				return ctrl.Result{}, err
 			}
 
+			publishEndpoint(false)
+
 			r.recorder.Event(&node, corev1.EventTypeNormal, "NodeDetatching", "Successfully stopped detaching and started re-attaching node")
 			log.Info("Started re-attaching node", "node", node.Name)
 		} else {
 			log.Info("Ensuring node to be detached")
 
-			if r, err := detachAll(); err != nil {
+			publishEndpoint(true)
+
+			// The re-attachment was interrupted by another trigger. Closes the readiness gates of pods on the node again
+			if _, ok := node.Annotations[NodeAnnotationKeyReattachmentStartedTimestamp]; ok {
+				updated := node.DeepCopy()
+
+				delete(updated.Annotations, NodeAnnotationKeyReattachmentStartedTimestamp)
+
+				if err := r.Update(ctx, updated); err != nil {
+					return ctrl.Result{}, err
+				}
+
+				node = *updated
+			}
+
+			if r, err := detachAll(); r != nil || err != nil {
 				return *r, err
 			}
+
+			if node.Annotations[NodeAnnotationKeyDrained] != "true" {
+				updated := node.DeepCopy()
+
+				updated.Annotations[NodeAnnotationKeyDrained] = "true"
+
+				if err := r.Update(ctx, updated); err != nil {
+					return ctrl.Result{}, err
+				}
+
+				node = *updated
+			}
+
+			if err := releaseNode(); err != nil {
+				return ctrl.Result{}, err
+			}
 		}
 
 		return ctrl.Result{}, nil
@@ -438,13 +986,102 @@ func (r *NodeController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		//
 		// We only detach the node when it is unschedulable.
 		// Wait until the node becomes unscheduralble.
+		publishEndpoint(false)
+
+		if r, err := rollbackIfUnhealthy(); r != nil || err != nil {
+			return *r, err
+		}
+
+		if trigger.recheckAfter > 0 {
+			log.Info("Waiting for pending detach trigger", "after", trigger.recheckAfter.String())
+
+			return ctrl.Result{RequeueAfter: trigger.recheckAfter}, nil
+		}
+
 		return ctrl.Result{}, nil
 	}
 
-	if r, err := detachAll(); err != nil {
-		return *r, err
+	// Held until the node is marked as being detached, so that nodes reconciled concurrently see each other
+	// when counting nodes being detached
+	r.detachMu.Lock()
+
+	var apiReader client.Reader = r.Client
+
+	if r.apiReader != nil {
+		apiReader = r.apiReader
 	}
 
+	if policy != nil && policy.Spec.MaxConcurrentDetachments != nil {
+		detaching, err := countDetachingNodes(ctx, apiReader, policies, policy)
+		if err != nil {
+			r.detachMu.Unlock()
+
+			log.Error(err, "Failed to count nodes being detached")
+
+			return ctrl.Result{}, err
+		}
+
+		if detaching >= int(*policy.Spec.MaxConcurrentDetachments) {
+			r.detachMu.Unlock()
+
+			log.Info("Postponed detaching node due to max concurrent detachments", "detaching", detaching, "max", *policy.Spec.MaxConcurrentDetachments)
+
+			return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+		}
+	}
+
+	var impacts []v1alpha1.ServiceImpact
+
+	if awsNode {
+		local, err := r.nodeAttachments.localEndpointsOfNode(node)
+		if err != nil {
+			r.detachMu.Unlock()
+
+			log.Error(err, "Failed to count local endpoints of services")
+
+			return ctrl.Result{}, err
+		}
+
+		impacts = serviceImpactsOf(local)
+	}
+
+	if policy != nil {
+		svc, err := checkLocalEndpointBudget(ctx, apiReader, r.Namespace, policies, policy, node, impacts)
+		if err != nil {
+			r.detachMu.Unlock()
+
+			log.Error(err, "Failed to check local endpoints removed by nodes being detached")
+
+			return ctrl.Result{}, err
+		}
+
+		if svc != "" {
+			r.detachMu.Unlock()
+
+			log.Info("Postponed detaching node due to max unavailable local endpoints", "service", svc, "max", policy.Spec.MaxUnavailableLocalEndpoints.String())
+
+			return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+		}
+	}
+
+	if awsNode {
+		// Recorded before marking the node as being detached, so that nodes detached next see the impact
+		if err := r.nodeAttachments.recordServiceImpacts(node, impacts); err != nil {
+			r.detachMu.Unlock()
+
+			log.Error(err, "Failed to record impact of detaching node on services")
+
+			return ctrl.Result{}, err
+		}
+
+		for _, i := range impacts {
+			r.recorder.Event(&node, corev1.EventTypeNormal, NodeEventReasonLocalEndpointsRemoved, fmt.Sprintf("Detaching node %s", i.Message))
+		}
+	}
+
+	// Start draining Envoy endpoints first, as it takes effect far sooner than deregistering from cloud LBs
+	publishEndpoint(true)
+
 	updated := node.DeepCopy()
 
 	if updated.Annotations == nil {
@@ -453,10 +1090,15 @@ func (r *NodeController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		updated.Annotations = map[string]string{}
 	}
 
+	// Mark the node as being detached before detaching anything.
+	// Otherwise, node-detacher crashing in the middle of detaching, followed by the trigger being cleared, e.g. CA
+	// cancelling the scale-down, results in the node never being re-attached.
 	updated.Annotations[NodeAnnotationKeyDetaching] = "true"
 
 	updated.Annotations[NodeAnnotationKeyDetachmentTimestamp] = time.Now().Format(time.RFC3339)
 	delete(updated.Annotations, NodeAnnotationKeyAttachmentTimestamp)
+	delete(updated.Annotations, NodeAnnotationKeyReattachFailed)
+	delete(updated.Annotations, NodeAnnotationKeyReattachmentStartedTimestamp)
 
 	updated.Status.Conditions = append(updated.Status.Conditions, corev1.NodeCondition{
 		Type:               NodeConditionTypeNodeBeingDetached,
@@ -466,19 +1108,58 @@ func (r *NodeController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		LastTransitionTime: metav1.NewTime(time.Now()),
 	})
 
-	taintNode(updated, r.Name)
+	if !noCordon {
+		taintNode(updated, r.Name)
+	}
+
+	err = r.Client.Update(ctx, updated)
 
-	if err := r.Client.Update(ctx, updated); err != nil {
+	r.detachMu.Unlock()
+
+	if err != nil {
 		log.Error(err, "Failed to update node conditions and annotations for detach", "node", updated.Name)
 
 		return ctrl.Result{}, err
 	}
 
+	node = *updated
+
 	log.Info("Successfully tainted node")
 
 	r.recorder.Event(&node, corev1.EventTypeNormal, NodeEventReasonNodeBeingDetached, "Successfully started detaching node")
+
+	if nodeClaim != nil {
+		r.recorder.Event(nodeClaim, corev1.EventTypeNormal, KarpenterEventReasonNodeDetaching, fmt.Sprintf("node-detacher started detaching node %s: %s", node.Name, trigger.reason))
+	}
+
+	res, err := detachAll()
+	if err != nil {
+		return *res, err
+	}
+
+	// The node is already detached and drained
+	if res == nil {
+		updated := node.DeepCopy()
+
+		updated.Annotations[NodeAnnotationKeyDrained] = "true"
+
+		if updated.DeletionTimestamp != nil {
+			removeNodeFinalizer(updated)
+		}
+
+		if err := r.Client.Update(ctx, updated); err != nil {
+			log.Error(err, "Failed to mark node as drained", "node", updated.Name)
+
+			return ctrl.Result{}, err
+		}
+	}
+
 	log.Info("Started detaching node", "node", node.Name)
 
+	if res != nil {
+		return *res, nil
+	}
+
 	return ctrl.Result{}, nil
 }
 
@@ -516,7 +1197,59 @@ func (r *NodeController) SetupWithManager(mgr ctrl.Manager) error {
 		return err
 	}
 
-	return ctrl.NewControllerManagedBy(mgr).
+	// Re-evaluates all the nodes on any change in detach policies
+	enqueueAllNodes := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(_ handler.MapObject) []reconcile.Request {
+			var nodes corev1.NodeList
+
+			if err := r.List(context.Background(), &nodes); err != nil {
+				r.Log.Error(err, "Failed to list nodes on detach policy change")
+
+				return nil
+			}
+
+			var reqs []reconcile.Request
+
+			for _, n := range nodes.Items {
+				reqs = append(reqs, reconcile.Request{NamespacedName: types.NamespacedName{Name: n.Name}})
+			}
+
+			return reqs
+		}),
+	}
+
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Node{}).
-		Complete(r)
+		Watches(&source.Kind{Type: &v1alpha1.DetachPolicy{}}, enqueueAllNodes).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles})
+
+	// Watched regardless of the Karpenter integration being enabled, as it can be enabled on reload.
+	// The NodeClaim version is the newest one served by the installed Karpenter release
+	for _, version := range karpenterNodeClaimVersions {
+		gvk := karpenterNodeClaimGVK.GroupKind().WithVersion(version)
+
+		if _, err := mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); err != nil {
+			if !meta.IsNoMatchError(err) {
+				r.Log.Error(err, "Unable to determine if Karpenter is installed. NodeClaims are read without being watched")
+
+				break
+			}
+
+			continue
+		}
+
+		nodeClaim := &unstructured.Unstructured{}
+		nodeClaim.SetGroupVersionKind(gvk)
+
+		r.nodeClaims = mgr.GetCache()
+		r.nodeClaimGVK = gvk
+
+		b = b.Watches(&source.Kind{Type: nodeClaim}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(nodeClaimToNode),
+		})
+
+		break
+	}
+
+	return b.Complete(r)
 }
@@ -20,25 +20,27 @@ import (
 	"context"
 	"github.com/go-logr/logr"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"strings"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	"time"
 
-	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 )
 
 // +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;update;patch;delete
 // +kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=pods/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=nodes/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=core,resources=events,verbs=get;create;update;patch
 
-// PodController reconciles daemonset pods
+// PodController reconciles daemonset pods, and optionally deployment and statefulset pods
 type PodController struct {
 	// Name is the name of the manager used from within daemonset annotations to specify which node-detacher instance to manage the daemonset
 	Name string
@@ -47,43 +49,18 @@ type PodController struct {
 	Log      logr.Logger
 	recorder record.EventRecorder
 
-	// DaemonSets is the list of daemonsets whose item is either "NAME" or "NAMESPACE/NAME" of the target daemonset.
-	//
-	// For example, let's say you'd like node-detacher deployed in kube-system to detach the node which is running the target
-	// pod and when the pod becomes `Terminating` state.
-	//
-	// When the pod is named `contour-<hash>` and it is managed by the daemonset named `contour` in namespace
-	// `kube-system`, you'd specifyc the daemonsets list as:
-	//
-	//  --daemonsets contour`
-	//
-	// If you'd like to deploy `contour` in another namespace that is different from where `node-detacher` is deployed
-	// to - e.g. `ingress` namespace - you'd specify the list as:
-	//
-	// --daemonsets ingress/contour
-	DaemonSets []string
-
-	// Namespace is the default namespace to watch for daemonset pods
-	Namespace string
-}
-
-func CalculateTargets(targetDaemonsets []string) (map[string]bool, map[string]bool) {
-	namespaces := map[string]bool{}
-
-	daemonsetNames := map[string]bool{}
+	// Targets resolves the daemonsets whose pods are managed
+	Targets *DaemonSetTargets
 
-	for _, ds := range targetDaemonsets {
-		nsName := strings.Split(ds, "/")
+	// ManageWorkloads enables detaching nodes running terminating pods of deployments and statefulsets, which are
+	// annotated with node-detacher.variant.run/managed-by=NAME or matched by WorkloadPodSelector
+	ManageWorkloads bool
 
-		if len(nsName) > 1 {
-			namespaces[nsName[0]] = true
-			daemonsetNames[nsName[1]] = true
-		} else {
-			daemonsetNames[nsName[0]] = true
-		}
-	}
+	// WorkloadPodSelector selects deployment and statefulset pods to be managed
+	WorkloadPodSelector labels.Selector
 
-	return namespaces, daemonsetNames
+	// SyncReadinessGates enables re-evaluating the node-attached readiness gate of pods on node changes
+	SyncReadinessGates bool
 }
 
 func (r *PodController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
@@ -91,46 +68,33 @@ func (r *PodController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 
 	log := r.Log.WithValues("pod", req.NamespacedName)
 
-	namespaces, daemonsetNames := CalculateTargets(r.DaemonSets)
-
-	podNamespace := req.Namespace
+	var latestPod corev1.Pod
 
-	// Try to list daemonsets only when there's no concrete list of target daemonsets specified.
-	// This gives you an option no not poke K8s API on each reconcilation loop
-	if r.Name != "" && len(r.DaemonSets) == 0 {
-		var dsList appsv1.DaemonSetList
+	if err := r.Client.Get(ctx, req.NamespacedName, &latestPod); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
 
-		if err := r.List(ctx, &dsList, client.InNamespace(podNamespace), client.MatchingFields{DaemonSetFieldManagedBy: r.Name}); err != nil {
-			return ctrl.Result{}, err
-		}
+	w, err := getPodWorkload(ctx, r.Client, &latestPod)
+	if err != nil {
+		log.Error(err, "Failed getting pod owner")
 
-		for _, ds := range dsList.Items {
-			namespaces[ds.GetNamespace()] = true
-			daemonsetNames[ds.GetName()] = true
-		}
+		return ctrl.Result{}, err
 	}
 
-	_, nsTargeted := namespaces[podNamespace]
-	if !nsTargeted {
-		log.Info("Skipping this pod. Only pods in one of target namespaces are reconciled by me.")
+	if w == nil {
+		log.V(1).Info("Skipping this pod. Only daemonset, deployment, and statefulset pods are reconciled by me")
 
 		return ctrl.Result{}, nil
 	}
 
-	var latestPod corev1.Pod
-
-	if err := r.Client.Get(ctx, req.NamespacedName, &latestPod); err != nil {
-		log.Error(err, "Failed getting pod owner")
+	if !r.isTargeted(w, &latestPod) {
+		log.V(1).Info("Skipping this pod. Only pods that are managed by one of target workloads are reconciled by me", "kind", w.Kind, "owner", w.Name)
 
-		return ctrl.Result{}, err
+		return ctrl.Result{}, nil
 	}
 
-	owner := metav1.GetControllerOf(&latestPod)
-
-	if owner.Kind != "DaemonSet" {
-		log.Info("Skipping this pod. Only daemonset pods are reconciled by me", "kind", owner.Kind)
-
-		return ctrl.Result{}, nil
+	if err := r.syncNodeAttachedCondition(ctx, &latestPod); err != nil {
+		return ctrl.Result{RequeueAfter: 1 * time.Second}, err
 	}
 
 	// Do thing on non-terminating pod
@@ -138,14 +102,15 @@ func (r *PodController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	// Perhaps it's seeing deletion timestamp? We assume so here.
 	// https://github.com/kubernetes/api/blob/b5bd82427fa87d8b6fdf2c0b4cc2a2115c0c6de9/core/v1/types.go#L2414-L2435
 	if latestPod.GetDeletionTimestamp() == nil && GetAnnotation(latestPod.GetObjectMeta(), PodAnnotationDetaching) != r.Name {
+		// Re-attach nodes once the replacement pods became ready
+		if err := r.reattachNodesForWorkload(ctx, w); err != nil {
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+		}
+
 		return ctrl.Result{}, nil
 	}
 
-	_, ownerTargeted := daemonsetNames[owner.Name]
-
-	if !ownerTargeted {
-		log.Info("Skipping this pod. Only pods that are managed by one of target daemonsets are reconciled by me", "owner", owner.Name)
-
+	if latestPod.Spec.NodeName == "" {
 		return ctrl.Result{}, nil
 	}
 
@@ -161,38 +126,158 @@ func (r *PodController) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{RequeueAfter: 1 * time.Second}, err
 	}
 
-	newNode := node.DeepCopy()
+	reason, err := lookupNeverDetachedReason(ctx, r.Client, node)
+	if err != nil {
+		return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+	}
+
+	// Annotating the node would only close the readiness gates of pods on the node, as NodeController never detaches it
+	if reason != "" {
+		log.V(1).Info("Skipped detaching node never detached by node-detacher", "node", node.Name, "reason", reason)
 
-	taintNode(newNode, r.Name)
+		return ctrl.Result{}, nil
+	}
 
-	if err := r.Patch(ctx, newNode, client.MergeFrom(&node)); err != nil {
+	// Let NodeController detach the node. The node isn't tainted so that the replacement pod can be scheduled onto it.
+	if err := setNodeDetachedForPodReplacement(ctx, r.Client, node, w.detachedAnnotationValue()); err != nil {
 		return ctrl.Result{RequeueAfter: 1 * time.Second}, err
 	}
 
 	return ctrl.Result{}, nil
 }
 
-func (r *PodController) SetupWithManager(mgr ctrl.Manager) error {
-	r.recorder = mgr.GetEventRecorderFor(r.Name)
+// isTargeted returns true when the pod should be reconciled.
+// Daemonset pods are targeted by DaemonSetTargets, and deployment and statefulset pods are targeted by the managed-by
+// annotation on deployments and statefulsets or the pod selector.
+func (r *PodController) isTargeted(w *podWorkload, pod *corev1.Pod) bool {
+	if pod.Annotations[PodAnnotationKeyInjected] == "true" {
+		return true
+	}
 
-	if err := mgr.GetFieldIndexer().IndexField(&appsv1.DaemonSet{}, DaemonSetFieldManagedBy, func(rawObj runtime.Object) []string {
-		ds := rawObj.(*appsv1.DaemonSet)
+	if w.Kind == WorkloadKindDaemonSet {
+		return r.Targets.Matches(w.Object)
+	}
 
-		managedBy := GetManagedBy(ds.GetObjectMeta())
+	if !r.ManageWorkloads {
+		return false
+	}
 
-		if managedBy == "" {
+	if r.Name != "" && GetManagedBy(w.Object) == r.Name {
+		return true
+	}
+
+	return r.WorkloadPodSelector != nil && r.WorkloadPodSelector.Matches(labels.Set(pod.Labels))
+}
+
+// syncNodeAttachedCondition sets the node-attached readiness gate condition of the running pod according to whether
+// the node is attached to load balancers
+func (r *PodController) syncNodeAttachedCondition(ctx context.Context, pod *corev1.Pod) error {
+	var gated bool
+
+	for _, g := range pod.Spec.ReadinessGates {
+		if g.ConditionType == PodConditionTypeNodeAttached {
+			gated = true
+		}
+	}
+
+	if !gated || pod.Spec.NodeName == "" || pod.DeletionTimestamp != nil {
+		return nil
+	}
+
+	var node corev1.Node
+
+	if err := r.Get(ctx, types.NamespacedName{Name: pod.Spec.NodeName}, &node); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	cond := corev1.PodCondition{
+		Type:   PodConditionTypeNodeAttached,
+		Status: corev1.ConditionTrue,
+		Reason: "NodeAttached",
+	}
+
+	if !isNodeAttachedForPods(node) {
+		cond.Status = corev1.ConditionFalse
+		cond.Reason = "NodeDetached"
+	}
+
+	updated := pod.DeepCopy()
+
+	var found bool
+
+	for i, c := range updated.Status.Conditions {
+		if c.Type != PodConditionTypeNodeAttached {
+			continue
+		}
+
+		if c.Status == cond.Status {
 			return nil
 		}
 
-		return []string{managedBy}
-	}); err != nil {
-		return err
+		found = true
+
+		cond.LastTransitionTime = metav1.Now()
+		updated.Status.Conditions[i] = cond
 	}
 
-	return ctrl.NewControllerManagedBy(mgr).
+	if !found {
+		cond.LastTransitionTime = metav1.Now()
+		updated.Status.Conditions = append(updated.Status.Conditions, cond)
+	}
+
+	return r.Status().Update(ctx, updated)
+}
+
+// isNodeAttachedForPods returns true when pods on the node can be considered ready in terms of the node-attached
+// readiness gate.
+//
+// The gate opens as soon as node-detacher starts re-registering the node, rather than once the re-registered targets
+// become healthy, as targets of `externalTrafficPolicy: Local` services become healthy only after pods on the node
+// become ready.
+func isNodeAttachedForPods(node corev1.Node) bool {
+	if _, ok := node.Annotations[NodeAnnotationKeyReattachmentStartedTimestamp]; ok {
+		return true
+	}
+
+	_, detached := node.Annotations[NodeAnnotationKeyDetached]
+
+	return !detached && node.Annotations[NodeAnnotationKeyDetaching] != "true"
+}
+
+func (r *PodController) SetupWithManager(mgr ctrl.Manager) error {
+	r.recorder = mgr.GetEventRecorderFor(r.Name)
+
+	// Static pods, bare pods, and pod updates irrelevant to detaching nodes never reach Reconcile
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Pod{}).
-		Complete(r)
+		WithEventFilter(podPredicate(r.ManageWorkloads, r.Targets))
+
+	if r.SyncReadinessGates {
+		// Re-evaluates the readiness gates of injected pods on the node on any change in the node
+		b = b.Watches(&source.Kind{Type: &corev1.Node{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(func(o handler.MapObject) []reconcile.Request {
+				var pods corev1.PodList
+
+				if err := r.List(context.Background(), &pods, client.MatchingFields{"spec.nodeName": o.Meta.GetName()}); err != nil {
+					r.Log.Error(err, "Failed to list pods on node change")
+
+					return nil
+				}
+
+				var reqs []reconcile.Request
+
+				for _, p := range pods.Items {
+					if p.Annotations[PodAnnotationKeyInjected] == "true" {
+						reqs = append(reqs, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: p.Namespace, Name: p.Name}})
+					}
+				}
+
+				return reqs
+			}),
+		})
+	}
 
+	return b.Complete(r)
 }
 
 func GetManagedBy(controllee metav1.Object) string {
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	// PodConditionTypeNodeAttached is the readiness gate injected into selected pods.
+	// node-detacher sets it to True only while the node running the pod is attached to load balancers, so that a new
+	// pod isn't considered ready until its node is re-attached.
+	PodConditionTypeNodeAttached corev1.PodConditionType = "node-detacher.variant.run/node-attached"
+
+	// PodAnnotationKeyInject opts the pod in the injection, in addition to the pod selector given via command-line flags
+	PodAnnotationKeyInject = "node-detacher.variant.run/inject"
+
+	// PodAnnotationKeyInjected is set on the pod injected with the readiness gate and the preStop hook.
+	// PodController detaches the node running the injected pod once the pod starts terminating.
+	PodAnnotationKeyInjected = "node-detacher.variant.run/injected"
+
+	PreStopPath = "/wait-for-detach"
+)
+
+// +kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=ignore,groups="",resources=pods,verbs=create,versions=v1,name=mpod.node-detacher.variant.run
+
+// PodMutator injects the node-attached readiness gate and the preStop hook that blocks until the node is drained into
+// selected pods
+type PodMutator struct {
+	Log logr.Logger
+
+	// Selector selects pods to inject. Pods annotated with node-detacher.variant.run/inject=true are always injected.
+	Selector labels.Selector
+
+	// PreStopHost and PreStopPort are the address kubelet calls the preStop hook at, i.e. the PreStopServer
+	PreStopHost string
+	PreStopPort int
+
+	decoder *admission.Decoder
+}
+
+// InjectDecoder implements admission.DecoderInjector
+func (m *PodMutator) InjectDecoder(d *admission.Decoder) error {
+	m.decoder = d
+
+	return nil
+}
+
+func (m *PodMutator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var pod corev1.Pod
+
+	if err := m.decoder.Decode(req, &pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if !m.selects(pod) {
+		return admission.Allowed("")
+	}
+
+	injectPod(&pod, m.PreStopHost, m.PreStopPort)
+
+	m.Log.V(1).Info("Injected pod", "namespace", req.Namespace, "generateName", pod.GenerateName, "name", pod.Name)
+
+	marshaled, err := json.Marshal(pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+func (m *PodMutator) selects(pod corev1.Pod) bool {
+	if pod.Annotations[PodAnnotationKeyInject] == "true" {
+		return true
+	}
+
+	return m.Selector != nil && m.Selector.Matches(labels.Set(pod.Labels))
+}
+
+// injectPod adds the node-attached readiness gate and the preStop hook to the pod.
+// Containers that already have their own preStop hooks are left as-is.
+func injectPod(pod *corev1.Pod, preStopHost string, preStopPort int) {
+	if pod.Annotations[PodAnnotationKeyInjected] == "true" {
+		return
+	}
+
+	var gated bool
+
+	for _, g := range pod.Spec.ReadinessGates {
+		if g.ConditionType == PodConditionTypeNodeAttached {
+			gated = true
+		}
+	}
+
+	if !gated {
+		pod.Spec.ReadinessGates = append(pod.Spec.ReadinessGates, corev1.PodReadinessGate{ConditionType: PodConditionTypeNodeAttached})
+	}
+
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+
+		if c.Lifecycle == nil {
+			c.Lifecycle = &corev1.Lifecycle{}
+		}
+
+		if c.Lifecycle.PreStop != nil {
+			continue
+		}
+
+		c.Lifecycle.PreStop = &corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Host:   preStopHost,
+				Port:   intstr.FromInt(preStopPort),
+				Path:   PreStopPath,
+				Scheme: corev1.URISchemeHTTP,
+			},
+		}
+	}
+
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+
+	pod.Annotations[PodAnnotationKeyInjected] = "true"
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PodMutator", func() {
+	It("injects the readiness gate and the preStop hook only once", func() {
+		custom := &corev1.Lifecycle{PreStop: &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"sleep", "10"}}}}
+
+		pod := corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "envoy"}, {Name: "sidecar", Lifecycle: custom}}}}
+
+		injectPod(&pod, "10.100.0.82", 8082)
+		injectPod(&pod, "10.100.0.82", 8082)
+
+		Expect(pod.Spec.ReadinessGates).To(Equal([]corev1.PodReadinessGate{{ConditionType: PodConditionTypeNodeAttached}}))
+		Expect(pod.Annotations).To(HaveKeyWithValue(PodAnnotationKeyInjected, "true"))
+
+		hook := pod.Spec.Containers[0].Lifecycle.PreStop.HTTPGet
+		Expect(hook.Host).To(Equal("10.100.0.82"))
+		Expect(hook.Port.IntValue()).To(Equal(8082))
+		Expect(hook.Path).To(Equal(PreStopPath))
+
+		Expect(pod.Spec.Containers[1].Lifecycle).To(Equal(custom))
+	})
+
+	It("selects pods by the annotation or the selector", func() {
+		m := &PodMutator{}
+
+		Expect(m.selects(corev1.Pod{})).To(BeFalse())
+		Expect(m.selects(corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{PodAnnotationKeyInject: "true"}}})).To(BeTrue())
+	})
+
+	It("considers the pod ready regardless of the node-attached readiness gate", func() {
+		pod := corev1.Pod{
+			Spec: corev1.PodSpec{ReadinessGates: []corev1.PodReadinessGate{{ConditionType: PodConditionTypeNodeAttached}}},
+			Status: corev1.PodStatus{Conditions: []corev1.PodCondition{
+				{Type: corev1.ContainersReady, Status: corev1.ConditionTrue},
+				{Type: corev1.PodReady, Status: corev1.ConditionFalse},
+				{Type: PodConditionTypeNodeAttached, Status: corev1.ConditionFalse},
+			}},
+		}
+
+		Expect(isPodReady(pod)).To(BeTrue())
+
+		pod.Spec.ReadinessGates = nil
+
+		Expect(isPodReady(pod)).To(BeFalse())
+	})
+
+	It("opens the node-attached readiness gate once the node starts being re-attached", func() {
+		node := corev1.Node{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+		Expect(isNodeAttachedForPods(node)).To(BeTrue())
+
+		node.Annotations[NodeAnnotationKeyDetaching] = "true"
+		Expect(isNodeAttachedForPods(node)).To(BeFalse())
+
+		// Targets of externalTrafficPolicy=Local services never become healthy until pods on the node become ready
+		node.Annotations[NodeAnnotationKeyReattachmentStartedTimestamp] = time.Now().Format(time.RFC3339)
+		Expect(isNodeAttachedForPods(node)).To(BeTrue())
+	})
+})
+
+var _ = Describe("PreStopServer", func() {
+	It("identifies the node only by the source address", func() {
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{NodeAnnotationKeyDrained: "true"}},
+			Status:     corev1.NodeStatus{Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.1"}}},
+		}
+
+		s := &PreStopServer{
+			Client:       fake.NewFakeClientWithScheme(k8sscheme.Scheme, node),
+			Log:          logf.Log,
+			Timeout:      time.Second,
+			PollInterval: 10 * time.Millisecond,
+		}
+
+		hook := func(remoteAddr, query string) string {
+			req := httptest.NewRequest("GET", PreStopPath+query, nil)
+			req.RemoteAddr = remoteAddr
+
+			rec := httptest.NewRecorder()
+
+			s.ServeHTTP(rec, req)
+
+			body, err := ioutil.ReadAll(rec.Body)
+			Expect(err).NotTo(HaveOccurred())
+
+			return string(body)
+		}
+
+		Expect(hook("10.0.0.1:41234", "")).To(Equal("drained\n"))
+		Expect(hook("10.0.0.2:41234", "?node=node1")).To(Equal("unknown node\n"))
+	})
+
+	It("serves preStop hooks on every replica regardless of leader election", func() {
+		var runnable manager.Runnable = &PreStopServer{}
+
+		le, ok := runnable.(manager.LeaderElectionRunnable)
+		Expect(ok).To(BeTrue())
+		Expect(le.NeedLeaderElection()).To(BeFalse())
+	})
+})
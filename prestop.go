@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"time"
+)
+
+// PreStopServer serves the preStop hook injected by PodMutator.
+//
+// Each request blocks until node-detacher detaches and drains the node running the terminating pod, so that the pod
+// keeps serving the traffic still routed to the node until then.
+// The node is identified only by the source address of the request, as kubelet calls the hook from the node. Otherwise
+// anyone reaching the server could block preStop hooks on behalf of other nodes.
+type PreStopServer struct {
+	// Addr is the address the preStop server binds to, like `:8082`
+	Addr string
+
+	client.Client
+	Log logr.Logger
+
+	// Timeout is the maximum duration each preStop hook blocks
+	Timeout time.Duration
+
+	// PollInterval is the interval to check if the node is drained
+	PollInterval time.Duration
+}
+
+func (s *PreStopServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	nodeName, err := s.nodeNameOf(ctx, r)
+	if err != nil {
+		s.Log.Error(err, "Failed to determine node of preStop hook", "remoteAddr", r.RemoteAddr)
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if nodeName == "" {
+		s.Log.Info("Skipped preStop hook from unknown node", "remoteAddr", r.RemoteAddr)
+
+		fmt.Fprintln(w, "unknown node")
+
+		return
+	}
+
+	log := s.Log.WithValues("node", nodeName)
+
+	log.Info("Waiting for node to be drained on preStop hook")
+
+	timeout := time.After(s.Timeout)
+
+	for {
+		var node corev1.Node
+
+		if err := s.Get(ctx, types.NamespacedName{Name: nodeName}, &node); err != nil {
+			if client.IgnoreNotFound(err) == nil {
+				fmt.Fprintln(w, "node not found")
+
+				return
+			}
+
+			log.Error(err, "Failed to get node")
+		} else if node.Annotations[NodeAnnotationKeyDrained] == "true" {
+			log.Info("Node is drained. Finishing preStop hook")
+
+			fmt.Fprintln(w, "drained")
+
+			return
+		} else if reason, err := lookupNeverDetachedReason(ctx, s.Client, node); err != nil {
+			log.Error(err, "Failed to determine if node is ever detached")
+		} else if reason != "" {
+			// NodeController never drains the node
+			log.Info("Node is never detached. Finishing preStop hook", "reason", reason)
+
+			fmt.Fprintln(w, "not detached")
+
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			// kubelet gave up on the hook, e.g. due to terminationGracePeriodSeconds
+			return
+		case <-timeout:
+			log.Info("Timed out waiting for node to be drained on preStop hook", "timeout", s.Timeout.String())
+
+			fmt.Fprintln(w, "timed out")
+
+			return
+		case <-time.After(s.PollInterval):
+		}
+	}
+}
+
+// nodeNameOf returns the name of the node the request came from, or an empty string when it is unknown
+func (s *PreStopServer) nodeNameOf(ctx context.Context, r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+
+	var nodes corev1.NodeList
+
+	if err := s.List(ctx, &nodes); err != nil {
+		return "", err
+	}
+
+	for _, n := range nodes.Items {
+		if getNodeInternalIP(n) == host {
+			return n.Name, nil
+		}
+	}
+
+	return "", nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable so that every replica serves preStop hooks.
+// Otherwise hooks routed to replicas other than the leader are refused, and pods terminate without waiting for the drain.
+// It is safe as the server only reads nodes from the cache.
+func (s *PreStopServer) NeedLeaderElection() bool {
+	return false
+}
+
+// Start implements manager.Runnable so that the preStop server runs along with controllers
+func (s *PreStopServer) Start(stop <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle(PreStopPath, s)
+
+	srv := &http.Server{Addr: s.Addr, Handler: mux}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		s.Log.Info("Starting preStop server", "addr", s.Addr)
+
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-stop:
+		return srv.Shutdown(context.Background())
+	}
+}
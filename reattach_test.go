@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Re-attaching uncordoned node", func() {
+	const warmup = 2 * time.Minute
+
+	var (
+		ctx        context.Context
+		c          client.Client
+		controller *NodeController
+	)
+
+	// newNode returns the uncordoned node that was being detached since detachedAt, whose Ready condition last
+	// transitioned at readyAt
+	newNode := func(ready corev1.ConditionStatus, readyAt, detachedAt time.Time) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "node1",
+				Labels: map[string]string{"kubernetes.io/hostname": "node1"},
+				Annotations: map[string]string{
+					NodeAnnotationKeyDetaching:           "true",
+					NodeAnnotationKeyDetachmentTimestamp: detachedAt.Format(time.RFC3339),
+					NodeAnnotationKeyDrained:             "true",
+				},
+			},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{
+					{Type: corev1.NodeReady, Status: ready, LastTransitionTime: metav1.NewTime(readyAt)},
+				},
+			},
+		}
+	}
+
+	setup := func(node *corev1.Node) {
+		scheme := runtime.NewScheme()
+		Expect(k8sscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		ctx = context.Background()
+
+		c = fake.NewFakeClientWithScheme(scheme, node)
+
+		controller = &NodeController{
+			Client:         c,
+			CoreV1Client:   kubefake.NewSimpleClientset().CoreV1(),
+			Log:            logf.Log.WithName("reattach"),
+			recorder:       &record.FakeRecorder{},
+			Namespace:      "default",
+			ReattachWarmup: warmup,
+		}
+	}
+
+	reconcile := func() ctrl.Result {
+		res, err := controller.reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: "node1"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		return res
+	}
+
+	getNode := func() corev1.Node {
+		var node corev1.Node
+
+		Expect(c.Get(ctx, types.NamespacedName{Name: "node1"}, &node)).To(Succeed())
+
+		return node
+	}
+
+	// setReadyAt updates the last transition time of the Ready condition, like kubelet reporting the node Ready again
+	setReadyAt := func(status corev1.ConditionStatus, at time.Time) {
+		node := getNode()
+
+		for i, cond := range node.Status.Conditions {
+			if cond.Type == corev1.NodeReady {
+				node.Status.Conditions[i].Status = status
+				node.Status.Conditions[i].LastTransitionTime = metav1.NewTime(at)
+			}
+		}
+
+		Expect(c.Update(ctx, &node)).To(Succeed())
+	}
+
+	It("doesn't re-attach the node until it becomes Ready", func() {
+		setup(newNode(corev1.ConditionFalse, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+
+		Expect(reconcile().RequeueAfter).To(Equal(10 * time.Second))
+		Expect(getNode().Annotations).To(HaveKeyWithValue(NodeAnnotationKeyDetaching, "true"))
+
+		setReadyAt(corev1.ConditionTrue, time.Now().Add(-warmup))
+
+		reconcile()
+
+		node := getNode()
+		Expect(node.Annotations).To(HaveKeyWithValue(NodeAnnotationKeyDetaching, "false"))
+		Expect(node.Annotations).To(HaveKey(NodeAnnotationKeyAttachmentTimestamp))
+		Expect(node.Annotations).NotTo(HaveKey(NodeAnnotationKeyDrained))
+	})
+
+	It("warms up the node for the duration since it became Ready", func() {
+		// Detached long ago, e.g. before being rebooted by kured
+		setup(newNode(corev1.ConditionTrue, time.Now().Add(-30*time.Second), time.Now().Add(-time.Hour)))
+
+		res := reconcile()
+		Expect(res.RequeueAfter).To(BeNumerically("~", warmup-30*time.Second, 5*time.Second))
+		Expect(getNode().Annotations).To(HaveKeyWithValue(NodeAnnotationKeyDetaching, "true"))
+
+		setReadyAt(corev1.ConditionTrue, time.Now().Add(-warmup))
+
+		reconcile()
+
+		Expect(getNode().Annotations).To(HaveKeyWithValue(NodeAnnotationKeyDetaching, "false"))
+	})
+
+	It("warms up the node again after a rollback even when it has been Ready for long", func() {
+		// Detached again by the rollback of the re-attachment 30 seconds ago, while being Ready for an hour
+		node := newNode(corev1.ConditionTrue, time.Now().Add(-time.Hour), time.Now().Add(-30*time.Second))
+		node.Annotations[NodeAnnotationKeyReattachFailed] = "Detached node again as targets became unhealthy"
+
+		setup(node)
+
+		res := reconcile()
+		Expect(res.RequeueAfter).To(BeNumerically("~", warmup-30*time.Second, 5*time.Second))
+		Expect(getNode().Annotations).To(HaveKeyWithValue(NodeAnnotationKeyDetaching, "true"))
+
+		updated := getNode()
+		updated.Annotations[NodeAnnotationKeyDetachmentTimestamp] = time.Now().Add(-warmup).Format(time.RFC3339)
+
+		Expect(c.Update(ctx, &updated)).To(Succeed())
+
+		reconcile()
+
+		Expect(getNode().Annotations).To(HaveKeyWithValue(NodeAnnotationKeyDetaching, "false"))
+	})
+})
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"time"
+)
+
+const (
+	RolloutPhaseProgressing = "Progressing"
+	RolloutPhasePaused      = "Paused"
+	RolloutPhaseAborted     = "Aborted"
+	RolloutPhaseCompleted   = "Completed"
+
+	// RolloutStepDetaching waits for the node to be de-registered from load balancers and drained
+	RolloutStepDetaching = "Detaching"
+
+	// RolloutStepReplacingPod deletes the outdated daemonset pod and waits for the replacement pod to become ready
+	RolloutStepReplacingPod = "ReplacingPod"
+
+	// RolloutStepReattaching waits for the node to be re-attached and verified healthy
+	RolloutStepReattaching = "Reattaching"
+
+	NodeLabelKeyZone     = "topology.kubernetes.io/zone"
+	NodeLabelKeyZoneBeta = "failure-domain.beta.kubernetes.io/zone"
+)
+
+// +kubebuilder:rbac:groups=node-detacher.variant.run,resources=rollouts,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=node-detacher.variant.run,resources=rollouts/status,verbs=get;update;patch
+
+// setNodeDetachedForPodReplacement makes NodeController detach the node, unless the node is already required to be detached
+// by someone else
+func setNodeDetachedForPodReplacement(ctx context.Context, c client.Client, node corev1.Node, value string) error {
+	if _, ok := node.Annotations[NodeAnnotationKeyDetached]; ok {
+		return nil
+	}
+
+	updated := node.DeepCopy()
+
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+
+	updated.Annotations[NodeAnnotationKeyDetached] = value
+
+	return c.Patch(ctx, updated, client.MergeFrom(&node))
+}
+
+// unsetNodeDetachedForPodReplacement makes NodeController re-attach the node, only when it was detached with the value
+func unsetNodeDetachedForPodReplacement(ctx context.Context, c client.Client, node corev1.Node, value string) error {
+	if node.Annotations[NodeAnnotationKeyDetached] != value {
+		return nil
+	}
+
+	updated := node.DeepCopy()
+
+	delete(updated.Annotations, NodeAnnotationKeyDetached)
+
+	return c.Patch(ctx, updated, client.MergeFrom(&node))
+}
+
+func nodeZone(node corev1.Node) string {
+	if z, ok := node.Labels[NodeLabelKeyZone]; ok {
+		return z
+	}
+
+	return node.Labels[NodeLabelKeyZoneBeta]
+}
+
+// isPodReady returns true when the pod is ready, ignoring the node-attached readiness gate that becomes true only after
+// node-detacher re-attaches the node, which in turn waits for the pod to become ready
+func isPodReady(pod corev1.Pod) bool {
+	conditions := map[corev1.PodConditionType]corev1.ConditionStatus{}
+
+	for _, c := range pod.Status.Conditions {
+		conditions[c.Type] = c.Status
+	}
+
+	if conditions[corev1.PodReady] == corev1.ConditionTrue {
+		return true
+	}
+
+	if conditions[corev1.ContainersReady] != corev1.ConditionTrue {
+		return false
+	}
+
+	var gated bool
+
+	for _, g := range pod.Spec.ReadinessGates {
+		if g.ConditionType == PodConditionTypeNodeAttached {
+			gated = true
+
+			continue
+		}
+
+		if conditions[g.ConditionType] != corev1.ConditionTrue {
+			return false
+		}
+	}
+
+	return gated
+}
+
+func isDaemonSetPodOutdated(ds *appsv1.DaemonSet, pod corev1.Pod) bool {
+	return GetPodTemplateGeneration(pod.GetObjectMeta()) < ds.Generation
+}
+
+// isDaemonSetPodReady returns true when any of the pods is the up-to-date, non-terminating, and ready daemonset pod
+func isDaemonSetPodReady(ds *appsv1.DaemonSet, pods []corev1.Pod) bool {
+	for _, pod := range pods {
+		if pod.DeletionTimestamp == nil && !isDaemonSetPodOutdated(ds, pod) && isPodReady(pod) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveMaxUnavailable resolves the absolute number or the percentage against the total, rounding down.
+// It never returns less than 1 so that the rollout always makes progress.
+func resolveMaxUnavailable(v *intstr.IntOrString, total int) (int, error) {
+	n, err := intstr.GetValueFromIntOrPercent(v, total, false)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 1 {
+		n = 1
+	}
+
+	return n, nil
+}
+
+// ParseMaxUnavailable parses the absolute number or the percentage like `25%` given via command-line flags.
+// It returns nil when the value is empty.
+func ParseMaxUnavailable(v string) (*intstr.IntOrString, error) {
+	if v == "" {
+		return nil, nil
+	}
+
+	parsed := intstr.Parse(v)
+
+	if _, err := intstr.GetValueFromIntOrPercent(&parsed, 100, false); err != nil {
+		return nil, err
+	}
+
+	return &parsed, nil
+}
+
+// selectRolloutBatch returns the candidates to start rolling next, so that the number of nodes being rolled never
+// exceeds any of maxUnavailable, maxUnavailablePerZone, and maxUnavailablePerTargetGroup.
+// nodes is the list of all the nodes running the daemonset, used to resolve percentages.
+func selectRolloutBatch(spec v1alpha1.RolloutSpec, nodes, inProgress, candidates []v1alpha1.RolloutNode) ([]v1alpha1.RolloutNode, error) {
+	zoneTotal := map[string]int{}
+	tgTotal := map[string]int{}
+
+	for _, n := range nodes {
+		zoneTotal[n.Zone]++
+
+		for _, tg := range n.TargetGroups {
+			tgTotal[tg]++
+		}
+	}
+
+	maxUnavailable := 1
+
+	if spec.MaxUnavailable != nil {
+		var err error
+
+		maxUnavailable, err = resolveMaxUnavailable(spec.MaxUnavailable, len(nodes))
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxUnavailable: %w", err)
+		}
+	}
+
+	unavailable := 0
+	zoneUnavailable := map[string]int{}
+	tgUnavailable := map[string]int{}
+
+	take := func(n v1alpha1.RolloutNode) {
+		unavailable++
+		zoneUnavailable[n.Zone]++
+
+		for _, tg := range n.TargetGroups {
+			tgUnavailable[tg]++
+		}
+	}
+
+	fits := func(n v1alpha1.RolloutNode) (bool, error) {
+		if unavailable >= maxUnavailable {
+			return false, nil
+		}
+
+		if spec.MaxUnavailablePerZone != nil {
+			max, err := resolveMaxUnavailable(spec.MaxUnavailablePerZone, zoneTotal[n.Zone])
+			if err != nil {
+				return false, fmt.Errorf("invalid maxUnavailablePerZone: %w", err)
+			}
+
+			if zoneUnavailable[n.Zone] >= max {
+				return false, nil
+			}
+		}
+
+		if spec.MaxUnavailablePerTargetGroup != nil {
+			for _, tg := range n.TargetGroups {
+				max, err := resolveMaxUnavailable(spec.MaxUnavailablePerTargetGroup, tgTotal[tg])
+				if err != nil {
+					return false, fmt.Errorf("invalid maxUnavailablePerTargetGroup: %w", err)
+				}
+
+				if tgUnavailable[tg] >= max {
+					return false, nil
+				}
+			}
+		}
+
+		return true, nil
+	}
+
+	for _, n := range inProgress {
+		take(n)
+	}
+
+	var batch []v1alpha1.RolloutNode
+
+	for _, n := range candidates {
+		ok, err := fits(n)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			take(n)
+
+			batch = append(batch, n)
+		}
+	}
+
+	return batch, nil
+}
+
+// getOrCreateRollout returns the rollout of the daemonset, creating it with the default maxUnavailable settings
+// given via command-line flags when missing
+func (r *DaemonsetController) getOrCreateRollout(ctx context.Context, ds *appsv1.DaemonSet) (*v1alpha1.Rollout, error) {
+	var rollout v1alpha1.Rollout
+
+	err := r.Get(ctx, types.NamespacedName{Namespace: ds.Namespace, Name: ds.Name}, &rollout)
+	if err == nil {
+		return &rollout, nil
+	}
+
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	rollout = v1alpha1.Rollout{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: ds.Namespace,
+			Name:      ds.Name,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(ds, appsv1.SchemeGroupVersion.WithKind("DaemonSet")),
+			},
+		},
+		Spec: v1alpha1.RolloutSpec{
+			DaemonSetName:                ds.Name,
+			MaxUnavailable:               r.MaxUnavailable,
+			MaxUnavailablePerZone:        r.MaxUnavailablePerZone,
+			MaxUnavailablePerTargetGroup: r.MaxUnavailablePerTargetGroup,
+			PodReadyTimeout:              r.PodReadyTimeout,
+		},
+	}
+
+	if err := r.Create(ctx, &rollout); err != nil {
+		return nil, err
+	}
+
+	return &rollout, nil
+}
+
+// progressRollout advances the nodes being rolled by a step each, and then starts rolling the next batch of nodes
+// running outdated daemonset pods within the maxUnavailable limits
+func (r *DaemonsetController) progressRollout(ctx context.Context, log logr.Logger, ds *appsv1.DaemonSet, rollout *v1alpha1.Rollout, pods []corev1.Pod) (ctrl.Result, error) {
+	podsByNode := map[string][]corev1.Pod{}
+
+	for _, pod := range pods {
+		if pod.Spec.NodeName == "" {
+			continue
+		}
+
+		podsByNode[pod.Spec.NodeName] = append(podsByNode[pod.Spec.NodeName], pod)
+	}
+
+	var attachments v1alpha1.AttachmentList
+
+	if err := r.List(ctx, &attachments, client.InNamespace(r.Namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	policies, err := listDetachPolicies(ctx, r.Client)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	targetGroups := map[string][]string{}
+
+	for _, a := range attachments.Items {
+		for _, tg := range a.Spec.AwsTargets {
+			targetGroups[a.Name] = append(targetGroups[a.Name], tg.ARN)
+		}
+	}
+
+	nodeNames := make([]string, 0, len(podsByNode))
+
+	for name := range podsByNode {
+		nodeNames = append(nodeNames, name)
+	}
+
+	sort.Strings(nodeNames)
+
+	var (
+		nodes    []v1alpha1.RolloutNode
+		outdated []v1alpha1.RolloutNode
+		updated  int32
+	)
+
+	for _, name := range nodeNames {
+		var node corev1.Node
+
+		if err := r.Get(ctx, types.NamespacedName{Name: name}, &node); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+
+			return ctrl.Result{}, err
+		}
+
+		n := v1alpha1.RolloutNode{Name: name, Zone: nodeZone(node), TargetGroups: targetGroups[name]}
+
+		nodes = append(nodes, n)
+
+		var hasOutdated bool
+
+		for _, pod := range podsByNode[name] {
+			if isDaemonSetPodOutdated(ds, pod) {
+				hasOutdated = true
+			}
+		}
+
+		if hasOutdated {
+			outdated = append(outdated, n)
+		} else if isDaemonSetPodReady(ds, podsByNode[name]) {
+			updated++
+		}
+	}
+
+	if rollout.Spec.Abort {
+		return r.abortRollout(ctx, log, ds, rollout, pods, updated)
+	}
+
+	pauseReason := rollout.Status.PauseReason
+
+	if !rollout.Spec.Paused {
+		pauseReason = ""
+	}
+
+	var inProgress []v1alpha1.RolloutNode
+
+	rolling := map[string]bool{}
+
+	for _, n := range rollout.Status.Nodes {
+		n := n
+
+		done, failure, err := r.advanceRolloutNode(ctx, log, ds, rollout, policies, &n, podsByNode[n.Name])
+		if err != nil {
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+		}
+
+		if failure != "" && !rollout.Spec.Paused {
+			log.Info("Pausing rollout", "reason", failure)
+
+			rollout.Spec.Paused = true
+
+			if err := r.Update(ctx, rollout); err != nil {
+				return ctrl.Result{}, err
+			}
+
+			pauseReason = failure
+
+			r.recorder.Event(ds, corev1.EventTypeWarning, "RolloutPaused", fmt.Sprintf("Paused rollout: %s", failure))
+		}
+
+		if done {
+			log.Info("Finished rolling node", "node", n.Name)
+
+			r.recorder.Event(ds, corev1.EventTypeNormal, "NodeRolled", fmt.Sprintf("Replaced daemonset pod and re-attached node %s", n.Name))
+
+			continue
+		}
+
+		inProgress = append(inProgress, n)
+		rolling[n.Name] = true
+	}
+
+	var candidates []v1alpha1.RolloutNode
+
+	for _, n := range outdated {
+		if !rolling[n.Name] {
+			candidates = append(candidates, n)
+		}
+	}
+
+	var batch []v1alpha1.RolloutNode
+
+	if !rollout.Spec.Paused {
+		var err error
+
+		batch, err = selectRolloutBatch(rollout.Spec, nodes, inProgress, candidates)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	value := daemonSetDetachedAnnotationValue(ds.Namespace, ds.Name)
+
+	for _, n := range batch {
+		var node corev1.Node
+
+		if err := r.Get(ctx, types.NamespacedName{Name: n.Name}, &node); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		reason, err := neverDetachedReason(policies, node)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		now := metav1.Now()
+
+		n.StartedAt = now
+		n.StepStartedAt = &now
+
+		if reason != "" {
+			// NodeController never detaches nor drains the node, so the pod is replaced without detaching the node
+			n.Step = RolloutStepReplacingPod
+
+			log.Info("Started rolling node without detaching it", "node", n.Name, "reason", reason)
+
+			r.recorder.Event(ds, corev1.EventTypeNormal, "NodeRolling", fmt.Sprintf("Replacing daemonset pod on node %s without detaching it: %s", n.Name, reason))
+		} else {
+			if err := setNodeDetachedForPodReplacement(ctx, r.Client, node, value); err != nil {
+				return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+			}
+
+			n.Step = RolloutStepDetaching
+
+			log.Info("Started rolling node", "node", n.Name)
+
+			r.recorder.Event(ds, corev1.EventTypeNormal, "NodeRolling", fmt.Sprintf("Detaching node %s to replace daemonset pod", n.Name))
+		}
+
+		inProgress = append(inProgress, n)
+	}
+
+	status := v1alpha1.RolloutStatus{
+		Phase:              RolloutPhaseProgressing,
+		ObservedGeneration: ds.Generation,
+		DesiredNodes:       ds.Status.DesiredNumberScheduled,
+		UpdatedNodes:       updated,
+		Nodes:              inProgress,
+		PauseReason:        pauseReason,
+		Message:            fmt.Sprintf("%d nodes being rolled, %d nodes waiting", len(inProgress), len(candidates)-len(batch)),
+		LastUpdateTime:     rollout.Status.LastUpdateTime,
+	}
+
+	if len(inProgress) == 0 && len(candidates) == 0 {
+		status.Phase = RolloutPhaseCompleted
+		status.Message = "All the daemonset pods are up-to-date"
+	} else if rollout.Spec.Paused {
+		status.Phase = RolloutPhasePaused
+	}
+
+	if !equality.Semantic.DeepEqual(status, rollout.Status) {
+		now := metav1.Now()
+
+		status.LastUpdateTime = &now
+
+		rollout.Status = status
+
+		if err := r.Status().Update(ctx, rollout); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if status.Phase == RolloutPhaseProgressing || len(inProgress) > 0 {
+		return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// abortRollout re-attaches all the nodes detached for the rollout, and clears the detaching annotation on the
+// daemonset pods so that no node is detached for the rollout until the abort is cancelled
+func (r *DaemonsetController) abortRollout(ctx context.Context, log logr.Logger, ds *appsv1.DaemonSet, rollout *v1alpha1.Rollout, pods []corev1.Pod, updated int32) (ctrl.Result, error) {
+	value := daemonSetDetachedAnnotationValue(ds.Namespace, ds.Name)
+
+	for _, n := range rollout.Status.Nodes {
+		var node corev1.Node
+
+		if err := r.Get(ctx, types.NamespacedName{Name: n.Name}, &node); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+
+			return ctrl.Result{}, err
+		}
+
+		log.Info("Re-attaching node on abort", "node", n.Name)
+
+		if err := unsetNodeDetachedForPodReplacement(ctx, r.Client, node, value); err != nil {
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+		}
+	}
+
+	for i := range pods {
+		pod := pods[i]
+
+		if GetAnnotation(pod.GetObjectMeta(), PodAnnotationDetaching) != r.Name {
+			continue
+		}
+
+		newPod := pod.DeepCopy()
+
+		delete(newPod.Annotations, PodAnnotationDetaching)
+
+		if err := r.Patch(ctx, newPod, client.MergeFrom(&pod)); err != nil {
+			return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+		}
+	}
+
+	if rollout.Status.Phase == RolloutPhaseAborted && len(rollout.Status.Nodes) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	now := metav1.Now()
+
+	rollout.Status = v1alpha1.RolloutStatus{
+		Phase:              RolloutPhaseAborted,
+		ObservedGeneration: ds.Generation,
+		DesiredNodes:       ds.Status.DesiredNumberScheduled,
+		UpdatedNodes:       updated,
+		Message:            fmt.Sprintf("Aborted and re-attached %d nodes", len(rollout.Status.Nodes)),
+		LastUpdateTime:     &now,
+	}
+
+	if err := r.Status().Update(ctx, rollout); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	r.recorder.Event(ds, corev1.EventTypeNormal, "RolloutAborted", rollout.Status.Message)
+
+	return ctrl.Result{}, nil
+}
+
+// isPodCrashLooping returns true when any of the containers is waiting to be restarted after crashes
+func isPodCrashLooping(pod corev1.Pod) bool {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.State.Waiting != nil && cs.State.Waiting.Reason == "CrashLoopBackOff" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// advanceRolloutNode advances the node being rolled by a step, and returns true once the node is fully rolled.
+// It also returns the reason of the failure that should pause the rollout, if any.
+func (r *DaemonsetController) advanceRolloutNode(ctx context.Context, log logr.Logger, ds *appsv1.DaemonSet, rollout *v1alpha1.Rollout, policies []v1alpha1.DetachPolicy, n *v1alpha1.RolloutNode, pods []corev1.Pod) (bool, string, error) {
+	var node corev1.Node
+
+	if err := r.Get(ctx, types.NamespacedName{Name: n.Name}, &node); err != nil {
+		if errors.IsNotFound(err) {
+			log.Info("Node has gone while rolling", "node", n.Name)
+
+			return true, "", nil
+		}
+
+		return false, "", err
+	}
+
+	value := daemonSetDetachedAnnotationValue(ds.Namespace, ds.Name)
+
+	// NodeController never sets the drained annotation on nor re-attaches nodes it skips, like nodes excluded from
+	// detach policies after the rollout started detaching them
+	neverDetached, err := neverDetachedReason(policies, node)
+	if err != nil {
+		return false, "", err
+	}
+
+	now := metav1.Now()
+
+	switch n.Step {
+	case RolloutStepDetaching:
+		if neverDetached != "" {
+			log.Info("Replacing daemonset pod without waiting for node to be drained", "node", n.Name, "reason", neverDetached)
+		} else if node.Annotations[NodeAnnotationKeyDrained] != "true" {
+			// Re-annotate in case the annotation was removed by someone else while detaching
+			return false, "", setNodeDetachedForPodReplacement(ctx, r.Client, node, value)
+		}
+
+		n.Step = RolloutStepReplacingPod
+		n.StepStartedAt = &now
+
+		fallthrough
+	case RolloutStepReplacingPod:
+		for i := range pods {
+			pod := pods[i]
+
+			if pod.DeletionTimestamp != nil || !isDaemonSetPodOutdated(ds, pod) {
+				continue
+			}
+
+			log.Info("Deleting outdated daemonset pod", "node", n.Name, "pod", pod.Name)
+
+			if err := r.Delete(ctx, &pod); err != nil && !errors.IsNotFound(err) {
+				return false, "", err
+			}
+		}
+
+		if !isDaemonSetPodReady(ds, pods) {
+			return false, replacementPodFailure(ds, rollout, n, pods, now.Time), nil
+		}
+
+		if err := unsetNodeDetachedForPodReplacement(ctx, r.Client, node, value); err != nil {
+			return false, "", err
+		}
+
+		n.Step = RolloutStepReattaching
+		n.StepStartedAt = &now
+
+		return false, "", nil
+	case RolloutStepReattaching:
+		// NodeController gave up waiting for the targets to become healthy, or rolled back the re-attachment.
+		// The node is no longer ours to wait for, but the rollout shouldn't continue.
+		if reason, ok := node.Annotations[NodeAnnotationKeyReattachFailed]; ok {
+			return true, fmt.Sprintf("node %s failed load balancer health checks: %s", n.Name, reason), nil
+		}
+
+		if neverDetached != "" {
+			return true, "", nil
+		}
+
+		_, detached := node.Annotations[NodeAnnotationKeyDetached]
+
+		return !detached && node.Annotations[NodeAnnotationKeyDetaching] != "true", "", nil
+	}
+
+	return false, "", fmt.Errorf("unknown rollout step %q for node %s", n.Step, n.Name)
+}
+
+// replacementPodFailure returns why the replacement pod on the node is considered failed, if it is
+func replacementPodFailure(ds *appsv1.DaemonSet, rollout *v1alpha1.Rollout, n *v1alpha1.RolloutNode, pods []corev1.Pod, now time.Time) string {
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil || isDaemonSetPodOutdated(ds, pod) {
+			continue
+		}
+
+		if isPodCrashLooping(pod) {
+			return fmt.Sprintf("pod %s on node %s is crash looping", pod.Name, n.Name)
+		}
+
+		timeout := rollout.Spec.PodReadyTimeout
+
+		if timeout != nil && timeout.Duration > 0 && n.StepStartedAt != nil && now.Sub(n.StepStartedAt.Time) > timeout.Duration {
+			return fmt.Sprintf("pod %s on node %s didn't become ready within %s", pod.Name, n.Name, timeout.Duration)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rollout", func() {
+	nodes := []v1alpha1.RolloutNode{
+		{Name: "a1", Zone: "a", TargetGroups: []string{"tg1"}},
+		{Name: "a2", Zone: "a", TargetGroups: []string{"tg1"}},
+		{Name: "a3", Zone: "a", TargetGroups: []string{"tg2"}},
+		{Name: "b1", Zone: "b", TargetGroups: []string{"tg1"}},
+		{Name: "b2", Zone: "b", TargetGroups: []string{"tg2"}},
+		{Name: "b3", Zone: "b", TargetGroups: []string{"tg2"}},
+	}
+
+	names := func(ns []v1alpha1.RolloutNode) []string {
+		var r []string
+
+		for _, n := range ns {
+			r = append(r, n.Name)
+		}
+
+		return r
+	}
+
+	intOrPercent := func(v string) *intstr.IntOrString {
+		p, err := ParseMaxUnavailable(v)
+		Expect(err).NotTo(HaveOccurred())
+
+		return p
+	}
+
+	It("rolls one node at a time by default", func() {
+		batch, err := selectRolloutBatch(v1alpha1.RolloutSpec{}, nodes, nil, nodes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(batch)).To(Equal([]string{"a1"}))
+
+		batch, err = selectRolloutBatch(v1alpha1.RolloutSpec{}, nodes, nodes[:1], nodes[1:])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(batch).To(BeEmpty())
+	})
+
+	It("limits nodes being rolled per zone and per target group", func() {
+		spec := v1alpha1.RolloutSpec{
+			MaxUnavailable:        intOrPercent("50%"),
+			MaxUnavailablePerZone: intOrPercent("1"),
+		}
+
+		batch, err := selectRolloutBatch(spec, nodes, nil, nodes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(batch)).To(Equal([]string{"a1", "b1"}))
+
+		spec.MaxUnavailablePerTargetGroup = intOrPercent("34%")
+
+		batch, err = selectRolloutBatch(spec, nodes, nil, nodes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(batch)).To(Equal([]string{"a1", "b2"}))
+	})
+
+	It("pauses on replacement pods that aren't ready in time or crash looping", func() {
+		ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Generation: 2}}
+		rollout := &v1alpha1.Rollout{Spec: v1alpha1.RolloutSpec{PodReadyTimeout: &metav1.Duration{Duration: 5 * time.Minute}}}
+
+		started := metav1.NewTime(time.Now().Add(-time.Minute))
+		n := &v1alpha1.RolloutNode{Name: "a1", Step: RolloutStepReplacingPod, StepStartedAt: &started}
+
+		pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "contour-x", Labels: map[string]string{"pod-template-generation": "2"}}}
+
+		Expect(replacementPodFailure(ds, rollout, n, []corev1.Pod{pod}, time.Now())).To(BeEmpty())
+		Expect(replacementPodFailure(ds, rollout, n, []corev1.Pod{pod}, time.Now().Add(5*time.Minute))).To(ContainSubstring("didn't become ready"))
+
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}}}
+
+		Expect(replacementPodFailure(ds, rollout, n, []corev1.Pod{pod}, time.Now())).To(ContainSubstring("crash looping"))
+	})
+
+	It("rejects invalid max unavailable", func() {
+		_, err := ParseMaxUnavailable("foo")
+		Expect(err).To(HaveOccurred())
+
+		p, err := ParseMaxUnavailable("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p).To(BeNil())
+	})
+
+	It("replaces pods without waiting for nodes never detached to be drained", func() {
+		scheme := runtime.NewScheme()
+		Expect(k8sscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		ctx := context.Background()
+
+		master := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "m1"},
+			Spec:       corev1.NodeSpec{Taints: []corev1.Taint{{Key: "node-role.kubernetes.io/master", Effect: corev1.TaintEffectNoSchedule}}},
+		}
+
+		ingress := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n1", Labels: map[string]string{"role": "ingress"}}}
+
+		policy := &v1alpha1.DetachPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "ingress"},
+			Spec: v1alpha1.DetachPolicySpec{
+				NodeSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "ingress"}},
+				Triggers:     v1alpha1.DetachTriggers{Cordon: true},
+			},
+		}
+
+		ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "contour", Generation: 2}}
+
+		c := fake.NewFakeClientWithScheme(scheme, master, ingress, policy, &v1alpha1.Rollout{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "contour"},
+		})
+
+		controller := &DaemonsetController{
+			Client:    c,
+			Log:       logf.Log.WithName("rollout"),
+			recorder:  &record.FakeRecorder{},
+			Namespace: "default",
+		}
+
+		podOf := func(node, generation string, ready bool) corev1.Pod {
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "contour-" + node + "-" + generation, Labels: map[string]string{"pod-template-generation": generation}},
+				Spec:       corev1.PodSpec{NodeName: node},
+			}
+
+			if ready {
+				pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+			}
+
+			return pod
+		}
+
+		progress := func(pods ...corev1.Pod) v1alpha1.RolloutStatus {
+			var rollout v1alpha1.Rollout
+
+			Expect(c.Get(ctx, types.NamespacedName{Namespace: "ingress", Name: "contour"}, &rollout)).To(Succeed())
+
+			_, err := controller.progressRollout(ctx, controller.Log, ds, &rollout, pods)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.Get(ctx, types.NamespacedName{Namespace: "ingress", Name: "contour"}, &rollout)).To(Succeed())
+
+			return rollout.Status
+		}
+
+		annotationsOf := func(name string) map[string]string {
+			var node corev1.Node
+
+			Expect(c.Get(ctx, types.NamespacedName{Name: name}, &node)).To(Succeed())
+
+			return node.Annotations
+		}
+
+		status := progress(podOf("m1", "1", true), podOf("n1", "1", true))
+		Expect(status.Nodes).To(HaveLen(1))
+		Expect(status.Nodes[0].Name).To(Equal("m1"))
+		Expect(status.Nodes[0].Step).To(Equal(RolloutStepReplacingPod))
+		Expect(annotationsOf("m1")).NotTo(HaveKey(NodeAnnotationKeyDetached))
+
+		status = progress(podOf("m1", "2", true), podOf("n1", "1", true))
+		Expect(status.Nodes[0].Step).To(Equal(RolloutStepReattaching))
+
+		status = progress(podOf("m1", "2", true), podOf("n1", "1", true))
+		Expect(status.Nodes).To(HaveLen(1))
+		Expect(status.Nodes[0].Name).To(Equal("n1"))
+		Expect(status.Nodes[0].Step).To(Equal(RolloutStepDetaching))
+		Expect(annotationsOf("n1")).To(HaveKeyWithValue(NodeAnnotationKeyDetached, daemonSetDetachedAnnotationValue("ingress", "contour")))
+
+		status = progress(podOf("m1", "2", true), podOf("n1", "1", true))
+		Expect(status.Nodes[0].Step).To(Equal(RolloutStepDetaching))
+
+		// The node is no longer selected by the detach policy, hence never drained by NodeController
+		var node corev1.Node
+
+		Expect(c.Get(ctx, types.NamespacedName{Name: "n1"}, &node)).To(Succeed())
+
+		node.Labels = nil
+
+		Expect(c.Update(ctx, &node)).To(Succeed())
+
+		status = progress(podOf("m1", "2", true), podOf("n1", "1", true))
+		Expect(status.Nodes[0].Step).To(Equal(RolloutStepReplacingPod))
+
+		status = progress(podOf("m1", "2", true), podOf("n1", "2", true))
+		Expect(status.Nodes[0].Step).To(Equal(RolloutStepReattaching))
+		Expect(annotationsOf("n1")).NotTo(HaveKey(NodeAnnotationKeyDetached))
+
+		status = progress(podOf("m1", "2", true), podOf("n1", "2", true))
+		Expect(status.Phase).To(Equal(RolloutPhaseCompleted))
+	})
+})
+
+var _ = Describe("Rollout progress", func() {
+	var (
+		ctx        context.Context
+		c          client.Client
+		controller *DaemonsetController
+	)
+
+	ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "contour", Generation: 2}}
+
+	value := daemonSetDetachedAnnotationValue("ingress", "contour")
+
+	newNode := func(name string, annotations map[string]string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"kubernetes.io/hostname": name}, Annotations: annotations}}
+	}
+
+	setup := func(rollout *v1alpha1.Rollout, objs ...runtime.Object) {
+		scheme := runtime.NewScheme()
+		Expect(k8sscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		ctx = context.Background()
+
+		rollout.ObjectMeta = metav1.ObjectMeta{Namespace: "ingress", Name: "contour"}
+
+		c = fake.NewFakeClientWithScheme(scheme, append(objs, rollout)...)
+
+		controller = &DaemonsetController{
+			Name:      "node-detacher",
+			Client:    c,
+			Log:       logf.Log.WithName("rollout"),
+			recorder:  &record.FakeRecorder{},
+			Namespace: "default",
+		}
+	}
+
+	podOf := func(node, generation string) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "contour-" + node + "-" + generation, Labels: map[string]string{"pod-template-generation": generation}},
+			Spec:       corev1.PodSpec{NodeName: node},
+			Status:     corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}},
+		}
+	}
+
+	getRollout := func() v1alpha1.Rollout {
+		var rollout v1alpha1.Rollout
+
+		Expect(c.Get(ctx, types.NamespacedName{Namespace: "ingress", Name: "contour"}, &rollout)).To(Succeed())
+
+		return rollout
+	}
+
+	progress := func(pods ...corev1.Pod) v1alpha1.Rollout {
+		rollout := getRollout()
+
+		_, err := controller.progressRollout(ctx, controller.Log, ds, &rollout, pods)
+		Expect(err).NotTo(HaveOccurred())
+
+		return getRollout()
+	}
+
+	updateRollout := func(f func(*v1alpha1.Rollout)) {
+		rollout := getRollout()
+
+		f(&rollout)
+
+		Expect(c.Update(ctx, &rollout)).To(Succeed())
+	}
+
+	annotationsOf := func(name string) map[string]string {
+		var node corev1.Node
+
+		Expect(c.Get(ctx, types.NamespacedName{Name: name}, &node)).To(Succeed())
+
+		return node.Annotations
+	}
+
+	It("re-attaches only nodes detached for the rollout on abort", func() {
+		detaching := podOf("n1", "1")
+		detaching.Annotations = map[string]string{PodAnnotationDetaching: "node-detacher"}
+
+		setup(
+			&v1alpha1.Rollout{
+				Spec: v1alpha1.RolloutSpec{Abort: true},
+				Status: v1alpha1.RolloutStatus{Nodes: []v1alpha1.RolloutNode{
+					{Name: "n1", Step: RolloutStepDetaching},
+					{Name: "n2", Step: RolloutStepDetaching},
+				}},
+			},
+			newNode("n1", map[string]string{NodeAnnotationKeyDetached: value}),
+			// Detached by someone else before the rollout started rolling it
+			newNode("n2", map[string]string{NodeAnnotationKeyDetached: daemonSetDetachedAnnotationValue("ingress", "envoy")}),
+			&detaching,
+		)
+
+		rollout := progress(detaching, podOf("n2", "1"))
+
+		Expect(annotationsOf("n1")).NotTo(HaveKey(NodeAnnotationKeyDetached))
+		Expect(annotationsOf("n2")).To(HaveKeyWithValue(NodeAnnotationKeyDetached, daemonSetDetachedAnnotationValue("ingress", "envoy")))
+
+		var pod corev1.Pod
+
+		Expect(c.Get(ctx, types.NamespacedName{Namespace: "ingress", Name: detaching.Name}, &pod)).To(Succeed())
+		Expect(pod.Annotations).NotTo(HaveKey(PodAnnotationDetaching))
+
+		Expect(rollout.Status.Phase).To(Equal(RolloutPhaseAborted))
+		Expect(rollout.Status.Nodes).To(BeEmpty())
+
+		// No more node is rolled until the abort is cancelled
+		progress(podOf("n1", "1"), podOf("n2", "1"))
+
+		Expect(annotationsOf("n1")).NotTo(HaveKey(NodeAnnotationKeyDetached))
+	})
+
+	It("starts rolling no more nodes while paused, and resumes once unpaused", func() {
+		setup(&v1alpha1.Rollout{Spec: v1alpha1.RolloutSpec{Paused: true}}, newNode("n1", nil), newNode("n2", nil))
+
+		rollout := progress(podOf("n1", "1"), podOf("n2", "1"))
+		Expect(rollout.Status.Phase).To(Equal(RolloutPhasePaused))
+		Expect(rollout.Status.Nodes).To(BeEmpty())
+		Expect(annotationsOf("n1")).NotTo(HaveKey(NodeAnnotationKeyDetached))
+
+		updateRollout(func(r *v1alpha1.Rollout) { r.Spec.Paused = false })
+
+		rollout = progress(podOf("n1", "1"), podOf("n2", "1"))
+		Expect(rollout.Status.Phase).To(Equal(RolloutPhaseProgressing))
+		Expect(rollout.Status.Nodes).To(HaveLen(1))
+		Expect(rollout.Status.Nodes[0].Name).To(Equal("n1"))
+		Expect(annotationsOf("n1")).To(HaveKeyWithValue(NodeAnnotationKeyDetached, value))
+
+		updateRollout(func(r *v1alpha1.Rollout) { r.Spec.Paused = true })
+
+		// The node already being rolled continues to be rolled
+		var node corev1.Node
+
+		Expect(c.Get(ctx, types.NamespacedName{Name: "n1"}, &node)).To(Succeed())
+
+		node.Annotations[NodeAnnotationKeyDrained] = "true"
+
+		Expect(c.Update(ctx, &node)).To(Succeed())
+
+		rollout = progress(podOf("n1", "2"), podOf("n2", "1"))
+		Expect(rollout.Status.Phase).To(Equal(RolloutPhasePaused))
+		Expect(rollout.Status.Nodes).To(HaveLen(1))
+		Expect(rollout.Status.Nodes[0].Step).To(Equal(RolloutStepReattaching))
+		Expect(annotationsOf("n1")).NotTo(HaveKey(NodeAnnotationKeyDetached))
+
+		rollout = progress(podOf("n1", "2"), podOf("n2", "1"))
+		Expect(rollout.Status.Phase).To(Equal(RolloutPhasePaused))
+		Expect(rollout.Status.Nodes).To(BeEmpty())
+		Expect(annotationsOf("n2")).NotTo(HaveKey(NodeAnnotationKeyDetached))
+
+		updateRollout(func(r *v1alpha1.Rollout) { r.Spec.Paused = false })
+
+		rollout = progress(podOf("n1", "2"), podOf("n2", "1"))
+		Expect(rollout.Status.Phase).To(Equal(RolloutPhaseProgressing))
+		Expect(rollout.Status.Nodes[0].Name).To(Equal("n2"))
+		Expect(annotationsOf("n2")).To(HaveKeyWithValue(NodeAnnotationKeyDetached, value))
+	})
+
+	It("pauses on nodes whose re-attachment failed", func() {
+		setup(
+			&v1alpha1.Rollout{Status: v1alpha1.RolloutStatus{Nodes: []v1alpha1.RolloutNode{{Name: "n1", Step: RolloutStepReattaching}}}},
+			newNode("n1", map[string]string{NodeAnnotationKeyReattachFailed: "Detached node again as targets became unhealthy"}),
+			newNode("n2", nil),
+		)
+
+		rollout := progress(podOf("n1", "2"), podOf("n2", "1"))
+		Expect(rollout.Spec.Paused).To(BeTrue())
+		Expect(rollout.Status.Phase).To(Equal(RolloutPhasePaused))
+		Expect(rollout.Status.PauseReason).To(ContainSubstring("node n1 failed load balancer health checks"))
+		// The node is left to NodeController, and no more node is rolled
+		Expect(rollout.Status.Nodes).To(BeEmpty())
+		Expect(annotationsOf("n2")).NotTo(HaveKey(NodeAnnotationKeyDetached))
+
+		updateRollout(func(r *v1alpha1.Rollout) { r.Spec.Paused = false })
+
+		rollout = progress(podOf("n1", "2"), podOf("n2", "1"))
+		Expect(rollout.Status.Phase).To(Equal(RolloutPhaseProgressing))
+		Expect(rollout.Status.PauseReason).To(BeEmpty())
+		Expect(annotationsOf("n2")).To(HaveKeyWithValue(NodeAnnotationKeyDetached, value))
+	})
+})
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route53Integration discovers, detaches and re-attaches Route 53 weighted and multivalue answer record sets
+// whose values are node IPs.
+type Route53Integration struct {
+	Svc route53iface.Route53API
+
+	// HostedZoneIDs is the list of hosted zones to be searched for record sets
+	HostedZoneIDs []string
+
+	// HostedZoneTags limits the hosted zones to be searched to ones tagged with all the key-value pairs.
+	// When set along with HostedZoneIDs, hosted zones matching either of them are searched.
+	HostedZoneTags map[string]string
+
+	mu sync.Mutex
+
+	// recordSetLocks are held while changing record sets, keyed by the hosted zone ID, the name, the type and the set
+	// identifier of the record set
+	recordSetLocks map[string]*sync.Mutex
+}
+
+func normalizeHostedZoneID(id string) string {
+	return strings.TrimPrefix(id, "/hostedzone/")
+}
+
+func (r *Route53Integration) hostedZoneIDs() ([]string, error) {
+	ids := map[string]bool{}
+
+	var result []string
+
+	for _, id := range r.HostedZoneIDs {
+		id = normalizeHostedZoneID(id)
+
+		if !ids[id] {
+			ids[id] = true
+			result = append(result, id)
+		}
+	}
+
+	if len(r.HostedZoneTags) == 0 {
+		return result, nil
+	}
+
+	var candidates []string
+
+	if err := r.Svc.ListHostedZonesPages(&route53.ListHostedZonesInput{}, func(output *route53.ListHostedZonesOutput, lastPage bool) bool {
+		for _, z := range output.HostedZones {
+			candidates = append(candidates, normalizeHostedZoneID(*z.Id))
+		}
+
+		return !lastPage
+	}); err != nil {
+		return nil, fmt.Errorf("Unable to list hosted zones: %v", err)
+	}
+
+	// ListTagsForResources accepts up to 10 resource IDs per call
+	for i := 0; i < len(candidates); i += 10 {
+		end := i + 10
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+
+		output, err := r.Svc.ListTagsForResources(&route53.ListTagsForResourcesInput{
+			ResourceType: aws.String(route53.TagResourceTypeHostedzone),
+			ResourceIds:  aws.StringSlice(candidates[i:end]),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list tags for hosted zones %v: %v", candidates[i:end], err)
+		}
+
+		for _, rts := range output.ResourceTagSets {
+			tags := map[string]string{}
+
+			for _, t := range rts.Tags {
+				tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+			}
+
+			matched := true
+
+			for k, v := range r.HostedZoneTags {
+				if tags[k] != v {
+					matched = false
+
+					break
+				}
+			}
+
+			id := normalizeHostedZoneID(*rts.ResourceId)
+
+			if matched && !ids[id] {
+				ids[id] = true
+				result = append(result, id)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// getIPToRecords returns weighted and multivalue answer record sets containing any of the IPs, keyed by the IP
+func (r *Route53Integration) getIPToRecords(ips []string) (map[string][]v1alpha1.Route53Record, error) {
+	if len(ips) == 0 {
+		return nil, nil
+	}
+
+	ipMap := map[string]bool{}
+	for _, ip := range ips {
+		ipMap[ip] = true
+	}
+
+	zones, err := r.hostedZoneIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	ipToRecords := map[string][]v1alpha1.Route53Record{}
+
+	for _, zone := range zones {
+		input := &route53.ListResourceRecordSetsInput{
+			HostedZoneId: aws.String(zone),
+		}
+
+		err := r.Svc.ListResourceRecordSetsPages(input, func(output *route53.ListResourceRecordSetsOutput, lastPage bool) bool {
+			for _, rrs := range output.ResourceRecordSets {
+				if rrs.SetIdentifier == nil || (rrs.Weight == nil && !aws.BoolValue(rrs.MultiValueAnswer)) {
+					continue
+				}
+
+				for _, rr := range rrs.ResourceRecords {
+					ip := aws.StringValue(rr.Value)
+
+					if !ipMap[ip] {
+						continue
+					}
+
+					ipToRecords[ip] = append(ipToRecords[ip], v1alpha1.Route53Record{
+						HostedZoneID:     zone,
+						Name:             aws.StringValue(rrs.Name),
+						Type:             aws.StringValue(rrs.Type),
+						SetIdentifier:    aws.StringValue(rrs.SetIdentifier),
+						Value:            ip,
+						Weight:           rrs.Weight,
+						MultiValueAnswer: aws.BoolValue(rrs.MultiValueAnswer),
+						TTL:              aws.Int64Value(rrs.TTL),
+						HealthCheckID:    aws.StringValue(rrs.HealthCheckId),
+					})
+				}
+			}
+
+			return !lastPage
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list record sets in hosted zone %q: %v", zone, err)
+		}
+	}
+
+	return ipToRecords, nil
+}
+
+// getRecordSet returns the current state of the record set, or nil if it doesn't exist
+func (r *Route53Integration) getRecordSet(rec v1alpha1.Route53Record) (*route53.ResourceRecordSet, error) {
+	output, err := r.Svc.ListResourceRecordSets(&route53.ListResourceRecordSetsInput{
+		HostedZoneId:          aws.String(rec.HostedZoneID),
+		StartRecordName:       aws.String(rec.Name),
+		StartRecordType:       aws.String(rec.Type),
+		StartRecordIdentifier: aws.String(rec.SetIdentifier),
+		MaxItems:              aws.String("1"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get record set %s %s %q: %v", rec.Name, rec.Type, rec.SetIdentifier, err)
+	}
+
+	for _, rrs := range output.ResourceRecordSets {
+		if aws.StringValue(rrs.Name) == rec.Name && aws.StringValue(rrs.Type) == rec.Type && aws.StringValue(rrs.SetIdentifier) == rec.SetIdentifier {
+			return rrs, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (r *Route53Integration) change(rec v1alpha1.Route53Record, action string, rrs *route53.ResourceRecordSet) error {
+	_, err := r.Svc.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(rec.HostedZoneID),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String("Updated by node-detacher"),
+			Changes: []*route53.Change{
+				{
+					Action:            aws.String(action),
+					ResourceRecordSet: rrs,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to %s record set %s %s %q: %v", strings.ToLower(action), rec.Name, rec.Type, rec.SetIdentifier, err)
+	}
+
+	return nil
+}
+
+// lockRecordSet serializes changes to the record set across concurrent reconciliations, and returns the function to
+// unlock it. Changes to a record set are read-modify-write of all its values, which otherwise overwrite each other when
+// nodes sharing the record set are detached or re-attached concurrently.
+func (r *Route53Integration) lockRecordSet(rec v1alpha1.Route53Record) func() {
+	key := strings.Join([]string{rec.HostedZoneID, rec.Name, rec.Type, rec.SetIdentifier}, "/")
+
+	r.mu.Lock()
+
+	if r.recordSetLocks == nil {
+		r.recordSetLocks = map[string]*sync.Mutex{}
+	}
+
+	l, ok := r.recordSetLocks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		r.recordSetLocks[key] = l
+	}
+
+	r.mu.Unlock()
+
+	l.Lock()
+
+	return l.Unlock
+}
+
+// hasOnlyValue returns true when the record set contains the value and nothing else
+func hasOnlyValue(rrs *route53.ResourceRecordSet, value string) bool {
+	return len(rrs.ResourceRecords) == 1 && aws.StringValue(rrs.ResourceRecords[0].Value) == value
+}
+
+// detachRecord removes the node IP from the record set.
+// The weight of the weighted record set is set to 0 instead when the node IP is the only value, so that the record set
+// is kept along with its routing policy and health check.
+func (r *Route53Integration) detachRecord(rec v1alpha1.Route53Record) error {
+	defer r.lockRecordSet(rec)()
+
+	rrs, err := r.getRecordSet(rec)
+	if err != nil {
+		return err
+	}
+
+	if rrs == nil {
+		// Already deleted by someone else. Nothing to detach
+		return nil
+	}
+
+	if !rec.MultiValueAnswer && hasOnlyValue(rrs, rec.Value) {
+		if aws.Int64Value(rrs.Weight) == 0 {
+			return nil
+		}
+
+		rrs.Weight = aws.Int64(0)
+
+		return r.change(rec, route53.ChangeActionUpsert, rrs)
+	}
+
+	var remaining []*route53.ResourceRecord
+
+	for _, rr := range rrs.ResourceRecords {
+		if aws.StringValue(rr.Value) != rec.Value {
+			remaining = append(remaining, rr)
+		}
+	}
+
+	if len(remaining) == len(rrs.ResourceRecords) {
+		return nil
+	}
+
+	if len(remaining) == 0 {
+		return r.change(rec, route53.ChangeActionDelete, rrs)
+	}
+
+	rrs.ResourceRecords = remaining
+
+	return r.change(rec, route53.ChangeActionUpsert, rrs)
+}
+
+// attachRecord adds the node IP back to the record set.
+// The original weight of the weighted record set is restored only when it has been set to 0 on detachment, in which case
+// the record set contains IPs of nodes being detached only. They are replaced with the node IP and added back on their
+// own re-attachment.
+func (r *Route53Integration) attachRecord(rec v1alpha1.Route53Record) error {
+	defer r.lockRecordSet(rec)()
+
+	rrs, err := r.getRecordSet(rec)
+	if err != nil {
+		return err
+	}
+
+	if rrs == nil {
+		rrs = &route53.ResourceRecordSet{
+			Name:          aws.String(rec.Name),
+			Type:          aws.String(rec.Type),
+			SetIdentifier: aws.String(rec.SetIdentifier),
+			TTL:           aws.Int64(rec.TTL),
+		}
+
+		if rec.MultiValueAnswer {
+			rrs.MultiValueAnswer = aws.Bool(true)
+		} else {
+			rrs.Weight = rec.Weight
+		}
+
+		if rec.HealthCheckID != "" {
+			rrs.HealthCheckId = aws.String(rec.HealthCheckID)
+		}
+	}
+
+	zeroed := !rec.MultiValueAnswer && aws.Int64Value(rrs.Weight) == 0 && aws.Int64Value(rec.Weight) != 0
+
+	if zeroed {
+		rrs.ResourceRecords = nil
+		rrs.Weight = rec.Weight
+	}
+
+	for _, rr := range rrs.ResourceRecords {
+		if aws.StringValue(rr.Value) == rec.Value {
+			// Already re-attached
+			return nil
+		}
+	}
+
+	rrs.ResourceRecords = append(rrs.ResourceRecords, &route53.ResourceRecord{Value: aws.String(rec.Value)})
+
+	return r.change(rec, route53.ChangeActionUpsert, rrs)
+}
+
+// route53DrainRemaining returns how long we need to wait until resolvers stop returning the detached node IP,
+// which is the longest remaining TTL among detached record sets
+func route53DrainRemaining(records []v1alpha1.Route53Record, now time.Time) time.Duration {
+	var remaining time.Duration
+
+	for _, rec := range records {
+		if !rec.Detached || rec.DetachedAt == nil {
+			continue
+		}
+
+		r := rec.DetachedAt.Add(time.Duration(rec.TTL) * time.Second).Sub(now)
+		if r > remaining {
+			remaining = r
+		}
+	}
+
+	return remaining
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"sort"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeRoute53 serves record sets of a hosted zone keyed by the set identifier
+type fakeRoute53 struct {
+	route53iface.Route53API
+
+	mu sync.Mutex
+
+	recordSets map[string]*route53.ResourceRecordSet
+}
+
+func (f *fakeRoute53) ListResourceRecordSets(input *route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	output := &route53.ListResourceRecordSetsOutput{}
+
+	if rrs, ok := f.recordSets[aws.StringValue(input.StartRecordIdentifier)]; ok {
+		copied := *rrs
+		copied.ResourceRecords = append([]*route53.ResourceRecord{}, rrs.ResourceRecords...)
+
+		output.ResourceRecordSets = append(output.ResourceRecordSets, &copied)
+	}
+
+	return output, nil
+}
+
+func (f *fakeRoute53) ListResourceRecordSetsPages(input *route53.ListResourceRecordSetsInput, fn func(*route53.ListResourceRecordSetsOutput, bool) bool) error {
+	f.mu.Lock()
+
+	output := &route53.ListResourceRecordSetsOutput{}
+
+	for _, rrs := range f.recordSets {
+		output.ResourceRecordSets = append(output.ResourceRecordSets, rrs)
+	}
+
+	f.mu.Unlock()
+
+	fn(output, true)
+
+	return nil
+}
+
+func (f *fakeRoute53) ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, c := range input.ChangeBatch.Changes {
+		id := aws.StringValue(c.ResourceRecordSet.SetIdentifier)
+
+		switch aws.StringValue(c.Action) {
+		case route53.ChangeActionUpsert:
+			f.recordSets[id] = c.ResourceRecordSet
+		case route53.ChangeActionDelete:
+			delete(f.recordSets, id)
+		default:
+			return nil, fmt.Errorf("unexpected action %s", aws.StringValue(c.Action))
+		}
+	}
+
+	return &route53.ChangeResourceRecordSetsOutput{}, nil
+}
+
+var _ = Describe("Route53Integration", func() {
+	var (
+		svc *fakeRoute53
+		r   *Route53Integration
+	)
+
+	BeforeEach(func() {
+		svc = &fakeRoute53{recordSets: map[string]*route53.ResourceRecordSet{}}
+		r = &Route53Integration{Svc: svc}
+	})
+
+	addRecordSet := func(id string, weight int64, ips ...string) {
+		rrs := &route53.ResourceRecordSet{
+			Name:          aws.String("web.example.com."),
+			Type:          aws.String(route53.RRTypeA),
+			SetIdentifier: aws.String(id),
+			Weight:        aws.Int64(weight),
+			TTL:           aws.Int64(60),
+		}
+
+		for _, ip := range ips {
+			rrs.ResourceRecords = append(rrs.ResourceRecords, &route53.ResourceRecord{Value: aws.String(ip)})
+		}
+
+		svc.recordSets[id] = rrs
+	}
+
+	recordOf := func(id string, weight int64, ip string) v1alpha1.Route53Record {
+		return v1alpha1.Route53Record{
+			Name:          "web.example.com.",
+			Type:          route53.RRTypeA,
+			SetIdentifier: id,
+			Value:         ip,
+			Weight:        aws.Int64(weight),
+			TTL:           60,
+		}
+	}
+
+	valuesOf := func(id string) []string {
+		var values []string
+
+		for _, rr := range svc.recordSets[id].ResourceRecords {
+			values = append(values, aws.StringValue(rr.Value))
+		}
+
+		sort.Strings(values)
+
+		return values
+	}
+
+	weightOf := func(id string) int64 {
+		return aws.Int64Value(svc.recordSets[id].Weight)
+	}
+
+	It("sets the weight to 0 when the node IP is the only value of the weighted record set", func() {
+		addRecordSet("blue", 10, "10.0.0.1")
+
+		Expect(r.detachRecord(recordOf("blue", 10, "10.0.0.1"))).To(Succeed())
+		Expect(valuesOf("blue")).To(Equal([]string{"10.0.0.1"}))
+		Expect(weightOf("blue")).To(BeZero())
+
+		Expect(r.attachRecord(recordOf("blue", 10, "10.0.0.1"))).To(Succeed())
+		Expect(valuesOf("blue")).To(Equal([]string{"10.0.0.1"}))
+		Expect(weightOf("blue")).To(Equal(int64(10)))
+	})
+
+	It("removes and adds back only the node IP in the weighted record set of multiple node IPs", func() {
+		addRecordSet("blue", 10, "10.0.0.1", "10.0.0.2", "10.0.0.3")
+
+		Expect(r.detachRecord(recordOf("blue", 10, "10.0.0.1"))).To(Succeed())
+		Expect(valuesOf("blue")).To(Equal([]string{"10.0.0.2", "10.0.0.3"}))
+		Expect(weightOf("blue")).To(Equal(int64(10)))
+
+		Expect(r.attachRecord(recordOf("blue", 10, "10.0.0.1"))).To(Succeed())
+		Expect(valuesOf("blue")).To(Equal([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}))
+		Expect(weightOf("blue")).To(Equal(int64(10)))
+	})
+
+	It("keeps node IPs and the weight consistent while every node in the weighted record set is detached and re-attached", func() {
+		addRecordSet("blue", 10, "10.0.0.1", "10.0.0.2")
+
+		Expect(r.detachRecord(recordOf("blue", 10, "10.0.0.1"))).To(Succeed())
+		Expect(r.detachRecord(recordOf("blue", 10, "10.0.0.2"))).To(Succeed())
+		Expect(valuesOf("blue")).To(Equal([]string{"10.0.0.2"}))
+		Expect(weightOf("blue")).To(BeZero())
+
+		// The IP of the node still being detached must not be served along with the restored weight
+		Expect(r.attachRecord(recordOf("blue", 10, "10.0.0.1"))).To(Succeed())
+		Expect(valuesOf("blue")).To(Equal([]string{"10.0.0.1"}))
+		Expect(weightOf("blue")).To(Equal(int64(10)))
+
+		Expect(r.attachRecord(recordOf("blue", 10, "10.0.0.2"))).To(Succeed())
+		Expect(valuesOf("blue")).To(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+		Expect(weightOf("blue")).To(Equal(int64(10)))
+	})
+
+	It("never loses concurrent changes to the same record set", func() {
+		var ips []string
+
+		for i := 1; i <= 10; i++ {
+			ips = append(ips, fmt.Sprintf("10.0.0.%d", i))
+		}
+
+		sort.Strings(ips)
+
+		addRecordSet("blue", 10, append(ips, "10.0.1.1")...)
+
+		var wg sync.WaitGroup
+
+		for _, ip := range ips {
+			wg.Add(1)
+
+			go func(ip string) {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				Expect(r.detachRecord(recordOf("blue", 10, ip))).To(Succeed())
+			}(ip)
+		}
+
+		wg.Wait()
+
+		Expect(valuesOf("blue")).To(Equal([]string{"10.0.1.1"}))
+
+		for _, ip := range ips {
+			wg.Add(1)
+
+			go func(ip string) {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				Expect(r.attachRecord(recordOf("blue", 10, ip))).To(Succeed())
+			}(ip)
+		}
+
+		wg.Wait()
+
+		Expect(valuesOf("blue")).To(Equal(append(ips, "10.0.1.1")))
+		Expect(weightOf("blue")).To(Equal(int64(10)))
+	})
+
+	It("adds record sets the node IP is added to after caching on detach", func() {
+		r.HostedZoneIDs = []string{"Z1"}
+
+		addRecordSet("blue", 10, "10.0.0.1", "10.0.0.2")
+
+		n := &NodeAttachments{route53: r}
+
+		node := corev1.Node{
+			Status: corev1.NodeStatus{
+				Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.1"}},
+			},
+		}
+
+		detached := recordOf("blue", 10, "10.0.0.1")
+		detached.HostedZoneID = "Z1"
+		detached.Detached = true
+
+		spec := v1alpha1.AttachmentSpec{Route53Records: []v1alpha1.Route53Record{detached}}
+
+		addRecordSet("green", 20, "10.0.0.1")
+
+		Expect(n.rediscoverOnDetach(node, &spec)).To(Succeed())
+		Expect(spec.Route53Records).To(HaveLen(2))
+		Expect(spec.Route53Records[0].Detached).To(BeTrue())
+		Expect(spec.Route53Records[1].SetIdentifier).To(Equal("green"))
+		Expect(spec.Route53Records[1].Detached).To(BeFalse())
+		Expect(aws.Int64Value(spec.Route53Records[1].Weight)).To(Equal(int64(20)))
+	})
+
+	It("deletes the multivalue answer record set once the last node IP is removed", func() {
+		svc.recordSets["a"] = &route53.ResourceRecordSet{
+			Name:             aws.String("web.example.com."),
+			Type:             aws.String(route53.RRTypeA),
+			SetIdentifier:    aws.String("a"),
+			MultiValueAnswer: aws.Bool(true),
+			TTL:              aws.Int64(60),
+			ResourceRecords:  []*route53.ResourceRecord{{Value: aws.String("10.0.0.1")}},
+		}
+
+		rec := v1alpha1.Route53Record{Name: "web.example.com.", Type: route53.RRTypeA, SetIdentifier: "a", Value: "10.0.0.1", MultiValueAnswer: true, TTL: 60}
+
+		Expect(r.detachRecord(rec)).To(Succeed())
+		Expect(svc.recordSets).NotTo(HaveKey("a"))
+
+		Expect(r.attachRecord(rec)).To(Succeed())
+		Expect(valuesOf("a")).To(Equal([]string{"10.0.0.1"}))
+		Expect(aws.BoolValue(svc.recordSets["a"].MultiValueAnswer)).To(BeTrue())
+	})
+})
@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
 	"k8s.io/client-go/kubernetes"
 	"path/filepath"
 	"testing"
@@ -54,7 +55,7 @@ var _ = BeforeSuite(func(done Done) {
 
 	By("bootstrapping test environment")
 	testEnv = &envtest.Environment{
-		CRDDirectoryPaths: []string{filepath.Join("..", "config", "crd", "bases")},
+		CRDDirectoryPaths: []string{filepath.Join("config", "crd", "bases")},
 	}
 
 	var err error
@@ -62,6 +63,9 @@ var _ = BeforeSuite(func(done Done) {
 	Expect(err).ToNot(HaveOccurred())
 	Expect(cfg).ToNot(BeNil())
 
+	err = v1alpha1.AddToScheme(k8scheme.Scheme)
+	Expect(err).NotTo(HaveOccurred())
+
 	// +kubebuilder:scaffold:scheme
 
 	clientset, err = kubernetes.NewForConfig(cfg)
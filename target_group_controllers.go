@@ -0,0 +1,130 @@
+package main
+
+import (
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	"time"
+)
+
+const (
+	// TargetGroupControllerAWSLoadBalancerController manages targets of target groups bound via TargetGroupBindings,
+	// including ones it creates for ingresses and services.
+	// It stops registering nodes labeled with node.kubernetes.io/exclude-from-external-load-balancers.
+	TargetGroupControllerAWSLoadBalancerController = "aws-load-balancer-controller"
+
+	// TargetGroupControllerALBIngressController manages targets of target groups it creates for ingresses.
+	// It stops registering nodes labeled with alpha.service-controller.kubernetes.io/exclude-balancer.
+	TargetGroupControllerALBIngressController = "aws-alb-ingress-controller"
+
+	// AWSTagKeyELBV2Cluster is added by aws-load-balancer-controller to every target group it creates
+	AWSTagKeyELBV2Cluster = "elbv2.k8s.aws/cluster"
+
+	DefaultAWSControllerTimeout = 1 * time.Minute
+
+	// controllerPollInterval is how often node-detacher checks if the controller has de-registered the node
+	controllerPollInterval = 5 * time.Second
+)
+
+// excludeBalancerLabels maps labels that make controllers de-register nodes from load balancers to annotations
+// remembering that node-detacher added them
+var excludeBalancerLabels = map[string]string{
+	NodeLabelKeyExcludeBalancer:                  NodeAnnotationKeyExcludeBalancerLabeled,
+	NodeLabelKeyExcludeFromExternalLoadBalancers: NodeAnnotationKeyExcludeFromExternalLoadBalancersLabeled,
+}
+
+// classifyTargetGroupController returns the controller managing targets of the target group with the tags, or empty
+// when no controller is known to manage them
+func classifyTargetGroupController(tags map[string]string) string {
+	for _, k := range []string{AWSTagKeyELBV2Cluster, AWSTagKeyIngressStack, AWSTagKeyServiceStack} {
+		if _, ok := tags[k]; ok {
+			return TargetGroupControllerAWSLoadBalancerController
+		}
+	}
+
+	if _, ok := tags[AWSTagKeyIngressName]; ok {
+		return TargetGroupControllerALBIngressController
+	}
+
+	return ""
+}
+
+// excludeBalancerLabelOf returns the label that makes the controller de-register the node.
+// The legacy label is used for target groups without controllers, too, as the Kubernetes service controller honors it.
+func excludeBalancerLabelOf(controller string) string {
+	if controller == TargetGroupControllerAWSLoadBalancerController {
+		return NodeLabelKeyExcludeFromExternalLoadBalancers
+	}
+
+	return NodeLabelKeyExcludeBalancer
+}
+
+// markBoundTargetGroups records that target groups bound via TargetGroupBindings are managed by
+// aws-load-balancer-controller, regardless of tags, as TargetGroupBindings may bind target groups created externally
+// to Kubernetes, e.g. by Terraform
+func (n *NodeAttachments) markBoundTargetGroups(instanceToTargets map[string][]v1alpha1.AwsTarget) error {
+	if len(instanceToTargets) == 0 {
+		return nil
+	}
+
+	refs, err := n.targetGroupBindingRefs()
+	if err != nil {
+		return err
+	}
+
+	bound := map[string]bool{}
+
+	for _, ref := range refs {
+		bound[ref.arn] = true
+	}
+
+	for _, targets := range instanceToTargets {
+		for i := range targets {
+			if bound[targets[i].ARN] {
+				targets[i].Controller = TargetGroupControllerAWSLoadBalancerController
+			}
+		}
+	}
+
+	return nil
+}
+
+// awaitsController returns true when node-detacher lets the controller de-register and register the target, before
+// falling back to doing it on its own
+func (n *NodeAttachments) awaitsController(t v1alpha1.AwsTarget) bool {
+	return t.Controller != "" && n.controllerTimeout > 0
+}
+
+// controllerWaitRemaining returns how long node-detacher keeps waiting for the controller on the target.
+// Zero or negative once the wait times out.
+func (n *NodeAttachments) controllerWaitRemaining(t v1alpha1.AwsTarget, now time.Time) time.Duration {
+	if t.ControllerWaitStartedAt == nil {
+		return 0
+	}
+
+	return t.ControllerWaitStartedAt.Add(n.controllerTimeout).Sub(now)
+}
+
+// controllerPollRemaining returns how long to wait until checking targets awaiting controllers again. Zero when none of
+// the targets awaits controllers
+func (n *NodeAttachments) controllerPollRemaining(targets []v1alpha1.AwsTarget, now time.Time) time.Duration {
+	var remaining time.Duration
+
+	for _, t := range targets {
+		if t.Phase != DetachPhaseAwaitingController {
+			continue
+		}
+
+		r := n.controllerWaitRemaining(t, now)
+		if r > controllerPollInterval {
+			r = controllerPollInterval
+		} else if r <= 0 {
+			// Falls back to de-registering the target on the next reconciliation
+			r = time.Second
+		}
+
+		if r > remaining {
+			remaining = r
+		}
+	}
+
+	return remaining
+}
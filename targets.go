@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"strings"
+	"sync"
+)
+
+// DaemonSetTargets resolves daemonsets managed by node-detacher across all the namespaces.
+//
+// A daemonset is targeted when any of the followings is true:
+//
+// - It is annotated with node-detacher.variant.run/managed-by=NAME
+// - It is listed in `--daemonset` as `NAME`, `NAMESPACE/NAME`, or `NAMESPACE/*`
+// - Its labels match `--daemonset-selector`
+// - Its annotations match `--daemonset-annotation-selector`
+//
+// For example, let's say you'd like node-detacher deployed in kube-system to detach the node which is running the target
+// pod and when the pod becomes `Terminating` state.
+//
+// When the pod is named `contour-<hash>` and it is managed by the daemonset named `contour` in namespace
+// `kube-system`, you'd specify the daemonsets list as:
+//
+//	--daemonset contour
+//
+// If you'd like to deploy `contour` in another namespace that is different from where `node-detacher` is deployed
+// to - e.g. `ingress` namespace - you'd specify the list as:
+//
+//	--daemonset ingress/contour
+//
+// Or `--daemonset ingress/*` to target all the daemonsets in the namespace.
+type DaemonSetTargets struct {
+	// Name is the name of the manager used from within daemonset annotations to specify which node-detacher instance to manage the daemonset
+	Name string
+
+	// Selector selects target daemonsets by labels
+	Selector labels.Selector
+
+	// AnnotationSelector selects target daemonsets by annotations
+	AnnotationSelector labels.Selector
+
+	// names is the set of `NAMESPACE/NAME` of target daemonsets
+	names map[string]bool
+
+	// namespaces is the set of namespaces all of whose daemonsets are targeted
+	namespaces map[string]bool
+
+	// anyNamespaceNames is the set of daemonset names given without namespaces when the default namespace is unknown
+	anyNamespaceNames map[string]bool
+
+	// mu guards all the fields, as the targets are updated on reload of the config while controllers are running
+	mu sync.RWMutex
+}
+
+// ParseDaemonSetTargets parses the list of `[NAMESPACE/]NAME` or `NAMESPACE/*` of target daemonsets.
+// A daemonset name without a namespace is resolved in the defaultNamespace, or in any namespace when the default
+// namespace is empty.
+func ParseDaemonSetTargets(name, defaultNamespace string, daemonsets []string, selector, annotationSelector string) (*DaemonSetTargets, error) {
+	t := &DaemonSetTargets{
+		Name:              name,
+		names:             map[string]bool{},
+		namespaces:        map[string]bool{},
+		anyNamespaceNames: map[string]bool{},
+	}
+
+	for _, ds := range daemonsets {
+		nsName := strings.Split(ds, "/")
+
+		switch {
+		case len(nsName) == 1 && nsName[0] != "" && nsName[0] != "*":
+			if defaultNamespace == "" {
+				t.anyNamespaceNames[nsName[0]] = true
+			} else {
+				t.names[defaultNamespace+"/"+nsName[0]] = true
+			}
+		case len(nsName) == 2 && nsName[0] != "" && nsName[0] != "*" && nsName[1] == "*":
+			t.namespaces[nsName[0]] = true
+		case len(nsName) == 2 && nsName[0] != "" && nsName[0] != "*" && nsName[1] != "":
+			t.names[ds] = true
+		default:
+			return nil, fmt.Errorf("invalid daemonset %q: it must be either NAME, NAMESPACE/NAME, or NAMESPACE/*", ds)
+		}
+	}
+
+	var err error
+
+	if selector != "" {
+		if t.Selector, err = labels.Parse(selector); err != nil {
+			return nil, fmt.Errorf("invalid daemonset selector %q: %w", selector, err)
+		}
+	}
+
+	if annotationSelector != "" {
+		if t.AnnotationSelector, err = labels.Parse(annotationSelector); err != nil {
+			return nil, fmt.Errorf("invalid daemonset annotation selector %q: %w", annotationSelector, err)
+		}
+	}
+
+	return t, nil
+}
+
+// Matches returns true when the daemonset is targeted
+func (t *DaemonSetTargets) Matches(ds metav1.Object) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.Name != "" && GetManagedBy(ds) == t.Name {
+		return true
+	}
+
+	if t.names[ds.GetNamespace()+"/"+ds.GetName()] || t.namespaces[ds.GetNamespace()] || t.anyNamespaceNames[ds.GetName()] {
+		return true
+	}
+
+	if t.Selector != nil && t.Selector.Matches(labels.Set(ds.GetLabels())) {
+		return true
+	}
+
+	return t.AnnotationSelector != nil && t.AnnotationSelector.Matches(labels.Set(ds.GetAnnotations()))
+}
+
+// Update replaces the targets with the other, so that controllers and event filters sharing the targets see the change
+func (t *DaemonSetTargets) Update(other *DaemonSetTargets) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.Name = other.Name
+	t.Selector = other.Selector
+	t.AnnotationSelector = other.AnnotationSelector
+	t.names = other.names
+	t.namespaces = other.namespaces
+	t.anyNamespaceNames = other.anyNamespaceNames
+}
+
+// daemonSetPredicate filters out events of daemonsets that aren't targeted, so that they are never reconciled.
+// Events of other kinds of objects are passed through.
+func daemonSetPredicate(targets *DaemonSetTargets) predicate.Funcs {
+	matches := func(obj runtime.Object, meta metav1.Object) bool {
+		if _, ok := obj.(*appsv1.DaemonSet); !ok {
+			return true
+		}
+
+		return targets.Matches(meta)
+	}
+
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return matches(e.Object, e.Meta)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return matches(e.ObjectNew, e.MetaNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return matches(e.Object, e.Meta)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return matches(e.Object, e.Meta)
+		},
+	}
+}
+
+// podState is the part of the pod that PodController is interested in.
+// Pod updates that don't change it are never reconciled.
+type podState struct {
+	NodeName     string
+	Terminating  bool
+	Detaching    string
+	Injected     string
+	Ready        bool
+	NodeAttached corev1.ConditionStatus
+}
+
+func podStateOf(pod *corev1.Pod) podState {
+	s := podState{
+		NodeName:    pod.Spec.NodeName,
+		Terminating: pod.DeletionTimestamp != nil,
+		Detaching:   pod.Annotations[PodAnnotationDetaching],
+		Injected:    pod.Annotations[PodAnnotationKeyInjected],
+		Ready:       isPodReady(*pod),
+	}
+
+	for _, c := range pod.Status.Conditions {
+		if c.Type == PodConditionTypeNodeAttached {
+			s.NodeAttached = c.Status
+		}
+	}
+
+	return s
+}
+
+// mayBeTargeted returns true when the pod may be reconciled by PodController, judging only from the pod itself.
+//
+// Pods controlled by replicasets and statefulsets are targeted only when workloads are managed, and pods of daemonsets
+// only when daemonsets are targeted at all. Pods with the injected readiness gate are targeted regardless of them.
+// Static pods, bare pods, and pods of jobs are never reconciled by PodController.
+func mayBeTargeted(pod *corev1.Pod, manageWorkloads bool, targets *DaemonSetTargets) bool {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return false
+	}
+
+	injected := pod.Annotations[PodAnnotationKeyInjected] == "true"
+
+	switch owner.Kind {
+	case WorkloadKindDaemonSet:
+		return targets != nil || injected
+	case "ReplicaSet", WorkloadKindStatefulSet:
+		return manageWorkloads || injected
+	}
+
+	return false
+}
+
+// podPredicate filters out events of pods that can't be targeted, and pod updates irrelevant to PodController.
+// Events of other kinds of objects, like nodes watched for syncing readiness gates, are passed through.
+func podPredicate(manageWorkloads bool, targets *DaemonSetTargets) predicate.Funcs {
+	targeted := func(pod *corev1.Pod) bool {
+		return mayBeTargeted(pod, manageWorkloads, targets)
+	}
+
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			pod, ok := e.Object.(*corev1.Pod)
+
+			return !ok || targeted(pod)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			pod, ok := e.ObjectNew.(*corev1.Pod)
+			if !ok {
+				return true
+			}
+
+			old, ok := e.ObjectOld.(*corev1.Pod)
+			if !ok {
+				return true
+			}
+
+			return targeted(pod) && podStateOf(old) != podStateOf(pod)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			pod, ok := e.Object.(*corev1.Pod)
+
+			return !ok || targeted(pod)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			pod, ok := e.Object.(*corev1.Pod)
+
+			return !ok || targeted(pod)
+		},
+	}
+}
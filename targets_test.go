@@ -0,0 +1,92 @@
+package main
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DaemonSetTargets", func() {
+	ds := func(ns, name string, labels, annotations map[string]string) *appsv1.DaemonSet {
+		return &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, Labels: labels, Annotations: annotations}}
+	}
+
+	It("resolves names, wildcards, and selectors across namespaces", func() {
+		t, err := ParseDaemonSetTargets("node-detacher", "kube-system", []string{"contour", "ingress/nginx", "edge/*"}, "tier=ingress", "example.com/ingress=true")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(t.Matches(ds("kube-system", "contour", nil, nil))).To(BeTrue())
+		Expect(t.Matches(ds("default", "contour", nil, nil))).To(BeFalse())
+		Expect(t.Matches(ds("ingress", "nginx", nil, nil))).To(BeTrue())
+		Expect(t.Matches(ds("edge", "anything", nil, nil))).To(BeTrue())
+		Expect(t.Matches(ds("default", "envoy", map[string]string{"tier": "ingress"}, nil))).To(BeTrue())
+		Expect(t.Matches(ds("default", "envoy", nil, map[string]string{"example.com/ingress": "true"}))).To(BeTrue())
+		Expect(t.Matches(ds("default", "envoy", nil, map[string]string{DaemonSetAnnotationKeyManagedBy: "node-detacher"}))).To(BeTrue())
+		Expect(t.Matches(ds("default", "envoy", nil, map[string]string{DaemonSetAnnotationKeyManagedBy: "another"}))).To(BeFalse())
+	})
+
+	It("rejects invalid daemonsets", func() {
+		for _, d := range []string{"*", "a/b/c", "/contour", "ingress/", "*/contour", "*/*"} {
+			_, err := ParseDaemonSetTargets("node-detacher", "kube-system", []string{d}, "", "")
+			Expect(err).To(HaveOccurred(), d)
+		}
+	})
+
+	It("filters out ownerless pods and irrelevant pod updates", func() {
+		p := podPredicate(false, &DaemonSetTargets{})
+
+		bare := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "kube-apiserver"}}
+		Expect(p.Create(event.CreateEvent{Meta: bare, Object: bare})).To(BeFalse())
+
+		controller := true
+		owned := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "ingress",
+			Name:            "contour-x",
+			OwnerReferences: []metav1.OwnerReference{{Kind: WorkloadKindDaemonSet, Name: "contour", Controller: &controller}},
+		}}
+		Expect(p.Create(event.CreateEvent{Meta: owned, Object: owned})).To(BeTrue())
+
+		relabeled := owned.DeepCopy()
+		relabeled.Labels = map[string]string{"foo": "bar"}
+		Expect(p.Update(event.UpdateEvent{MetaOld: owned, ObjectOld: owned, MetaNew: relabeled, ObjectNew: relabeled})).To(BeFalse())
+
+		terminating := owned.DeepCopy()
+		now := metav1.Now()
+		terminating.DeletionTimestamp = &now
+		Expect(p.Update(event.UpdateEvent{MetaOld: owned, ObjectOld: owned, MetaNew: terminating, ObjectNew: terminating})).To(BeTrue())
+	})
+
+	It("filters out pods of replicasets and statefulsets unless workloads are managed", func() {
+		controller := true
+
+		pod := func(kind string, annotations map[string]string) *corev1.Pod {
+			return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace:       "default",
+				Name:            "web-x",
+				Annotations:     annotations,
+				OwnerReferences: []metav1.OwnerReference{{Kind: kind, Name: "web", Controller: &controller}},
+			}}
+		}
+
+		created := func(p predicate.Funcs, pod *corev1.Pod) bool {
+			return p.Create(event.CreateEvent{Meta: pod, Object: pod})
+		}
+
+		unmanaged := podPredicate(false, &DaemonSetTargets{})
+		Expect(created(unmanaged, pod("ReplicaSet", nil))).To(BeFalse())
+		Expect(created(unmanaged, pod(WorkloadKindStatefulSet, nil))).To(BeFalse())
+		Expect(created(unmanaged, pod(WorkloadKindDaemonSet, nil))).To(BeTrue())
+		// Readiness gates of injected pods are synced regardless of workloads being managed
+		Expect(created(unmanaged, pod("ReplicaSet", map[string]string{PodAnnotationKeyInjected: "true"}))).To(BeTrue())
+
+		managed := podPredicate(true, nil)
+		Expect(created(managed, pod("ReplicaSet", nil))).To(BeTrue())
+		Expect(created(managed, pod(WorkloadKindStatefulSet, nil))).To(BeTrue())
+		Expect(created(managed, pod(WorkloadKindDaemonSet, nil))).To(BeFalse())
+	})
+})
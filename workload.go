@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+)
+
+const (
+	// NodeAnnotationValuePrefixDaemonSet, NodeAnnotationValuePrefixDeployment, and NodeAnnotationValuePrefixStatefulSet
+	// are the prefixes of the values of the detached annotation that is set by node-detacher for replacing pods.
+	// Nodes detached this way are de-registered from load balancers but never tainted, so that the replacement pod can
+	// be scheduled onto the node.
+	NodeAnnotationValuePrefixDaemonSet   = "daemonset:"
+	NodeAnnotationValuePrefixDeployment  = "deployment:"
+	NodeAnnotationValuePrefixStatefulSet = "statefulset:"
+
+	WorkloadKindDaemonSet   = "DaemonSet"
+	WorkloadKindDeployment  = "Deployment"
+	WorkloadKindStatefulSet = "StatefulSet"
+)
+
+// +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch
+
+func daemonSetDetachedAnnotationValue(namespace, name string) string {
+	return NodeAnnotationValuePrefixDaemonSet + namespace + "/" + name
+}
+
+func isDetachedForPodReplacement(node corev1.Node) bool {
+	v := node.Annotations[NodeAnnotationKeyDetached]
+
+	for _, prefix := range []string{NodeAnnotationValuePrefixDaemonSet, NodeAnnotationValuePrefixDeployment, NodeAnnotationValuePrefixStatefulSet} {
+		if strings.HasPrefix(v, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// podWorkload is the daemonset, deployment, or statefulset that manages the pod
+type podWorkload struct {
+	Kind      string
+	Namespace string
+	Name      string
+
+	Object   metav1.Object
+	Selector labels.Selector
+
+	daemonSet   *appsv1.DaemonSet
+	deployment  *appsv1.Deployment
+	statefulSet *appsv1.StatefulSet
+}
+
+// detachedAnnotationValue is the value of the detached annotation set on the node running the pod being replaced
+func (w *podWorkload) detachedAnnotationValue() string {
+	switch w.Kind {
+	case WorkloadKindDeployment:
+		return NodeAnnotationValuePrefixDeployment + w.Namespace + "/" + w.Name
+	case WorkloadKindStatefulSet:
+		return NodeAnnotationValuePrefixStatefulSet + w.Namespace + "/" + w.Name
+	}
+
+	return daemonSetDetachedAnnotationValue(w.Namespace, w.Name)
+}
+
+// replacementReady returns true when the node running the pods can be re-attached.
+//
+// A daemonset pod is always replaced on the same node, hence the up-to-date daemonset pod must be ready on the node.
+// A pod of a deployment or a statefulset may be replaced on another node, hence either a pod on the node is ready or
+// all the replicas are ready.
+func (w *podWorkload) replacementReady(pods []corev1.Pod) bool {
+	switch w.Kind {
+	case WorkloadKindDaemonSet:
+		return isDaemonSetPodReady(w.daemonSet, pods)
+	}
+
+	for _, pod := range pods {
+		if pod.DeletionTimestamp == nil && isPodReady(pod) {
+			return true
+		}
+	}
+
+	var desired, ready int32 = 1, 0
+
+	switch w.Kind {
+	case WorkloadKindDeployment:
+		if w.deployment.Spec.Replicas != nil {
+			desired = *w.deployment.Spec.Replicas
+		}
+
+		ready = w.deployment.Status.ReadyReplicas
+	case WorkloadKindStatefulSet:
+		if w.statefulSet.Spec.Replicas != nil {
+			desired = *w.statefulSet.Spec.Replicas
+		}
+
+		ready = w.statefulSet.Status.ReadyReplicas
+	}
+
+	return ready >= desired
+}
+
+// getPodWorkload returns the workload that manages the pod, or nil when the pod isn't managed by any of daemonsets,
+// deployments, and statefulsets
+func getPodWorkload(ctx context.Context, c client.Client, pod *corev1.Pod) (*podWorkload, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return nil, nil
+	}
+
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: owner.Name}
+
+	w := &podWorkload{Namespace: pod.Namespace}
+
+	var selector *metav1.LabelSelector
+
+	switch owner.Kind {
+	case WorkloadKindDaemonSet:
+		var ds appsv1.DaemonSet
+
+		if err := c.Get(ctx, key, &ds); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+
+		w.Kind, w.Name, w.Object, w.daemonSet, selector = WorkloadKindDaemonSet, ds.Name, &ds, &ds, ds.Spec.Selector
+	case "ReplicaSet":
+		var rs appsv1.ReplicaSet
+
+		if err := c.Get(ctx, key, &rs); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+
+		rsOwner := metav1.GetControllerOf(&rs)
+		if rsOwner == nil || rsOwner.Kind != WorkloadKindDeployment {
+			return nil, nil
+		}
+
+		var d appsv1.Deployment
+
+		if err := c.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: rsOwner.Name}, &d); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+
+		w.Kind, w.Name, w.Object, w.deployment, selector = WorkloadKindDeployment, d.Name, &d, &d, d.Spec.Selector
+	case WorkloadKindStatefulSet:
+		var sts appsv1.StatefulSet
+
+		if err := c.Get(ctx, key, &sts); err != nil {
+			return nil, client.IgnoreNotFound(err)
+		}
+
+		w.Kind, w.Name, w.Object, w.statefulSet, selector = WorkloadKindStatefulSet, sts.Name, &sts, &sts, sts.Spec.Selector
+	default:
+		return nil, nil
+	}
+
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector in %s %s/%s: %w", w.Kind, w.Namespace, w.Name, err)
+	}
+
+	w.Selector = s
+
+	return w, nil
+}
+
+// reattachNodesForWorkload re-attaches the nodes detached for replacing pods of the workload, once there's no pod
+// being terminated on the node and the replacement became ready
+func (r *PodController) reattachNodesForWorkload(ctx context.Context, w *podWorkload) error {
+	value := w.detachedAnnotationValue()
+
+	var nodes corev1.NodeList
+
+	if err := r.List(ctx, &nodes); err != nil {
+		return err
+	}
+
+	var pods corev1.PodList
+
+	if err := r.List(ctx, &pods, client.InNamespace(w.Namespace), client.MatchingLabelsSelector{Selector: w.Selector}); err != nil {
+		return err
+	}
+
+	podsByNode := map[string][]corev1.Pod{}
+
+	for _, pod := range pods.Items {
+		podsByNode[pod.Spec.NodeName] = append(podsByNode[pod.Spec.NodeName], pod)
+	}
+
+	for _, node := range nodes.Items {
+		if node.Annotations[NodeAnnotationKeyDetached] != value {
+			continue
+		}
+
+		var replacing bool
+
+		for _, pod := range podsByNode[node.Name] {
+			if pod.DeletionTimestamp != nil || GetAnnotation(pod.GetObjectMeta(), PodAnnotationDetaching) == r.Name {
+				replacing = true
+			}
+		}
+
+		if replacing || !w.replacementReady(podsByNode[node.Name]) {
+			continue
+		}
+
+		r.Log.Info("Re-attaching node as the replacement pod became ready", "node", node.Name, "kind", w.Kind, "name", w.Name)
+
+		if err := unsetNodeDetachedForPodReplacement(ctx, r.Client, node, value); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Workload", func() {
+	readyPod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"pod-template-generation": "1"}},
+		Status:     corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}},
+	}
+
+	It("waits for the up-to-date daemonset pod to become ready on the node", func() {
+		w := &podWorkload{Kind: WorkloadKindDaemonSet, Namespace: "ingress", Name: "contour", daemonSet: &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Generation: 2}}}
+
+		Expect(w.detachedAnnotationValue()).To(Equal("daemonset:ingress/contour"))
+		Expect(w.replacementReady([]corev1.Pod{readyPod})).To(BeFalse())
+
+		w.daemonSet.Generation = 1
+
+		Expect(w.replacementReady([]corev1.Pod{readyPod})).To(BeTrue())
+	})
+
+	It("waits for the replacement deployment pod to become ready on any node", func() {
+		replicas := int32(2)
+
+		w := &podWorkload{Kind: WorkloadKindDeployment, Namespace: "edge", Name: "envoy", deployment: &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: &replicas}}}
+
+		Expect(w.detachedAnnotationValue()).To(Equal("deployment:edge/envoy"))
+		Expect(isDetachedForPodReplacement(corev1.Node{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{NodeAnnotationKeyDetached: w.detachedAnnotationValue()}}})).To(BeTrue())
+
+		terminating := readyPod.DeepCopy()
+		terminating.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+
+		Expect(w.replacementReady([]corev1.Pod{*terminating})).To(BeFalse())
+		Expect(w.replacementReady(nil)).To(BeFalse())
+
+		w.deployment.Status.ReadyReplicas = 2
+
+		Expect(w.replacementReady(nil)).To(BeTrue())
+		Expect(w.replacementReady([]corev1.Pod{readyPod})).To(BeTrue())
+	})
+
+	It("detaches only nodes NodeController ever detaches for terminating pods", func() {
+		scheme := runtime.NewScheme()
+		Expect(k8sscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		ctx := context.Background()
+
+		sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "edge", Name: "envoy"}}
+
+		now := metav1.Now()
+
+		podOn := func(node string) *corev1.Pod {
+			return &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:         "edge",
+					Name:              "envoy-" + node,
+					Labels:            map[string]string{"app": "envoy"},
+					DeletionTimestamp: &now,
+					OwnerReferences:   []metav1.OwnerReference{*metav1.NewControllerRef(sts, appsv1.SchemeGroupVersion.WithKind(WorkloadKindStatefulSet))},
+				},
+				Spec: corev1.PodSpec{NodeName: node},
+			}
+		}
+
+		master := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "m1"},
+			Spec:       corev1.NodeSpec{Taints: []corev1.Taint{{Key: "node-role.kubernetes.io/master", Effect: corev1.TaintEffectNoSchedule}}},
+		}
+
+		c := fake.NewFakeClientWithScheme(scheme, sts, master, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n1"}}, podOn("m1"), podOn("n1"))
+
+		controller := &PodController{
+			Client:              c,
+			Log:                 logf.Log.WithName("workload"),
+			ManageWorkloads:     true,
+			WorkloadPodSelector: labels.SelectorFromSet(labels.Set{"app": "envoy"}),
+		}
+
+		for _, name := range []string{"envoy-m1", "envoy-n1"} {
+			_, err := controller.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "edge", Name: name}})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		var node corev1.Node
+
+		Expect(c.Get(ctx, types.NamespacedName{Name: "m1"}, &node)).To(Succeed())
+		Expect(node.Annotations).NotTo(HaveKey(NodeAnnotationKeyDetached))
+
+		Expect(c.Get(ctx, types.NamespacedName{Name: "n1"}, &node)).To(Succeed())
+		Expect(node.Annotations).To(HaveKeyWithValue(NodeAnnotationKeyDetached, "statefulset:edge/envoy"))
+	})
+})
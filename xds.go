@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"net/http"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	XDSTypeURLClusterLoadAssignment = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+	XDSHealthStatusHealthy  = "HEALTHY"
+	XDSHealthStatusDraining = "DRAINING"
+)
+
+// XDSServer serves nodes as Envoy endpoints via the REST-JSON variant of the xDS endpoint discovery service (EDS).
+//
+// Each node is exposed as an endpoint of every configured cluster, whose health status flips to DRAINING when
+// node-detacher starts detaching the node, and back to HEALTHY when the node gets re-attached.
+// That way, Envoy-based fronts can gracefully drain nodes without relying on any cloud load balancer API.
+//
+// Every node is published, including ones that node-detacher never detaches, e.g. master nodes and nodes not selected
+// by any detach policy, so that Envoy keeps routing to them.
+//
+// Every replica serves endpoints regardless of leader election, by syncing them with nodes in the informer cache on
+// each discovery request. That way, Envoy can poll any replica behind a service.
+//
+// Configure Envoy to fetch endpoints with an `api_config_source` of `api_type: REST` pointing to this server.
+// See https://www.envoyproxy.io/docs/envoy/latest/api-docs/xds_protocol#rest-json-polling-subscriptions
+type XDSServer struct {
+	// Addr is the address the xDS server binds to, like `:18000`
+	Addr string
+
+	// Clusters maps the Envoy cluster name to the node port every endpoint of the cluster listens on
+	Clusters map[string]int64
+
+	// Client lists nodes to be published from the informer cache, so that Envoy sees all the nodes even before each
+	// node is reconciled, and on replicas not running controllers
+	client.Client
+
+	Log logr.Logger
+
+	mu        sync.RWMutex
+	version   int64
+	endpoints map[string]xdsEndpoint
+
+	// resourceVersions maps the node name to the resource version of the node its endpoint was last published for.
+	// Nodes whose resource versions are unchanged are never synced, so that the endpoint drained by the controller
+	// ahead of annotating the node keeps draining
+	resourceVersions map[string]string
+}
+
+type xdsEndpoint struct {
+	address  string
+	draining bool
+}
+
+// ParseXDSClusters parses `NAME=PORT` pairs given via command-line flags into the cluster name to node port map
+func ParseXDSClusters(pairs []string) (map[string]int64, error) {
+	clusters := map[string]int64{}
+
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid xds cluster %q: it must be in the form of NAME=PORT", p)
+		}
+
+		port, err := strconv.ParseInt(kv[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in xds cluster %q: %w", p, err)
+		}
+
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port in xds cluster %q: it must be between 1 and 65535", p)
+		}
+
+		clusters[kv[0]] = port
+	}
+
+	return clusters, nil
+}
+
+// SetNodeEndpoint adds or updates the endpoint for the node
+func (s *XDSServer) SetNodeEndpoint(node corev1.Node, draining bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.setNodeEndpoint(node, draining)
+}
+
+// setNodeEndpoint is SetNodeEndpoint for callers holding the lock
+func (s *XDSServer) setNodeEndpoint(node corev1.Node, draining bool) {
+	address := getNodeInternalIP(node)
+	if address == "" {
+		s.Log.V(1).Info("Skipped publishing node without internal IP", "node", node.Name)
+
+		return
+	}
+
+	if s.endpoints == nil {
+		s.endpoints = map[string]xdsEndpoint{}
+		s.resourceVersions = map[string]string{}
+	}
+
+	s.resourceVersions[node.Name] = node.ResourceVersion
+
+	ep := xdsEndpoint{address: address, draining: draining}
+
+	if cur, ok := s.endpoints[node.Name]; ok && cur == ep {
+		return
+	}
+
+	s.endpoints[node.Name] = ep
+	s.version++
+
+	s.Log.Info("Updated xDS endpoint", "node", node.Name, "address", address, "draining", draining, "version", s.version)
+}
+
+// SyncNode publishes the node as an endpoint, which is draining while node-detacher is detaching the node
+func (s *XDSServer) SyncNode(node corev1.Node) {
+	s.SetNodeEndpoint(node, node.Annotations[NodeAnnotationKeyDetaching] == "true")
+}
+
+// sync publishes all the nodes in the cluster updated since they were last published, and removes endpoints for
+// deleted nodes
+func (s *XDSServer) sync(ctx context.Context) error {
+	var nodes corev1.NodeList
+
+	if err := s.List(ctx, &nodes); err != nil {
+		return fmt.Errorf("Unable to list nodes to be published: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exists := map[string]bool{}
+
+	for _, node := range nodes.Items {
+		exists[node.Name] = true
+
+		if rv, ok := s.resourceVersions[node.Name]; ok && rv == node.ResourceVersion {
+			continue
+		}
+
+		s.setNodeEndpoint(node, node.Annotations[NodeAnnotationKeyDetaching] == "true")
+	}
+
+	for name := range s.endpoints {
+		if !exists[name] {
+			s.removeNode(name)
+		}
+	}
+
+	return nil
+}
+
+// RemoveNode removes the endpoint for the node, typically after the node is deleted
+func (s *XDSServer) RemoveNode(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeNode(name)
+}
+
+// removeNode is RemoveNode for callers holding the lock
+func (s *XDSServer) removeNode(name string) {
+	if _, ok := s.endpoints[name]; !ok {
+		return
+	}
+
+	delete(s.endpoints, name)
+	delete(s.resourceVersions, name)
+	s.version++
+}
+
+type xdsDiscoveryRequest struct {
+	VersionInfo   string   `json:"version_info,omitempty"`
+	ResourceNames []string `json:"resource_names,omitempty"`
+	TypeURL       string   `json:"type_url,omitempty"`
+}
+
+type xdsDiscoveryResponse struct {
+	VersionInfo string                     `json:"version_info"`
+	Resources   []xdsClusterLoadAssignment `json:"resources"`
+	TypeURL     string                     `json:"type_url"`
+}
+
+type xdsClusterLoadAssignment struct {
+	Type        string                  `json:"@type"`
+	ClusterName string                  `json:"cluster_name"`
+	Endpoints   []xdsLocalityLbEndpoint `json:"endpoints"`
+}
+
+type xdsLocalityLbEndpoint struct {
+	LbEndpoints []xdsLbEndpoint `json:"lb_endpoints"`
+}
+
+type xdsLbEndpoint struct {
+	Endpoint     xdsEndpointAddress `json:"endpoint"`
+	HealthStatus string             `json:"health_status"`
+}
+
+type xdsEndpointAddress struct {
+	Address xdsAddress `json:"address"`
+}
+
+type xdsAddress struct {
+	SocketAddress xdsSocketAddress `json:"socket_address"`
+}
+
+type xdsSocketAddress struct {
+	Address   string `json:"address"`
+	PortValue int64  `json:"port_value"`
+}
+
+// response builds the discovery response for the requested clusters, or all the clusters when none is requested
+func (s *XDSServer) response(clusterNames []string) xdsDiscoveryResponse {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(clusterNames) == 0 {
+		for name := range s.Clusters {
+			clusterNames = append(clusterNames, name)
+		}
+
+		sort.Strings(clusterNames)
+	}
+
+	nodeNames := make([]string, 0, len(s.endpoints))
+	for name := range s.endpoints {
+		nodeNames = append(nodeNames, name)
+	}
+
+	sort.Strings(nodeNames)
+
+	res := xdsDiscoveryResponse{
+		VersionInfo: strconv.FormatInt(s.version, 10),
+		Resources:   []xdsClusterLoadAssignment{},
+		TypeURL:     XDSTypeURLClusterLoadAssignment,
+	}
+
+	for _, cluster := range clusterNames {
+		port, ok := s.Clusters[cluster]
+		if !ok {
+			continue
+		}
+
+		lbEndpoints := []xdsLbEndpoint{}
+
+		for _, name := range nodeNames {
+			ep := s.endpoints[name]
+
+			health := XDSHealthStatusHealthy
+			if ep.draining {
+				health = XDSHealthStatusDraining
+			}
+
+			lbEndpoints = append(lbEndpoints, xdsLbEndpoint{
+				Endpoint: xdsEndpointAddress{
+					Address: xdsAddress{
+						SocketAddress: xdsSocketAddress{Address: ep.address, PortValue: port},
+					},
+				},
+				HealthStatus: health,
+			})
+		}
+
+		res.Resources = append(res.Resources, xdsClusterLoadAssignment{
+			Type:        XDSTypeURLClusterLoadAssignment,
+			ClusterName: cluster,
+			Endpoints:   []xdsLocalityLbEndpoint{{LbEndpoints: lbEndpoints}},
+		})
+	}
+
+	return res
+}
+
+func (s *XDSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req xdsDiscoveryRequest
+
+	if r.Method == http.MethodPost && r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid discovery request: %v", err), http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	if req.TypeURL != "" && req.TypeURL != XDSTypeURLClusterLoadAssignment {
+		http.Error(w, fmt.Sprintf("unsupported type_url %q", req.TypeURL), http.StatusBadRequest)
+
+		return
+	}
+
+	// Non-leader replicas would otherwise serve no endpoints, as only the leader reconciles nodes
+	if err := s.sync(r.Context()); err != nil {
+		s.Log.Error(err, "Failed syncing xDS endpoints")
+
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(s.response(req.ResourceNames)); err != nil {
+		s.Log.Error(err, "Failed writing xDS response")
+	}
+}
+
+// Start implements manager.Runnable so that the xDS server runs along with controllers
+func (s *XDSServer) Start(stop <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle("/v3/discovery:endpoints", s)
+
+	srv := &http.Server{Addr: s.Addr, Handler: mux}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		s.Log.Info("Starting xDS server", "addr", s.Addr)
+
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-stop:
+		return srv.Shutdown(context.Background())
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable so that every replica serves endpoints, as Envoy may
+// poll any of them
+func (s *XDSServer) NeedLeaderElection() bool {
+	return false
+}
+
+func getNodeInternalIP(node corev1.Node) string {
+	for _, a := range node.Status.Addresses {
+		if a.Type == corev1.NodeInternalIP {
+			return a.Address
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/mumoshu/node-detacher/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("XDSServer", func() {
+	var (
+		c      client.Client
+		server *XDSServer
+	)
+
+	newNode := func(name, ip string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{}},
+			Status: corev1.NodeStatus{
+				Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}},
+			},
+		}
+	}
+
+	BeforeEach(func() {
+		scheme := runtime.NewScheme()
+		Expect(k8sscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		master := newNode("master1", "10.0.0.1")
+		master.Spec.Taints = []corev1.Taint{{Key: "node-role.kubernetes.io/master", Effect: corev1.TaintEffectNoSchedule}}
+
+		detaching := newNode("node2", "10.0.0.2")
+		detaching.Annotations[NodeAnnotationKeyDetaching] = "true"
+
+		c = fake.NewFakeClientWithScheme(scheme, master, detaching, newNode("node3", "10.0.0.3"))
+
+		server = &XDSServer{
+			Addr:     "127.0.0.1:0",
+			Clusters: map[string]int64{"ingress": 30080, "admin": 30081},
+			Client:   c,
+			Log:      logf.Log.WithName("xds"),
+		}
+	})
+
+	// discover calls the handler like Envoy polling endpoints of the cluster
+	discover := func(clusters ...string) xdsDiscoveryResponse {
+		body, err := json.Marshal(xdsDiscoveryRequest{ResourceNames: clusters, TypeURL: XDSTypeURLClusterLoadAssignment})
+		Expect(err).NotTo(HaveOccurred())
+
+		rec := httptest.NewRecorder()
+
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v3/discovery:endpoints", bytes.NewReader(body)))
+
+		Expect(rec.Code).To(Equal(http.StatusOK))
+
+		var res xdsDiscoveryResponse
+
+		Expect(json.NewDecoder(rec.Body).Decode(&res)).To(Succeed())
+
+		return res
+	}
+
+	// healthOf returns health statuses of endpoints of the cluster keyed by the address
+	healthOf := func(res xdsDiscoveryResponse, cluster string) map[string]string {
+		health := map[string]string{}
+
+		for _, a := range res.Resources {
+			if a.ClusterName != cluster {
+				continue
+			}
+
+			for _, e := range a.Endpoints {
+				for _, ep := range e.LbEndpoints {
+					health[ep.Endpoint.Address.SocketAddress.Address] = ep.HealthStatus
+				}
+			}
+		}
+
+		return health
+	}
+
+	It("publishes all the nodes on every replica regardless of leader election", func() {
+		var runnable manager.Runnable = server
+
+		le, ok := runnable.(manager.LeaderElectionRunnable)
+		Expect(ok).To(BeTrue())
+		Expect(le.NeedLeaderElection()).To(BeFalse())
+
+		stop := make(chan struct{})
+
+		errCh := make(chan error, 1)
+
+		go func() {
+			errCh <- server.Start(stop)
+		}()
+
+		Eventually(func() map[string]string {
+			return healthOf(discover("ingress"), "ingress")
+		}).Should(Equal(map[string]string{
+			"10.0.0.1": XDSHealthStatusHealthy,
+			"10.0.0.2": XDSHealthStatusDraining,
+			"10.0.0.3": XDSHealthStatusHealthy,
+		}))
+
+		close(stop)
+
+		Eventually(errCh).Should(Receive(BeNil()))
+	})
+
+	It("syncs endpoints with nodes without reconciliation", func() {
+		ctx := context.Background()
+
+		Expect(healthOf(discover("ingress"), "ingress")).To(HaveKeyWithValue("10.0.0.3", XDSHealthStatusHealthy))
+
+		var node corev1.Node
+
+		Expect(c.Get(ctx, types.NamespacedName{Name: "node3"}, &node)).To(Succeed())
+
+		node.Annotations = map[string]string{NodeAnnotationKeyDetaching: "true"}
+
+		Expect(c.Update(ctx, &node)).To(Succeed())
+
+		Expect(healthOf(discover("ingress"), "ingress")).To(HaveKeyWithValue("10.0.0.3", XDSHealthStatusDraining))
+
+		Expect(c.Delete(ctx, &node)).To(Succeed())
+
+		Expect(healthOf(discover("ingress"), "ingress")).NotTo(HaveKey("10.0.0.3"))
+	})
+
+	It("keeps draining the endpoint the controller drained ahead of annotating the node", func() {
+		var node corev1.Node
+
+		Expect(c.Get(context.Background(), types.NamespacedName{Name: "node3"}, &node)).To(Succeed())
+
+		server.SetNodeEndpoint(node, true)
+
+		Expect(healthOf(discover("ingress"), "ingress")).To(HaveKeyWithValue("10.0.0.3", XDSHealthStatusDraining))
+	})
+
+	It("rejects clusters on invalid ports", func() {
+		Expect(ParseXDSClusters([]string{"ingress=30080", "admin=65535"})).To(Equal(map[string]int64{"ingress": 30080, "admin": 65535}))
+
+		for _, pair := range []string{"ingress", "ingress=http", "ingress=0", "ingress=-1", "ingress=65536"} {
+			_, err := ParseXDSClusters([]string{pair})
+			Expect(err).To(HaveOccurred(), pair)
+		}
+	})
+
+	It("serves only the requested clusters on the node ports", func() {
+		server.SetNodeEndpoint(*newNode("node3", "10.0.0.3"), false)
+
+		res := discover("admin")
+
+		Expect(res.TypeURL).To(Equal(XDSTypeURLClusterLoadAssignment))
+		Expect(res.Resources).To(HaveLen(1))
+		Expect(res.Resources[0].ClusterName).To(Equal("admin"))
+		Expect(res.Resources[0].Endpoints[0].LbEndpoints[0].Endpoint.Address.SocketAddress.PortValue).To(Equal(int64(30081)))
+
+		Expect(discover().Resources).To(HaveLen(2))
+	})
+
+	It("rejects requests for other resource types", func() {
+		rec := httptest.NewRecorder()
+
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v3/discovery:endpoints", bytes.NewReader([]byte(`{"type_url":"type.googleapis.com/envoy.config.cluster.v3.Cluster"}`))))
+
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("publishes nodes never detached on reconciliation", func() {
+		// node3 is selected by no detach policy
+		Expect(c.Create(context.Background(), &v1alpha1.DetachPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "ingress"},
+			Spec: v1alpha1.DetachPolicySpec{
+				NodeSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"role": "ingress"}},
+				Triggers:     v1alpha1.DetachTriggers{Cordon: true},
+			},
+		})).To(Succeed())
+
+		controller := &NodeController{
+			Client:       c,
+			CoreV1Client: kubefake.NewSimpleClientset().CoreV1(),
+			Log:          logf.Log.WithName("xds"),
+			recorder:     &record.FakeRecorder{},
+			Namespace:    "default",
+			XDSServer:    server,
+		}
+
+		for _, name := range []string{"master1", "node2", "node3"} {
+			_, err := controller.reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: name}})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Expect(healthOf(discover("ingress"), "ingress")).To(Equal(map[string]string{
+			"10.0.0.1": XDSHealthStatusHealthy,
+			"10.0.0.2": XDSHealthStatusDraining,
+			"10.0.0.3": XDSHealthStatusHealthy,
+		}))
+
+		Expect(c.Delete(context.Background(), newNode("node3", "10.0.0.3"))).To(Succeed())
+
+		_, err := controller.reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Name: "node3"}})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(healthOf(discover("ingress"), "ingress")).NotTo(HaveKey("10.0.0.3"))
+	})
+})